@@ -1,12 +1,19 @@
 package app
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/endpoint"
 	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/signals"
+	"github.com/k3s-io/kine/pkg/tracing"
+	"github.com/k3s-io/kine/pkg/util"
 	"github.com/k3s-io/kine/pkg/version"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -16,6 +23,15 @@ var (
 	config                 endpoint.Config
 	metricsConfig          metrics.Config
 	metricsIgnoreTLSConfig bool
+	replicaEndpoints       repeatedStringFlag
+	additionalListeners    repeatedStringFlag
+	serverClientAllowedCNs cli.StringSlice
+	advertiseClientURLs    cli.StringSlice
+	omitPrevValuePrefixes  cli.StringSlice
+	mysqlSessionVariables  repeatedStringFlag
+	tablePartitions        repeatedStringFlag
+	backendCipherSuites    string
+	credentialProvider     string
 )
 
 func New() *cli.App {
@@ -29,17 +45,59 @@ func New() *cli.App {
 			Value:       "0.0.0.0:2379",
 			Destination: &config.Listener,
 		},
+		&cli.GenericFlag{
+			Name:    "additional-listen-address",
+			Usage:   "Additional address to serve the etcd API on, sharing the same backend. May be specified multiple times. Server TLS for the listener may be configured by appending ',cert-file=<path>,key-file=<path>' to the address, and ',client-ca-file=<path>' to verify client certificates with a different CA than the primary listener.",
+			EnvVars: []string{"KINE_ADDITIONAL_LISTEN_ADDRESS"},
+			Value:   &additionalListeners,
+		},
 		&cli.StringFlag{
 			Name:        "endpoint",
 			Usage:       "Storage endpoint (default is sqlite)",
 			Destination: &config.Endpoint,
 		},
+		&cli.StringFlag{
+			Name:        "endpoint-file",
+			Usage:       "File containing the storage endpoint, such as a mounted secret, so that credentials are not passed on the command line. The file is watched for changes, and SQL drivers other than sqlite reconnect when the endpoint changes. Cannot be used with --endpoint.",
+			EnvVars:     []string{"KINE_DATASOURCE_FILE"},
+			Destination: &config.EndpointFile,
+		},
+		&cli.StringFlag{
+			Name:        "datastore-credential-provider",
+			Usage:       "Source from which the datastore username and password are fetched, instead of using the credentials in the endpoint: 'file:<path>' for a JSON file or a directory containing username and password files, 'exec:<command>' for a command that prints JSON, or 'vault:<secret path>' for a Vault secret, using the VAULT_ADDR, VAULT_TOKEN, VAULT_NAMESPACE and VAULT_CACERT environment variables. Only supported by SQL drivers other than sqlite.",
+			EnvVars:     []string{"KINE_DATASTORE_CREDENTIAL_PROVIDER"},
+			Destination: &credentialProvider,
+		},
+		&cli.DurationFlag{
+			Name:        "datastore-credential-refresh-interval",
+			Usage:       "How often the datastore credentials are fetched from the credential provider. When the credentials change, kine reconnects to the datastore with the new credentials. Dynamic Vault secrets are only re-read once two thirds of their lease has passed.",
+			EnvVars:     []string{"KINE_DATASTORE_CREDENTIAL_REFRESH_INTERVAL"},
+			Destination: &config.CredentialConfig.RefreshInterval,
+			Value:       time.Minute,
+		},
+		&cli.GenericFlag{
+			Name:  "read-replica-endpoint",
+			Usage: "Storage endpoint for a read replica of the primary endpoint. May be specified multiple times. Serializable range requests are spread across the replicas; linearizable requests are always served by the primary. Only supported by the mysql driver.",
+			Value: &replicaEndpoints,
+		},
 		&cli.StringFlag{
 			Name:        "table-name",
 			Usage:       "The table name for the selected backend. Defaults to 'kine'.",
 			Destination: &config.TableName,
 			Value:       "kine",
 		},
+		&cli.GenericFlag{
+			Name:    "table-partition",
+			Usage:   "Key prefix whose keys are stored in a table of their own, as prefix=table, such as /registry/events/=kine_events, so that writes and compaction of frequently changing keys do not contend with the rest of the keys. May be specified multiple times. Prefixes must start and end with '/', and may not overlap. All tables share one revision space, allocated from a sequence table; transactions may not span tables. Partitions must be configured before any keys are written under their prefix, and all nodes must use the same partitions. Only supported by the sqlite and mysql drivers.",
+			EnvVars: []string{"KINE_TABLE_PARTITION"},
+			Value:   &tablePartitions,
+		},
+		&cli.StringFlag{
+			Name:        "database-name",
+			Usage:       "The database name for the selected backend. Overrides the database name in the endpoint, if set. Defaults to 'kubernetes' if not set in either place.",
+			EnvVars:     []string{"KINE_DB_NAME"},
+			Destination: &config.DatabaseName,
+		},
 		&cli.StringFlag{
 			Name:        "ca-file",
 			Usage:       "CA cert for DB connection",
@@ -61,18 +119,172 @@ func New() *cli.App {
 			Destination: &config.BackendTLSConfig.SkipVerify,
 			Value:       false,
 		},
+		&cli.StringFlag{
+			Name:        "tls-min-version",
+			Usage:       "Minimum TLS version for DB connection. Options are '1.2' or '1.3'. Default is 1.2.",
+			Destination: &config.BackendTLSConfig.MinVersion,
+			Value:       "1.2",
+		},
+		&cli.StringFlag{
+			Name:        "tls-cipher-suites",
+			Usage:       "Comma-separated list of TLS cipher suites for DB connection, using the names from the Go crypto/tls package. If omitted, the Go default cipher suites will be used. Ignored for TLS 1.3.",
+			Destination: &backendCipherSuites,
+		},
+		&cli.StringFlag{
+			Name:        "encryption-key-file",
+			Usage:       "Path to a file containing AES keys used to encrypt values at rest, one <key ID>:<base64-encoded key> per line. New values are encrypted with the first key; the remaining keys are used to decrypt existing values during key rotation. Only supported by SQL drivers; kine fails to start if set with any other driver.",
+			EnvVars:     []string{"KINE_ENCRYPTION_KEY_FILE"},
+			Destination: &config.EncryptionKeyFile,
+		},
+		&cli.StringFlag{
+			Name:        "cloudsql-instance",
+			Usage:       "Cloud SQL for MySQL instance connection name, in the form project:region:instance. If set, connections are made through the built-in Cloud SQL connector using Application Default Credentials, and the host in the endpoint is ignored.",
+			Destination: &config.CloudSQLConfig.Instance,
+		},
+		&cli.StringFlag{
+			Name:        "cloudsql-ip-type",
+			Usage:       "Cloud SQL instance IP address to connect to. Options are 'PUBLIC' or 'PRIVATE'.",
+			Destination: &config.CloudSQLConfig.IPType,
+			Value:       "PUBLIC",
+		},
+		&cli.BoolFlag{
+			Name:        "cloudsql-iam-auth",
+			Usage:       "Authenticate to Cloud SQL with IAM database authentication, instead of the password in the endpoint.",
+			Destination: &config.CloudSQLConfig.IAMAuth,
+		},
+		&cli.StringFlag{
+			Name:        "mysql-isolation-level",
+			Usage:       "Transaction isolation level to set on each MySQL connection, such as 'READ COMMITTED'. READ COMMITTED does not take gap locks, so concurrent inserts and compaction deadlock and retry less often than at the server default of REPEATABLE READ. Kine relies on the unique index rather than the isolation level for concurrency control, so this does not affect consistency. If not set, the server default is used.",
+			EnvVars:     []string{"KINE_MYSQL_ISOLATION_LEVEL"},
+			Destination: &config.MySQLConfig.IsolationLevel,
+		},
+		&cli.BoolFlag{
+			Name:        "mysql-revision-sequence",
+			Usage:       "Allocate revisions from a sequence table, in the transaction that writes each row, instead of by the AUTO_INCREMENT id column. Rows are committed in revision order by all nodes, so the auto-increment values that clustered MySQL such as Galera interleaves across nodes do not leave gaps in the log for watchers to wait for and fill. This trades write throughput for gap-free ordering: every write on every node is serialized on the sequence row until it commits, which scales worse than AUTO_INCREMENT, so it does not relieve a write hotspot. Revisions are not allocated in blocks per node, as rows would then be committed out of revision order. All nodes should use the same setting.",
+			EnvVars:     []string{"KINE_MYSQL_REVISION_SEQUENCE"},
+			Destination: &config.MySQLConfig.RevisionSequence,
+		},
+		&cli.BoolFlag{
+			Name:        "mysql-long-values",
+			Usage:       "Use LONGBLOB columns for values, to store values larger than 16MB. Existing tables are widened by schema migration 4; set KINE_SCHEMA_MIGRATION=4 or higher. The GRPC max receive message size must also be increased to accept such values.",
+			EnvVars:     []string{"KINE_MYSQL_LONG_VALUES"},
+			Destination: &config.MySQLConfig.LongValues,
+		},
+		&cli.StringFlag{
+			Name:        "mysql-name-charset",
+			Usage:       "Charset of the name column, either ascii or utf8mb4. Index keys are limited to 3072 bytes, and MySQL reserves 4 bytes for each utf8mb4 character, so utf8mb4 allows UTF-8 keys but limits the name column length to 766 characters, or 189 characters with the COMPACT or REDUNDANT InnoDB row formats. Existing tables are converted by schema migration 6; set KINE_SCHEMA_MIGRATION=6 or higher. Defaults to ascii.",
+			EnvVars:     []string{"KINE_MYSQL_NAME_CHARSET"},
+			Destination: &config.MySQLConfig.NameCharset,
+			Value:       "ascii",
+		},
+		&cli.StringFlag{
+			Name:        "mysql-name-collation",
+			Usage:       "Collation of the name column, such as utf8mb4_bin. If not set, a utf8mb4 column uses utf8mb4_bin, so that keys are compared and ordered by code point as in etcd, and an ascii column uses the server default.",
+			EnvVars:     []string{"KINE_MYSQL_NAME_COLLATION"},
+			Destination: &config.MySQLConfig.NameCollation,
+		},
+		&cli.StringFlag{
+			Name:        "mysql-tls-config-name",
+			Usage:       "Name under which the backend TLS config is registered with the MySQL driver. TLS configs are shared by the whole process, so the name must not be used by any other MySQL client in the same process; if not set, a unique name is generated.",
+			EnvVars:     []string{"KINE_MYSQL_TLS_CONFIG_NAME"},
+			Destination: &config.MySQLConfig.TLSConfigName,
+		},
+		&cli.GenericFlag{
+			Name:    "mysql-session-variable",
+			Usage:   "System variable to set on each MySQL connection, as name=value, such as innodb_lock_wait_timeout=10, wait_timeout=600 or time_zone=+00:00. May be specified multiple times. Variables are set whenever the pool opens a connection, so they also apply after connections are closed and reopened. Values that are not numbers are set as strings, and may not contain backslashes. ANSI_QUOTES is added to sql_mode if not included, as it is required by kine.",
+			EnvVars: []string{"KINE_MYSQL_SESSION_VARIABLE"},
+			Value:   &mysqlSessionVariables,
+		},
+		&cli.BoolFlag{
+			Name:        "postgres-require-channel-binding",
+			Usage:       "Require SCRAM-SHA-256-PLUS authentication with channel binding for postgres connections, failing to connect if the server requests any other authentication method. Requires a TLS connection to the server.",
+			EnvVars:     []string{"KINE_POSTGRES_REQUIRE_CHANNEL_BINDING"},
+			Destination: &config.PostgresConfig.RequireChannelBinding,
+		},
+		&cli.StringFlag{
+			Name:        "postgres-min-auth-method",
+			Usage:       "Weakest password authentication method that a postgres server may request: 'password', 'md5', or 'scram-sha-256'. Connections fail if the server requests a weaker method, or no authentication. If not set, any method is accepted.",
+			EnvVars:     []string{"KINE_POSTGRES_MIN_AUTH_METHOD"},
+			Destination: &config.PostgresConfig.MinAuthMethod,
+		},
+		&cli.StringFlag{
+			Name:        "postgres-schema",
+			Usage:       "Schema in which to create and query the table for postgres, cockroach and yugabytedb, set as the search_path of each connection, so that several instances can share a database under separate schemas. The schema is created if it does not exist. If not set, the server default search_path is used, normally the public schema.",
+			EnvVars:     []string{"KINE_POSTGRES_SCHEMA"},
+			Destination: &config.PostgresConfig.Schema,
+		},
+		&cli.StringFlag{
+			Name:        "sqlite-journal-mode",
+			Usage:       "SQLite journal mode to set on each connection, such as 'WAL'. If not set, the journal mode from the endpoint is used.",
+			Destination: &config.SQLiteConfig.JournalMode,
+		},
+		&cli.DurationFlag{
+			Name:        "sqlite-busy-timeout",
+			Usage:       "Time for SQLite connections to wait on a locked database before failing. If not set, the busy timeout from the endpoint is used.",
+			Destination: &config.SQLiteConfig.BusyTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "sqlite-synchronous",
+			Usage:       "SQLite synchronous mode to set on each connection: 'OFF', 'NORMAL', 'FULL', or 'EXTRA'. If not set, the synchronous mode from the endpoint is used.",
+			Destination: &config.SQLiteConfig.Synchronous,
+		},
+		&cli.IntFlag{
+			Name:        "sqlite-wal-autocheckpoint",
+			Usage:       "Number of WAL pages at which SQLite connections automatically checkpoint the WAL. If not set, the SQLite default is used.",
+			Destination: &config.SQLiteConfig.WALAutocheckpoint,
+		},
+		&cli.StringFlag{
+			Name:        "libsql-replica-path",
+			Usage:       "Path of the local embedded replica database file used by the libsql driver.",
+			EnvVars:     []string{"KINE_LIBSQL_REPLICA_PATH"},
+			Destination: &config.LibSQLConfig.ReplicaPath,
+			Value:       "./db/libsql-replica.db",
+		},
+		&cli.StringFlag{
+			Name:        "libsql-auth-token",
+			Usage:       "Token used by the libsql driver to authenticate to the primary database.",
+			EnvVars:     []string{"KINE_LIBSQL_AUTH_TOKEN"},
+			Destination: &config.LibSQLConfig.AuthToken,
+		},
+		&cli.DurationFlag{
+			Name:        "libsql-sync-interval",
+			Usage:       "How often the libsql driver syncs the local replica from the primary database. Writes made by other kine servers sharing the primary are seen once synced. If value <= 0, the replica is only synced at startup.",
+			EnvVars:     []string{"KINE_LIBSQL_SYNC_INTERVAL"},
+			Destination: &config.LibSQLConfig.SyncInterval,
+			Value:       time.Second,
+		},
 		&cli.StringFlag{
 			Name:        "log-format",
-			Usage:       "Log format to use. Options are 'plain' or 'json'.",
+			Usage:       "Log format to use. Options are 'plain' or 'json'. The json format logs fields such as SQL statements and compaction statistics as separate keys.",
+			EnvVars:     []string{"KINE_LOG_FORMAT"},
 			Destination: &config.LogFormat,
 			Value:       "plain",
 		},
+		&cli.StringFlag{
+			Name:        "log-sql-args",
+			Usage:       "How the arguments of SQL statements are logged with --debug. Options are 'none', 'redacted', which logs the length of values rather than their content, or 'full', which logs up to 64 bytes of each value. Values may hold secrets.",
+			EnvVars:     []string{"KINE_LOG_SQL_ARGS"},
+			Destination: &config.LogSQLArgs,
+			Value:       "none",
+		},
 		&cli.StringFlag{
 			Name:        "metrics-bind-address",
 			Usage:       "The address the metric endpoint binds to. Default :8080, set 0 to disable metrics serving.",
 			Destination: &metricsConfig.ServerAddress,
 			Value:       ":8080",
 		},
+		&cli.DurationFlag{
+			Name:        "shutdown-timeout",
+			Usage:       "Time to wait on shutdown for in-flight requests to complete, after watch streams have been closed and new connections are no longer accepted. Requests still in progress after this time are interrupted.",
+			EnvVars:     []string{"KINE_SHUTDOWN_TIMEOUT"},
+			Destination: &config.ShutdownTimeout,
+			Value:       15 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:        "health-address",
+			Usage:       "The address to listen on for HTTP health checks, which report datastore connectivity at /healthz and /readyz. Disabled if not set.",
+			Destination: &config.HealthAddress,
+		},
 		&cli.StringFlag{
 			Name:        "server-cert-file",
 			Usage:       "Certificate for etcd connection",
@@ -83,41 +295,100 @@ func New() *cli.App {
 			Usage:       "Key file for etcd connection",
 			Destination: &config.ServerTLSConfig.KeyFile,
 		},
+		&cli.StringFlag{
+			Name:        "server-client-ca-file",
+			Usage:       "CA used to verify client certificates for etcd connections. If set, clients must present a certificate signed by the CA, and connections without one are rejected. Requires the server certificate and key files.",
+			EnvVars:     []string{"KINE_SERVER_CLIENT_CA_FILE"},
+			Destination: &config.ServerTLSConfig.ClientCAFile,
+		},
+		&cli.StringSliceFlag{
+			Name:        "server-client-allowed-cn",
+			Usage:       "Common name of a client certificate accepted for etcd connections. May be specified multiple times. If not set, any client certificate signed by the client CA is accepted.",
+			EnvVars:     []string{"KINE_SERVER_CLIENT_ALLOWED_CN"},
+			Destination: &serverClientAllowedCNs,
+		},
+		&cli.StringSliceFlag{
+			Name:        "advertise-client-urls",
+			Usage:       "Client URL reported for the kine member in the etcd member list. May be specified multiple times. If not set, the URL the client connected to is reported.",
+			EnvVars:     []string{"KINE_ADVERTISE_CLIENT_URLS"},
+			Destination: &advertiseClientURLs,
+		},
 		&cli.IntFlag{
 			Name:        "datastore-max-idle-connections",
 			Usage:       "Maximum number of idle connections retained by datastore. If value = 0, the system default will be used. If value < 0, idle connections will not be reused.",
+			EnvVars:     []string{"KINE_DATASTORE_MAX_IDLE_CONNECTIONS"},
 			Destination: &config.ConnectionPoolConfig.MaxIdle,
 			Value:       0,
 		},
 		&cli.IntFlag{
 			Name:        "datastore-max-open-connections",
 			Usage:       "Maximum number of open connections used by datastore. If value <= 0, then there is no limit",
+			EnvVars:     []string{"KINE_DATASTORE_MAX_OPEN_CONNECTIONS"},
 			Destination: &config.ConnectionPoolConfig.MaxOpen,
 			Value:       0,
 		},
 		&cli.DurationFlag{
 			Name:        "datastore-connection-max-lifetime",
-			Usage:       "Maximum amount of time a connection may be reused. If value <= 0, then there is no limit.",
+			Usage:       "Maximum amount of time a connection may be reused. Each connection's lifetime is randomly shortened by up to 10 percent, so that connections opened together are not all closed together. If value <= 0, then there is no limit.",
+			EnvVars:     []string{"KINE_DATASTORE_CONNECTION_MAX_LIFETIME"},
 			Destination: &config.ConnectionPoolConfig.MaxLifetime,
 			Value:       0,
 		},
+		&cli.DurationFlag{
+			Name:        "datastore-connection-max-idle-time",
+			Usage:       "Maximum amount of time a connection may be idle before it is closed. If value <= 0, then there is no limit.",
+			EnvVars:     []string{"KINE_DATASTORE_CONNECTION_MAX_IDLE_TIME"},
+			Destination: &config.ConnectionPoolConfig.MaxIdleTime,
+		},
+		&cli.DurationFlag{
+			Name:        "datastore-max-connect-wait",
+			Usage:       "Maximum amount of time to wait at startup for the datastore to accept connections, retrying with exponential backoff. Errors such as authentication failures are not retried. If value < 0, the connection is not retried.",
+			Destination: &config.ConnectionPoolConfig.MaxConnectWait,
+			Value:       5 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:        "datastore-setup-timeout",
+			Usage:       "Maximum amount of time for each attempt to check for or create the database at startup. Attempts that time out are retried until the max connect wait has elapsed. If value < 0, attempts do not time out.",
+			EnvVars:     []string{"KINE_DATASTORE_SETUP_TIMEOUT"},
+			Destination: &config.ConnectionPoolConfig.SetupTimeout,
+			Value:       30 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:        "datastore-statement-timeout",
+			Usage:       "Maximum amount of time for each datastore query or statement, so that a single slow query cannot hold a connection indefinitely. Compaction is limited by the compact timeout instead. On MySQL, read queries are also limited on the server with the MAX_EXECUTION_TIME hint. If value <= 0, statements do not time out.",
+			EnvVars:     []string{"KINE_DATASTORE_STATEMENT_TIMEOUT"},
+			Destination: &config.ConnectionPoolConfig.StatementTimeout,
+		},
 		&cli.DurationFlag{
 			Name:        "slow-sql-threshold",
-			Usage:       "The duration which SQL executed longer than will be logged at level info. Default 1s, set <= 0 to disable slow SQL log.",
+			Usage:       "Duration above which SQL statements are logged at level warn, with the statement, duration and number of arguments. Default is 0 (disabled).",
+			EnvVars:     []string{"KINE_SLOW_SQL_THRESHOLD"},
 			Destination: &metrics.SlowSQLThreshold,
-			Value:       time.Second,
 		},
 		&cli.DurationFlag{
 			Name:        "slow-sql-warning-threshold",
-			Usage:       "The duration which SQL executed longer than will be logged at level warn. Default 5s.",
+			Usage:       "Deprecated and ignored: slow SQL statements are logged at level warn once they exceed --slow-sql-threshold.",
+			EnvVars:     []string{"KINE_SLOW_SQL_WARNING_THRESHOLD"},
 			Destination: &metrics.SlowSQLWarningThreshold,
-			Value:       5 * time.Second,
+		},
+		&cli.Int64Flag{
+			Name:        "revision-gap-warning-threshold",
+			Usage:       "The number of missing revisions in a gap between sequential revisions at or above which a warning is logged. Gaps are left by inserts that are rolled back after reserving a revision. Set <= 0 to disable the warning.",
+			EnvVars:     []string{"KINE_REVISION_GAP_WARNING_THRESHOLD"},
+			Destination: &metrics.RevisionGapWarningThreshold,
+			Value:       100,
 		},
 		&cli.BoolFlag{
 			Name:        "metrics-enable-profiling",
 			Usage:       "Enable net/http/pprof handlers on the metrics bind address. Default is false.",
 			Destination: &metricsConfig.EnableProfiling,
 		},
+		&cli.StringFlag{
+			Name:        "profiling-address",
+			Usage:       "Address to serve net/http/pprof handlers on, separately from the metrics server. The metrics TLS configuration is used. Default is empty (disabled).",
+			EnvVars:     []string{"KINE_PROFILING_ADDRESS"},
+			Destination: &metricsConfig.ProfilingAddress,
+		},
 		&cli.BoolFlag{
 			Name:        "metrics-ignore-tls-config",
 			Usage:       "Ignore TLS config for metrics server. Default is false.",
@@ -126,10 +397,43 @@ func New() *cli.App {
 		},
 		&cli.DurationFlag{
 			Name:        "watch-progress-notify-interval",
-			Usage:       "Interval between periodic watch progress notifications. Default is 5s to ensure support for watch progress notifications.",
+			Usage:       "Interval between periodic watch progress notifications, which are sent to watches that requested them and have not received any events since the previous notification. Default is 5s to ensure support for watch progress notifications. Set to 0 to disable periodic notifications.",
 			Destination: &config.NotifyInterval,
 			Value:       time.Second * 5,
 		},
+		&cli.IntFlag{
+			Name:        "grpc-max-recv-msg-size",
+			Usage:       "Maximum size in bytes of a message received by the GRPC server. Watch responses are split into fragments smaller than this size for clients that request fragmentation. Default is 4MiB.",
+			EnvVars:     []string{"KINE_GRPC_MAX_RECV_MSG_SIZE"},
+			Destination: &config.GRPCMaxRecvMsgSize,
+			Value:       server.DefaultMaxRecvMsgSize,
+		},
+		&cli.IntFlag{
+			Name:        "grpc-max-send-msg-size",
+			Usage:       "Maximum size in bytes of a message sent by the GRPC server. If not set, the GRPC default is used, which does not limit the message size.",
+			EnvVars:     []string{"KINE_GRPC_MAX_SEND_MSG_SIZE"},
+			Destination: &config.GRPCMaxSendMsgSize,
+		},
+		&cli.DurationFlag{
+			Name:        "grpc-keepalive-interval",
+			Usage:       "Frequency of pings sent by the GRPC server to check that quiet client connections are still alive. Lower this to detect connections dropped by a load balancer or network without a reset. Default is 2h.",
+			EnvVars:     []string{"KINE_GRPC_KEEPALIVE_INTERVAL"},
+			Destination: &config.GRPCKeepAliveInterval,
+			Value:       2 * time.Hour,
+		},
+		&cli.DurationFlag{
+			Name:        "grpc-keepalive-timeout",
+			Usage:       "Time that the GRPC server waits for a reply to a keepalive ping before closing the connection. Default is 20s.",
+			EnvVars:     []string{"KINE_GRPC_KEEPALIVE_TIMEOUT"},
+			Destination: &config.GRPCKeepAliveTimeout,
+			Value:       20 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:        "grpc-max-connection-idle",
+			Usage:       "Close GRPC client connections that have had no active requests or watches for this long. Default is 0 (connections are not closed for being idle).",
+			EnvVars:     []string{"KINE_GRPC_MAX_CONNECTION_IDLE"},
+			Destination: &config.GRPCMaxConnectionIdle,
+		},
 		&cli.StringFlag{
 			Name:        "emulated-etcd-version",
 			Usage:       "The emulated etcd version to return on a call to the status endpoint. Defaults to 3.5.13, in order to indicate support for watch progress notifications.",
@@ -142,6 +446,12 @@ func New() *cli.App {
 			Destination: &config.CompactInterval,
 			Value:       5 * time.Minute,
 		},
+		&cli.DurationFlag{
+			Name:        "compact-min-interval",
+			Usage:       "Minimum interval between automatic compaction. If set, compaction runs adaptively: the interval is shortened towards this value and the batch size increased towards compact-max-batch-size while the database grows quickly or compaction falls behind, and returns towards compact-interval and compact-batch-size while the database size is stable. Default is 0 (fixed interval).",
+			EnvVars:     []string{"KINE_COMPACT_MIN_INTERVAL"},
+			Destination: &config.CompactMinInterval,
+		},
 		&cli.IntFlag{
 			Name:        "compact-interval-jitter",
 			Usage:       "Percentage of jitter to apply to interval durations. A value of 10 will apply a jitter of +/-10 percent to the interval duration. It cannot be negative, and must be less than 100. Default is 0.",
@@ -160,20 +470,167 @@ func New() *cli.App {
 			Destination: &config.CompactMinRetain,
 			Value:       1000,
 		},
+		&cli.DurationFlag{
+			Name:        "compact-retention",
+			Usage:       "Minimum duration of revision history to retain when compacting. Revisions that were current within this window are not compacted, in addition to the revisions retained by compact-min-retain. Default is 0 (disabled).",
+			EnvVars:     []string{"KINE_COMPACT_RETENTION"},
+			Destination: &config.CompactRetention,
+		},
+		&cli.DurationFlag{
+			Name:        "compact-deleted-retention",
+			Usage:       "Minimum duration to retain the final value of deleted keys when compacting. Deleted rows are kept in the table for this long after the key was deleted, but are not visible to reads. Default is 0 (disabled).",
+			EnvVars:     []string{"KINE_COMPACT_DELETED_RETENTION"},
+			Destination: &config.CompactDeletedRetention,
+		},
 		&cli.Int64Flag{
 			Name:        "compact-batch-size",
 			Usage:       "Number of revisions to compact in a single batch. Default is 1000.",
 			Destination: &config.CompactBatchSize,
 			Value:       1000,
 		},
+		&cli.Int64Flag{
+			Name:        "compact-max-batch-size",
+			Usage:       "Maximum number of revisions to compact in a single batch when compacting adaptively; see compact-min-interval. Default is 0 (the compact batch size).",
+			EnvVars:     []string{"KINE_COMPACT_MAX_BATCH_SIZE"},
+			Destination: &config.CompactMaxBatchSize,
+		},
+		&cli.DurationFlag{
+			Name:        "compact-batch-delay",
+			Usage:       "Time to wait between compaction batches, so that writes waiting on locks held by the previous batch can proceed. Each batch is committed in its own transaction. Default is 0 (no delay).",
+			EnvVars:     []string{"KINE_COMPACT_BATCH_DELAY"},
+			Destination: &config.CompactBatchDelay,
+		},
+		&cli.BoolFlag{
+			Name:        "compact-dry-run",
+			Usage:       "Log the number and approximate size of the rows that automatic compaction would delete, without deleting them. Default is false.",
+			EnvVars:     []string{"KINE_COMPACT_DRY_RUN"},
+			Destination: &config.CompactDryRun,
+		},
+		&cli.BoolFlag{
+			Name:        "compact-repair",
+			Usage:       "Reset the compact revision to just below the lowest revision in the table on startup, even if it appears to be consistent. An inconsistent compact revision greater than the current revision is always repaired. Default is false.",
+			EnvVars:     []string{"KINE_COMPACT_REPAIR"},
+			Destination: &config.CompactRepair,
+		},
 		&cli.Int64Flag{
 			Name:        "poll-batch-size",
 			Usage:       "Number of revisions to poll in a single batch. Default is 500.",
 			Destination: &config.PollBatchSize,
 			Value:       500,
 		},
+		&cli.DurationFlag{
+			Name:        "poll-max-interval",
+			Usage:       "Maximum interval between polls for new rows when the datastore is idle. The table is polled every second while rows are being written, and each poll that finds no new rows doubles the interval up to this maximum. Rows written by this server, or announced by the driver's insert notifications where supported, are seen immediately, but watches on a server sharing the datastore with other servers may see rows written through them up to this much later. Default is 0 (always poll every second).",
+			EnvVars:     []string{"KINE_POLL_MAX_INTERVAL"},
+			Destination: &config.PollMaxInterval,
+		},
+		&cli.StringSliceFlag{
+			Name:        "omit-prev-value-prefix",
+			Usage:       "Key prefix, such as /registry/leases/, for which the previous value is not stored with each create or update, roughly halving the space used by frequently updated keys. May be specified multiple times. Watches of these keys that request the previous key-value receive none for updates; the previous value is still stored and returned for deletes. Prefixes must start with '/'. Only supported by SQL drivers.",
+			EnvVars:     []string{"KINE_OMIT_PREV_VALUE_PREFIX"},
+			Destination: &omitPrevValuePrefixes,
+		},
+		&cli.Int64Flag{
+			Name:        "quota-backend-bytes",
+			Usage:       "Datastore size in bytes at which a NOSPACE alarm is raised and writes are rejected until compaction and defragmentation bring the size back under the quota. Deletes are still allowed. Default is 0 (disabled).",
+			EnvVars:     []string{"KINE_QUOTA_BACKEND_BYTES"},
+			Destination: &config.QuotaBackendBytes,
+		},
+		&cli.IntFlag{
+			Name:        "max-concurrent-reads",
+			Usage:       "Maximum number of range requests and read-only transactions that are served at once. Requests beyond the limit are rejected with a ResourceExhausted error, so that a client making many concurrent requests cannot exhaust the datastore connection pool. Default is 0 (unlimited).",
+			EnvVars:     []string{"KINE_MAX_CONCURRENT_READS"},
+			Destination: &config.MaxConcurrentReads,
+		},
+		&cli.IntFlag{
+			Name:        "max-concurrent-writes",
+			Usage:       "Maximum number of transactions with writes, and compaction requests, that are served at once. Requests beyond the limit are rejected with a ResourceExhausted error. Default is 0 (unlimited).",
+			EnvVars:     []string{"KINE_MAX_CONCURRENT_WRITES"},
+			Destination: &config.MaxConcurrentWrites,
+		},
+		&cli.BoolFlag{
+			Name:        "read-only",
+			Usage:       "Start in read-only mode, serving reads and watches but rejecting writes and pausing compaction, such as during datastore maintenance. Read-only mode can be toggled at runtime through the /readonly endpoint of the health server.",
+			EnvVars:     []string{"KINE_READ_ONLY"},
+			Destination: &config.ReadOnly,
+		},
+		&cli.DurationFlag{
+			Name:        "insert-batch-window",
+			Usage:       "Time to wait for concurrent creates, and with --insert-batch-writes all writes, to be coalesced into a single multi-row insert. Useful to speed up bulk writes, such as when restoring a cluster from backup. Disabled if set to 0. Only supported by SQL drivers.",
+			Destination: &config.InsertBatchWindow,
+		},
+		&cli.BoolFlag{
+			Name:        "insert-batch-writes",
+			Usage:       "Coalesce concurrent updates and deletes into batched inserts along with creates, so that all writes made within the insert batch window are committed together. Increases write throughput on datastores limited by commit latency, at the cost of up to the batch window of added latency for each write. Requires --insert-batch-window.",
+			EnvVars:     []string{"KINE_INSERT_BATCH_WRITES"},
+			Destination: &config.InsertBatchWrites,
+		},
+		&cli.IntFlag{
+			Name:        "key-prefix-metrics-limit",
+			Usage:       "Maximum number of key prefixes, such as /registry/pods, for which the number of writes and size of values written are recorded in metrics. Writes to prefixes beyond the limit are recorded under the \"other\" prefix. Disabled if set to 0. Only supported by SQL drivers.",
+			EnvVars:     []string{"KINE_KEY_PREFIX_METRICS_LIMIT"},
+			Destination: &config.KeyPrefixMetricsLimit,
+		},
+		&cli.IntFlag{
+			Name:        "watch-buffer-size",
+			Usage:       "Number of event batches buffered for each watch. Watches that fall further behind are cancelled as compacted, so that the client relists instead of slowing down other watches. Only supported by SQL drivers.",
+			EnvVars:     []string{"KINE_WATCH_BUFFER_SIZE"},
+			Destination: &config.WatchBufferSize,
+			Value:       100,
+		},
+		&cli.IntFlag{
+			Name:        "read-cache-size",
+			Usage:       "Number of point reads to cache in memory, for keys such as leader election leases that are read far more often than they are written. Only serializable reads are served from the cache; linearizable reads and transactions always read the datastore. Cached reads are invalidated when the key is written; with more than one node, serializable reads may return a value replaced by another node for up to the poll interval. Disabled if set to 0. Only supported by SQL drivers.",
+			EnvVars:     []string{"KINE_READ_CACHE_SIZE"},
+			Destination: &config.ReadCacheSize,
+		},
+		&cli.IntFlag{
+			Name:        "write-retry-attempts",
+			Usage:       "Number of times to retry a write that failed due to a transient conflict with a concurrent write, such as a deadlock or serialization failure. Disabled if set to 0. Only supported by SQL drivers.",
+			EnvVars:     []string{"KINE_WRITE_RETRY_ATTEMPTS"},
+			Destination: &config.WriteRetryAttempts,
+			Value:       3,
+		},
+		&cli.DurationFlag{
+			Name:        "write-retry-backoff",
+			Usage:       "Time to wait before the first retry of a write that failed due to a transient conflict. Each subsequent wait is twice as long, up to one second, with random jitter.",
+			EnvVars:     []string{"KINE_WRITE_RETRY_BACKOFF"},
+			Destination: &config.WriteRetryBackoff,
+			Value:       10 * time.Millisecond,
+		},
+		&cli.IntFlag{
+			Name:        "watch-replay-buffer-size",
+			Usage:       "Number of recent events to hold in memory, so that watches resuming from a compacted revision can continue from the buffered events instead of failing and forcing the client to relist. Disabled if set to 0.",
+			EnvVars:     []string{"KINE_WATCH_REPLAY_BUFFER_SIZE"},
+			Destination: &config.WatchReplayBufferSize,
+		},
+		&cli.DurationFlag{
+			Name:        "watch-coalesce-window",
+			Usage:       "Time each watch waits after receiving events for more events to send with them, so that repeated updates to a key within the window are sent as a single event with its latest value, reducing watch traffic for frequently updated keys such as status objects. Creates and deletes are always sent, and updates are never merged across them. Watchers skip the revisions of merged updates, and all events are delayed by up to this long. Default is 0 (disabled).",
+			EnvVars:     []string{"KINE_WATCH_COALESCE_WINDOW"},
+			Destination: &config.WatchCoalesceWindow,
+		},
+		&cli.IntFlag{
+			Name:        "mysql-name-length",
+			Usage:       "Length of the VARCHAR name column when creating the MySQL table. Existing tables with a shorter column are widened when KINE_SCHEMA_MIGRATION is set to 3 or higher. With the ascii charset, lengths of up to 3064 are supported, and lengths over 759 require the DYNAMIC or COMPRESSED InnoDB row format; see --mysql-name-charset for utf8mb4. Only supported by the MySQL driver.",
+			Destination: &config.NameColumnLength,
+			Value:       630,
+		},
+		&cli.BoolFlag{
+			Name:        "skip-schema-setup",
+			Usage:       "Do not create the database, table or indexes, or run schema migrations, when starting. The existing schema is validated instead, and kine fails to start if any of it is missing. For use when the schema is managed outside of kine.",
+			EnvVars:     []string{"KINE_SKIP_SETUP"},
+			Destination: &config.SkipSchemaSetup,
+		},
+		&cli.BoolFlag{
+			Name:        "schema-require-latest",
+			Usage:       "Fail to start if the schema version recorded for the table is behind the latest schema migration of this release, after running any migrations requested with KINE_SCHEMA_MIGRATION, instead of running with an outdated schema. Only supported by the MySQL and Postgres drivers.",
+			EnvVars:     []string{"KINE_SCHEMA_REQUIRE_LATEST"},
+			Destination: &config.SchemaRequireLatest,
+		},
 		&cli.BoolFlag{Name: "debug"},
 	}
+	app.Commands = []*cli.Command{migrateCommand(), snapshotCommand()}
 	app.Action = run
 	return app
 }
@@ -195,21 +652,105 @@ func run(c *cli.Context) error {
 	} else {
 		return fmt.Errorf("invalid log format: %s", config.LogFormat)
 	}
+	if err := util.SetSQLArgs(config.LogSQLArgs); err != nil {
+		return err
+	}
 
 	if c.Bool("debug") {
 		logrus.SetLevel(logrus.TraceLevel)
 	}
 	ctx := signals.SetupSignalContext()
 
+	shutdownTracing, err := tracing.Init(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize tracing: %w", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logrus.Warnf("Failed to shut down tracing: %v", err)
+		}
+	}()
+
 	if !metricsIgnoreTLSConfig {
 		metricsConfig.ServerTLSConfig = config.ServerTLSConfig
 	}
 	go metrics.Serve(ctx, metricsConfig)
+	go metrics.ServeProfiling(ctx, metricsConfig)
 	config.MetricsRegisterer = metrics.Registry
-	_, err := endpoint.Listen(ctx, config)
+	config.ReplicaEndpoints = []string(replicaEndpoints)
+	config.ServerTLSConfig.AllowedCNs = serverClientAllowedCNs.Value()
+	config.AdvertiseClientURLs = advertiseClientURLs.Value()
+	config.OmitPrevValuePrefixes = omitPrevValuePrefixes.Value()
+	config.MySQLConfig.SessionVariables = []string(mysqlSessionVariables)
+	for _, value := range []string(tablePartitions) {
+		prefix, tableName, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("invalid table partition %q: must be given as prefix=table", value)
+		}
+		config.TablePartitions = append(config.TablePartitions, drivers.TablePartition{Prefix: prefix, TableName: tableName})
+	}
+	for _, value := range []string(additionalListeners) {
+		listener, err := parseListener(value)
+		if err != nil {
+			return err
+		}
+		config.AdditionalListeners = append(config.AdditionalListeners, listener)
+	}
+	if credentialProvider != "" {
+		provider, err := generic.NewCredentialProvider(credentialProvider)
+		if err != nil {
+			return err
+		}
+		config.CredentialConfig.Provider = provider
+	}
+	if backendCipherSuites != "" {
+		config.BackendTLSConfig.CipherSuites = strings.Split(backendCipherSuites, ",")
+	}
+	etcdConfig, err := endpoint.Listen(ctx, config)
 	if err != nil {
 		return err
 	}
 	<-ctx.Done()
+	if etcdConfig.Stopped != nil {
+		<-etcdConfig.Stopped
+	}
 	return ctx.Err()
 }
+
+// parseListener parses an additional listener address, optionally followed by comma-separated
+// server TLS options.
+func parseListener(value string) (endpoint.ListenerConfig, error) {
+	parts := strings.Split(value, ",")
+	listener := endpoint.ListenerConfig{Address: parts[0]}
+	for _, option := range parts[1:] {
+		key, val, _ := strings.Cut(option, "=")
+		switch key {
+		case "cert-file":
+			listener.ServerTLSConfig.CertFile = val
+		case "key-file":
+			listener.ServerTLSConfig.KeyFile = val
+		case "client-ca-file":
+			listener.ServerTLSConfig.ClientCAFile = val
+		default:
+			return listener, fmt.Errorf("invalid option %q for additional listen address %s", option, listener.Address)
+		}
+	}
+	if (listener.ServerTLSConfig.CertFile == "") != (listener.ServerTLSConfig.KeyFile == "") {
+		return listener, fmt.Errorf("both cert-file and key-file must be set for additional listen address %s", listener.Address)
+	}
+	return listener, nil
+}
+
+// repeatedStringFlag is a flag value that may be specified multiple times. Unlike cli.StringSlice,
+// values are not split on commas, as endpoints, listener options and session variables may contain
+// them.
+type repeatedStringFlag []string
+
+func (f *repeatedStringFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func (f *repeatedStringFlag) String() string {
+	return strings.Join(*f, " ")
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/migrate"
+	"github.com/k3s-io/kine/pkg/signals"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	migrateSource      drivers.Config
+	migrateDestination drivers.Config
+	migrateOptions     migrate.Options
+)
+
+func migrateCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "migrate",
+		Usage: "Copy all keys from one datastore to another",
+		Description: "Copies the current value and lease of every key from the source datastore into the destination datastore. " +
+			"If the destination is empty and supports importing keys, keys are written at their original revisions. " +
+			"Otherwise, revisions are not preserved, so Kubernetes apiservers must be restarted against the destination once the copy is complete, " +
+			"and an interrupted copy can be resumed by running it again with --start-key set to the last key reported.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "source-endpoint",
+				Usage:       "Storage endpoint to copy keys from, in the same format as --endpoint",
+				Destination: &migrateSource.Endpoint,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "source-table-name",
+				Usage:       "Table name for the source storage endpoint, for SQL backends",
+				Destination: &migrateSource.TableName,
+				Value:       "kine",
+			},
+			&cli.StringFlag{
+				Name:        "destination-endpoint",
+				Usage:       "Storage endpoint to copy keys to, in the same format as --endpoint",
+				Destination: &migrateDestination.Endpoint,
+				Required:    true,
+			},
+			&cli.StringFlag{
+				Name:        "destination-table-name",
+				Usage:       "Table name for the destination storage endpoint, for SQL backends",
+				Destination: &migrateDestination.TableName,
+				Value:       "kine",
+			},
+			&cli.StringFlag{
+				Name:        "prefix",
+				Usage:       "Only copy keys with this prefix",
+				Destination: &migrateOptions.Prefix,
+				Value:       "/",
+			},
+			&cli.StringFlag{
+				Name:        "start-key",
+				Usage:       "Resume copying after this key",
+				Destination: &migrateOptions.StartKey,
+			},
+			&cli.Int64Flag{
+				Name:        "batch-size",
+				Usage:       "Number of keys to read from the source at a time",
+				Destination: &migrateOptions.BatchSize,
+				Value:       500,
+			},
+		},
+		Action: runMigrate,
+	}
+}
+
+func runMigrate(c *cli.Context) error {
+	if c.Bool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	ctx := signals.SetupSignalContext()
+
+	for _, cfg := range []*drivers.Config{&migrateSource, &migrateDestination} {
+		cfg.CompactInterval = 5 * time.Minute
+		cfg.CompactTimeout = 5 * time.Second
+		cfg.CompactMinRetain = 1000
+		cfg.CompactBatchSize = 1000
+		cfg.PollBatchSize = 500
+	}
+
+	_, src, err := drivers.New(ctx, &migrateSource)
+	if err != nil {
+		return errors.Wrap(err, "failed to create driver for source endpoint")
+	}
+	_, dst, err := drivers.New(ctx, &migrateDestination)
+	if err != nil {
+		return errors.Wrap(err, "failed to create driver for destination endpoint")
+	}
+	if src == nil || dst == nil {
+		return errors.New("etcd endpoints are not supported for migration")
+	}
+	// The source is only read from. The destination is started by Migrate, once keys have been
+	// imported into it at their original revisions, or before they are copied.
+	migrateOptions.Progress = func(p migrate.Progress) {
+		logrus.Infof("Copied keys through %s at revision %d: created=%d updated=%d unchanged=%d", p.LastKey, p.Revision, p.Created, p.Updated, p.Unchanged)
+	}
+	p, err := migrate.Migrate(ctx, src, dst, migrateOptions)
+	if err != nil {
+		if p.LastKey != "" {
+			logrus.Errorf("Migration failed; resume with --start-key=%s", p.LastKey)
+		}
+		return err
+	}
+
+	rev, err := dst.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Migration complete: created=%d updated=%d unchanged=%d, destination revision is %d", p.Created, p.Updated, p.Unchanged, rev)
+	return nil
+}
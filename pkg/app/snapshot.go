@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/signals"
+	"github.com/k3s-io/kine/pkg/snapshot"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	snapshotConfig  drivers.Config
+	snapshotOptions snapshot.Options
+)
+
+func snapshotCommand() *cli.Command {
+	datastoreFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:        "endpoint",
+			Usage:       "Storage endpoint, in the same format as for the server",
+			Destination: &snapshotConfig.Endpoint,
+			Required:    true,
+		},
+		&cli.StringFlag{
+			Name:        "table-name",
+			Usage:       "Table name for the storage endpoint, for SQL backends",
+			Destination: &snapshotConfig.TableName,
+			Value:       "kine",
+		},
+	}
+	return &cli.Command{
+		Name:  "snapshot",
+		Usage: "Save or restore a snapshot in the etcd snapshot format",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "save",
+				Usage:     "Save the current keys in the datastore to a snapshot file",
+				ArgsUsage: "<filename>",
+				Description: "Writes the current value, lease and revisions of every key to a file in the format written by etcdctl snapshot save, " +
+					"which can be restored into kine or into etcd with etcdutl snapshot restore.",
+				Flags: append(datastoreFlags,
+					&cli.StringFlag{
+						Name:        "prefix",
+						Usage:       "Only save keys with this prefix",
+						Destination: &snapshotOptions.Prefix,
+						Value:       "/",
+					},
+					&cli.Int64Flag{
+						Name:        "batch-size",
+						Usage:       "Number of keys to read from the datastore at a time",
+						Destination: &snapshotOptions.BatchSize,
+						Value:       500,
+					},
+				),
+				Action: runSnapshotSave,
+			},
+			{
+				Name:      "restore",
+				Usage:     "Restore the keys in a snapshot file into an empty datastore",
+				ArgsUsage: "<filename>",
+				Description: "Writes the keys in a snapshot taken by kine or etcdctl into the datastore at their original revisions. " +
+					"The datastore must be empty, and kine must not be running against it during the restore.",
+				Flags:  datastoreFlags,
+				Action: runSnapshotRestore,
+			},
+		},
+	}
+}
+
+func runSnapshotSave(c *cli.Context) error {
+	ctx, backend, err := snapshotBackend(c)
+	if err != nil {
+		return err
+	}
+	info, err := snapshot.Save(ctx, backend, c.Args().First(), snapshotOptions)
+	if err != nil {
+		return errors.Wrap(err, "failed to save snapshot")
+	}
+	logrus.Infof("Saved %d keys at revision %d to %s", info.Keys, info.Revision, c.Args().First())
+	return nil
+}
+
+func runSnapshotRestore(c *cli.Context) error {
+	ctx, backend, err := snapshotBackend(c)
+	if err != nil {
+		return err
+	}
+	info, err := snapshot.Restore(ctx, backend, c.Args().First())
+	if err != nil {
+		return errors.Wrap(err, "failed to restore snapshot")
+	}
+	logrus.Infof("Restored %d keys at revision %d from %s", info.Keys, info.Revision, c.Args().First())
+	return nil
+}
+
+// snapshotBackend returns the backend for the datastore that a snapshot is saved from or restored
+// into. The backend is not started, as a restore requires that it has not been.
+func snapshotBackend(c *cli.Context) (context.Context, server.Backend, error) {
+	if c.Bool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	if c.NArg() != 1 {
+		return nil, nil, errors.New("snapshot filename must be specified")
+	}
+	ctx := signals.SetupSignalContext()
+
+	snapshotConfig.CompactInterval = 5 * time.Minute
+	snapshotConfig.CompactTimeout = 5 * time.Second
+	snapshotConfig.CompactMinRetain = 1000
+	snapshotConfig.CompactBatchSize = 1000
+	snapshotConfig.PollBatchSize = 500
+
+	_, backend, err := drivers.New(ctx, &snapshotConfig)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create driver for endpoint")
+	}
+	if backend == nil {
+		return nil, nil, errors.New("etcd endpoints are not supported for snapshots; use etcdctl instead")
+	}
+	return ctx, backend, nil
+}
@@ -2,15 +2,26 @@ package broadcaster
 
 import (
 	"context"
+	"errors"
 	"sync"
 )
 
+const defaultBufferSize = 100
+
+// ErrOverflow is the last item received by a subscriber that is dropped because it did not keep
+// up with the stream. Items buffered for the subscriber are discarded.
+var ErrOverflow = errors.New("subscriber did not keep up with the stream")
+
 type ConnectFunc func() (chan interface{}, error)
 
 type Broadcaster struct {
 	sync.Mutex
-	running bool
-	subs    map[chan interface{}]struct{}
+	// BufferSize is the number of items buffered for each subscriber. Subscribers that fall
+	// further behind are dropped, so that they do not block the stream for other subscribers.
+	// If not set, 100 items are buffered.
+	BufferSize int
+	running    bool
+	subs       map[chan interface{}]struct{}
 }
 
 func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc) (<-chan interface{}, error) {
@@ -23,7 +34,11 @@ func (b *Broadcaster) Subscribe(ctx context.Context, connect ConnectFunc) (<-cha
 		}
 	}
 
-	sub := make(chan interface{}, 100)
+	bufferSize := b.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	sub := make(chan interface{}, bufferSize)
 	if b.subs == nil {
 		b.subs = map[chan interface{}]struct{}{}
 	}
@@ -49,6 +64,23 @@ func (b *Broadcaster) unsub(sub chan interface{}, lock bool) {
 	}
 }
 
+// overflow drops a subscriber that has not kept up with the stream. The items buffered for the
+// subscriber are discarded to make room for ErrOverflow, so that the subscriber can tell that it
+// was dropped instead of unsubscribed. The lock must be held.
+func (b *Broadcaster) overflow(sub chan interface{}) {
+	delete(b.subs, sub)
+drain:
+	for {
+		select {
+		case <-sub:
+		default:
+			break drain
+		}
+	}
+	sub <- ErrOverflow
+	close(sub)
+}
+
 func (b *Broadcaster) start(connect ConnectFunc) error {
 	c, err := connect()
 	if err != nil {
@@ -67,8 +99,7 @@ func (b *Broadcaster) stream(input chan interface{}) {
 			select {
 			case sub <- item:
 			default:
-				// Slow consumer, drop
-				go b.unsub(sub, true)
+				b.overflow(sub)
 			}
 		}
 		b.Unlock()
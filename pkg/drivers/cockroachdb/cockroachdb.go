@@ -0,0 +1,177 @@
+package cockroachdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // sql driver
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/pgsql"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// getSchema returns the CockroachDB table schema. The id column is backed by an explicit
+// sequence instead of SERIAL, as CockroachDB's default SERIAL normalization uses unique_rowid(),
+// which is neither dense nor monotonic across nodes and would cause the poll loop to create
+// an endless series of gap fill records.
+func getSchema(tableName string) []string {
+	return []string{
+		`CREATE SEQUENCE IF NOT EXISTS "` + tableName + `_id_seq"`,
+		`CREATE TABLE IF NOT EXISTS "` + tableName + `"
+			(
+				id INT8 PRIMARY KEY DEFAULT nextval('"` + tableName + `_id_seq"'),
+				name STRING,
+				created INT8,
+				deleted INT8,
+				create_revision INT8,
+				prev_revision INT8,
+				lease INT8,
+				value BYTES,
+				old_value BYTES
+			)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_name_index" ON "` + tableName + `" (name)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_name_id_index" ON "` + tableName + `" (name,id)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_id_deleted_index" ON "` + tableName + `" (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_prev_revision_index" ON "` + tableName + `" (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "` + tableName + `_name_prev_revision_uindex" ON "` + tableName + `" (name, prev_revision)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_list_query_index" on "` + tableName + `"(name, id DESC, deleted)`,
+	}
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	parsedDSN, err := pgsql.PrepareDSN(cfg.DataSourceName, cfg.DatabaseName, cfg.BackendTLSConfig, cfg.PostgresConfig)
+	if err != nil {
+		return false, nil, err
+	}
+	credentials, err := generic.FetchCredentials(ctx, cfg.CredentialConfig.Provider)
+	if err != nil {
+		return false, nil, err
+	}
+	if parsedDSN, err = generic.URLCredentials(parsedDSN, credentials); err != nil {
+		return false, nil, err
+	}
+	pgsql.LogDSN("cockroachdb", parsedDSN)
+
+	// An existing connection pool is already connected to the database.
+	if !cfg.SkipSchemaSetup && cfg.ConnectionPoolConfig.DB == nil {
+		if err := pgsql.CreateDBIfNotExist(ctx, parsedDSN, cfg.ConnectionPoolConfig.MaxConnectWait, cfg.ConnectionPoolConfig.SetupTimeout); err != nil {
+			return false, nil, err
+		}
+	}
+
+	tableName := cfg.TableName
+	if tableName == "" {
+		tableName = "kine"
+	}
+
+	connector, err := generic.ReloadingConnector(ctx, cfg.Scheme, cfg.DataSourceName, cfg.EndpointFile, cfg.CredentialConfig, func(dataSourceName string, credentials *generic.Credentials) (driver.Connector, error) {
+		parsedDSN, err := pgsql.PrepareDSN(dataSourceName, cfg.DatabaseName, cfg.BackendTLSConfig, cfg.PostgresConfig)
+		if err != nil {
+			return nil, err
+		}
+		if parsedDSN, err = generic.URLCredentials(parsedDSN, credentials); err != nil {
+			return nil, err
+		}
+		return generic.DSNConnector("pgx", parsedDSN)
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	dialect, err := generic.OpenConnector(ctx, "pgx", connector, cfg.ConnectionPoolConfig, "$", true, cfg.MetricsRegisterer, tableName)
+	if err != nil {
+		return false, nil, err
+	}
+	dialect.DatabaseName = pgsql.DatabaseName(parsedDSN)
+
+	// Rows inserted with an explicit id do not advance the id sequence.
+	dialect.AdvanceRevisionSQL = dialect.Rebind(`SELECT setval('"` + tableName + `_id_seq"', GREATEST(?, (SELECT last_value FROM "` + tableName + `_id_seq")))`)
+	dialect.GetSizeSQL = `SELECT COALESCE(SUM(range_size), 0)::INT8 FROM [SHOW RANGES FROM TABLE "` + tableName + `" WITH DETAILS]`
+	// CockroachDB does not handle the multi-table DELETE ... USING join well, so select
+	// the rows to delete with a subquery instead.
+	dialect.CompactSQL = dialect.Rebind(`
+		DELETE FROM "` + tableName + `"
+		WHERE
+			id IN (
+				SELECT kp.prev_revision AS id
+				FROM "` + tableName + `" AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM "` + tableName + `" AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			) AND
+			(deleted = 0 OR id <= ?)`)
+	dialect.FillRetryDuration = time.Millisecond + 5
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*pgconn.PgError); ok {
+			return err.Code
+		}
+		return err.Error()
+	}
+	// CockroachDB runs all transactions at serializable isolation, and asks the client
+	// to retry any transaction that could not be serialized.
+	dialect.Retry = func(err error) bool {
+		return dialect.ErrCode(err) == pgerrcode.SerializationFailure
+	}
+	dialect.InsertRetry = func(err error) bool {
+		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation && err.ConstraintName == tableName+"_pkey" {
+			return true
+		}
+		return dialect.Retry(err)
+	}
+	dialect.TranslateErr = func(err error) error {
+		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+
+	if cfg.SkipSchemaSetup {
+		if err := generic.ValidateSchema(dialect.DB, tableName, getSchema(tableName), pgsql.IndexesSQL); err != nil {
+			return false, nil, err
+		}
+	} else if err := pgsql.CreateSchemaIfNotExist(ctx, dialect.DB, cfg.PostgresConfig.Schema); err != nil {
+		return false, nil, err
+	} else if err := setup(dialect.DB, tableName); err != nil {
+		return false, nil, err
+	}
+
+	dialect.Migrate(context.Background())
+	return true, logstructured.New(sqllog.New(dialect, cfg.SQLLogConfig()), cfg.ReadCacheSize, cfg.AdmissionHooks), nil
+}
+
+func setup(db *sql.DB, tableName string) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	for _, stmt := range getSchema(tableName) {
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+func init() {
+	drivers.Register("cockroachdb", New)
+}
@@ -4,22 +4,174 @@ import (
 	"time"
 
 	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/encryption"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/tls"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Config struct {
-	MetricsRegisterer     prometheus.Registerer
-	Endpoint              string
-	TableName             string
-	Scheme                string
-	DataSourceName        string
-	ConnectionPoolConfig  generic.ConnectionPoolConfig
-	BackendTLSConfig      tls.Config
-	CompactInterval       time.Duration
-	CompactIntervalJitter int
-	CompactTimeout        time.Duration
-	CompactMinRetain      int64
-	CompactBatchSize      int64
-	PollBatchSize         int64
+	MetricsRegisterer      prometheus.Registerer
+	Endpoint               string
+	EndpointFile           string
+	TableName              string
+	DatabaseName           string
+	Scheme                 string
+	DataSourceName         string
+	ReplicaEndpoints       []string
+	ReplicaDataSourceNames []string
+	ConnectionPoolConfig   generic.ConnectionPoolConfig
+	CredentialConfig       generic.CredentialConfig
+	BackendTLSConfig       tls.Config
+	CompactInterval        time.Duration
+	CompactMinInterval     time.Duration
+	CompactIntervalJitter  int
+	CompactTimeout         time.Duration
+	CompactMinRetain       int64
+	CompactRetention       time.Duration
+	CompactBatchSize       int64
+	CompactMaxBatchSize    int64
+	CompactBatchDelay      time.Duration
+	CompactDryRun          bool
+	CompactRepair          bool
+	PollBatchSize          int64
+	PollMaxInterval        time.Duration
+	OmitPrevValuePrefixes  []string
+	InsertBatchWindow      time.Duration
+	InsertBatchWrites      bool
+	KeyPrefixMetricsLimit  int
+	WatchBufferSize        int
+	ReadCacheSize          int
+	WriteRetryAttempts     int
+	WriteRetryBackoff      time.Duration
+	NameColumnLength       int
+	SkipSchemaSetup        bool
+	SchemaRequireLatest    bool
+	ValueTransformer       encryption.Transformer
+	AdmissionHooks         []logstructured.AdmissionHook
+	SQLiteConfig           SQLiteConfig
+	LibSQLConfig           LibSQLConfig
+	CloudSQLConfig         CloudSQLConfig
+	MySQLConfig            MySQLConfig
+	PostgresConfig         PostgresConfig
+
+	// CompactDeletedRetention keeps deleted rows from being compacted until they are older than
+	// this period.
+	CompactDeletedRetention time.Duration
+
+	// TablePartitions store the keys under their prefixes in tables of their own, instead of the
+	// main table. Only supported by the sqlite and mysql drivers.
+	TablePartitions []TablePartition
+}
+
+// TablePartition stores the keys under a prefix, such as /registry/events/, in a table of their
+// own.
+type TablePartition struct {
+	Prefix    string
+	TableName string
+}
+
+// SQLLogConfig returns the settings of the log used by the SQL drivers. Revisions are assigned by
+// the database unless the driver sets an allocator.
+func (c *Config) SQLLogConfig() sqllog.Config {
+	return sqllog.Config{
+		CompactInterval:         c.CompactInterval,
+		CompactMinInterval:      c.CompactMinInterval,
+		CompactIntervalJitter:   c.CompactIntervalJitter,
+		CompactTimeout:          c.CompactTimeout,
+		CompactMinRetain:        c.CompactMinRetain,
+		CompactRetention:        c.CompactRetention,
+		CompactDeletedRetention: c.CompactDeletedRetention,
+		CompactBatchSize:        c.CompactBatchSize,
+		CompactMaxBatchSize:     c.CompactMaxBatchSize,
+		CompactBatchDelay:       c.CompactBatchDelay,
+		CompactDryRun:           c.CompactDryRun,
+		CompactRepair:           c.CompactRepair,
+		PollBatchSize:           c.PollBatchSize,
+		PollMaxInterval:         c.PollMaxInterval,
+		OmitPrevValuePrefixes:   c.OmitPrevValuePrefixes,
+		Transformer:             c.ValueTransformer,
+		InsertBatchWindow:       c.InsertBatchWindow,
+		InsertBatchWrites:       c.InsertBatchWrites,
+		KeyPrefixMetricsLimit:   c.KeyPrefixMetricsLimit,
+		WatchBufferSize:         c.WatchBufferSize,
+	}
+}
+
+// SQLiteConfig holds PRAGMA settings that are applied to every connection opened by the sqlite
+// driver. Zero values leave the setting at the default for the connection, as configured by
+// the DSN or the SQLite library.
+type SQLiteConfig struct {
+	JournalMode       string
+	BusyTimeout       time.Duration
+	Synchronous       string
+	WALAutocheckpoint int
+}
+
+// LibSQLConfig holds settings for the libsql driver, which keeps a local embedded replica of a
+// remote libsql primary, such as a Turso database.
+type LibSQLConfig struct {
+	// ReplicaPath is the path of the local replica database file.
+	ReplicaPath string
+	// AuthToken is the token used to authenticate to the primary.
+	AuthToken string
+	// SyncInterval is how often the replica is synced from the primary. If zero, the replica is
+	// only synced when opened, and writes made through other replicas of the primary are not seen.
+	SyncInterval time.Duration
+}
+
+// CloudSQLConfig holds settings for connecting to a GCP Cloud SQL for MySQL instance through the
+// built-in Cloud SQL connector.
+type CloudSQLConfig struct {
+	// Instance is the instance connection name, in the form project:region:instance.
+	Instance string
+	// IPType selects the instance IP address to connect to, either PUBLIC or PRIVATE.
+	IPType string
+	// IAMAuth enables IAM database authentication, using an access token as the password.
+	IAMAuth bool
+}
+
+// MySQLConfig holds settings that are applied to every connection opened by the mysql driver.
+type MySQLConfig struct {
+	// IsolationLevel is the session transaction isolation level, such as READ COMMITTED. If not
+	// set, the server default is used, which is REPEATABLE READ unless configured otherwise.
+	IsolationLevel string
+	// RevisionSequence enables allocating revisions from a sequence table, in the transaction
+	// that inserts each row, instead of using the AUTO_INCREMENT id column. Writes by all nodes
+	// are serialized on the sequence row, trading throughput for a log without gaps.
+	RevisionSequence bool
+	// LongValues enables LONGBLOB value columns, which hold values of up to 4GB, instead of
+	// MEDIUMBLOB columns, which hold values of up to 16MB.
+	LongValues bool
+	// TLSConfigName is the name under which the backend TLS config is registered with the
+	// driver. If not set, a name unique to the backend is used.
+	TLSConfigName string
+	// NameCharset is the charset of the name column, either ascii or utf8mb4. If not set, ascii
+	// is used, which allows the longest keys to be indexed.
+	NameCharset string
+	// NameCollation is the collation of the name column. If not set, the binary collation of the
+	// charset is used for utf8mb4, and the server default for ascii.
+	NameCollation string
+	// SessionVariables are system variables set on each connection, each given as name=value,
+	// such as innodb_lock_wait_timeout=10 or time_zone=+00:00. Values that are not numbers are
+	// set as strings.
+	SessionVariables []string
+}
+
+// PostgresConfig holds authentication and schema settings that are applied to every connection
+// opened by the postgres, cockroach and yugabytedb drivers. Connections fail if the server requests
+// a weaker authentication method than configured.
+type PostgresConfig struct {
+	// RequireChannelBinding requires SCRAM-SHA-256-PLUS authentication, which binds the
+	// authentication exchange to the TLS connection. This requires a TLS connection to the server.
+	RequireChannelBinding bool
+	// MinAuthMethod is the weakest password authentication method that the server may request:
+	// password, md5 or scram-sha-256. If not set, any method is accepted.
+	MinAuthMethod string
+	// Schema is the schema that the table is created and queried in, set as the search_path of
+	// each connection, so that several instances can share a database under separate schemas. The
+	// schema is created if it does not exist. If not set, the search_path from the endpoint or
+	// the server default is used. It is not applied to an existing connection pool.
+	Schema string
 }
@@ -3,15 +3,40 @@ package drivers
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
 
+	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
 )
 
 var ErrUnknownDriver = errors.New("unknown driver")
 
+// ErrEncryptionNotSupported is returned by drivers that do not store values in a SQL datastore,
+// and so cannot encrypt them, if a value transformer is configured.
+var ErrEncryptionNotSupported = errors.New("encryption at rest is only supported by SQL drivers")
+
 func New(ctx context.Context, cfg *Config) (leaderElect bool, backend server.Backend, err error) {
+	// The table name is checked before connecting, so that an invalid name is reported at startup
+	// instead of as a failed statement.
+	if cfg.TableName != "" {
+		if err := generic.ValidateTableName(cfg.TableName); err != nil {
+			return false, nil, err
+		}
+	}
+	// Internal keys, such as compact_rev_key, do not start with a slash, and always store the
+	// previous value.
+	for _, prefix := range cfg.OmitPrevValuePrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return false, nil, fmt.Errorf("omit previous value prefix %q must start with /", prefix)
+		}
+	}
+
+	if err := validateTablePartitions(cfg); err != nil {
+		return false, nil, err
+	}
+
 	if cfg.Endpoint == "" {
 		driver := GetDefault()
 		if driver == nil {
@@ -26,10 +51,25 @@ func New(ctx context.Context, cfg *Config) (leaderElect bool, backend server.Bac
 
 	cfg.Scheme, cfg.DataSourceName = util.SchemeAndAddress(cfg.Endpoint)
 
+	cfg.ReplicaDataSourceNames = nil
+	for _, replica := range cfg.ReplicaEndpoints {
+		if err := validateDSNuri(replica); err != nil {
+			return false, nil, err
+		}
+		scheme, dataSourceName := util.SchemeAndAddress(replica)
+		if scheme != cfg.Scheme {
+			return false, nil, errors.New("invalid read replica endpoint; replica endpoint scheme must match the datastore endpoint")
+		}
+		cfg.ReplicaDataSourceNames = append(cfg.ReplicaDataSourceNames, dataSourceName)
+	}
+
 	driver, ok := Get(cfg.Scheme)
 	if !ok {
 		return false, nil, ErrUnknownDriver
 	}
+	if len(cfg.TablePartitions) > 0 && !partitionSchemes[cfg.Scheme] {
+		return false, nil, fmt.Errorf("table partitions are not supported by the %s driver", cfg.Scheme)
+	}
 	return driver(ctx, cfg)
 }
 
@@ -0,0 +1,152 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tracing"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// rowKey identifies an inserted row by the columns of the unique name/prev_revision index.
+type rowKey struct {
+	name         string
+	prevRevision int64
+}
+
+// InsertBatch inserts multiple rows with a single multi-row INSERT statement, and returns the
+// revision assigned to each row, in the same order as the rows. The rows are inserted in a single
+// transaction; if any row cannot be inserted, for example because it violates the unique
+// name/prev_revision index, the transaction is rolled back and none of the rows are inserted.
+func (d *Generic) InsertBatch(ctx context.Context, rows []*server.InsertRow) (ids []int64, err error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	for _, row := range rows {
+		if err := d.checkValueSize(row.Key, row.Value, row.PrevValue); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.LockWrites {
+		d.Lock()
+		defer d.Unlock()
+	}
+
+	values := make([]string, 0, len(rows))
+	args := make([]interface{}, 0, len(rows)*8)
+	keys := make([]interface{}, 0, len(rows)*2)
+	for _, row := range rows {
+		cVal := 0
+		dVal := 0
+		if row.Create {
+			cVal = 1
+		}
+		if row.Delete {
+			dVal = 1
+		}
+		values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, row.Key, cVal, dVal, row.CreateRevision, row.PreviousRevision, row.TTL, row.Value, row.PrevValue)
+		keys = append(keys, row.Key, row.PreviousRevision)
+	}
+
+	insertSQL := fmt.Sprintf(`INSERT INTO "%s"(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		values %s`, d.tableName, strings.Join(values, ", "))
+
+	ctx, span := d.startSpan(ctx, "sql.InsertBatch", insertSQL)
+	defer func() {
+		tracing.End(span, err)
+	}()
+	ctx, cancel := d.statementContext(ctx)
+	defer cancel()
+
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if rerr := tx.Rollback(); rerr != nil && rerr != sql.ErrTxDone {
+				logrus.Warnf("Failed to roll back batch insert: %v", rerr)
+			}
+		}
+	}()
+
+	var result *sql.Rows
+	if d.LastInsertID {
+		// Drivers without RETURNING cannot rely on LAST_INSERT_ID() for multi-row inserts, as
+		// the IDs assigned to a single statement are not guaranteed to be consecutive. Look up
+		// the new rows by name and previous revision within the same transaction instead; these
+		// are unique, so only the inserted rows are selected, using the name/prev_revision index,
+		// rather than every row of the keys.
+		if _, err = d.txExec(ctx, tx, q(insertSQL, d.paramCharacter, d.numbered), args...); err != nil {
+			return nil, err
+		}
+		selectSQL := fmt.Sprintf(`SELECT id, name, prev_revision FROM "%s" WHERE %s`,
+			d.tableName, strings.TrimSuffix(strings.Repeat("(name = ? AND prev_revision = ?) OR ", len(rows)), " OR "))
+		result, err = d.txQuery(ctx, tx, q(selectSQL, d.paramCharacter, d.numbered), keys...)
+	} else {
+		result, err = d.txQuery(ctx, tx, q(insertSQL+" RETURNING id, name, prev_revision", d.paramCharacter, d.numbered), args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inserted := make(map[rowKey]int64, len(rows))
+	for result.Next() {
+		var (
+			id  int64
+			key rowKey
+		)
+		if err = result.Scan(&id, &key.name, &key.prevRevision); err != nil {
+			result.Close()
+			return nil, err
+		}
+		inserted[key] = id
+	}
+	if err = result.Close(); err != nil {
+		return nil, err
+	}
+	if err = result.Err(); err != nil {
+		return nil, err
+	}
+
+	ids = make([]int64, 0, len(rows))
+	for _, row := range rows {
+		id, ok := inserted[rowKey{name: row.Key, prevRevision: row.PreviousRevision}]
+		if !ok {
+			err = fmt.Errorf("failed to find revision for batch inserted key %s", row.Key)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (d *Generic) txExec(ctx context.Context, tx *sql.Tx, sql string, args ...interface{}) (result sql.Result, err error) {
+	util.TraceSQL("TX EXEC BATCH", sql, nil, logrus.Fields{"args_count": len(args)})
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args...)
+	}()
+	return tx.ExecContext(ctx, sql, args...)
+}
+
+func (d *Generic) txQuery(ctx context.Context, tx *sql.Tx, sql string, args ...interface{}) (result *sql.Rows, err error) {
+	util.TraceSQL("TX QUERY BATCH", sql, nil, logrus.Fields{"args_count": len(args)})
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args...)
+	}()
+	return tx.QueryContext(ctx, sql, args...)
+}
@@ -0,0 +1,279 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+const (
+	vaultAddrEnvVar      = "VAULT_ADDR"
+	vaultTokenEnvVar     = "VAULT_TOKEN"
+	vaultNamespaceEnvVar = "VAULT_NAMESPACE"
+	vaultCACertEnvVar    = "VAULT_CACERT"
+	vaultDefaultAddr     = "https://127.0.0.1:8200"
+)
+
+// credentialRefreshInterval is how often credentials are fetched from the provider, if the
+// refresh interval is not set.
+var credentialRefreshInterval = time.Minute
+
+// credentialFetchTimeout bounds the time taken to fetch credentials from a provider.
+const credentialFetchTimeout = 30 * time.Second
+
+// Credentials are the username and password used to authenticate to the datastore.
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// CredentialProvider fetches the datastore credentials from an external source. Credentials is
+// called each time the credentials are refreshed, and should return the current credentials,
+// which may be cached by the provider until they are due to be rotated.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (*Credentials, error)
+}
+
+// CredentialConfig configures fetching the datastore credentials from a provider, instead of using
+// the username and password in the endpoint.
+type CredentialConfig struct {
+	// Provider is the source of the credentials. If nil, the endpoint credentials are used.
+	Provider CredentialProvider
+	// RefreshInterval is how often the credentials are fetched from the provider. When they
+	// change, new connections are opened with the new credentials, and connections opened with
+	// the previous credentials are closed by the pool instead of being reused.
+	RefreshInterval time.Duration
+}
+
+// NewCredentialProvider returns the built-in provider for the spec, which is one of:
+//
+//	file:<path>    a JSON file with username and password fields, or a directory containing
+//	               username and password files, such as a mounted secret
+//	exec:<command> a command that prints a JSON object with username and password fields
+//	vault:<path>   a Vault secret, such as database/creds/kine, read using the VAULT_ADDR,
+//	               VAULT_TOKEN, VAULT_NAMESPACE and VAULT_CACERT environment variables
+func NewCredentialProvider(spec string) (CredentialProvider, error) {
+	kind, source, _ := strings.Cut(spec, ":")
+	if source == "" {
+		return nil, fmt.Errorf("credential provider %q must be in the form <type>:<source>", spec)
+	}
+	switch kind {
+	case "file":
+		return &fileCredentialProvider{path: source}, nil
+	case "exec":
+		args := strings.Fields(source)
+		if len(args) == 0 {
+			return nil, errors.New("credential provider command is empty")
+		}
+		return &execCredentialProvider{args: args}, nil
+	case "vault":
+		return newVaultCredentialProvider(source)
+	default:
+		return nil, fmt.Errorf("unknown credential provider type %q; must be file, exec or vault", kind)
+	}
+}
+
+// FetchCredentials returns credentials from the provider, or nil if the provider is nil.
+func FetchCredentials(ctx context.Context, provider CredentialProvider) (*Credentials, error) {
+	if provider == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, credentialFetchTimeout)
+	defer cancel()
+	credentials, err := provider.Credentials(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching datastore credentials: %w", err)
+	}
+	if credentials == nil || credentials.Username == "" {
+		return nil, errors.New("fetching datastore credentials: provider did not return a username")
+	}
+	return credentials, nil
+}
+
+// URLCredentials returns the URL-style DSN with its username and password replaced by the
+// credentials. The DSN is returned unchanged if the credentials are nil.
+func URLCredentials(dataSourceName string, credentials *Credentials) (string, error) {
+	if credentials == nil {
+		return dataSourceName, nil
+	}
+	u, err := util.ParseURL(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(credentials.Username, credentials.Password)
+	return u.String(), nil
+}
+
+// parseCredentials decodes credentials from a JSON object with username and password fields.
+func parseCredentials(b []byte) (*Credentials, error) {
+	credentials := &Credentials{}
+	if err := json.Unmarshal(b, credentials); err != nil {
+		return nil, fmt.Errorf("decoding credentials: %w", err)
+	}
+	return credentials, nil
+}
+
+// fileCredentialProvider reads credentials from a file or directory, which is re-read each time
+// the credentials are refreshed, so that files rotated on disk are picked up.
+type fileCredentialProvider struct {
+	path string
+}
+
+func (f *fileCredentialProvider) Credentials(context.Context) (*Credentials, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		return parseCredentials(b)
+	}
+	username, err := os.ReadFile(filepath.Join(f.path, "username"))
+	if err != nil {
+		return nil, err
+	}
+	password, err := os.ReadFile(filepath.Join(f.path, "password"))
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{
+		Username: strings.TrimSpace(string(username)),
+		Password: strings.TrimRight(string(password), "\r\n"),
+	}, nil
+}
+
+// execCredentialProvider runs a command each time the credentials are refreshed, and reads the
+// credentials from its output.
+type execCredentialProvider struct {
+	args []string
+}
+
+func (e *execCredentialProvider) Credentials(ctx context.Context) (*Credentials, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.args[0], e.args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("running credential provider command: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("running credential provider command: %w", err)
+	}
+	return parseCredentials(out)
+}
+
+// vaultCredentialProvider reads credentials from a Vault secret. Dynamic secrets, such as those
+// issued by the database secrets engine, are cached until two thirds of their lease has passed,
+// at which point a new secret is read, so that the credentials are rotated before they expire.
+// Secrets without a lease, such as those in a KV store, are re-read each time.
+type vaultCredentialProvider struct {
+	path   string
+	client *http.Client
+
+	mu          sync.Mutex
+	credentials *Credentials
+	renewAt     time.Time
+}
+
+func newVaultCredentialProvider(path string) (*vaultCredentialProvider, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile := os.Getenv(vaultCACertEnvVar); caFile != "" {
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading Vault CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates found in Vault CA certificate file")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &vaultCredentialProvider{
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: credentialFetchTimeout, Transport: transport},
+	}, nil
+}
+
+func (v *vaultCredentialProvider) Credentials(ctx context.Context) (*Credentials, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.credentials != nil && time.Now().Before(v.renewAt) {
+		return v.credentials, nil
+	}
+
+	addr := os.Getenv(vaultAddrEnvVar)
+	if addr == "" {
+		addr = vaultDefaultAddr
+	}
+	// The token is re-read for each request, so that a token renewed by an agent is picked up.
+	token := os.Getenv(vaultTokenEnvVar)
+	if token == "" {
+		return nil, errors.New(vaultTokenEnvVar + " must be set to read credentials from Vault")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv(vaultNamespaceEnvVar); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(body, &errResp) == nil && len(errResp.Errors) > 0 {
+			return nil, fmt.Errorf("reading Vault secret %s failed with status %d: %s", v.path, resp.StatusCode, strings.Join(errResp.Errors, "; "))
+		}
+		return nil, fmt.Errorf("reading Vault secret %s failed with status %d", v.path, resp.StatusCode)
+	}
+
+	// KV version 2 secrets nest the secret data in a further data field.
+	var secret struct {
+		LeaseDuration int64 `json:"lease_duration"`
+		Data          struct {
+			Credentials
+			Data *Credentials `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("decoding Vault secret %s: %w", v.path, err)
+	}
+	credentials := &secret.Data.Credentials
+	if secret.Data.Data != nil {
+		credentials = secret.Data.Data
+	}
+
+	v.credentials = credentials
+	v.renewAt = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second * 2 / 3)
+	return credentials, nil
+}
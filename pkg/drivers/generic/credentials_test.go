@@ -0,0 +1,158 @@
+package generic
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadingConnectorCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	credentialFile := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(credentialFile, []byte(`{"username":"kine","password":"old"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewCredentialProvider("file:" + credentialFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := CredentialConfig{Provider: provider, RefreshInterval: 10 * time.Millisecond}
+	connector, err := ReloadingConnector(ctx, "postgres", "user:secret@db", "", config, func(dataSourceName string, credentials *Credentials) (driver.Connector, error) {
+		dataSourceName, err := URLCredentials("postgres://"+dataSourceName, credentials)
+		return &testConnector{dataSourceName: dataSourceName}, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.(*lifetimeConn).Conn.(*testConn).dataSourceName; got != "postgres://kine:old@db" {
+		t.Fatalf("expected connection to postgres://kine:old@db, got %s", got)
+	}
+
+	if err := os.WriteFile(credentialFile, []byte(`{"username":"kine","password":"new"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.(driver.Validator).IsValid() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be invalid after credentials change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err = connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.(*lifetimeConn).Conn.(*testConn).dataSourceName; got != "postgres://kine:new@db" {
+		t.Fatalf("expected connection to postgres://kine:new@db, got %s", got)
+	}
+}
+
+func TestCredentialProviders(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "username"), []byte("kine\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jsonFile := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(jsonFile, []byte(`{"username":"kine","password":"secret"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, spec := range []string{"file:" + dir, "file:" + jsonFile, "exec:cat " + jsonFile} {
+		provider, err := NewCredentialProvider(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		credentials, err := FetchCredentials(ctx, provider)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if *credentials != (Credentials{Username: "kine", Password: "secret"}) {
+			t.Fatalf("%s: expected kine:secret, got %s:%s", spec, credentials.Username, credentials.Password)
+		}
+	}
+
+	for _, spec := range []string{"", "file", "env:KINE_PASSWORD", "exec: "} {
+		if _, err := NewCredentialProvider(spec); err == nil {
+			t.Fatalf("expected error for credential provider %q", spec)
+		}
+	}
+}
+
+func TestVaultCredentialProvider(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/database/creds/kine":
+			w.Write([]byte(`{"lease_duration":3600,"data":{"username":"v-kine","password":"dynamic"}}`))
+		case "/v1/secret/data/kine":
+			w.Write([]byte(`{"lease_duration":0,"data":{"data":{"username":"kine","password":"static"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv(vaultAddrEnvVar, server.URL)
+	t.Setenv(vaultTokenEnvVar, "token")
+
+	ctx := context.Background()
+	provider, err := NewCredentialProvider("vault:database/creds/kine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		credentials, err := FetchCredentials(ctx, provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *credentials != (Credentials{Username: "v-kine", Password: "dynamic"}) {
+			t.Fatalf("expected v-kine:dynamic, got %s:%s", credentials.Username, credentials.Password)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected dynamic secret to be cached for its lease, got %d requests", requests)
+	}
+
+	provider, err = NewCredentialProvider("vault:secret/data/kine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := FetchCredentials(ctx, provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *credentials != (Credentials{Username: "kine", Password: "static"}) {
+		t.Fatalf("expected kine:static, got %s:%s", credentials.Username, credentials.Password)
+	}
+
+	t.Setenv(vaultTokenEnvVar, "invalid")
+	provider, err = NewCredentialProvider("vault:database/creds/kine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchCredentials(ctx, provider); err == nil {
+		t.Fatal("expected error with invalid Vault token")
+	}
+}
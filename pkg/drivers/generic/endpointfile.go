@@ -0,0 +1,182 @@
+package generic
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// endpointFilePollInterval is how often the endpoint file is checked for changes.
+var endpointFilePollInterval = 10 * time.Second
+
+// ConnectorFunc returns a connector for the DSN, prepared in the same way as the DSN that the
+// driver was opened with. If a credential provider is configured, the credentials are used
+// instead of the username and password in the DSN; otherwise they are nil.
+type ConnectorFunc func(dataSourceName string, credentials *Credentials) (driver.Connector, error)
+
+// ReadEndpointFile returns the datastore endpoint held in the file, such as a mounted secret, with
+// surrounding whitespace removed.
+func ReadEndpointFile(endpointFile string) (string, error) {
+	b, err := os.ReadFile(endpointFile)
+	if err != nil {
+		return "", err
+	}
+	endpoint := strings.TrimSpace(string(b))
+	if endpoint == "" {
+		return "", errors.New("datastore endpoint file is empty")
+	}
+	return endpoint, nil
+}
+
+// ReloadingConnector returns a connector for the DSN. If an endpoint file is set, the file is
+// checked for changes until the context is done. If a credential provider is set, credentials
+// are fetched from the provider at the refresh interval until the context is done. When the
+// endpoint in the file or the credentials change, new connections are opened with a connector
+// for the new DSN or credentials, and connections opened previously are closed by the pool
+// instead of being reused, so that rotated credentials are used without restarting kine.
+// Changes to the endpoint scheme are ignored, as the driver cannot be changed once started.
+func ReloadingConnector(ctx context.Context, scheme, dataSourceName, endpointFile string, credentialConfig CredentialConfig, newConnector ConnectorFunc) (driver.Connector, error) {
+	credentials, err := FetchCredentials(ctx, credentialConfig.Provider)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := newConnector(dataSourceName, credentials)
+	if err != nil || (endpointFile == "" && credentialConfig.Provider == nil) {
+		return connector, err
+	}
+
+	c := &reloadingConnector{
+		connector:      connector,
+		newConnector:   newConnector,
+		dataSourceName: dataSourceName,
+		credentials:    credentials,
+	}
+
+	if endpointFile != "" {
+		endpoint := scheme + "://" + dataSourceName
+		go util.PollWithContext(ctx, endpointFilePollInterval, func(context.Context) (bool, error) {
+			updated, err := ReadEndpointFile(endpointFile)
+			if err != nil {
+				logrus.Warnf("Failed to read datastore endpoint file: %v", err)
+				return false, nil
+			}
+			if updated == endpoint {
+				return false, nil
+			}
+			// The endpoint is not logged, as it may contain credentials.
+			endpoint = updated
+			updatedScheme, updatedDataSourceName := util.SchemeAndAddress(updated)
+			if updatedScheme != scheme {
+				logrus.Warnf("Ignoring change to datastore endpoint file; the endpoint scheme cannot be changed without restarting")
+				return false, nil
+			}
+			if err := c.reload(&updatedDataSourceName, nil); err != nil {
+				logrus.Errorf("Failed to use updated datastore endpoint from file: %v", err)
+				return false, nil
+			}
+			logrus.Infof("Datastore endpoint file changed, reconnecting to datastore")
+			return true, nil
+		})
+	}
+
+	if credentialConfig.Provider != nil {
+		interval := credentialConfig.RefreshInterval
+		if interval <= 0 {
+			interval = credentialRefreshInterval
+		}
+		go util.PollWithContext(ctx, interval, func(ctx context.Context) (bool, error) {
+			updated, err := FetchCredentials(ctx, credentialConfig.Provider)
+			if err != nil {
+				logrus.Warnf("Failed to refresh datastore credentials: %v", err)
+				return false, nil
+			}
+			if *updated == *c.currentCredentials() {
+				return false, nil
+			}
+			if err := c.reload(nil, updated); err != nil {
+				logrus.Errorf("Failed to use refreshed datastore credentials: %v", err)
+				return false, nil
+			}
+			logrus.Infof("Datastore credentials changed, reconnecting to datastore")
+			return true, nil
+		})
+	}
+	return c, nil
+}
+
+// reloadingConnector opens connections with the most recently set connector. Connections opened
+// by a previous connector report themselves as invalid, so that the pool replaces them.
+type reloadingConnector struct {
+	newConnector ConnectorFunc
+	// reloadMu serializes reloads, and guards dataSourceName.
+	reloadMu       sync.Mutex
+	dataSourceName string
+
+	mu          sync.RWMutex
+	connector   driver.Connector
+	generation  int
+	credentials *Credentials
+}
+
+func (c *reloadingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mu.RLock()
+	connector, generation := c.connector, c.generation
+	c.mu.RUnlock()
+
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &lifetimeConn{Conn: conn, expired: func() bool { return c.current() != generation }}, nil
+}
+
+func (c *reloadingConnector) Driver() driver.Driver {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connector.Driver()
+}
+
+func (c *reloadingConnector) current() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.generation
+}
+
+func (c *reloadingConnector) currentCredentials() *Credentials {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.credentials
+}
+
+// reload replaces the connector with one for the DSN and credentials. A nil DSN or credentials
+// leave the current value in place, so that the endpoint file and credential provider can be
+// reloaded independently.
+func (c *reloadingConnector) reload(updatedDataSourceName *string, credentials *Credentials) error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	dataSourceName := c.dataSourceName
+	if updatedDataSourceName != nil {
+		dataSourceName = *updatedDataSourceName
+	}
+	if credentials == nil {
+		credentials = c.currentCredentials()
+	}
+	connector, err := c.newConnector(dataSourceName, credentials)
+	if err != nil {
+		return err
+	}
+	c.dataSourceName = dataSourceName
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connector = connector
+	c.credentials = credentials
+	c.generation++
+	return nil
+}
@@ -0,0 +1,83 @@
+package generic
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testConnector struct {
+	dataSourceName string
+}
+
+func (c *testConnector) Connect(context.Context) (driver.Conn, error) {
+	return &testConn{dataSourceName: c.dataSourceName}, nil
+}
+
+func (c *testConnector) Driver() driver.Driver {
+	return nil
+}
+
+type testConn struct {
+	driver.Conn
+	dataSourceName string
+}
+
+func TestReloadingConnector(t *testing.T) {
+	endpointFilePollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	endpointFile := filepath.Join(t.TempDir(), "endpoint")
+	if err := os.WriteFile(endpointFile, []byte("postgres://old@db\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := ReadEndpointFile(endpointFile)
+	if err != nil || endpoint != "postgres://old@db" {
+		t.Fatalf("expected endpoint postgres://old@db, got %q: %v", endpoint, err)
+	}
+
+	connector, err := ReloadingConnector(ctx, "postgres", "old@db", endpointFile, CredentialConfig{}, func(dataSourceName string, _ *Credentials) (driver.Connector, error) {
+		return &testConnector{dataSourceName: dataSourceName}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.(*lifetimeConn).Conn.(*testConn).dataSourceName; got != "old@db" {
+		t.Fatalf("expected connection to old@db, got %s", got)
+	}
+
+	// A change of scheme is ignored, as the driver cannot be changed.
+	if err := os.WriteFile(endpointFile, []byte("mysql://new@db"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !conn.(driver.Validator).IsValid() {
+		t.Fatal("expected connection to be valid after scheme change")
+	}
+
+	if err := os.WriteFile(endpointFile, []byte("postgres://new@db"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.(driver.Validator).IsValid() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be invalid after endpoint change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err = connector.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.(*lifetimeConn).Conn.(*testConn).dataSourceName; got != "new@db" {
+		t.Fatalf("expected connection to new@db, got %s", got)
+	}
+}
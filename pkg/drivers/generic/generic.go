@@ -3,48 +3,62 @@ package generic
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Rican7/retry/backoff"
 	"github.com/Rican7/retry/strategy"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tracing"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	defaultMaxIdleConns = 2  // copied from database/sql
 	tableNameMaxLength  = 32 // set to 32 to avoid table name and index name too long
+
+	rowsAffectedAttr = attribute.Key("db.rows_affected")
 )
 
 // explicit interface check
 var _ server.Dialect = (*Generic)(nil)
 
-var (
-	columns       = `kv.id AS theid, kv.name AS thename, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value`
-	revSQL        string
-	compactRevSQL string
-	listSQL       string
-	tableName     string
-)
+var columns = `kv.id AS theid, kv.name AS thename, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value`
 
 type ErrRetry func(error) bool
 type TranslateErr func(error) error
 type ErrCode func(error) string
+type ListenFunc func(ctx context.Context, notify chan<- int64) error
+
+// LimitFunc returns the statement with its results limited to the given number of rows.
+type LimitFunc func(sql string, limit int64) string
 
 type ConnectionPoolConfig struct {
 	MaxIdle     int           // zero means defaultMaxIdleConns; negative means 0
 	MaxOpen     int           // <= 0 means unlimited
-	MaxLifetime time.Duration // maximum amount of time a connection may be reused
+	MaxLifetime time.Duration // maximum amount of time a connection may be reused; each connection's lifetime is shortened by a random jitter
+	MaxIdleTime time.Duration // maximum amount of time a connection may be idle before being closed
+
+	MaxConnectWait time.Duration // maximum time to wait for the datastore to accept connections at startup; zero means defaultMaxConnectWait
+	SetupTimeout   time.Duration // maximum time for each attempt to check for or create the database at startup; zero means defaultSetupTimeout; negative means no timeout
+
+	StatementTimeout time.Duration // maximum time for each query or statement, other than compaction and defragmentation; <= 0 means no timeout
+
+	DB *sql.DB // existing connection pool to use instead of opening one, when embedding kine; its pool settings are left unchanged, and it is not closed by kine
 }
 
 type Generic struct {
@@ -53,6 +67,8 @@ type Generic struct {
 	LockWrites            bool
 	LastInsertID          bool
 	DB                    *sql.DB
+	ReadDBs               []*sql.DB
+	readIndex             uint64
 	GetCurrentSQL         string
 	GetRevisionSQL        string
 	RevisionSQL           string
@@ -63,27 +79,83 @@ type Generic struct {
 	AfterSQL              string
 	DeleteSQL             string
 	CompactSQL            string
+	CompactDryRunSQL      string
+	MinRevisionSQL        string
 	UpdateCompactSQL      string
 	PostCompactSQL        string
 	InsertSQL             string
 	FillSQL               string
 	InsertLastInsertIDSQL string
 	GetSizeSQL            string
+	DefragSQL             string
 	Retry                 ErrRetry
 	InsertRetry           ErrRetry
 	TranslateErr          TranslateErr
 	ErrCode               ErrCode
+	ListenFunc            ListenFunc
+	LimitFunc             LimitFunc
 	FillRetryDuration     time.Duration
+	// MaxValueSize is the largest value that fits in the value columns, if set by the driver.
+	// Larger values are rejected instead of being sent to the database.
+	MaxValueSize int64
+	// LeaseRemainingSQL selects the revision and remaining TTL in seconds of each row with a lease,
+	// computed from the time that the row was written, if set by the driver. Rows written before
+	// the driver recorded the time are not selected.
+	LeaseRemainingSQL string
+	// ListRangeSQL and CountRangeSQL select keys by range rather than by prefix. They are
+	// templates with a placeholder for the range condition, which is completed when the range
+	// is queried, as the condition depends on the form of the range bounds.
+	ListRangeSQL  string
+	CountRangeSQL string
+	// ListRevisionSQL lists keys at a past revision, if set. It is a template like ListRangeSQL,
+	// with a placeholder for the key condition, followed by parameters for the revision (twice)
+	// and whether to include deleted keys. Rather than grouping all of the rows of the selected
+	// keys to find the latest row at the revision for each, every row at or before the revision
+	// is checked against the name_id_index for a newer row that is also at or before the revision.
+	// The rows are read in name order, so that a limited list only reads as many keys as it needs.
+	ListRevisionSQL string
+	// AdvanceRevisionSQL raises the sequence that the id column is assigned from to at least the
+	// given revision, if set by the driver. It is only needed by databases whose sequence is not
+	// advanced by inserting rows with an explicit id.
+	AdvanceRevisionSQL string
+	// WriteRetryAttempts is the number of times that a write that failed with one of the
+	// RetryErrCodes, such as a deadlock, is retried. Retries are made with exponential backoff
+	// starting at WriteRetryBackoff, with jitter so that conflicting writers do not retry in step.
+	WriteRetryAttempts int
+	WriteRetryBackoff  time.Duration
+	RetryErrCodes      []string
+	// DatabaseName is recorded on trace spans for SQL operations, if set by the driver.
+	DatabaseName string
+	// StatementTimeout bounds the time taken by each query or statement, including reading the
+	// rows returned by a query, so that a single slow query cannot hold a connection indefinitely.
+	// Compaction and defragmentation are bounded by their own timeouts instead.
+	StatementTimeout time.Duration
+	rangeSQL         sync.Map
+	// tableName is the table that the dialect's statements read and write, and revSQL and
+	// compactRevSQL select its current and compact revisions. They are held by each dialect, so
+	// that dialects for different tables can be opened in the same process.
+	tableName      string
+	revSQL         string
+	compactRevSQL  string
+	sharedDB       bool
+	driverName     string
+	paramCharacter string
+	numbered       bool
 }
 
+// placeholderPattern matches the ? placeholders that statements are written with.
+var placeholderPattern = regexp.MustCompile(`\?`)
+
+// q rewrites the ? placeholders in sql into the given placeholder style: param as is if not
+// numbered, such as ? for MySQL and SQLite, or param followed by the position of the placeholder,
+// such as $1 for PostgreSQL or @p1 for SQL Server. Statements must not otherwise contain ?.
 func q(sql, param string, numbered bool) string {
 	if param == "?" && !numbered {
 		return sql
 	}
 
-	regex := regexp.MustCompile(`\?`)
 	n := 0
-	return regex.ReplaceAllStringFunc(sql, func(string) string {
+	return placeholderPattern.ReplaceAllStringFunc(sql, func(string) string {
 		if numbered {
 			n++
 			return param + strconv.Itoa(n)
@@ -92,11 +164,17 @@ func q(sql, param string, numbered bool) string {
 	})
 }
 
+// Rebind rewrites the ? placeholders in sql into the placeholder style of the dialect, so that
+// drivers can write statements that override the generic ones once for all placeholder styles.
+func (d *Generic) Rebind(sql string) string {
+	return q(sql, d.paramCharacter, d.numbered)
+}
+
 func (d *Generic) Migrate(ctx context.Context) {
 	var (
 		count     = 0
 		countKV   = d.queryRow(ctx, `SELECT COUNT(*) FROM key_value`)
-		countKine = d.queryRow(ctx, `SELECT COUNT(*) FROM "`+tableName+`"`)
+		countKine = d.queryRow(ctx, `SELECT COUNT(*) FROM "`+d.tableName+`"`)
 	)
 
 	if err := countKV.Scan(&count); err != nil || count == 0 {
@@ -109,7 +187,7 @@ func (d *Generic) Migrate(ctx context.Context) {
 
 	logrus.Infof("Migrating content from old table")
 	_, err := d.execute(ctx,
-		`INSERT INTO "`+tableName+`"(deleted, create_revision, prev_revision, name, value, created, lease)
+		`INSERT INTO "`+d.tableName+`"(deleted, create_revision, prev_revision, name, value, created, lease)
 					SELECT 0, 0, 0, kv.name, kv.value, 1, CASE WHEN kv.ttl > 0 THEN 15 ELSE 0 END
 					FROM key_value kv
 						WHERE kv.id IN (SELECT MAX(kvd.id) FROM key_value kvd GROUP BY kvd.name)`)
@@ -126,28 +204,37 @@ func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB,
 		connPoolConfig.MaxIdle = defaultMaxIdleConns
 	}
 
-	logrus.Infof("Configuring %s database connection pooling: maxIdleConns=%d, maxOpenConns=%d, connMaxLifetime=%s", driverName, connPoolConfig.MaxIdle, connPoolConfig.MaxOpen, connPoolConfig.MaxLifetime)
+	logrus.WithFields(logrus.Fields{
+		"driver":          driverName,
+		"maxIdleConns":    connPoolConfig.MaxIdle,
+		"maxOpenConns":    connPoolConfig.MaxOpen,
+		"connMaxLifetime": connPoolConfig.MaxLifetime,
+		"connMaxIdleTime": connPoolConfig.MaxIdleTime,
+	}).Info("Configuring database connection pooling")
 	db.SetMaxIdleConns(connPoolConfig.MaxIdle)
 	db.SetMaxOpenConns(connPoolConfig.MaxOpen)
 	db.SetConnMaxLifetime(connPoolConfig.MaxLifetime)
+	db.SetConnMaxIdleTime(connPoolConfig.MaxIdleTime)
 }
 
-func validateTableName(customTableName string) error {
-	if len(customTableName) > tableNameMaxLength {
-		return fmt.Errorf("invalid table name '%s': must be less than %d characters", customTableName, tableNameMaxLength)
-	}
+// tableNamePattern matches the table names that are accepted. Table names are interpolated into
+// statements, so they are restricted to characters that are valid in an identifier in all of the
+// supported databases, and cannot end a quoted identifier or string literal.
+var tableNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_$]*$`)
 
-	matched, err := regexp.MatchString(`^[a-zA-Z][a-zA-Z0-9_\$]*$`, customTableName)
-	if err != nil {
-		return fmt.Errorf("failed to validate table name: %w", err)
+// ValidateTableName returns an error if the table name is too long, or contains characters other
+// than letters, numbers, underscores and dollar signs.
+func ValidateTableName(customTableName string) error {
+	if len(customTableName) > tableNameMaxLength {
+		return fmt.Errorf("invalid table name %q: must be at most %d characters", customTableName, tableNameMaxLength)
 	}
-	if !matched {
-		return fmt.Errorf("invalid table name '%s': must contain only letters, numbers, underscores, dollar signs and start with letter", customTableName)
+	if !tableNamePattern.MatchString(customTableName) {
+		return fmt.Errorf("invalid table name %q: must start with a letter and contain only letters, numbers, underscores and dollar signs", customTableName)
 	}
 	return nil
 }
 
-func buildSQLStatements() (rev, compactRev, list string) {
+func buildSQLStatements(tableName string) (rev, compactRev, list, count, listRevision string) {
 	rev = fmt.Sprintf(`
 		SELECT MAX(rkv.id) AS id
 		FROM "%s" AS rkv`, tableName)
@@ -177,11 +264,52 @@ func buildSQLStatements() (rev, compactRev, list string) {
 		ORDER BY lkv.thename ASC
 		`, rev, compactRev, columns, tableName, tableName)
 
-	return rev, compactRev, list
+	// count selects the same rows as list, but without fetching any columns or sorting
+	// the results, so that counting a large prefix does not require reading every value.
+	count = fmt.Sprintf(`
+		SELECT (%s), COUNT(kv.id)
+		FROM "%s" AS kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM "%s" AS mkv
+			WHERE
+				mkv.name LIKE ?
+				%%s
+			GROUP BY mkv.name) AS maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.deleted = 0 OR
+			?
+		`, rev, tableName, tableName)
+
+	listRevision = fmt.Sprintf(`
+		SELECT (%s), (%s), %s
+		FROM "%s" AS kv
+		WHERE
+			kv.name LIKE ?
+			%%s AND
+			kv.id <= ? AND
+			NOT EXISTS (
+				SELECT 1
+				FROM "%s" AS nkv
+				WHERE
+					nkv.name = kv.name AND
+					nkv.id > kv.id AND
+					nkv.id <= ?
+			) AND
+			(kv.deleted = 0 OR ?)
+		ORDER BY kv.name ASC
+		`, rev, compactRev, columns, tableName, tableName)
+
+	return rev, compactRev, list, count, listRevision
 }
 
-func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+// openFunc returns a new database handle. It is used to defer the choice between
+// opening by driver name and DSN, or by a driver-provided connector.
+type openFunc func() (*sql.DB, error)
+
+func openAndTest(open openFunc) (*sql.DB, error) {
+	db, err := open()
 	if err != nil {
 		return nil, err
 	}
@@ -197,40 +325,70 @@ func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
 }
 
 func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer, customTableName string) (*Generic, error) {
+	open := func() (*sql.DB, error) {
+		connector, err := DSNConnector(driverName, dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		return sql.OpenDB(withLifetimeJitter(connector, connPoolConfig.MaxLifetime)), nil
+	}
+	return openGeneric(ctx, driverName, open, connPoolConfig, paramCharacter, numbered, metricsRegisterer, customTableName)
+}
+
+// OpenConnector is like Open, but opens connections using the provided connector instead of a
+// fixed DSN. This allows drivers to adjust connection parameters, such as short-lived credentials,
+// each time the pool opens a new physical connection.
+func OpenConnector(ctx context.Context, driverName string, connector driver.Connector, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer, customTableName string) (*Generic, error) {
+	open := func() (*sql.DB, error) {
+		return sql.OpenDB(withLifetimeJitter(connector, connPoolConfig.MaxLifetime)), nil
+	}
+	return openGeneric(ctx, driverName, open, connPoolConfig, paramCharacter, numbered, metricsRegisterer, customTableName)
+}
+
+func openGeneric(ctx context.Context, driverName string, open openFunc, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer, customTableName string) (*Generic, error) {
 	var (
 		db  *sql.DB
 		err error
 	)
 
-	if err := validateTableName(customTableName); err != nil {
+	if err := ValidateTableName(customTableName); err != nil {
 		return nil, err
 	}
 
-	tableName = customTableName
-	revSQL, compactRevSQL, listSQL = buildSQLStatements()
+	tableName := customTableName
+	revSQL, compactRevSQL, listSQL, countSQL, listRevisionSQL := buildSQLStatements(tableName)
 
-	for i := 0; i < 300; i++ {
-		db, err = openAndTest(driverName, dataSourceName)
-		if err == nil {
-			break
+	if connPoolConfig.DB != nil {
+		db = connPoolConfig.DB
+		if err := db.PingContext(ctx); err != nil {
+			return nil, err
 		}
-
-		logrus.Errorf("failed to ping connection: %v", err)
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(time.Second):
+	} else {
+		err = RetryConnect(ctx, connPoolConfig.MaxConnectWait, IsRetryableConnectError, func() error {
+			db, err = openAndTest(open)
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	configureConnectionPooling(connPoolConfig, db, driverName)
+		configureConnectionPooling(connPoolConfig, db, driverName)
+	}
 
 	if metricsRegisterer != nil {
 		metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, "kine"))
 	}
 
 	return &Generic{
-		DB: db,
+		DB:               db,
+		StatementTimeout: connPoolConfig.StatementTimeout,
+		sharedDB:         connPoolConfig.DB != nil,
+		driverName:       driverName,
+		paramCharacter:   paramCharacter,
+		numbered:         numbered,
+		tableName:        tableName,
+		revSQL:           revSQL,
+		compactRevSQL:    compactRevSQL,
 
 		GetRevisionSQL: q(fmt.Sprintf(`
 			SELECT
@@ -242,17 +400,12 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 		ListRevisionStartSQL: q(fmt.Sprintf(listSQL, "AND mkv.id <= ?"), paramCharacter, numbered),
 		GetRevisionAfterSQL:  q(fmt.Sprintf(listSQL, "AND mkv.name > ? AND mkv.id <= ?"), paramCharacter, numbered),
 
-		CountCurrentSQL: q(fmt.Sprintf(`
-			SELECT (%s), COUNT(c.theid)
-			FROM (
-				%s
-			) c`, revSQL, fmt.Sprintf(listSQL, "AND mkv.name > ?")), paramCharacter, numbered),
+		CountCurrentSQL:  q(fmt.Sprintf(countSQL, "AND mkv.name > ?"), paramCharacter, numbered),
+		CountRevisionSQL: q(fmt.Sprintf(countSQL, "AND mkv.name > ? AND mkv.id <= ?"), paramCharacter, numbered),
 
-		CountRevisionSQL: q(fmt.Sprintf(`
-			SELECT (%s), COUNT(c.theid)
-			FROM (
-				%s
-			) c`, revSQL, fmt.Sprintf(listSQL, "AND mkv.name > ? AND mkv.id <= ?")), paramCharacter, numbered),
+		ListRangeSQL:    listSQL,
+		CountRangeSQL:   countSQL,
+		ListRevisionSQL: listRevisionSQL,
 
 		AfterSQL: q(fmt.Sprintf(`
 			SELECT (%s), (%s), %s
@@ -266,6 +419,33 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 			DELETE FROM "%s" AS kv
 			WHERE kv.id = ?`, tableName), paramCharacter, numbered),
 
+		CompactDryRunSQL: q(fmt.Sprintf(`
+			SELECT
+				COUNT(*),
+				COALESCE(SUM(LENGTH(kv.name) + COALESCE(LENGTH(kv.value), 0) + COALESCE(LENGTH(kv.old_value), 0)), 0)
+			FROM "%[1]s" AS kv
+			WHERE
+				kv.id IN (
+					SELECT kp.prev_revision AS id
+					FROM "%[1]s" AS kp
+					WHERE
+						kp.name != 'compact_rev_key' AND
+						kp.prev_revision != 0 AND
+						kp.id <= ?
+					UNION
+					SELECT kd.id AS id
+					FROM "%[1]s" AS kd
+					WHERE
+						kd.deleted != 0 AND
+						kd.id <= ?
+				) AND
+				(kv.deleted = 0 OR kv.id <= ?)`, tableName), paramCharacter, numbered),
+
+		MinRevisionSQL: fmt.Sprintf(`
+			SELECT COALESCE(MIN(kv.id), 0)
+			FROM "%s" AS kv
+			WHERE kv.name != 'compact_rev_key'`, tableName),
+
 		UpdateCompactSQL: q(fmt.Sprintf(`
 			UPDATE "%s"
 			SET prev_revision = ?
@@ -279,25 +459,96 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 
 		FillSQL: q(fmt.Sprintf(`INSERT INTO "%s"(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
 			values(?, ?, ?, ?, ?, ?, ?, ?, ?)`, tableName), paramCharacter, numbered),
-	}, err
+	}, nil
 }
 
-func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (result *sql.Rows, err error) {
-	logrus.Tracef("QUERY %v : %s", args, util.Stripped(sql))
+// OpenReadReplicas opens a connection pool for each of the provided read replica connectors.
+// Once opened, read-only list and count queries that do not require read-after-write consistency,
+// such as serializable range requests, are spread across the replicas.
+func (d *Generic) OpenReadReplicas(ctx context.Context, driverName string, connectors []driver.Connector, connPoolConfig ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) error {
+	for i, connector := range connectors {
+		var (
+			db  *sql.DB
+			err error
+		)
+
+		open := func() (*sql.DB, error) {
+			return sql.OpenDB(withLifetimeJitter(connector, connPoolConfig.MaxLifetime)), nil
+		}
+
+		err = RetryConnect(ctx, connPoolConfig.MaxConnectWait, IsRetryableConnectError, func() error {
+			db, err = openAndTest(open)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to connect to read replica %d: %w", i, err)
+		}
+
+		configureConnectionPooling(connPoolConfig, db, fmt.Sprintf("%s read replica %d", driverName, i))
+
+		if metricsRegisterer != nil {
+			metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, fmt.Sprintf("kine_replica_%d", i)))
+		}
+
+		d.ReadDBs = append(d.ReadDBs, db)
+	}
+	return nil
+}
+
+// readDB returns the database handle that read-only queries should be sent to. Replicas are
+// selected in round-robin order; the primary is used if there are no replicas, or if the
+// context requires read-after-write consistency.
+func (d *Generic) readDB(ctx context.Context) *sql.DB {
+	if len(d.ReadDBs) == 0 || server.IsPrimaryRead(ctx) {
+		return d.DB
+	}
+	i := atomic.AddUint64(&d.readIndex, 1)
+	return d.ReadDBs[i%uint64(len(d.ReadDBs))]
+}
+
+// QueryContextRead executes a read-only query, using a read replica if one is available.
+func (d *Generic) QueryContextRead(ctx context.Context, sql string, args ...interface{}) (result server.Rows, err error) {
+	util.TraceSQL("QUERY READ", sql, args, nil)
+	ctx, span := d.startSpan(ctx, "sql.QueryRead", sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args...)
+		tracing.End(span, err)
 	}()
-	return d.DB.QueryContext(ctx, sql, args...)
+	return d.queryRows(ctx, d.readDB(ctx), sql, args...)
 }
 
-func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
-	logrus.Tracef("QUERY ROW %v : %s", args, util.Stripped(sql))
+func (d *Generic) queryRowRead(ctx context.Context, sql string, args ...interface{}) (result *row) {
+	util.TraceSQL("QUERY ROW READ", sql, args, nil)
+	ctx, span := d.startSpan(ctx, "sql.QueryRowRead", sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()), util.Stripped(sql), args)
+		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()), util.Stripped(sql), args...)
+		tracing.End(span, result.Err())
 	}()
-	return d.DB.QueryRowContext(ctx, sql, args...)
+	return d.queryOneRow(ctx, d.readDB(ctx), sql, args...)
+}
+
+func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (result server.Rows, err error) {
+	util.TraceSQL("QUERY", sql, args, nil)
+	ctx, span := d.startSpan(ctx, "sql.Query", sql)
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args...)
+		tracing.End(span, err)
+	}()
+	return d.queryRows(ctx, d.DB, sql, args...)
+}
+
+func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) (result *row) {
+	util.TraceSQL("QUERY ROW", sql, args, nil)
+	ctx, span := d.startSpan(ctx, "sql.QueryRow", sql)
+	startTime := time.Now()
+	defer func() {
+		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()), util.Stripped(sql), args...)
+		tracing.End(span, result.Err())
+	}()
+	return d.queryOneRow(ctx, d.DB, sql, args...)
 }
 
 func (d *Generic) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
@@ -306,12 +557,24 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 		defer d.Unlock()
 	}
 
+	ctx, span := d.startSpan(ctx, "sql.Exec", sql)
+	defer func() {
+		if result != nil {
+			if rows, err := result.RowsAffected(); err == nil {
+				span.SetAttributes(rowsAffectedAttr.Int64(rows))
+			}
+		}
+		tracing.End(span, err)
+	}()
+
 	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
 	for i := uint(0); i < 20; i++ {
-		logrus.Tracef("EXEC (try: %d) %v : %s", i, args, util.Stripped(sql))
+		util.TraceSQL("EXEC", sql, args, logrus.Fields{"try": i})
+		execCtx, cancel := d.statementContext(ctx)
 		startTime := time.Now()
-		result, err = d.DB.ExecContext(ctx, sql, args...)
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		result, err = d.DB.ExecContext(execCtx, sql, args...)
+		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args...)
+		cancel()
 		if err != nil && d.Retry != nil && d.Retry(err) {
 			wait(i)
 			continue
@@ -321,9 +584,82 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 	return
 }
 
+type noStatementTimeoutKey struct{}
+
+// withoutStatementTimeout marks the context of compaction and defragmentation statements, which may
+// legitimately take much longer than other statements, and are bounded by their own timeouts.
+func withoutStatementTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noStatementTimeoutKey{}, true)
+}
+
+// statementContext returns a context that is cancelled once the statement timeout has passed,
+// unless the context already has an earlier deadline, or is exempt from the statement timeout.
+func (d *Generic) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.StatementTimeout <= 0 || ctx.Value(noStatementTimeoutKey{}) != nil {
+		return ctx, func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= d.StatementTimeout {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d.StatementTimeout)
+}
+
+// rows are the rows of a query, whose statement context is released once they are closed. The
+// deadline of the statement remains in effect while the rows are read.
+type rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// row is the result of a single row query, whose statement context is released once it is scanned.
+type row struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+func (r *row) Scan(dest ...any) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+// queryRows runs the query on the database with the statement timeout.
+func (d *Generic) queryRows(ctx context.Context, db *sql.DB, sql string, args ...interface{}) (server.Rows, error) {
+	ctx, cancel := d.statementContext(ctx)
+	result, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &rows{Rows: result, cancel: cancel}, nil
+}
+
+// queryOneRow runs the single row query on the database with the statement timeout.
+func (d *Generic) queryOneRow(ctx context.Context, db *sql.DB, sql string, args ...interface{}) *row {
+	ctx, cancel := d.statementContext(ctx)
+	return &row{Row: db.QueryRowContext(ctx, sql, args...), cancel: cancel}
+}
+
+// startSpan starts a client span for a SQL operation.
+func (d *Generic) startSpan(ctx context.Context, name, sql string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemKey.String(d.driverName),
+		semconv.DBQueryText(util.Stripped(sql).String()),
+		semconv.DBCollectionName(d.tableName),
+	}
+	if d.DatabaseName != "" {
+		attrs = append(attrs, semconv.DBNamespace(d.DatabaseName))
+	}
+	return tracing.Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
 func (d *Generic) GetCompactRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := d.queryRow(ctx, compactRevSQL)
+	row := d.queryRow(ctx, d.compactRevSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -337,25 +673,51 @@ func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error
 	return err
 }
 
-func (d *Generic) Compact(ctx context.Context, revision int64) (int64, error) {
-	logrus.Tracef("COMPACT %v", revision)
-	res, err := d.execute(ctx, d.CompactSQL, revision, revision)
+// AdvanceRevision ensures that rows inserted after rows were written at explicit revisions, such as
+// by an import, are assigned revisions after the given revision.
+func (d *Generic) AdvanceRevision(ctx context.Context, revision int64) error {
+	if d.AdvanceRevisionSQL == "" {
+		return nil
+	}
+	logrus.Tracef("ADVANCEREVISION %v", revision)
+	_, err := d.execute(ctx, d.AdvanceRevisionSQL, revision)
+	return err
+}
+
+// Compact executes the CompactSQL statement, which deletes rows that were superseded or deleted at
+// or before the given revision. Deleted rows newer than deletedRevision are kept.
+func (d *Generic) Compact(ctx context.Context, revision, deletedRevision int64) (int64, error) {
+	logrus.Tracef("COMPACT %v deleted=%v", revision, deletedRevision)
+	res, err := d.execute(withoutStatementTimeout(ctx), d.CompactSQL, revision, revision, deletedRevision)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
+// CompactDryRun executes the CompactDryRunSQL statement, which selects the rows that would be
+// deleted by compacting to the given revisions. It returns the number of rows, and their
+// approximate size in bytes.
+func (d *Generic) CompactDryRun(ctx context.Context, revision, deletedRevision int64) (int64, int64, error) {
+	logrus.Tracef("COMPACTDRYRUN %v deleted=%v", revision, deletedRevision)
+	var rows, size int64
+	row := d.queryRow(withoutStatementTimeout(ctx), d.CompactDryRunSQL, revision, revision, deletedRevision)
+	if err := row.Scan(&rows, &size); err != nil {
+		return 0, 0, err
+	}
+	return rows, size, nil
+}
+
 func (d *Generic) PostCompact(ctx context.Context) error {
 	logrus.Trace("POSTCOMPACT")
 	if d.PostCompactSQL != "" {
-		_, err := d.execute(ctx, d.PostCompactSQL)
+		_, err := d.execute(withoutStatementTimeout(ctx), d.PostCompactSQL)
 		return err
 	}
 	return nil
 }
 
-func (d *Generic) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
+func (d *Generic) GetRevision(ctx context.Context, revision int64) (server.Rows, error) {
 	return d.query(ctx, d.GetRevisionSQL, revision)
 }
 
@@ -365,28 +727,41 @@ func (d *Generic) DeleteRevision(ctx context.Context, revision int64) error {
 	return err
 }
 
-func (d *Generic) ListCurrent(ctx context.Context, prefix, startKey string, limit int64, includeDeleted bool) (*sql.Rows, error) {
+func (d *Generic) ListCurrent(ctx context.Context, prefix, startKey string, limit int64, includeDeleted bool) (server.Rows, error) {
 	sql := d.GetCurrentSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
-	return d.query(ctx, sql, prefix, startKey, includeDeleted)
+	return d.QueryContextRead(ctx, sql, prefix, startKey, includeDeleted)
 }
 
-func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
+func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (server.Rows, error) {
+	if revision > 0 && d.ListRevisionSQL != "" {
+		cond, args := "", []interface{}{prefix}
+		if startKey != "" {
+			cond = "AND name > ?"
+			args = append(args, startKey)
+		}
+		sql := d.templateSQL(d.ListRevisionSQL, cond)
+		if limit > 0 {
+			sql = d.limit(sql, limit)
+		}
+		return d.QueryContextRead(ctx, sql, append(args, revision, revision, includeDeleted)...)
+	}
+
 	if startKey == "" {
 		sql := d.ListRevisionStartSQL
 		if limit > 0 {
-			sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+			sql = d.limit(sql, limit)
 		}
-		return d.query(ctx, sql, prefix, revision, includeDeleted)
+		return d.QueryContextRead(ctx, sql, prefix, revision, includeDeleted)
 	}
 
 	sql := d.GetRevisionAfterSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
-	return d.query(ctx, sql, prefix, startKey, revision, includeDeleted)
+	return d.QueryContextRead(ctx, sql, prefix, startKey, revision, includeDeleted)
 }
 
 func (d *Generic) CountCurrent(ctx context.Context, prefix, startKey string) (int64, int64, error) {
@@ -395,7 +770,7 @@ func (d *Generic) CountCurrent(ctx context.Context, prefix, startKey string) (in
 		id  int64
 	)
 
-	row := d.queryRow(ctx, d.CountCurrentSQL, prefix, startKey, false)
+	row := d.queryRowRead(ctx, d.CountCurrentSQL, prefix, startKey, false)
 	err := row.Scan(&rev, &id)
 	return rev.Int64, id, err
 }
@@ -406,14 +781,93 @@ func (d *Generic) Count(ctx context.Context, prefix, startKey string, revision i
 		id  int64
 	)
 
-	row := d.queryRow(ctx, d.CountRevisionSQL, prefix, startKey, revision, false)
+	row := d.queryRowRead(ctx, d.CountRevisionSQL, prefix, startKey, revision, false)
+	err := row.Scan(&rev, &id)
+	return rev.Int64, id, err
+}
+
+// ListRange returns the latest row for each key in the range [start, end), at the given revision,
+// or at the current revision if revision is 0. An end of "\x00" selects all keys from start.
+func (d *Generic) ListRange(ctx context.Context, start, end string, limit, revision int64, includeDeleted bool) (server.Rows, error) {
+	if revision > 0 && d.ListRevisionSQL != "" {
+		sql, args := d.rangeQuery(d.ListRevisionSQL, start, end, 0)
+		if limit > 0 {
+			sql = d.limit(sql, limit)
+		}
+		return d.QueryContextRead(ctx, sql, append(args, revision, revision, includeDeleted)...)
+	}
+
+	sql, args := d.rangeQuery(d.ListRangeSQL, start, end, revision)
+	if limit > 0 {
+		sql = d.limit(sql, limit)
+	}
+	return d.QueryContextRead(ctx, sql, append(args, includeDeleted)...)
+}
+
+// CountRange returns the current revision, and the number of keys that ListRange would return for
+// the same range and revision.
+func (d *Generic) CountRange(ctx context.Context, start, end string, revision int64) (int64, int64, error) {
+	var (
+		rev sql.NullInt64
+		id  int64
+	)
+
+	sql, args := d.rangeQuery(d.CountRangeSQL, start, end, revision)
+	row := d.queryRowRead(ctx, sql, append(args, false)...)
 	err := row.Scan(&rev, &id)
 	return rev.Int64, id, err
 }
 
+// rangeQuery completes a range statement template with the condition selecting keys in the range
+// [start, end) at the given revision, and returns the statement and its arguments. Text columns
+// cannot hold NUL characters on all databases, so a bound with a trailing NUL, such as the
+// key+"\x00" form used to start a range immediately after a key, is compared against the key
+// without the NUL instead: name >= key+"\x00" is equivalent to name > key, and name < key+"\x00"
+// to name <= key.
+func (d *Generic) rangeQuery(template, start, end string, revision int64) (string, []interface{}) {
+	// The templates match names by prefix, so every name is matched before applying the range.
+	args := []interface{}{"%"}
+	cond := "AND name != 'compact_rev_key'"
+	if key, ok := strings.CutSuffix(start, "\x00"); ok {
+		cond += " AND name > ?"
+		args = append(args, key)
+	} else {
+		cond += " AND name >= ?"
+		args = append(args, start)
+	}
+	switch {
+	case end == "\x00":
+	case strings.HasSuffix(end, "\x00"):
+		cond += " AND name <= ?"
+		args = append(args, strings.TrimSuffix(end, "\x00"))
+	default:
+		cond += " AND name < ?"
+		args = append(args, end)
+	}
+	if revision > 0 {
+		cond += " AND id <= ?"
+		args = append(args, revision)
+	}
+
+	return d.templateSQL(template, cond), args
+}
+
+// templateSQL completes a statement template with the condition, and converts its parameters to
+// the form used by the driver. Completed statements are cached, as there are only a few forms of
+// condition for each template.
+func (d *Generic) templateSQL(template, cond string) string {
+	key := template + cond
+	if sql, ok := d.rangeSQL.Load(key); ok {
+		return sql.(string)
+	}
+	sql := q(fmt.Sprintf(template, cond), d.paramCharacter, d.numbered)
+	d.rangeSQL.Store(key, sql)
+	return sql
+}
+
 func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := d.queryRow(ctx, revSQL)
+	row := d.queryRow(ctx, d.revSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -421,14 +875,31 @@ func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	return id, err
 }
 
-func (d *Generic) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+// MinRevision returns the lowest revision of any row other than the compact revision, or zero if
+// there are no such rows.
+func (d *Generic) MinRevision(ctx context.Context) (int64, error) {
+	var id int64
+	err := d.queryRow(ctx, d.MinRevisionSQL).Scan(&id)
+	return id, err
+}
+
+func (d *Generic) After(ctx context.Context, prefix string, rev, limit int64) (server.Rows, error) {
 	sql := d.AfterSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
 	return d.query(ctx, sql, prefix, rev)
 }
 
+// limit limits the results of the statement with the driver's LimitFunc, or a LIMIT clause if the
+// driver does not set one.
+func (d *Generic) limit(sql string, limit int64) string {
+	if d.LimitFunc != nil {
+		return d.LimitFunc(sql, limit)
+	}
+	return fmt.Sprintf("%s LIMIT %d", sql, limit)
+}
+
 func (d *Generic) Fill(ctx context.Context, revision int64) error {
 	_, err := d.execute(ctx, d.FillSQL, revision, fmt.Sprintf("gap-%d", revision), 0, 1, 0, 0, 0, nil, nil)
 	return err
@@ -444,10 +915,17 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 		defer func() {
 			if err != nil {
 				err = d.TranslateErr(err)
+				if err == server.ErrKeyExists {
+					metrics.KeyExistsTotal.WithLabelValues(insertOperation(create, delete)).Inc()
+				}
 			}
 		}()
 	}
 
+	if err := d.checkValueSize(key, value, prevValue); err != nil {
+		return 0, err
+	}
+
 	cVal := 0
 	dVal := 0
 	if create {
@@ -457,6 +935,15 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 		dVal = 1
 	}
 
+	err = d.RetryWrite(ctx, key, func() error {
+		id, err = d.insert(ctx, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		return err
+	})
+	return id, err
+}
+
+// insert inserts a row, returning its revision. Transient errors are retried by the caller.
+func (d *Generic) insert(ctx context.Context, key string, cVal, dVal int, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
 	if d.LastInsertID {
 		row, err := d.execute(ctx, d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
 		if err != nil {
@@ -492,6 +979,75 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 	return
 }
 
+// InsertRevision inserts a row at a revision allocated by the caller, instead of by the database.
+//
+//nolint:revive
+func (d *Generic) InsertRevision(ctx context.Context, revision int64, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (err error) {
+	if d.TranslateErr != nil {
+		defer func() {
+			if err != nil {
+				err = d.TranslateErr(err)
+				if err == server.ErrKeyExists {
+					metrics.KeyExistsTotal.WithLabelValues(insertOperation(create, delete)).Inc()
+				}
+			}
+		}()
+	}
+
+	if err := d.checkValueSize(key, value, prevValue); err != nil {
+		return err
+	}
+
+	cVal := 0
+	dVal := 0
+	if create {
+		cVal = 1
+	}
+	if delete {
+		dVal = 1
+	}
+
+	return d.RetryWrite(ctx, key, func() error {
+		_, err := d.execute(ctx, d.FillSQL, revision, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		return err
+	})
+}
+
+// checkValueSize returns an error if the value or previous value is larger than the value columns
+// can hold, so that the value is not truncated by the database.
+func (d *Generic) checkValueSize(key string, value, prevValue []byte) error {
+	if d.MaxValueSize <= 0 {
+		return nil
+	}
+	if size := int64(max(len(value), len(prevValue))); size > d.MaxValueSize {
+		logrus.Errorf("Rejecting write to key %s: value size %d exceeds the maximum value size %d", key, size, d.MaxValueSize)
+		return server.ErrTooLarge
+	}
+	return nil
+}
+
+// insertOperation returns the operation that inserted a row, for use as a metric label.
+func insertOperation(create, delete bool) string {
+	switch {
+	case create:
+		return "create"
+	case delete:
+		return "delete"
+	default:
+		return "update"
+	}
+}
+
+// Defragment executes the DefragSQL statement, which rebuilds the table or database file to
+// release space freed by compaction.
+func (d *Generic) Defragment(ctx context.Context) error {
+	if d.DefragSQL == "" {
+		return errors.New("driver does not support defragmentation")
+	}
+	_, err := d.execute(withoutStatementTimeout(ctx), d.DefragSQL)
+	return err
+}
+
 func (d *Generic) GetSize(ctx context.Context) (int64, error) {
 	if d.GetSizeSQL == "" {
 		return 0, errors.New("driver does not support size reporting")
@@ -504,6 +1060,58 @@ func (d *Generic) GetSize(ctx context.Context) (int64, error) {
 	return size, nil
 }
 
+// LeaseRemaining returns the remaining TTL in seconds of each row with a lease, by revision. In
+// kine, a lease is granted by writing a key with it, so the TTL runs from the time that the row was
+// written. It returns nil if the driver does not record the time that rows are written.
+func (d *Generic) LeaseRemaining(ctx context.Context) (map[int64]int64, error) {
+	if d.LeaseRemainingSQL == "" {
+		return nil, nil
+	}
+	rows, err := d.query(ctx, d.LeaseRemainingSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	remaining := map[int64]int64{}
+	for rows.Next() {
+		var revision, ttl int64
+		if err := rows.Scan(&revision, &ttl); err != nil {
+			return nil, err
+		}
+		remaining[revision] = ttl
+	}
+	return remaining, rows.Err()
+}
+
 func (d *Generic) FillRetryDelay(ctx context.Context) {
 	time.Sleep(d.FillRetryDuration)
 }
+
+// Close closes the connection pools for the primary database and any read replicas. An existing
+// connection pool provided in the configuration is left open.
+func (d *Generic) Close() error {
+	for _, db := range d.ReadDBs {
+		db.Close()
+	}
+	if d.sharedDB {
+		return nil
+	}
+	return d.DB.Close()
+}
+
+// Ping checks connectivity to the primary database.
+func (d *Generic) Ping(ctx context.Context) error {
+	return d.DB.PingContext(ctx)
+}
+
+// Listen sends the revision of newly inserted rows to the notify channel, for drivers that
+// support push notification of inserts. It blocks until the context is cancelled or the
+// notification connection fails. Nil is returned immediately if the driver does not support
+// notifications.
+func (d *Generic) Listen(ctx context.Context, notify chan<- int64) error {
+	if d.ListenFunc == nil {
+		return nil
+	}
+	return d.ListenFunc(ctx, notify)
+}
@@ -0,0 +1,52 @@
+package generic
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTableName(t *testing.T) {
+	for _, name := range []string{"kine", "Kine", "kine_2", "tenant$kine", strings.Repeat("k", tableNameMaxLength)} {
+		if err := ValidateTableName(name); err != nil {
+			t.Errorf("expected table name %q to be valid, got %v", name, err)
+		}
+	}
+	for _, name := range []string{
+		"",
+		"2kine",
+		"_kine",
+		"kine-test",
+		"kine.test",
+		`kine"; DROP TABLE kine; --`,
+		"kine' OR '1'='1",
+		"kine\n",
+		strings.Repeat("k", tableNameMaxLength+1),
+	} {
+		if err := ValidateTableName(name); err == nil {
+			t.Errorf("expected table name %q to be rejected", name)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	const sql = `SELECT id FROM "kine" WHERE name LIKE ? AND id <= ? AND (deleted = 0 OR ?)`
+	for _, tt := range []struct {
+		param    string
+		numbered bool
+		want     string
+	}{
+		{"?", false, sql},
+		{"$", true, `SELECT id FROM "kine" WHERE name LIKE $1 AND id <= $2 AND (deleted = 0 OR $3)`},
+		{"@p", true, `SELECT id FROM "kine" WHERE name LIKE @p1 AND id <= @p2 AND (deleted = 0 OR @p3)`},
+		{"?", true, `SELECT id FROM "kine" WHERE name LIKE ?1 AND id <= ?2 AND (deleted = 0 OR ?3)`},
+	} {
+		d := &Generic{paramCharacter: tt.param, numbered: tt.numbered}
+		if got := d.Rebind(sql); got != tt.want {
+			t.Errorf("expected %s placeholders (numbered %v) to render %q, got %q", tt.param, tt.numbered, tt.want, got)
+		}
+		// Each statement is numbered from 1.
+		if got := d.Rebind(sql); got != tt.want {
+			t.Errorf("expected %s placeholders to render %q when rebound again, got %q", tt.param, tt.want, got)
+		}
+	}
+}
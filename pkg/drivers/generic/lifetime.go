@@ -0,0 +1,137 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"math/rand/v2"
+	"time"
+)
+
+// lifetimeJitter is the fraction of the maximum connection lifetime by which each connection's
+// lifetime is randomly shortened.
+const lifetimeJitter = 0.1
+
+// DSNConnector returns a connector for the named driver and DSN, as used by sql.Open.
+func DSNConnector(driverName, dataSourceName string) (driver.Connector, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	if dc, ok := d.(driver.DriverContext); ok {
+		return dc.OpenConnector(dataSourceName)
+	}
+	return &driverConnector{driver: d, dataSourceName: dataSourceName}, nil
+}
+
+// driverConnector opens connections by DSN, for drivers that do not provide a connector.
+type driverConnector struct {
+	driver         driver.Driver
+	dataSourceName string
+}
+
+func (c *driverConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dataSourceName)
+}
+
+func (c *driverConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// withLifetimeJitter wraps the connector so that each connection expires after a random lifetime
+// of up to lifetimeJitter less than maxLifetime. The pool only expires connections after a fixed
+// lifetime, so connections opened together, such as when the pool is first filled, would
+// otherwise all expire and be reopened together. The connector is returned unchanged if the
+// lifetime is not limited.
+func withLifetimeJitter(connector driver.Connector, maxLifetime time.Duration) driver.Connector {
+	if maxLifetime <= 0 {
+		return connector
+	}
+	return &lifetimeConnector{Connector: connector, maxLifetime: maxLifetime}
+}
+
+type lifetimeConnector struct {
+	driver.Connector
+	maxLifetime time.Duration
+}
+
+func (c *lifetimeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lifetime := c.maxLifetime - time.Duration(rand.Float64()*lifetimeJitter*float64(c.maxLifetime))
+	expires := time.Now().Add(lifetime)
+	return &lifetimeConn{Conn: conn, expired: func() bool { return time.Now().After(expires) }}, nil
+}
+
+// lifetimeConn reports itself as invalid once expired, so that the pool closes it instead of
+// returning it to the idle pool or reusing it.
+type lifetimeConn struct {
+	driver.Conn
+	expired func() bool
+}
+
+func (c *lifetimeConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *lifetimeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck
+}
+
+func (c *lifetimeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if queryer, ok := c.Conn.(driver.QueryerContext); ok {
+		return queryer.QueryContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *lifetimeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := c.Conn.(driver.ExecerContext); ok {
+		return execer.ExecContext(ctx, query, args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c *lifetimeConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *lifetimeConn) ResetSession(ctx context.Context) error {
+	if c.expired() {
+		return driver.ErrBadConn
+	}
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *lifetimeConn) IsValid() bool {
+	if c.expired() {
+		return false
+	}
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *lifetimeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,140 @@
+package generic
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/Rican7/retry/backoff"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxConnectWait = 5 * time.Minute
+	defaultSetupTimeout   = 30 * time.Second
+	connectBackoffFactor  = 250 * time.Millisecond
+	connectBackoffMax     = 10 * time.Second
+	writeRetryBackoff     = 10 * time.Millisecond
+	writeRetryBackoffMax  = time.Second
+)
+
+var connectBackoff = backoff.BinaryExponential(connectBackoffFactor)
+
+// RetryConnect calls fn until it succeeds, returns an error that isRetryable reports is permanent,
+// the context is cancelled, or maxWait has elapsed. Attempts are made with exponential backoff.
+// If maxWait is zero, the default of 5 minutes is used; if negative, fn is only called once.
+// This is intended to wait at startup for a datastore that is not yet accepting connections,
+// while failing fast on errors such as bad credentials that will not resolve themselves.
+func RetryConnect(ctx context.Context, maxWait time.Duration, isRetryable func(error) bool, fn func() error) error {
+	if maxWait == 0 {
+		maxWait = defaultMaxConnectWait
+	}
+	deadline := time.Now().Add(maxWait)
+
+	for attempt := uint(0); ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+
+		wait := connectBackoff(attempt)
+		if wait > connectBackoffMax || wait <= 0 {
+			wait = connectBackoffMax
+		}
+		if remaining := time.Until(deadline); remaining <= 0 {
+			return err
+		} else if wait > remaining {
+			wait = remaining
+		}
+
+		logrus.Errorf("Failed to connect to datastore, retrying in %s: %v", wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RetrySetup calls fn as RetryConnect does, but gives each call a context that is cancelled after
+// timeout, so that a datastore that accepts connections but does not respond cannot block startup
+// indefinitely. If timeout is zero, the default of 30 seconds is used; if negative, calls are not
+// timed out.
+func RetrySetup(ctx context.Context, maxWait, timeout time.Duration, isRetryable func(error) bool, fn func(context.Context) error) error {
+	if timeout == 0 {
+		timeout = defaultSetupTimeout
+	}
+	return RetryConnect(ctx, maxWait, isRetryable, func() error {
+		if timeout < 0 {
+			return fn(ctx)
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return fn(attemptCtx)
+	})
+}
+
+// IsRetryableConnectError returns true if the error indicates that the datastore could not be
+// reached, or is not ready to accept connections. Errors reported by a running datastore, such
+// as authentication failures or an unknown database, are not retryable.
+func IsRetryableConnectError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// Errors with an SQLSTATE code, such as those from postgres. Class 08 is a connection exception,
+	// 57P03 indicates that the server is starting up, and 53300 that there are too many connections.
+	var stateErr interface{ SQLState() string }
+	if errors.As(err, &stateErr) {
+		state := stateErr.SQLState()
+		return len(state) == 5 && (state[:2] == "08" || state == "57P03" || state == "53300")
+	}
+	return false
+}
+
+// RetryWrite calls fn until it succeeds, or fails with an error that is not one of the dialect's
+// RetryErrCodes, retrying up to WriteRetryAttempts times. The first wait is WriteRetryBackoff, or
+// 10ms if not set, and each wait is twice as long as the last, up to one second. Waits are
+// randomly shortened by up to half, so that writers that conflicted do not conflict again.
+func (d *Generic) RetryWrite(ctx context.Context, key string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= d.WriteRetryAttempts || d.ErrCode == nil || !slices.Contains(d.RetryErrCodes, d.ErrCode(err)) {
+			return err
+		}
+
+		factor := d.WriteRetryBackoff
+		if factor <= 0 {
+			factor = writeRetryBackoff
+		}
+		wait := backoff.BinaryExponential(factor)(uint(attempt))
+		if wait > writeRetryBackoffMax || wait <= 0 {
+			wait = writeRetryBackoffMax
+		}
+		wait -= time.Duration(rand.Int63n(int64(wait)/2 + 1))
+
+		logrus.Warnf("Retrying write to key %s in %s after transient error: %v", key, wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
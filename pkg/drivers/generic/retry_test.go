@@ -0,0 +1,69 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryWrite(t *testing.T) {
+	errDeadlock := errors.New("deadlock")
+	errOther := errors.New("other")
+	d := &Generic{
+		WriteRetryAttempts: 2,
+		WriteRetryBackoff:  time.Millisecond,
+		RetryErrCodes:      []string{"deadlock"},
+		ErrCode:            func(err error) string { return err.Error() },
+	}
+
+	for _, tt := range []struct {
+		name     string
+		errs     []error
+		err      error
+		attempts int
+	}{
+		{name: "success", errs: []error{nil}, attempts: 1},
+		{name: "transient", errs: []error{errDeadlock, errDeadlock, nil}, attempts: 3},
+		{name: "exhausted", errs: []error{errDeadlock, errDeadlock, errDeadlock, nil}, err: errDeadlock, attempts: 3},
+		{name: "permanent", errs: []error{errOther, nil}, err: errOther, attempts: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			err := d.RetryWrite(context.Background(), "/a", func() error {
+				err := tt.errs[attempts]
+				attempts++
+				return err
+			})
+			if err != tt.err || attempts != tt.attempts {
+				t.Errorf("expected error %v after %d attempts, got %v after %d", tt.err, tt.attempts, err, attempts)
+			}
+		})
+	}
+}
+
+func TestRetrySetup(t *testing.T) {
+	// The first attempt blocks until it is timed out, and is retried.
+	var attempts int
+	err := RetrySetup(context.Background(), time.Second, 10*time.Millisecond, IsRetryableConnectError, func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected success after 2 attempts, got %v after %d", err, attempts)
+	}
+
+	// Attempts that keep timing out are given up once the max wait has elapsed.
+	start := time.Now()
+	err = RetrySetup(context.Background(), 100*time.Millisecond, 10*time.Millisecond, IsRetryableConnectError, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected deadline exceeded after max wait, got %v after %s", err, time.Since(start))
+	}
+}
@@ -0,0 +1,229 @@
+package generic
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// schemaMigrationEnvVar sets the schema version to migrate up to.
+	schemaMigrationEnvVar = "KINE_SCHEMA_MIGRATION"
+	// schemaMigrationDownEnvVar sets the schema version to migrate down to. If set, no up
+	// migrations are run.
+	schemaMigrationDownEnvVar = "KINE_SCHEMA_MIGRATION_DOWN"
+)
+
+// SchemaMigration is a change to the schema of tables created by prior releases, and the statement
+// that reverts it. Empty statements are skipped, so that versions match up between drivers.
+type SchemaMigration struct {
+	Up   string
+	Down string
+}
+
+// SchemaMigrationExec executes the up or down statement of the migration at the given index.
+// Drivers may adjust or skip statements, or ignore errors that indicate that the change is
+// already in place.
+type SchemaMigrationExec func(index int, down bool, stmt string) error
+
+// RunSchemaMigrations migrates the schema to the version requested by KINE_SCHEMA_MIGRATION, or
+// KINE_SCHEMA_MIGRATION_DOWN if set, and records the resulting version in the table's schema
+// version table. If created is true, the table was created by this release with the latest schema,
+// so all migrations are recorded as applied.
+//
+// If there is no recorded version, the table was last set up by a release that did not record the
+// version, and all migrations up to the requested version are run, as they were by that release.
+// Migrations are not rerun once recorded, and the schema is never migrated down unless requested.
+// A schema recorded with a version newer than this release supports cannot be migrated down, and
+// must be migrated down by the newer release before rolling back.
+func RunSchemaMigrations(db *sql.DB, tableName string, created bool, migrations []SchemaMigration, exec SchemaMigrationExec) error {
+	versionTable := tableName + "_schema"
+	stmt := `CREATE TABLE IF NOT EXISTS "` + versionTable + `" (id INTEGER PRIMARY KEY, version INTEGER NOT NULL)`
+	util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+	if _, err := db.Exec(stmt); err != nil {
+		return err
+	}
+
+	recorded, err := schemaVersion(db, versionTable)
+	if err != nil {
+		return err
+	}
+	if created {
+		recorded = len(migrations)
+		if err := setSchemaVersion(db, versionTable, recorded); err != nil {
+			return err
+		}
+	}
+
+	// The requested version is checked even when migrating down, so that a misconfigured value is
+	// reported instead of being read as 0.
+	target := 0
+	if up := os.Getenv(schemaMigrationEnvVar); up != "" {
+		if target, err = strconv.Atoi(up); err != nil || target < 0 {
+			return fmt.Errorf("invalid %s value %q: must be a schema version of 0 or higher", schemaMigrationEnvVar, up)
+		}
+	}
+
+	if down := os.Getenv(schemaMigrationDownEnvVar); down != "" {
+		target, err := strconv.Atoi(down)
+		if err != nil || target < 0 {
+			return fmt.Errorf("invalid %s value %q", schemaMigrationDownEnvVar, down)
+		}
+		if recorded < 0 {
+			return fmt.Errorf("cannot migrate down: schema version of table %s is not recorded; set %s to the current version to record it", tableName, schemaMigrationEnvVar)
+		}
+		if recorded > len(migrations) {
+			return fmt.Errorf("cannot migrate down: schema version %d of table %s is newer than the latest version %d supported by this release", recorded, tableName, len(migrations))
+		}
+		for version := recorded; version > target; version-- {
+			if stmt := migrations[version-1].Down; stmt != "" {
+				logrus.Infof("Reverting schema migration %d of table %s", version, tableName)
+				if err := exec(version-1, true, stmt); err != nil {
+					return err
+				}
+			}
+			if err := setSchemaVersion(db, versionTable, version-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if recorded > len(migrations) {
+		logrus.Warnf("Schema version %d of table %s is newer than the latest version %d supported by this release; set %s=%d with the newer release to migrate down before rolling back", recorded, tableName, len(migrations), schemaMigrationDownEnvVar, len(migrations))
+		return nil
+	}
+
+	if target > len(migrations) {
+		target = len(migrations)
+	}
+	start := recorded
+	if start < 0 {
+		start = 0
+	}
+	for version := start; version < target; version++ {
+		if stmt := migrations[version].Up; stmt != "" {
+			if err := exec(version, false, stmt); err != nil {
+				return err
+			}
+		}
+		if version >= recorded {
+			if err := setSchemaVersion(db, versionTable, version+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSchemaVersion returns an error if the schema version recorded for the table is behind
+// latest, the version of the schema created by this release, so that a table that still needs to
+// be migrated is reported when starting instead of causing errors once running.
+func CheckSchemaVersion(db *sql.DB, tableName string, latest int) error {
+	version, err := SchemaVersion(db, tableName)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version of table %s: %w", tableName, err)
+	}
+	if version < 0 {
+		return fmt.Errorf("schema version of table %s is not recorded, and this release requires version %d; set %s=%d to run the migrations and record the version", tableName, latest, schemaMigrationEnvVar, latest)
+	}
+	if version < latest {
+		return fmt.Errorf("schema version %d of table %s is behind version %d required by this release; set %s=%d to run the migrations", version, tableName, latest, schemaMigrationEnvVar, latest)
+	}
+	return nil
+}
+
+// SchemaVersion returns the schema version recorded for the table, or -1 if no version is
+// recorded.
+func SchemaVersion(db *sql.DB, tableName string) (int, error) {
+	return schemaVersion(db, tableName+"_schema")
+}
+
+// schemaVersion returns the recorded schema version, or -1 if no version is recorded.
+func schemaVersion(db *sql.DB, versionTable string) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT version FROM "` + versionTable + `" WHERE id = 1`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	return version, err
+}
+
+func setSchemaVersion(db *sql.DB, versionTable string, version int) error {
+	current, err := schemaVersion(db, versionTable)
+	if err != nil {
+		return err
+	}
+	stmt := fmt.Sprintf(`UPDATE "%s" SET version = %d WHERE id = 1`, versionTable, version)
+	if current < 0 {
+		stmt = fmt.Sprintf(`INSERT INTO "%s" (id, version) VALUES (1, %d)`, versionTable, version)
+	}
+	util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+	_, err = db.Exec(stmt)
+	return err
+}
+
+// createIndexRegexp matches the name of the index created by a CREATE INDEX statement.
+var createIndexRegexp = regexp.MustCompile(`(?i)CREATE\s+(?:UNIQUE\s+)?INDEX\s+(?:IF\s+NOT\s+EXISTS\s+)?"?([^"\s]+)"?\s+ON`)
+
+// IndexName returns the name of the index created by the statement, if it is a CREATE INDEX
+// statement.
+func IndexName(stmt string) (string, bool) {
+	match := createIndexRegexp.FindStringSubmatch(stmt)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// ValidateSchema checks that the table exists with the columns used by kine, and that every index
+// created by the schema statements exists, for use in place of setting up the schema when the
+// schema is managed outside of kine. The indexes query selects the names of the indexes on the
+// table, given the table name as its only parameter. If the table is missing or lacks any of the
+// columns, or any of the indexes are missing, the error names what is missing.
+func ValidateSchema(db *sql.DB, tableName string, schema []string, indexesSQL string) error {
+	logrus.Infof("Skipping schema setup, validating database table schema and indexes")
+	stmt := `SELECT id, name, created, deleted, create_revision, prev_revision, lease, value, old_value FROM "` + tableName + `" WHERE 1 = 0`
+	util.TraceSQL("SETUP QUERY", stmt, nil, nil)
+	rows, err := db.Query(stmt)
+	if err != nil {
+		return fmt.Errorf("schema setup is skipped, but table %s could not be read; it may be missing or lack columns used by kine: %w", tableName, err)
+	}
+	rows.Close()
+
+	util.TraceSQL("SETUP QUERY", indexesSQL, nil, nil)
+	rows, err = db.Query(indexesSQL, tableName)
+	if err != nil {
+		return fmt.Errorf("schema setup is skipped, but the indexes of table %s could not be listed: %w", tableName, err)
+	}
+	defer rows.Close()
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, stmt := range schema {
+		if name, ok := IndexName(stmt); ok && !existing[strings.ToLower(name)] {
+			missing = append(missing, "index "+name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("schema setup is skipped, but the schema of table %s is incomplete: missing %s", tableName, strings.Join(missing, ", "))
+	}
+	logrus.Infof("Database tables and indexes are present")
+	return nil
+}
@@ -0,0 +1,135 @@
+//go:build cgo
+// +build cgo
+
+package generic
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestRunSchemaMigrations(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := []SchemaMigration{
+		{Up: "up 0", Down: "down 0"},
+		{},
+		{Up: "up 2", Down: "down 2"},
+	}
+	var executed []string
+	exec := func(i int, down bool, stmt string) error {
+		executed = append(executed, stmt)
+		return nil
+	}
+	run := func(created bool, up, down string) []string {
+		t.Helper()
+		executed = nil
+		t.Setenv(schemaMigrationEnvVar, up)
+		t.Setenv(schemaMigrationDownEnvVar, down)
+		if err := RunSchemaMigrations(db, "kine", created, migrations, exec); err != nil {
+			t.Fatal(err)
+		}
+		return executed
+	}
+	version := func() int {
+		t.Helper()
+		v, err := schemaVersion(db, "kine_schema")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// Without a recorded version, requested migrations are run and recorded.
+	if executed := run(false, "1", ""); len(executed) != 1 || executed[0] != "up 0" {
+		t.Fatalf("expected up 0 to be run, got %v", executed)
+	}
+	if v := version(); v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+
+	// Once recorded, only new migrations are run, and an older requested version has no effect.
+	if executed := run(false, "3", ""); len(executed) != 1 || executed[0] != "up 2" {
+		t.Fatalf("expected up 2 to be run, got %v", executed)
+	}
+	if executed := run(false, "", ""); len(executed) != 0 || version() != 3 {
+		t.Fatalf("expected no migrations at version 3, got %v at version %d", executed, version())
+	}
+
+	// Down migrations are run in reverse order.
+	if executed := run(false, "3", "0"); len(executed) != 2 || executed[0] != "down 2" || executed[1] != "down 0" {
+		t.Fatalf("expected down 2 and down 0 to be run, got %v", executed)
+	}
+	if v := version(); v != 0 {
+		t.Fatalf("expected version 0, got %d", v)
+	}
+
+	// A schema newer than the known migrations can't be migrated down.
+	if err := setSchemaVersion(db, "kine_schema", 4); err != nil {
+		t.Fatal(err)
+	}
+	if executed := run(false, "3", ""); len(executed) != 0 {
+		t.Fatalf("expected no migrations for newer schema, got %v", executed)
+	}
+	t.Setenv(schemaMigrationDownEnvVar, "0")
+	if err := RunSchemaMigrations(db, "kine", false, migrations, exec); err == nil {
+		t.Fatal("expected error migrating down newer schema")
+	}
+
+	// New tables are created with the latest schema.
+	if executed := run(true, "", ""); len(executed) != 0 || version() != 3 {
+		t.Fatalf("expected no migrations for new table, got %v at version %d", executed, version())
+	}
+
+	// Unparseable or negative versions are rejected rather than read as 0.
+	t.Setenv(schemaMigrationDownEnvVar, "")
+	for _, up := range []string{"latest", "-1", "3.0"} {
+		t.Setenv(schemaMigrationEnvVar, up)
+		if err := RunSchemaMigrations(db, "kine", false, migrations, exec); err == nil {
+			t.Errorf("expected error for %s=%q", schemaMigrationEnvVar, up)
+		}
+	}
+}
+
+func TestCheckSchemaVersion(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(`CREATE TABLE "kine_schema" (id INTEGER PRIMARY KEY, version INTEGER NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchemaVersion(db, "kine", 2); err == nil {
+		t.Error("expected error for unrecorded schema version")
+	}
+	for version, ok := range map[int]bool{1: false, 2: true, 3: true} {
+		if err := setSchemaVersion(db, "kine_schema", version); err != nil {
+			t.Fatal(err)
+		}
+		if err := CheckSchemaVersion(db, "kine", 2); (err == nil) != ok {
+			t.Errorf("expected schema version %d to be accepted %v, got %v", version, ok, err)
+		}
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	for stmt, want := range map[string]string{
+		`CREATE INDEX "kine_name_index" ON "kine" (name)`:                                                       "kine_name_index",
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`:        "kine_name_prev_revision_uindex",
+		`IF NOT EXISTS (SELECT 1 FROM sys.indexes) CREATE INDEX "kine_id_deleted_index" ON "kine" (id,deleted)`: "kine_id_deleted_index",
+		`CREATE TABLE IF NOT EXISTS "kine" (id INTEGER)`:                                                        "",
+	} {
+		if got, ok := IndexName(stmt); got != want || ok != (want != "") {
+			t.Errorf("expected index name %q for %s, got %q", want, stmt, got)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+)
+
+// SequenceAllocator allocates revisions from a sequence table, instead of relying on the
+// auto-increment id column. Each revision is allocated in the transaction that inserts the row,
+// and the sequence row stays locked until that transaction commits or rolls back, so rows are
+// committed in revision order even when several nodes are writing. On clustered databases that
+// interleave auto-increment values across nodes, this keeps the log free of gaps that watchers
+// would otherwise wait for and fill, at the cost of serializing writes on the sequence row.
+//
+// This scales worse than the auto-increment id column, as each write holds the sequence row until
+// it commits. Revisions are deliberately not reserved in blocks by each node, which would avoid
+// the contention, as rows would then be committed out of revision order, and watchers could not
+// tell a revision that is yet to be committed from one that will never be written.
+type SequenceAllocator struct {
+	d *Generic
+
+	createSQL  string
+	initSQL    string
+	reserveSQL string
+	currentSQL string
+	// revSQL selects the current revision from the sequence, in the form of the dialect's revSQL.
+	revSQL string
+}
+
+// NewSequenceAllocator returns an allocator that allocates revisions from the sequence table for
+// the dialect's table. If dialects for other tables are given, the revisions are shared with
+// those tables, and each revision is written to only one of them; use Share to allocate the
+// revisions of rows inserted into the other tables. The sequence table is created by Setup.
+func NewSequenceAllocator(d *Generic, shared ...*Generic) *SequenceAllocator {
+	sequenceTable := d.tableName + "_revision"
+	// The sequence never falls below the highest revision in the tables, so that it catches up
+	// with any rows written without it, such as by gap fills or nodes using the auto-increment
+	// id column.
+	maxRevisions := []string{fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) AS id FROM "%s"`, d.tableName)}
+	for _, s := range shared {
+		maxRevisions = append(maxRevisions, fmt.Sprintf(`SELECT COALESCE(MAX(id), 0) AS id FROM "%s"`, s.tableName))
+	}
+	maxRevision := fmt.Sprintf(`(SELECT MAX(mr.id) FROM (%s) AS mr)`, strings.Join(maxRevisions, " UNION ALL "))
+	return &SequenceAllocator{
+		d:         d,
+		createSQL: fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (id INTEGER PRIMARY KEY, revision BIGINT NOT NULL)`, sequenceTable),
+		initSQL:   fmt.Sprintf(`INSERT INTO "%s" (id, revision) SELECT 1, %s`, sequenceTable, maxRevision),
+		reserveSQL: fmt.Sprintf(`
+			UPDATE "%[1]s"
+			SET revision = CASE WHEN revision > %[2]s THEN revision ELSE %[2]s END + 1
+			WHERE id = 1`, sequenceTable, maxRevision),
+		currentSQL: fmt.Sprintf(`SELECT revision FROM "%s" WHERE id = 1`, sequenceTable),
+		revSQL: fmt.Sprintf(`
+		SELECT rs.revision AS id
+		FROM "%s" AS rs
+		WHERE rs.id = 1`, sequenceTable),
+	}
+}
+
+// Share returns an allocator that allocates revisions from the same sequence for rows inserted
+// into the table of another dialect. The dialect must have been passed to NewSequenceAllocator.
+func (s *SequenceAllocator) Share(d *Generic) *SequenceAllocator {
+	shared := *s
+	shared.d = d
+	return &shared
+}
+
+// UseRevisionSequence reads the current revision of the dialect's table from the sequence,
+// instead of taking the highest revision in the table, as when the table shares the sequence's
+// revisions with other tables. The statements that return the current revision along with their
+// rows are changed to read it from the sequence, so that reads report the revision of the latest
+// write to any of the tables. The sequence table must be set up before the dialect is used.
+func (d *Generic) UseRevisionSequence(s *SequenceAllocator) {
+	for _, stmt := range []*string{
+		&d.GetCurrentSQL,
+		&d.ListRevisionStartSQL,
+		&d.GetRevisionAfterSQL,
+		&d.CountCurrentSQL,
+		&d.CountRevisionSQL,
+		&d.ListRangeSQL,
+		&d.CountRangeSQL,
+		&d.ListRevisionSQL,
+		&d.AfterSQL,
+	} {
+		*stmt = strings.ReplaceAll(*stmt, d.revSQL, s.revSQL)
+	}
+	d.revSQL = s.revSQL
+}
+
+// Setup creates the sequence table, starting the sequence at the highest revision in the table.
+func (s *SequenceAllocator) Setup(ctx context.Context) error {
+	util.TraceSQL("SETUP EXEC", s.createSQL, nil, nil)
+	if _, err := s.d.DB.ExecContext(ctx, s.createSQL); err != nil {
+		return err
+	}
+	return s.Init(ctx)
+}
+
+// Init starts the sequence from the highest revision in the table, if it has not already been
+// started. The sequence table must already exist.
+func (s *SequenceAllocator) Init(ctx context.Context) error {
+	var revision int64
+	err := s.d.DB.QueryRowContext(ctx, s.currentSQL).Scan(&revision)
+	if err != sql.ErrNoRows {
+		return err
+	}
+	util.TraceSQL("SETUP EXEC", s.initSQL, nil, nil)
+	if _, err := s.d.DB.ExecContext(ctx, s.initSQL); err != nil {
+		// Another node may have started the sequence concurrently.
+		if s.d.DB.QueryRowContext(ctx, s.currentSQL).Scan(&revision) == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// NextRevision advances the sequence within the transaction, and returns the new revision. The
+// transaction must have been started by the allocator's dialect.
+func (s *SequenceAllocator) NextRevision(ctx context.Context, tx server.Transaction) (int64, error) {
+	t, ok := tx.(*Tx)
+	if !ok || t.d != s.d {
+		return 0, fmt.Errorf("revision sequence cannot be advanced by a %T transaction from another dialect", tx)
+	}
+	if _, err := t.execute(ctx, s.reserveSQL); err != nil {
+		return 0, err
+	}
+	var revision int64
+	err := t.queryRow(ctx, s.currentSQL).Scan(&revision)
+	return revision, err
+}
+
+// Insert inserts a row at the next revision from the sequence, in a transaction of its own, and
+// returns the revision. Transactions that fail with one of the dialect's RetryErrCodes, such as
+// deadlocks or conflicts with writes by other nodes, are retried.
+//
+//nolint:revive
+func (s *SequenceAllocator) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (revision int64, err error) {
+	err = s.d.RetryWrite(ctx, key, func() error {
+		tx, err := s.d.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.MustRollback()
+
+		if revision, err = s.NextRevision(ctx, tx); err != nil {
+			return err
+		}
+		if err := tx.InsertRevision(ctx, revision, key, create, delete, createRevision, previousRevision, ttl, value, prevValue); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == server.ErrKeyExists {
+		metrics.KeyExistsTotal.WithLabelValues(insertOperation(create, delete)).Inc()
+	}
+	return revision, err
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tracing"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/sirupsen/logrus"
 )
@@ -57,7 +58,7 @@ func (t *Tx) MustRollback() {
 
 func (t *Tx) GetCompactRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := t.queryRow(ctx, compactRevSQL)
+	row := t.queryRow(ctx, t.d.compactRevSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -71,16 +72,16 @@ func (t *Tx) SetCompactRevision(ctx context.Context, revision int64) error {
 	return err
 }
 
-func (t *Tx) Compact(ctx context.Context, revision int64) (int64, error) {
-	logrus.Tracef("TX COMPACT %v", revision)
-	res, err := t.execute(ctx, t.d.CompactSQL, revision, revision)
+func (t *Tx) Compact(ctx context.Context, revision, deletedRevision int64) (int64, error) {
+	logrus.Tracef("TX COMPACT %v deleted=%v", revision, deletedRevision)
+	res, err := t.execute(ctx, t.d.CompactSQL, revision, revision, deletedRevision)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
-func (t *Tx) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
+func (t *Tx) GetRevision(ctx context.Context, revision int64) (server.Rows, error) {
 	return t.query(ctx, t.d.GetRevisionSQL, revision)
 }
 
@@ -92,7 +93,7 @@ func (t *Tx) DeleteRevision(ctx context.Context, revision int64) error {
 
 func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := t.queryRow(ctx, revSQL)
+	row := t.queryRow(ctx, t.d.revSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -100,29 +101,105 @@ func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 	return id, err
 }
 
+// Insert inserts a row within the transaction, returning its revision. Unlike Generic.Insert,
+// failed inserts are not retried, as an error may have aborted the transaction.
+//
+//nolint:revive
+func (t *Tx) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+	defer func() {
+		if err != nil && t.d.TranslateErr != nil {
+			err = t.d.TranslateErr(err)
+			if err == server.ErrKeyExists {
+				metrics.KeyExistsTotal.WithLabelValues(insertOperation(create, delete)).Inc()
+			}
+		}
+	}()
+	if err := t.d.checkValueSize(key, value, prevValue); err != nil {
+		return 0, err
+	}
+
+	logrus.Tracef("TX INSERT %s", key)
+	cVal, dVal := boolInt(create), boolInt(delete)
+	if t.d.LastInsertID {
+		res, err := t.execute(ctx, t.d.InsertLastInsertIDSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		if err != nil {
+			return 0, err
+		}
+		return res.LastInsertId()
+	}
+	err = t.queryRow(ctx, t.d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue).Scan(&id)
+	return id, err
+}
+
+// InsertRevision inserts a row at the revision within the transaction.
+//
+//nolint:revive
+func (t *Tx) InsertRevision(ctx context.Context, revision int64, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (err error) {
+	defer func() {
+		if err != nil && t.d.TranslateErr != nil {
+			err = t.d.TranslateErr(err)
+			if err == server.ErrKeyExists {
+				metrics.KeyExistsTotal.WithLabelValues(insertOperation(create, delete)).Inc()
+			}
+		}
+	}()
+	if err := t.d.checkValueSize(key, value, prevValue); err != nil {
+		return err
+	}
+
+	logrus.Tracef("TX INSERTREVISION %s, revision=%d", key, revision)
+	_, err = t.execute(ctx, t.d.FillSQL, revision, key, boolInt(create), boolInt(delete), createRevision, previousRevision, ttl, value, prevValue)
+	return err
+}
+
+// ListRange returns the latest row for each key in the range [start, end) that has not been
+// deleted, as seen by the transaction.
+func (t *Tx) ListRange(ctx context.Context, start, end string) (server.Rows, error) {
+	sql, args := t.d.rangeQuery(t.d.ListRangeSQL, start, end, 0)
+	return t.query(ctx, sql, append(args, false)...)
+}
+
 func (t *Tx) query(ctx context.Context, sql string, args ...interface{}) (result *sql.Rows, err error) {
-	logrus.Tracef("TX QUERY %v : %s", args, util.Stripped(sql))
+	util.TraceSQL("TX QUERY", sql, args, nil)
+	ctx, span := t.d.startSpan(ctx, "sql.TxQuery", sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args...)
+		tracing.End(span, err)
 	}()
 	return t.x.QueryContext(ctx, sql, args...)
 }
 
 func (t *Tx) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
-	logrus.Tracef("TX QUERY ROW %v : %s", args, util.Stripped(sql))
+	util.TraceSQL("TX QUERY ROW", sql, args, nil)
+	ctx, span := t.d.startSpan(ctx, "sql.TxQueryRow", sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(result.Err()), util.Stripped(sql), args)
+		metrics.ObserveSQL(startTime, t.d.ErrCode(result.Err()), util.Stripped(sql), args...)
+		tracing.End(span, result.Err())
 	}()
 	return t.x.QueryRowContext(ctx, sql, args...)
 }
 
 func (t *Tx) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
-	logrus.Tracef("TX EXEC %v : %s", args, util.Stripped(sql))
+	util.TraceSQL("TX EXEC", sql, args, nil)
+	ctx, span := t.d.startSpan(ctx, "sql.TxExec", sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args...)
+		if result != nil {
+			if rows, err := result.RowsAffected(); err == nil {
+				span.SetAttributes(rowsAffectedAttr.Int64(rows))
+			}
+		}
+		tracing.End(span, err)
 	}()
 	return t.x.ExecContext(ctx, sql, args...)
 }
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -8,6 +8,9 @@ import (
 )
 
 func New(ctx context.Context, cfg *drivers.Config) (leaderElect bool, backend server.Backend, err error) {
+	if cfg.ValueTransformer != nil {
+		return false, nil, drivers.ErrEncryptionNotSupported
+	}
 	return true, nil, nil
 }
 
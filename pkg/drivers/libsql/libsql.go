@@ -0,0 +1,160 @@
+//go:build cgo && libsql
+// +build cgo,libsql
+
+package libsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tursodatabase/go-libsql"
+)
+
+const defaultReplicaPath = "./db/libsql-replica.db"
+
+func getSchema(tableName string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS "` + tableName + `"
+			(
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name INTEGER,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision INTEGER,
+				prev_revision INTEGER,
+				lease INTEGER,
+				value BLOB,
+				old_value BLOB
+			)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_name_index" ON "` + tableName + `" (name)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_name_id_index" ON "` + tableName + `" (name,id)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_id_deleted_index" ON "` + tableName + `" (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_prev_revision_index" ON "` + tableName + `" (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "` + tableName + `_name_prev_revision_uindex" ON "` + tableName + `" (name, prev_revision)`,
+	}
+}
+
+// New opens an embedded replica of the libsql primary named by the endpoint, such as
+// libsql://my-db.turso.io. Reads are served from the local replica file, and writes are sent to
+// the primary. The replica is synced from the primary at the configured interval, so that writes
+// made by other kine servers sharing the primary are seen by watches.
+func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	if cfg.DataSourceName == "" {
+		return false, nil, errors.New("libsql primary database URL is required")
+	}
+	primaryURL := "libsql://" + cfg.DataSourceName
+
+	replicaPath := cfg.LibSQLConfig.ReplicaPath
+	if replicaPath == "" {
+		replicaPath = defaultReplicaPath
+	}
+	if err := os.MkdirAll(filepath.Dir(replicaPath), 0700); err != nil {
+		return false, nil, err
+	}
+
+	tableName := cfg.TableName
+	if tableName == "" {
+		tableName = "kine"
+	}
+
+	opts := []libsql.Option{}
+	if cfg.LibSQLConfig.AuthToken != "" {
+		opts = append(opts, libsql.WithAuthToken(cfg.LibSQLConfig.AuthToken))
+	}
+	if cfg.LibSQLConfig.SyncInterval > 0 {
+		opts = append(opts, libsql.WithSyncInterval(cfg.LibSQLConfig.SyncInterval))
+	}
+	connector, err := libsql.NewEmbeddedReplicaConnector(replicaPath, primaryURL, opts...)
+	if err != nil {
+		return false, nil, errors.Wrap(err, "open libsql embedded replica")
+	}
+
+	// The pool closes connectors that implement io.Closer when it is closed, including pools that
+	// are discarded while retrying the initial connection, so the replica is hidden from the pool
+	// and left open for the life of the process.
+	dialect, err := generic.OpenConnector(ctx, "libsql", replicaConnector{connector}, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer, tableName)
+	if err != nil {
+		connector.Close()
+		return false, nil, err
+	}
+
+	dialect.LastInsertID = true
+	dialect.GetSizeSQL = `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`
+	dialect.CompactSQL = `
+		DELETE FROM "` + tableName + `" AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM "` + tableName + `" AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM "` + tableName + `" AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			) AND
+			(kv.deleted = 0 OR kv.id <= ?)`
+	// The libsql driver does not return typed errors, so constraint violations are identified by
+	// the message from the server.
+	dialect.TranslateErr = func(err error) error {
+		if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+
+	if cfg.SkipSchemaSetup {
+		if err := generic.ValidateSchema(dialect.DB, tableName, getSchema(tableName), `SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?`); err != nil {
+			return false, nil, err
+		}
+	} else if err := setup(dialect.DB, tableName); err != nil {
+		return false, nil, errors.Wrap(err, "setup db")
+	}
+
+	return true, logstructured.New(sqllog.New(dialect, cfg.SQLLogConfig()), cfg.ReadCacheSize, cfg.AdmissionHooks), nil
+}
+
+// replicaConnector opens connections to the embedded replica, without exposing its Close method.
+type replicaConnector struct {
+	driver.Connector
+}
+
+func setup(db *sql.DB, tableName string) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	for _, stmt := range getSchema(tableName) {
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+func init() {
+	drivers.Register("libsql", New)
+}
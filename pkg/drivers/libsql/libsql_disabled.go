@@ -0,0 +1,20 @@
+//go:build !cgo || !libsql
+// +build !cgo !libsql
+
+package libsql
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func New(_ context.Context, _ *drivers.Config) (bool, server.Backend, error) {
+	return false, nil, errors.New(`this binary is built without libsql support, compile with "-tags libsql"`)
+}
+
+func init() {
+	drivers.Register("libsql", New)
+}
@@ -0,0 +1,454 @@
+package mssql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/util"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDSN    = "sqlserver://sa@localhost:1433"
+	defaultDBName = "kubernetes"
+
+	// Error numbers returned by SQL Server.
+	errDeadlock        = 1205
+	errDuplicateKey    = 2601
+	errUniqueViolation = 2627
+)
+
+// sessionInitSQL is run on each new or reset connection, so that quoted identifiers are accepted
+// and failed statements roll back their transaction regardless of the database defaults.
+const sessionInitSQL = `SET QUOTED_IDENTIFIER ON; SET ANSI_NULLS ON; SET XACT_ABORT ON`
+
+// getSchema returns the statements that create the table and indexes. SQL Server does not support
+// IF NOT EXISTS for tables or indexes, so each statement checks the catalog first. The name column
+// uses a binary collation, so that names are compared case-sensitively and ordered by code point,
+// as with the "C" collation on postgres.
+func getSchema(tableName string) []string {
+	return []string{
+		`IF OBJECT_ID(N'` + tableName + `', N'U') IS NULL
+			CREATE TABLE "` + tableName + `"
+			(
+				id BIGINT IDENTITY(1,1) CONSTRAINT "` + tableName + `_pkey" PRIMARY KEY,
+				name NVARCHAR(630) COLLATE Latin1_General_100_BIN2,
+				created INT,
+				deleted INT,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease INT,
+				value VARBINARY(MAX),
+				old_value VARBINARY(MAX)
+			)`,
+
+		createIndex(tableName, "_name_index", `CREATE INDEX "`+tableName+`_name_index" ON "`+tableName+`" (name)`),
+		createIndex(tableName, "_name_id_index", `CREATE INDEX "`+tableName+`_name_id_index" ON "`+tableName+`" (name,id)`),
+		createIndex(tableName, "_id_deleted_index", `CREATE INDEX "`+tableName+`_id_deleted_index" ON "`+tableName+`" (id,deleted)`),
+		createIndex(tableName, "_prev_revision_index", `CREATE INDEX "`+tableName+`_prev_revision_index" ON "`+tableName+`" (prev_revision)`),
+		createIndex(tableName, "_name_prev_revision_uindex", `CREATE UNIQUE INDEX "`+tableName+`_name_prev_revision_uindex" ON "`+tableName+`" (name, prev_revision)`),
+		createIndex(tableName, "_list_query_index", `CREATE INDEX "`+tableName+`_list_query_index" ON "`+tableName+`" (name, id DESC, deleted)`),
+	}
+}
+
+// createIndex wraps the statement so that it is only run if the table does not already have an
+// index with the given name suffix.
+func createIndex(tableName, suffix, stmt string) string {
+	return `IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'` + tableName + suffix + `' AND object_id = OBJECT_ID(N'` + tableName + `'))
+			` + stmt
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	parsedDSN, err := prepareDSN(cfg.DataSourceName, cfg.DatabaseName, cfg.BackendTLSConfig)
+	if err != nil {
+		return false, nil, err
+	}
+	credentials, err := generic.FetchCredentials(ctx, cfg.CredentialConfig.Provider)
+	if err != nil {
+		return false, nil, err
+	}
+	if parsedDSN, err = generic.URLCredentials(parsedDSN, credentials); err != nil {
+		return false, nil, err
+	}
+
+	// An existing connection pool is already connected to the database.
+	if !cfg.SkipSchemaSetup && cfg.ConnectionPoolConfig.DB == nil {
+		if err := createDBIfNotExist(ctx, parsedDSN, cfg.ConnectionPoolConfig.MaxConnectWait, cfg.ConnectionPoolConfig.SetupTimeout); err != nil {
+			return false, nil, err
+		}
+	}
+
+	tableName := cfg.TableName
+	if tableName == "" {
+		tableName = "kine"
+	}
+
+	connector, err := generic.ReloadingConnector(ctx, cfg.Scheme, cfg.DataSourceName, cfg.EndpointFile, cfg.CredentialConfig, func(dataSourceName string, credentials *generic.Credentials) (driver.Connector, error) {
+		parsedDSN, err := prepareDSN(dataSourceName, cfg.DatabaseName, cfg.BackendTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		if parsedDSN, err = generic.URLCredentials(parsedDSN, credentials); err != nil {
+			return nil, err
+		}
+		connector, err := mssql.NewConnector(parsedDSN)
+		if err != nil {
+			return nil, err
+		}
+		connector.SessionInitSQL = sessionInitSQL
+		return connector, nil
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	dialect, err := generic.OpenConnector(ctx, "sqlserver", connector, cfg.ConnectionPoolConfig, "@p", true, cfg.MetricsRegisterer, tableName)
+	if err != nil {
+		return false, nil, err
+	}
+	dialect.DatabaseName = databaseName(parsedDSN)
+
+	// The revision subqueries must be named, as SQL Server requires every column of a derived
+	// table to have a name, and bit parameters must be compared rather than used as predicates.
+	revSQL := `SELECT MAX(rkv.id) AS id FROM "` + tableName + `" AS rkv`
+	compactRevSQL := `SELECT MAX(crkv.prev_revision) AS prev_revision FROM "` + tableName + `" AS crkv WHERE crkv.name = 'compact_rev_key'`
+	listSQL := `
+		SELECT *
+		FROM (
+			SELECT
+				(` + revSQL + `) AS current_revision,
+				(` + compactRevSQL + `) AS compact_revision,
+				kv.id AS theid, kv.name AS thename, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value
+			FROM "` + tableName + `" AS kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM "` + tableName + `" AS mkv
+				WHERE
+					mkv.name LIKE ?
+					%s
+				GROUP BY mkv.name) AS maxkv
+				ON maxkv.id = kv.id
+			WHERE
+				kv.deleted = 0 OR
+				? = 1
+		) AS lkv
+		ORDER BY lkv.thename ASC
+	`
+
+	countSQL := `
+		SELECT
+			(` + revSQL + `),
+			(SELECT COUNT(kv.id)
+			FROM "` + tableName + `" AS kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM "` + tableName + `" AS mkv
+				WHERE
+					mkv.name LIKE ?
+					%s
+				GROUP BY mkv.name) AS maxkv
+				ON maxkv.id = kv.id
+			WHERE
+				kv.deleted = 0 OR
+				? = 1)
+	`
+	dialect.GetCurrentSQL = dialect.Rebind(fmt.Sprintf(listSQL, "AND mkv.name > ?"))
+	dialect.ListRevisionStartSQL = dialect.Rebind(fmt.Sprintf(listSQL, "AND mkv.id <= ?"))
+	dialect.GetRevisionAfterSQL = dialect.Rebind(fmt.Sprintf(listSQL, "AND mkv.name > ? AND mkv.id <= ?"))
+	dialect.CountCurrentSQL = dialect.Rebind(fmt.Sprintf(countSQL, "AND mkv.name > ?"))
+	dialect.CountRevisionSQL = dialect.Rebind(fmt.Sprintf(countSQL, "AND mkv.name > ? AND mkv.id <= ?"))
+	dialect.ListRangeSQL = listSQL
+	dialect.CountRangeSQL = countSQL
+	dialect.ListRevisionSQL = `
+		SELECT
+			(` + revSQL + `) AS current_revision,
+			(` + compactRevSQL + `) AS compact_revision,
+			kv.id AS theid, kv.name AS thename, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value
+		FROM "` + tableName + `" AS kv
+		WHERE
+			kv.name LIKE ?
+			%s AND
+			kv.id <= ? AND
+			NOT EXISTS (
+				SELECT 1
+				FROM "` + tableName + `" AS nkv
+				WHERE
+					nkv.name = kv.name AND
+					nkv.id > kv.id AND
+					nkv.id <= ?
+			) AND
+			(kv.deleted = 0 OR ? = 1)
+		ORDER BY kv.name ASC
+	`
+	// SQL Server does not support LIMIT; OFFSET ... FETCH requires an ORDER BY clause, which all
+	// limited queries end with.
+	dialect.LimitFunc = func(sql string, limit int64) string {
+		return fmt.Sprintf("%s OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", sql, limit)
+	}
+	dialect.DeleteSQL = dialect.Rebind(`DELETE FROM "` + tableName + `" WHERE id = ?`)
+	dialect.CompactSQL = dialect.Rebind(`
+		DELETE kv FROM "` + tableName + `" AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM "` + tableName + `" AS kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM "` + tableName + `" AS kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id <= ?
+		) AS ks
+		ON kv.id = ks.id
+		WHERE kv.deleted = 0 OR kv.id <= ?`)
+	dialect.CompactDryRunSQL = dialect.Rebind(`
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(CAST(DATALENGTH(kv.name) AS BIGINT) + COALESCE(CAST(DATALENGTH(kv.value) AS BIGINT), 0) + COALESCE(CAST(DATALENGTH(kv.old_value) AS BIGINT), 0)), 0)
+		FROM "` + tableName + `" AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM "` + tableName + `" AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM "` + tableName + `" AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			) AND
+			(kv.deleted = 0 OR kv.id <= ?)`)
+	// Untyped nil parameters are sent as NVARCHAR, which is not implicitly converted to VARBINARY,
+	// so the value parameters are converted explicitly.
+	dialect.InsertSQL = dialect.Rebind(`INSERT INTO "` + tableName + `"(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		OUTPUT INSERTED.id
+		VALUES(?, ?, ?, ?, ?, ?, CONVERT(VARBINARY(MAX), ?), CONVERT(VARBINARY(MAX), ?))`)
+	// Explicit ids can only be inserted into an identity column with IDENTITY_INSERT enabled,
+	// which requires ALTER permission on the table.
+	dialect.FillSQL = dialect.Rebind(`SET IDENTITY_INSERT "` + tableName + `" ON;
+		INSERT INTO "` + tableName + `"(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		VALUES(?, ?, ?, ?, ?, ?, ?, CONVERT(VARBINARY(MAX), ?), CONVERT(VARBINARY(MAX), ?));
+		SET IDENTITY_INSERT "` + tableName + `" OFF`)
+	dialect.GetSizeSQL = `SELECT CAST(COALESCE(SUM(reserved_page_count), 0) * 8192 AS BIGINT) FROM sys.dm_db_partition_stats WHERE object_id = OBJECT_ID(N'` + tableName + `')`
+	dialect.DefragSQL = `ALTER INDEX ALL ON "` + tableName + `" REBUILD`
+	dialect.FillRetryDuration = time.Millisecond + 5
+	dialect.RetryErrCodes = []string{strconv.Itoa(errDeadlock)}
+	dialect.WriteRetryAttempts = cfg.WriteRetryAttempts
+	dialect.WriteRetryBackoff = cfg.WriteRetryBackoff
+	dialect.Retry = func(err error) bool {
+		var mssqlErr mssql.Error
+		return errors.As(err, &mssqlErr) && mssqlErr.Number == errDeadlock
+	}
+	dialect.InsertRetry = func(err error) bool {
+		var mssqlErr mssql.Error
+		return errors.As(err, &mssqlErr) && mssqlErr.Number == errUniqueViolation && strings.Contains(mssqlErr.Message, tableName+"_pkey")
+	}
+	dialect.TranslateErr = func(err error) error {
+		var mssqlErr mssql.Error
+		if errors.As(err, &mssqlErr) && (mssqlErr.Number == errDuplicateKey || mssqlErr.Number == errUniqueViolation) {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		var mssqlErr mssql.Error
+		if errors.As(err, &mssqlErr) {
+			return strconv.Itoa(int(mssqlErr.Number))
+		}
+		return err.Error()
+	}
+
+	if cfg.SkipSchemaSetup {
+		if err := generic.ValidateSchema(dialect.DB, tableName, getSchema(tableName), `SELECT name FROM sys.indexes WHERE object_id = OBJECT_ID(@p1) AND name IS NOT NULL`); err != nil {
+			return false, nil, err
+		}
+	} else if err := setup(dialect.DB, tableName); err != nil {
+		return false, nil, err
+	}
+
+	// Batched inserts rely on multi-row INSERT ... RETURNING, which SQL Server does not support.
+	logConfig := cfg.SQLLogConfig()
+	if logConfig.InsertBatchWindow > 0 {
+		logrus.Warnf("Insert batching is not supported by the sqlserver driver, ignoring insert batch window")
+		logConfig.InsertBatchWindow, logConfig.InsertBatchWrites = 0, false
+	}
+
+	return true, logstructured.New(sqllog.New(dialect, logConfig), cfg.ReadCacheSize, cfg.AdmissionHooks), nil
+}
+
+// setup creates the table schema and indexes. There are no prior releases of this driver, so
+// there are no schema migrations to run.
+func setup(db *sql.DB, tableName string) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	for _, stmt := range getSchema(tableName) {
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+// databaseName returns the database named in the DSN query.
+func databaseName(dataSourceName string) string {
+	u, err := util.ParseURL(dataSourceName)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("database")
+}
+
+// createDBIfNotExist connects to the server's default database and creates the database named in
+// the DSN, if it does not already exist. Newly created databases are switched to read committed
+// snapshot isolation, so that reads do not block on concurrent writes.
+// The server is given up to maxWait to begin accepting connections, and each attempt to connect,
+// check for, or create the database is given up to timeout.
+func createDBIfNotExist(ctx context.Context, dataSourceName string, maxWait, timeout time.Duration) error {
+	u, err := util.ParseURL(dataSourceName)
+	if err != nil {
+		return err
+	}
+
+	query := u.Query()
+	dbName := query.Get("database")
+	query.Del("database")
+	u.RawQuery = query.Encode()
+
+	db, err := sql.Open("sqlserver", u.String())
+	if err != nil {
+		logrus.WithField("database", dbName).Warnf("failed to ensure existence of database: unable to connect to default database: %v", err)
+		return nil
+	}
+	defer db.Close()
+
+	logrus.WithField("database", dbName).Info("Checking that database exists")
+	if err := generic.RetrySetup(ctx, maxWait, timeout, generic.IsRetryableConnectError, db.PingContext); err != nil {
+		if generic.IsRetryableConnectError(err) || ctx.Err() != nil {
+			return err
+		}
+		logrus.WithField("database", dbName).Warnf("failed to ensure existence of database: unable to connect to default database: %v", err)
+		return nil
+	}
+
+	var exists bool
+	err = generic.RetrySetup(ctx, maxWait, timeout, generic.IsRetryableConnectError, func(ctx context.Context) error {
+		err := db.QueryRowContext(ctx, "SELECT 1 FROM sys.databases WHERE name = @p1", dbName).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		logrus.WithField("database", dbName).Warnf("failed to check existence of database, going to attempt create: %v", err)
+	}
+
+	if !exists {
+		quoted := "[" + strings.ReplaceAll(dbName, "]", "]]") + "]"
+		stmt := "CREATE DATABASE " + quoted
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		err = generic.RetrySetup(ctx, maxWait, timeout, generic.IsRetryableConnectError, func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, stmt)
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			logrus.WithField("database", dbName).Warnf("failed to create database: %v", err)
+			return nil
+		}
+		logrus.WithField("database", dbName).Trace("Created database")
+
+		stmt = "ALTER DATABASE " + quoted + " SET READ_COMMITTED_SNAPSHOT ON"
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		err = generic.RetrySetup(ctx, maxWait, timeout, generic.IsRetryableConnectError, func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, stmt)
+			return err
+		})
+		if err != nil {
+			logrus.WithField("database", dbName).Warnf("failed to enable read committed snapshot isolation: %v", err)
+		}
+	}
+	return nil
+}
+
+// prepareDSN converts the datastore endpoint address into a sqlserver connection URL, filling in
+// the TLS parameters if not otherwise set. The database name is taken from dbName if set,
+// otherwise from the DSN, falling back to the default if neither specifies a name.
+func prepareDSN(dataSourceName, dbName string, tlsInfo tls.Config) (string, error) {
+	if len(dataSourceName) == 0 {
+		dataSourceName = defaultDSN
+	} else {
+		dataSourceName = "sqlserver://" + dataSourceName
+	}
+	u, err := util.ParseURL(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+
+	queryMap, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+	// The driver matches parameter names case-insensitively, so existing parameters are looked
+	// up the same way.
+	params := url.Values{}
+	for k, v := range queryMap {
+		params.Set(strings.ToLower(k), v[0])
+	}
+	if len(dbName) > 0 {
+		params.Set("database", dbName)
+	} else if params.Get("database") == "" {
+		params.Set("database", defaultDBName)
+	}
+
+	// set up tls dsn
+	if tlsInfo.CertFile != "" || tlsInfo.KeyFile != "" {
+		logrus.Warnf("Client certificate authentication is not supported by the sqlserver driver, ignoring backend TLS certificate and key")
+	}
+	if _, ok := params["certificate"]; tlsInfo.CAFile != "" && !ok {
+		params.Set("certificate", tlsInfo.CAFile)
+		if _, ok := params["encrypt"]; !ok {
+			params.Set("encrypt", "true")
+		}
+	}
+	if _, ok := params["trustservercertificate"]; tlsInfo.SkipVerify && !ok {
+		params.Set("trustservercertificate", "true")
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+func init() {
+	drivers.Register("sqlserver", New)
+}
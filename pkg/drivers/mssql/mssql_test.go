@@ -0,0 +1,55 @@
+package mssql
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/tls"
+)
+
+func TestPrepareDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		dbName  string
+		tlsInfo tls.Config
+		host    string
+		params  url.Values
+	}{
+		{name: "default", host: "localhost:1433", params: url.Values{"database": {"kubernetes"}}},
+		{name: "database from dsn", dsn: "kine:secret@db:1433?Database=kine", host: "db:1433", params: url.Values{"database": {"kine"}}},
+		{name: "database from config", dsn: "kine:secret@db:1433?database=kine", dbName: "other", host: "db:1433", params: url.Values{"database": {"other"}}},
+		{
+			name:    "ca file",
+			dsn:     "kine:secret@db",
+			tlsInfo: tls.Config{CAFile: "/etc/kine/ca.crt", SkipVerify: true},
+			host:    "db",
+			params:  url.Values{"database": {"kubernetes"}, "certificate": {"/etc/kine/ca.crt"}, "encrypt": {"true"}, "trustservercertificate": {"true"}},
+		},
+		{
+			name:    "explicit encrypt",
+			dsn:     "kine:secret@db?encrypt=strict",
+			tlsInfo: tls.Config{CAFile: "/etc/kine/ca.crt"},
+			host:    "db",
+			params:  url.Values{"database": {"kubernetes"}, "certificate": {"/etc/kine/ca.crt"}, "encrypt": {"strict"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := prepareDSN(tt.dsn, tt.dbName, tt.tlsInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Scheme != "sqlserver" || u.Host != tt.host {
+				t.Errorf("expected sqlserver://%s, got %s://%s", tt.host, u.Scheme, u.Host)
+			}
+			if got := u.Query().Encode(); got != tt.params.Encode() {
+				t.Errorf("expected params %s, got %s", tt.params.Encode(), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package mysql
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	azureAuthEnvVar       = "KINE_MYSQL_AZURE_AUTH"
+	azureTokenExpiryDelta = 5 * time.Minute
+)
+
+// azureMySQLScope is the Entra ID scope of access tokens for Azure Database for MySQL and
+// PostgreSQL.
+const azureMySQLScope = "https://ossrdbms-aad.database.windows.net/.default"
+
+// azureAuthEnabled returns true if Entra ID authentication has been requested.
+func azureAuthEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(azureAuthEnvVar))
+	return enabled
+}
+
+// azureTokenSource gets and caches Entra ID access tokens for Azure Database for MySQL from a
+// credential. Tokens are cached until shortly before they expire, so that a burst of new
+// connections does not request a token for each connection from credentials that do not cache
+// tokens themselves, such as the Azure CLI.
+type azureTokenSource struct {
+	mu         sync.Mutex
+	credential azcore.TokenCredential
+	token      azcore.AccessToken
+}
+
+// Token returns a cached access token, or gets a new token if the cached token has expired or
+// will expire soon.
+func (a *azureTokenSource) Token(ctx context.Context) (azcore.AccessToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token.Token != "" && time.Now().Add(azureTokenExpiryDelta).Before(a.token.ExpiresOn) {
+		return a.token, nil
+	}
+	token, err := a.credential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureMySQLScope}})
+	if err != nil {
+		return azcore.AccessToken{}, err
+	}
+	a.token = token
+	return token, nil
+}
+
+// configureAzureAuth sets up the mysql config so that an Entra ID access token is used as the
+// password for every new physical connection. Tokens are obtained with the Azure SDK's default
+// credential chain: a service principal or workload identity configured by environment
+// variables, the managed identity of the host, or the Azure CLI or Azure Developer CLI login.
+func configureAzureAuth(config *mysql.Config) error {
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return err
+	}
+	return configureAzureTokenAuth(config, credential)
+}
+
+// configureAzureTokenAuth sets up the mysql config to use tokens from the credential as the
+// password for every new physical connection, so connections opened after the token has expired
+// use a new token. Azure requires TLS and the cleartext auth plugin when authenticating with a
+// token, so both are forced on.
+func configureAzureTokenAuth(config *mysql.Config, credential azcore.TokenCredential) error {
+	tokens := &azureTokenSource{credential: credential}
+	requireTLS(config, "Azure Entra ID authentication")
+	config.AllowCleartextPasswords = true
+
+	return config.Apply(mysql.BeforeConnect(azureBeforeConnect(tokens)))
+}
+
+// azureBeforeConnect returns a hook that sets the password of each new connection to an access
+// token from the token source.
+func azureBeforeConnect(tokens *azureTokenSource) func(context.Context, *mysql.Config) error {
+	return func(ctx context.Context, c *mysql.Config) error {
+		token, err := tokens.Token(ctx)
+		if err != nil {
+			return err
+		}
+		c.Passwd = token.Token
+		return nil
+	}
+}
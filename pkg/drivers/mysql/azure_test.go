@@ -0,0 +1,119 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeAzureCredential returns a new token for each request, which expires after ttl.
+type fakeAzureCredential struct {
+	requests int64
+	ttl      time.Duration
+}
+
+func (f *fakeAzureCredential) GetToken(_ context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if len(opts.Scopes) != 1 || opts.Scopes[0] != azureMySQLScope {
+		return azcore.AccessToken{}, fmt.Errorf("unexpected scopes %v", opts.Scopes)
+	}
+	n := atomic.AddInt64(&f.requests, 1)
+	return azcore.AccessToken{Token: fmt.Sprintf("token-%d", n), ExpiresOn: time.Now().Add(f.ttl)}, nil
+}
+
+// TestAzureTokenAuth ensures that the token is used as the password of each connection, and that
+// it is cached until it is about to expire.
+func TestAzureTokenAuth(t *testing.T) {
+	ctx := context.Background()
+	credential := &fakeAzureCredential{ttl: time.Hour}
+	tokens := &azureTokenSource{credential: credential}
+	before := azureBeforeConnect(tokens)
+
+	config := &mysql.Config{Addr: "kine.mysql.database.azure.com:3306", User: "kine"}
+	for i := 0; i < 2; i++ {
+		if err := before(ctx, config); err != nil {
+			t.Fatal(err)
+		}
+		if config.Passwd != "token-1" {
+			t.Fatalf("expected cached token as password, got %s", config.Passwd)
+		}
+	}
+
+	// Simulate expiry of the cached token.
+	tokens.token.ExpiresOn = time.Now()
+	if err := before(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Passwd != "token-2" {
+		t.Fatalf("expected new token as password after expiry, got %s", config.Passwd)
+	}
+}
+
+// TestAzureAuthPreferredTLS ensures that the preferred TLS mode, which skips certificate
+// verification and falls back to plaintext, is upgraded to verified TLS before tokens are sent as
+// passwords.
+func TestAzureAuthPreferredTLS(t *testing.T) {
+	config, err := mysql.ParseDSN("kine@tcp(kine.mysql.database.azure.com:3306)/kine?tls=preferred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configureAzureTokenAuth(config, &fakeAzureCredential{ttl: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if config.TLS == nil || config.TLS.InsecureSkipVerify || config.AllowFallbackToPlaintext {
+		t.Fatalf("expected verified TLS without plaintext fallback, got %+v, fallback=%v", config.TLS, config.AllowFallbackToPlaintext)
+	}
+}
+
+// TestAzureAuthReconnect ensures that a new token is requested when reconnecting after the
+// connection is dropped, once the previous token has expired.
+func TestAzureAuthReconnect(t *testing.T) {
+	// Tokens that expire within the refresh window are never reused.
+	credential := &fakeAzureCredential{ttl: time.Minute}
+
+	// The database drops every connection before completing the handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	config := mysql.NewConfig()
+	config.Net = "tcp"
+	config.Addr = listener.Addr().String()
+	config.User = "kine"
+	if err := configureAzureTokenAuth(config, credential); err != nil {
+		t.Fatal(err)
+	}
+	if config.TLSConfig != "true" || !config.AllowCleartextPasswords {
+		t.Fatal("expected TLS and cleartext passwords to be enabled")
+	}
+
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := connector.Connect(context.Background()); err == nil {
+			t.Fatal("expected connection to be dropped")
+		}
+		if n := atomic.LoadInt64(&credential.requests); n != int64(i) {
+			t.Fatalf("expected %d token requests after %d connections, got %d", i, i, n)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package mysql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// killTimeout is the maximum time allowed to connect to the server and kill a cancelled statement.
+const killTimeout = 5 * time.Second
+
+// killConnector wraps a connector so that when the context of a running statement is cancelled,
+// the statement is also killed on the server. The MySQL driver only closes the connection when a
+// context is cancelled, and the server does not notice that the client has gone away until it
+// tries to send results, so an expensive query would otherwise continue to run to completion
+// after the client that requested it has gone.
+type killConnector struct {
+	driver.Connector
+}
+
+func (c *killConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := connectionID(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &killConn{Conn: conn, id: id, connector: c.Connector}, nil
+}
+
+// connectionID returns the server's id for the connection, as used by KILL.
+func connectionID(ctx context.Context, conn driver.Conn) (uint64, error) {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return 0, fmt.Errorf("driver connection %T does not support queries", conn)
+	}
+	rows, err := queryer.QueryContext(ctx, "SELECT CONNECTION_ID()", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("no rows returned for connection id")
+		}
+		return 0, err
+	}
+	switch id := dest[0].(type) {
+	case int64:
+		return uint64(id), nil
+	case uint64:
+		return id, nil
+	case []byte:
+		return strconv.ParseUint(string(id), 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected connection id type %T", dest[0])
+	}
+}
+
+// killConn kills running statements on the server when their context is cancelled. Once a kill
+// has been issued the connection is reported as invalid, so that it is not reused.
+type killConn struct {
+	driver.Conn
+	id        uint64
+	connector driver.Connector
+	killed    atomic.Bool
+}
+
+// watch arranges for the running statement to be killed if the context is cancelled before the
+// returned stop function is called.
+func (c *killConn) watch(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := context.AfterFunc(ctx, c.kill)
+	return func() { stop() }
+}
+
+func (c *killConn) kill() {
+	c.killed.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		logrus.Warnf("Failed to connect to kill cancelled query on connection %d: %v", c.id, err)
+		return
+	}
+	defer conn.Close()
+
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		if _, err := execer.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", c.id), nil); err != nil {
+			logrus.Warnf("Failed to kill cancelled query on connection %d: %v", c.id, err)
+			return
+		}
+		logrus.Debugf("Killed cancelled query on connection %d", c.id)
+	}
+}
+
+func (c *killConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &killStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *killConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck
+}
+
+func (c *killConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	stop := c.watch(ctx)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return &killRows{Rows: rows, stop: stop}, nil
+}
+
+func (c *killConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer c.watch(ctx)()
+	return execer.ExecContext(ctx, query, args)
+}
+
+func (c *killConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *killConn) ResetSession(ctx context.Context) error {
+	if c.killed.Load() {
+		return driver.ErrBadConn
+	}
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *killConn) IsValid() bool {
+	if c.killed.Load() {
+		return false
+	}
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *killConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// killStmt kills prepared statements on the server when their context is cancelled.
+type killStmt struct {
+	driver.Stmt
+	conn *killConn
+}
+
+func (s *killStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		return nil, fmt.Errorf("driver statement %T does not support QueryContext", s.Stmt)
+	}
+	stop := s.conn.watch(ctx)
+	rows, err := queryer.QueryContext(ctx, args)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return &killRows{Rows: rows, stop: stop}, nil
+}
+
+func (s *killStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		return nil, fmt.Errorf("driver statement %T does not support ExecContext", s.Stmt)
+	}
+	defer s.conn.watch(ctx)()
+	return execer.ExecContext(ctx, args)
+}
+
+func (s *killStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+// killRows keeps the statement watched until all of its rows have been read, as the server may
+// still be executing the query while results are sent.
+type killRows struct {
+	driver.Rows
+	stop func()
+}
+
+func (r *killRows) Close() error {
+	r.stop()
+	return r.Rows.Close()
+}
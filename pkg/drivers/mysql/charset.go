@@ -0,0 +1,80 @@
+package mysql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultNameCharset is the charset of the name column used by prior releases.
+	defaultNameCharset = "ascii"
+	// maxNameBytes is the longest name column, in bytes, that can be indexed. InnoDB limits index
+	// keys to 3072 bytes when using the DYNAMIC or COMPRESSED row formats, and the
+	// name_prev_revision index also contains the 8-byte prev_revision column. Tables using the
+	// older COMPACT or REDUNDANT row formats are limited to 767 byte index keys.
+	//
+	// Prefix indexes cannot be used to fit a longer column, as the name_prev_revision index must
+	// cover the whole key to enforce that each key has only one row per revision, and range
+	// queries rely on the name indexes to return keys in order. The length is limited instead.
+	maxNameBytes = 3064
+)
+
+// nameCharsetBytes is the maximum number of bytes taken by each character of the supported name
+// column charsets, which MySQL reserves in full for each index key. ascii allows the longest keys,
+// but only ascii keys; utf8mb4 allows any UTF-8 key, but only a quarter as long, at most 766
+// characters, or 189 characters with a 767 byte index key limit.
+var nameCharsetBytes = map[string]int{
+	"ascii":   1,
+	"utf8mb4": 4,
+}
+
+var collationPattern = regexp.MustCompile(`^[a-z0-9]+_[a-z0-9_]+$`)
+
+// nameColumn is the definition of the name column.
+type nameColumn struct {
+	length    int
+	charset   string
+	collation string
+}
+
+// String returns the SQL type of the column.
+func (c nameColumn) String() string {
+	def := "VARCHAR(" + strconv.Itoa(c.length) + ") CHARACTER SET " + c.charset
+	if c.collation != "" {
+		def += " COLLATE " + c.collation
+	}
+	return def
+}
+
+// newNameColumn returns the definition of the name column, validating that the charset and
+// collation are supported, and that a column of the given length can be indexed. If the collation
+// is not set, charsets other than ascii use their binary collation, so that keys are compared and
+// ordered by code point, as in etcd; the ascii column uses the server default collation, as in
+// prior releases.
+func newNameColumn(length int, charset, collation string) (nameColumn, error) {
+	if length == 0 {
+		length = defaultNameLength
+	}
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "" {
+		charset = defaultNameCharset
+	}
+	collation = strings.ToLower(strings.TrimSpace(collation))
+
+	bytes, ok := nameCharsetBytes[charset]
+	if !ok {
+		return nameColumn{}, fmt.Errorf("unsupported name column charset %q; must be ascii or utf8mb4", charset)
+	}
+	if collation == "" && charset != defaultNameCharset {
+		collation = charset + "_bin"
+	}
+	if collation != "" && (!collationPattern.MatchString(collation) || !strings.HasPrefix(collation, charset+"_")) {
+		return nameColumn{}, fmt.Errorf("invalid name column collation %q for charset %s", collation, charset)
+	}
+	if max := maxNameBytes / bytes; length < 0 || length > max {
+		return nameColumn{}, fmt.Errorf("name column length must be between 1 and %d for the %s charset", max, charset)
+	}
+	return nameColumn{length: length, charset: charset, collation: collation}, nil
+}
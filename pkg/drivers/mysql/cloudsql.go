@@ -0,0 +1,120 @@
+package mysql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"cloud.google.com/go/cloudsqlconn/instance"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+)
+
+const (
+	cloudSQLNet       = "cloudsql"
+	cloudSQLIPPublic  = "PUBLIC"
+	cloudSQLIPPrivate = "PRIVATE"
+)
+
+var (
+	cloudSQLOnce    sync.Once
+	cloudSQLDialer  *cloudSQLConnector
+	cloudSQLErr     error
+	cloudSQLIPTypes = map[string]cloudsqlconn.DialOption{
+		cloudSQLIPPublic:  cloudsqlconn.WithPublicIP(),
+		cloudSQLIPPrivate: cloudsqlconn.WithPrivateIP(),
+	}
+)
+
+// configureCloudSQL sets up the mysql config to connect through the Cloud SQL Go connector, if the
+// Cloud SQL instance is set in the config, or the DSN uses the cloudsql network, such as
+// "user@cloudsql(project:region:instance)/kubernetes". The connector authenticates with the
+// Application Default Credentials, and dials the instance over TLS with ephemeral client
+// certificates that it refreshes before they expire.
+func configureCloudSQL(ctx context.Context, config *mysql.Config, cloudSQLConfig drivers.CloudSQLConfig) error {
+	if cloudSQLConfig.Instance != "" {
+		config.Net = cloudSQLNet
+		config.Addr = cloudSQLConfig.Instance
+	}
+	if config.Net != cloudSQLNet {
+		return nil
+	}
+
+	if _, err := instance.ParseConnName(config.Addr); err != nil {
+		return err
+	}
+	ipType := strings.ToUpper(cloudSQLConfig.IPType)
+	if ipType == "" {
+		ipType = cloudSQLIPPublic
+	}
+	if _, ok := cloudSQLIPTypes[ipType]; !ok {
+		return fmt.Errorf("invalid Cloud SQL IP type %q; must be one of %s or %s", cloudSQLConfig.IPType, cloudSQLIPPublic, cloudSQLIPPrivate)
+	}
+	if cloudSQLConfig.IAMAuth && config.User == "" {
+		return errors.New("Cloud SQL IAM authentication requires a database user")
+	}
+
+	cloudSQLOnce.Do(func() {
+		var dialer *cloudsqlconn.Dialer
+		dialer, cloudSQLErr = cloudsqlconn.NewDialer(ctx)
+		if cloudSQLErr != nil {
+			return
+		}
+		cloudSQLDialer = newCloudSQLConnector(dialer)
+		mysql.RegisterDialContext(cloudSQLNet, cloudSQLDialer.dial)
+	})
+	if cloudSQLErr != nil {
+		return fmt.Errorf("failed to create Cloud SQL connector: %w", cloudSQLErr)
+	}
+	cloudSQLDialer.setOptions(config.Addr, ipType, cloudSQLConfig.IAMAuth)
+
+	// The connection to the instance is already encrypted by the connector, so TLS is not
+	// negotiated within the mysql protocol.
+	if config.TLS != nil || (config.TLSConfig != "" && config.TLSConfig != "false") {
+		logrus.Infof("Ignoring TLS configuration for Cloud SQL connection; connections are secured by the Cloud SQL connector")
+	}
+	config.TLS = nil
+	config.TLSConfig = ""
+	return nil
+}
+
+// cloudSQLConnector dials Cloud SQL instances with the Cloud SQL Go connector, using the IP type
+// and authentication set for each instance.
+type cloudSQLConnector struct {
+	mu      sync.Mutex
+	dialer  *cloudsqlconn.Dialer
+	options map[string][]cloudsqlconn.DialOption
+}
+
+func newCloudSQLConnector(dialer *cloudsqlconn.Dialer) *cloudSQLConnector {
+	return &cloudSQLConnector{
+		dialer:  dialer,
+		options: map[string][]cloudsqlconn.DialOption{},
+	}
+}
+
+// setOptions sets the dial options for an instance. With IAM database authentication, the
+// connector binds an access token to the client certificate, and the server authenticates the
+// user with the token instead of a password.
+func (c *cloudSQLConnector) setOptions(name, ipType string, iamAuth bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options[name] = []cloudsqlconn.DialOption{
+		cloudSQLIPTypes[ipType],
+		cloudsqlconn.WithDialIAMAuthN(iamAuth),
+	}
+}
+
+// dial is registered with the mysql driver as the dial function for the cloudsql network.
+func (c *cloudSQLConnector) dial(ctx context.Context, addr string) (net.Conn, error) {
+	c.mu.Lock()
+	opts := c.options[addr]
+	c.mu.Unlock()
+	return c.dialer.Dial(ctx, addr, opts...)
+}
@@ -0,0 +1,175 @@
+package mysql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/oauth2"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+)
+
+// fakeCloudSQLAdmin serves the Cloud SQL Admin API for instances in project:region that only have
+// a private IP address, and records the access token bound to each ephemeral certificate request.
+type fakeCloudSQLAdmin struct {
+	mu           sync.Mutex
+	cert         string
+	accessTokens map[string]string
+}
+
+func newFakeCloudSQLAdmin(t *testing.T) *fakeCloudSQLAdmin {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "project:instance"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeCloudSQLAdmin{
+		cert:         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		accessTokens: map[string]string{},
+	}
+}
+
+func (f *fakeCloudSQLAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[strings.Index(r.URL.Path, "/projects/"):]
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/connectSettings"):
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"region":          "region",
+			"backendType":     "SECOND_GEN",
+			"databaseVersion": "MYSQL_8_0",
+			"serverCaCert":    map[string]string{"cert": f.cert},
+			"ipAddresses":     []map[string]string{{"type": "PRIVATE", "ipAddress": "10.0.0.1"}},
+		})
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":generateEphemeralCert"):
+		var req struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.accessTokens[strings.TrimSuffix(path, ":generateEphemeralCert")] = req.AccessToken
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ephemeralCert": map[string]string{"cert": f.cert},
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeCloudSQLAdmin) accessToken(path string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token, ok := f.accessTokens[path]
+	return token, ok
+}
+
+// TestCloudSQLDialOptions ensures that each instance is dialed with its own IP type and
+// authentication settings.
+func TestCloudSQLDialOptions(t *testing.T) {
+	ctx := context.Background()
+	admin := newFakeCloudSQLAdmin(t)
+	server := httptest.NewServer(admin)
+	defer server.Close()
+
+	errDial := errors.New("dial refused")
+	var mu sync.Mutex
+	var dialed []string
+	tokens := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "login-token", Expiry: time.Now().Add(time.Hour)})
+	dialer, err := cloudsqlconn.NewDialer(ctx,
+		cloudsqlconn.WithAdminAPIEndpoint(server.URL),
+		cloudsqlconn.WithIAMAuthN(),
+		cloudsqlconn.WithIAMAuthNTokenSources(tokens, tokens),
+		cloudsqlconn.WithDialFunc(func(_ context.Context, _, addr string) (net.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dialed = append(dialed, addr)
+			return nil, errDial
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	connector := newCloudSQLConnector(dialer)
+	connector.setOptions("project:region:public", cloudSQLIPPublic, false)
+	connector.setOptions("project:region:private", cloudSQLIPPrivate, false)
+	connector.setOptions("project:region:iam", cloudSQLIPPrivate, true)
+
+	if _, err := connector.dial(ctx, "project:region:public"); err == nil || !strings.Contains(err.Error(), "PUBLIC") {
+		t.Fatalf("expected error dialing instance without a public IP, got %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Fatalf("expected no connection to instance without a public IP, got %v", dialed)
+	}
+
+	for _, name := range []string{"private", "iam"} {
+		if _, err := connector.dial(ctx, "project:region:"+name); !errors.Is(err, errDial) {
+			t.Fatalf("expected dial of %s instance to reach the private IP, got %v", name, err)
+		}
+	}
+	if len(dialed) != 2 || dialed[0] != "10.0.0.1:3307" || dialed[1] != "10.0.0.1:3307" {
+		t.Fatalf("expected both instances to be dialed at the private IP, got %v", dialed)
+	}
+
+	if token, ok := admin.accessToken("/projects/project/instances/private"); !ok || token != "" {
+		t.Errorf("expected certificate without access token for private instance, got %q", token)
+	}
+	if token, ok := admin.accessToken("/projects/project/instances/iam"); !ok || token != "login-token" {
+		t.Errorf("expected certificate bound to the login token for IAM instance, got %q", token)
+	}
+}
+
+func TestConfigureCloudSQLInvalid(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name           string
+		cloudSQLConfig drivers.CloudSQLConfig
+	}{
+		{name: "instance name", cloudSQLConfig: drivers.CloudSQLConfig{Instance: "project:instance"}},
+		{name: "IP type", cloudSQLConfig: drivers.CloudSQLConfig{Instance: "project:region:instance", IPType: "PSC"}},
+		{name: "IAM user", cloudSQLConfig: drivers.CloudSQLConfig{Instance: "project:region:instance", IAMAuth: true}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := configureCloudSQL(ctx, mysql.NewConfig(), test.cloudSQLConfig); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	config := mysql.NewConfig()
+	config.Addr = "127.0.0.1:3306"
+	if err := configureCloudSQL(ctx, config, drivers.CloudSQLConfig{}); err != nil || config.Net == cloudSQLNet {
+		t.Fatalf("expected TCP connection to be left as is, got net %s: %v", config.Net, err)
+	}
+}
@@ -0,0 +1,93 @@
+package mysql
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	iamAuthEnvVar   = "KINE_MYSQL_IAM_AUTH"
+	iamRegionEnvVar = "KINE_MYSQL_IAM_REGION"
+)
+
+// iamAuthEnabled returns true if RDS IAM authentication has been requested.
+func iamAuthEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(iamAuthEnvVar))
+	return enabled
+}
+
+// loadIAMConfig loads the AWS config used to sign RDS auth tokens, using the SDK's default
+// credential chain: environment variables, shared config and credential files including SSO
+// profiles, web identity tokens such as those of EKS service accounts, and the ECS or EC2 instance
+// role. Temporary credentials are cached by the SDK and refreshed before they expire. The region is
+// taken from KINE_MYSQL_IAM_REGION if set, otherwise from the SDK's default region chain.
+func loadIAMConfig(ctx context.Context) (aws.Config, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if region := os.Getenv(iamRegionEnvVar); region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	awsConfig, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if awsConfig.Region == "" {
+		return aws.Config{}, errors.New("AWS region must be set via " + iamRegionEnvVar + " or AWS_REGION for RDS IAM authentication")
+	}
+	if awsConfig.Credentials == nil {
+		return aws.Config{}, errors.New("AWS credentials not found for RDS IAM authentication")
+	}
+	return awsConfig, nil
+}
+
+// configureIAMAuth sets up the mysql config so that a fresh RDS IAM auth token is used as the
+// password for every new physical connection. RDS requires TLS and the cleartext auth plugin
+// when authenticating with a token, so both are forced on.
+func configureIAMAuth(ctx context.Context, config *mysql.Config) error {
+	awsConfig, err := loadIAMConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	requireTLS(config, "RDS IAM authentication")
+	config.AllowCleartextPasswords = true
+
+	return config.Apply(mysql.BeforeConnect(iamBeforeConnect(awsConfig)))
+}
+
+// requireTLS enables TLS with certificate verification for an authentication method that sends a
+// token as a cleartext password, unless TLS has already been required. The preferred mode is not
+// sufficient, as it skips verification and falls back to plaintext; ParseDSN has already turned it
+// into such a TLS config, which is replaced along with the tls parameter.
+func requireTLS(config *mysql.Config, method string) {
+	if config.TLSConfig == "" || config.TLSConfig == "false" || config.TLSConfig == "preferred" {
+		logrus.Infof("Enabling TLS for %s", method)
+		config.TLSConfig = "true"
+		config.TLS = &tls.Config{}
+		config.AllowFallbackToPlaintext = false
+	}
+}
+
+// iamBeforeConnect returns a hook that sets the password of each new connection to an RDS IAM
+// auth token for the connection's host and user, signed with the current AWS credentials.
+func iamBeforeConnect(awsConfig aws.Config) func(context.Context, *mysql.Config) error {
+	return func(ctx context.Context, c *mysql.Config) error {
+		if c.Addr == "" || c.User == "" {
+			return errors.New("RDS IAM authentication requires both a host and a user")
+		}
+		token, err := auth.BuildAuthToken(ctx, c.Addr, awsConfig.Region, c.User, awsConfig.Credentials)
+		if err != nil {
+			return err
+		}
+		c.Passwd = token
+		return nil
+	}
+}
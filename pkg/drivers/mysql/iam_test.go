@@ -0,0 +1,139 @@
+package mysql
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-sql-driver/mysql"
+)
+
+// setIAMEnv sets up the environment so that the AWS SDK loads static credentials from the
+// environment, without reading the shared config of the host or contacting the instance metadata
+// service.
+func setIAMEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	t.Setenv("AWS_SESSION_TOKEN", "session-token")
+	t.Setenv(iamRegionEnvVar, "us-east-1")
+}
+
+// parseIAMToken returns the query of an RDS auth token, after checking that it is a presigned
+// connect URL for the host.
+func parseIAMToken(t *testing.T, token, host string) url.Values {
+	t.Helper()
+	if !strings.HasPrefix(token, host+"?") {
+		t.Fatalf("expected token for %s, got %s", host, token)
+	}
+	query, err := url.ParseQuery(strings.TrimPrefix(token, host+"?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestIAMAuthToken(t *testing.T) {
+	setIAMEnv(t)
+	ctx := context.Background()
+
+	config := mysql.NewConfig()
+	config.Addr = "kine.cluster-example.us-east-1.rds.amazonaws.com:3306"
+	config.User = "kine"
+	if err := configureIAMAuth(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.TLSConfig != "true" || !config.AllowCleartextPasswords {
+		t.Fatal("expected TLS and cleartext passwords to be enabled")
+	}
+
+	awsConfig, err := loadIAMConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iamBeforeConnect(awsConfig)(ctx, config); err != nil {
+		t.Fatal(err)
+	}
+	query := parseIAMToken(t, config.Passwd, config.Addr)
+	expected := map[string]string{
+		"Action":               "connect",
+		"DBUser":               "kine",
+		"X-Amz-Algorithm":      "AWS4-HMAC-SHA256",
+		"X-Amz-Expires":        "900",
+		"X-Amz-SignedHeaders":  "host",
+		"X-Amz-Security-Token": "session-token",
+	}
+	for k, v := range expected {
+		if query.Get(k) != v {
+			t.Errorf("expected %s=%s in token, got %q", k, v, query.Get(k))
+		}
+	}
+	if credential := query.Get("X-Amz-Credential"); !strings.HasPrefix(credential, "AKIDEXAMPLE/") || !strings.HasSuffix(credential, "/us-east-1/rds-db/aws4_request") {
+		t.Errorf("expected token to be signed for rds-db in us-east-1 with the environment credentials, got credential %q", credential)
+	}
+	if query.Get("X-Amz-Signature") == "" {
+		t.Error("expected token to be signed")
+	}
+
+	config.User = ""
+	if err := iamBeforeConnect(awsConfig)(ctx, config); err == nil {
+		t.Fatal("expected error for missing user")
+	}
+}
+
+// TestIAMAuthPreferredTLS ensures that the preferred TLS mode, which skips certificate verification
+// and falls back to plaintext, is upgraded to verified TLS before tokens are sent as passwords.
+func TestIAMAuthPreferredTLS(t *testing.T) {
+	setIAMEnv(t)
+
+	config, err := mysql.ParseDSN("kine@tcp(kine.cluster-example.us-east-1.rds.amazonaws.com:3306)/kine?tls=preferred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configureIAMAuth(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if config.TLS == nil || config.TLS.InsecureSkipVerify || config.AllowFallbackToPlaintext {
+		t.Fatalf("expected verified TLS without plaintext fallback, got %+v, fallback=%v", config.TLS, config.AllowFallbackToPlaintext)
+	}
+}
+
+// TestIAMAuthRefresh ensures that each connection is signed with the current credentials, so that
+// temporary credentials are refreshed once they expire.
+func TestIAMAuthRefresh(t *testing.T) {
+	var retrieved int64
+	provider := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		n := atomic.AddInt64(&retrieved, 1)
+		return aws.Credentials{
+			AccessKeyID:     "AKID" + strings.Repeat("X", int(n)),
+			SecretAccessKey: "secret",
+			SessionToken:    "session-token",
+			CanExpire:       true,
+			Expires:         time.Now(),
+		}, nil
+	})
+	awsConfig := aws.Config{Region: "eu-west-1", Credentials: aws.NewCredentialsCache(provider)}
+
+	ctx := context.Background()
+	config := &mysql.Config{Addr: "db.example.com:3306", User: "kine"}
+	before := iamBeforeConnect(awsConfig)
+	for i := 1; i <= 2; i++ {
+		if err := before(ctx, config); err != nil {
+			t.Fatal(err)
+		}
+		query := parseIAMToken(t, config.Passwd, config.Addr)
+		if expected := "AKID" + strings.Repeat("X", i) + "/"; !strings.HasPrefix(query.Get("X-Amz-Credential"), expected) {
+			t.Fatalf("expected connection %d to be signed with refreshed credentials %s, got %s", i, expected, query.Get("X-Amz-Credential"))
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package mysql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isolationLevels are the transaction isolation levels that may be set for kine's connections.
+var isolationLevels = []string{"READ UNCOMMITTED", "READ COMMITTED", "REPEATABLE READ", "SERIALIZABLE"}
+
+// parseIsolationLevel returns the SQL name of the isolation level, accepting either the SQL
+// name or the hyphenated form used by the transaction_isolation variable, in any case.
+func parseIsolationLevel(level string) (string, error) {
+	name := strings.ToUpper(strings.NewReplacer("-", " ", "_", " ").Replace(strings.TrimSpace(level)))
+	for _, l := range isolationLevels {
+		if name == l {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("invalid transaction isolation level %q; must be one of %s", level, strings.Join(isolationLevels, ", "))
+}
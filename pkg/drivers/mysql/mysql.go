@@ -4,10 +4,12 @@ import (
 	"context"
 	cryptotls "crypto/tls"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
@@ -23,23 +25,82 @@ import (
 const (
 	defaultUnixDSN = "root@unix(/var/run/mysqld/mysqld.sock)/"
 	defaultHostDSN = "root@tcp(127.0.0.1)/"
+	defaultDBName  = "kubernetes"
+
+	// defaultNameLength is the length of the name column used by prior releases.
+	defaultNameLength = 630
+	// nameLengthMigration is the index of the schema migration that widens the name column.
+	nameLengthMigration = 2
+	// valueTypeMigration is the index of the schema migration that changes the type of the value
+	// columns.
+	valueTypeMigration = 3
+	// leaseGrantedMigration is the index of the schema migration that adds the column recording
+	// the time that each row was written, from which the remaining TTL of leases is computed.
+	leaseGrantedMigration = 4
+	// nameCharsetMigration is the index of the schema migration that changes the charset of the
+	// name column.
+	nameCharsetMigration = 5
+
+	// defaultValueType is the type of the value columns used by prior releases, which holds
+	// values of up to 16MB.
+	defaultValueType = "MEDIUMBLOB"
+	// longValueType is the type of the value columns if long values are enabled, which holds
+	// values of up to 4GB.
+	longValueType = "LONGBLOB"
 )
 
+// maxValueSizes are the largest values that can be stored in each type of value column.
+var maxValueSizes = map[string]int64{
+	defaultValueType: 1<<24 - 1,
+	longValueType:    1<<32 - 1,
+}
+
 var createDB = "CREATE DATABASE IF NOT EXISTS `%s`;"
 
-func getSchema(tableName string) []string {
+// flavor holds the schema and SQL statements that differ between MySQL-compatible servers.
+type flavor struct {
+	// params are additional connection parameters required by the server.
+	params map[string]string
+	// schema returns the statements used to create the table and its indexes.
+	schema func(tableName string, name nameColumn, valueType string) []string
+	// schemaMigrations returns the migrations for tables created by prior releases.
+	schemaMigrations func(tableName string, name nameColumn, valueType string) []generic.SchemaMigration
+	// compactSQL returns the statement used to delete compacted rows.
+	compactSQL func(tableName string) string
+	// defragSQL returns the statement used to defragment the table, if supported.
+	defragSQL func(tableName string) string
+	// retry reports whether a failed statement should be retried.
+	retry func(err error) bool
+	// killCancelled enables killing statements on the server when their context is cancelled.
+	// This requires that KILL is handled by the same server that the connection is to.
+	killCancelled bool
+}
+
+var mysqlFlavor = flavor{
+	schema:           getSchema,
+	schemaMigrations: getSchemaMigrations,
+	compactSQL:       getCompactSQL,
+	killCancelled:    true,
+	defragSQL: func(tableName string) string {
+		// InnoDB implements OPTIMIZE TABLE as an online table rebuild.
+		return `OPTIMIZE TABLE "` + tableName + `"`
+	},
+}
+
+func getSchema(tableName string, name nameColumn, valueType string) []string {
 	return []string{
 		`CREATE TABLE IF NOT EXISTS "` + tableName + `"
 			(
 				id BIGINT UNSIGNED AUTO_INCREMENT,
-				name VARCHAR(630) CHARACTER SET ascii,
+				name ` + name.String() + `,
 				created INTEGER,
 				deleted INTEGER,
 				create_revision BIGINT UNSIGNED,
 				prev_revision BIGINT UNSIGNED,
 				lease INTEGER,
-				value MEDIUMBLOB,
-				old_value MEDIUMBLOB,
+				value ` + valueType + `,
+				old_value ` + valueType + `,
+				lease_granted TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
 				PRIMARY KEY (id)
 			);`,
 		`CREATE INDEX "` + tableName + `_name_index" ON "` + tableName + `" (name)`,
@@ -50,69 +111,258 @@ func getSchema(tableName string) []string {
 	}
 }
 
-func getSchemaMigrations(tableName string) []string {
-	return []string{
-		`ALTER TABLE "` + tableName + `" MODIFY COLUMN id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL UNIQUE, MODIFY COLUMN create_revision BIGINT UNSIGNED, MODIFY COLUMN prev_revision BIGINT UNSIGNED`,
+func getSchemaMigrations(tableName string, name nameColumn, valueType string) []generic.SchemaMigration {
+	return []generic.SchemaMigration{
+		{
+			Up:   `ALTER TABLE "` + tableName + `" MODIFY COLUMN id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL UNIQUE, MODIFY COLUMN create_revision BIGINT UNSIGNED, MODIFY COLUMN prev_revision BIGINT UNSIGNED`,
+			Down: `ALTER TABLE "` + tableName + `" MODIFY COLUMN id INTEGER AUTO_INCREMENT NOT NULL UNIQUE, MODIFY COLUMN create_revision INTEGER, MODIFY COLUMN prev_revision INTEGER`,
+		},
 		// Creating an empty migration to ensure that postgresql and mysql migrations match up
 		// with each other for a give value of KINE_SCHEMA_MIGRATION env var
-		``,
+		{},
+		getNameLengthMigration(tableName, name),
+		getValueTypeMigration(tableName, valueType),
+		getLeaseGrantedMigration(tableName),
+		getNameCharsetMigration(tableName, name),
+	}
+}
+
+// getNameCharsetMigration returns the migration that converts the name column to the configured
+// charset and collation, and restores the ascii charset used by prior releases. Converting the
+// column rebuilds the table and its name indexes.
+func getNameCharsetMigration(tableName string, name nameColumn) generic.SchemaMigration {
+	ascii := nameColumn{length: name.length, charset: defaultNameCharset}
+	return generic.SchemaMigration{
+		Up:   `ALTER TABLE "` + tableName + `" MODIFY COLUMN name ` + name.String(),
+		Down: `ALTER TABLE "` + tableName + `" MODIFY COLUMN name ` + ascii.String(),
+	}
+}
+
+// getLeaseGrantedMigration returns the migration that adds the column recording the time that each
+// row was written. The column is added without a default, so that rows written before the
+// migration are not recorded as granted at the time of the migration; the statements are run
+// separately, as multiple statements are not enabled on the connection.
+func getLeaseGrantedMigration(tableName string) generic.SchemaMigration {
+	return generic.SchemaMigration{
+		Up:   `ALTER TABLE "` + tableName + `" ADD COLUMN lease_granted TIMESTAMP NULL DEFAULT NULL; ALTER TABLE "` + tableName + `" ALTER COLUMN lease_granted SET DEFAULT CURRENT_TIMESTAMP`,
+		Down: `ALTER TABLE "` + tableName + `" DROP COLUMN lease_granted`,
+	}
+}
+
+// getValueTypeMigration returns the migration that changes the value columns to the configured
+// type, and restores the type used by prior releases.
+func getValueTypeMigration(tableName string, valueType string) generic.SchemaMigration {
+	return generic.SchemaMigration{
+		Up:   `ALTER TABLE "` + tableName + `" MODIFY COLUMN value ` + valueType + `, MODIFY COLUMN old_value ` + valueType,
+		Down: `ALTER TABLE "` + tableName + `" MODIFY COLUMN value ` + defaultValueType + `, MODIFY COLUMN old_value ` + defaultValueType,
+	}
+}
+
+// getNameLengthMigration returns the migration that widens the name column to the configured
+// length, and restores the length used by prior releases. The down migration is run after the
+// charset migration has been reverted, so it restores the ascii charset.
+func getNameLengthMigration(tableName string, name nameColumn) generic.SchemaMigration {
+	previous := nameColumn{length: defaultNameLength, charset: defaultNameCharset}
+	return generic.SchemaMigration{
+		Up:   `ALTER TABLE "` + tableName + `" MODIFY COLUMN name ` + name.String(),
+		Down: `ALTER TABLE "` + tableName + `" MODIFY COLUMN name ` + previous.String(),
 	}
 }
 
+func getCompactSQL(tableName string) string {
+	return `
+		DELETE kv FROM "` + tableName + `" AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM "` + tableName + `" AS kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM "` + tableName + `" AS kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id <= ?
+		) AS ks
+		ON kv.id = ks.id
+		WHERE kv.deleted = 0 OR kv.id <= ?`
+}
+
 func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	return newBackend(ctx, cfg, mysqlFlavor)
+}
+
+func newBackend(ctx context.Context, cfg *drivers.Config, f flavor) (bool, server.Backend, error) {
 	tlsConfig, err := cfg.BackendTLSConfig.ClientConfig()
 	if err != nil {
 		return false, nil, err
 	}
 
-	if tlsConfig != nil {
-		tlsConfig.MinVersion = cryptotls.VersionTLS11
-	}
+	tlsConfigName := resolveTLSConfigName(cfg.MySQLConfig.TLSConfigName)
 
-	parsedDSN, err := prepareDSN(cfg.DataSourceName, tlsConfig)
+	var sessionStatements []string
+	if cfg.MySQLConfig.IsolationLevel != "" {
+		isolationLevel, err := parseIsolationLevel(cfg.MySQLConfig.IsolationLevel)
+		if err != nil {
+			return false, nil, err
+		}
+		sessionStatements = append(sessionStatements, "SET SESSION TRANSACTION ISOLATION LEVEL "+isolationLevel)
+	}
+	sessionVariables, err := sessionVariablesSQL(cfg.MySQLConfig.SessionVariables)
 	if err != nil {
 		return false, nil, err
 	}
+	if sessionVariables != "" {
+		sessionStatements = append(sessionStatements, sessionVariables)
+	}
 
-	if err := createDBIfNotExist(parsedDSN); err != nil {
+	config, err := prepareConfig(ctx, cfg.DataSourceName, cfg.DatabaseName, tlsConfig, tlsConfigName, cfg.CloudSQLConfig, f)
+	if err != nil {
+		return false, nil, err
+	}
+	logrus.WithFields(dsnFields(config)).Info("Connecting to MySQL datastore")
+	credentials, err := generic.FetchCredentials(ctx, cfg.CredentialConfig.Provider)
+	if err != nil {
 		return false, nil, err
 	}
+	setCredentials(config, credentials)
+
+	// An existing connection pool is already connected to the database.
+	if !cfg.SkipSchemaSetup && cfg.ConnectionPoolConfig.DB == nil {
+		if err := createDBIfNotExist(ctx, config, cfg.ConnectionPoolConfig.MaxConnectWait, cfg.ConnectionPoolConfig.SetupTimeout); err != nil {
+			return false, nil, err
+		}
+	}
 
 	tableName := cfg.TableName
 	if tableName == "" {
 		tableName = "kine"
 	}
 
-	dialect, err := generic.Open(ctx, "mysql", parsedDSN, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer, tableName)
+	name, err := newNameColumn(cfg.NameColumnLength, cfg.MySQLConfig.NameCharset, cfg.MySQLConfig.NameCollation)
+	if err != nil {
+		return false, nil, err
+	}
+
+	connector, err := generic.ReloadingConnector(ctx, cfg.Scheme, cfg.DataSourceName, cfg.EndpointFile, cfg.CredentialConfig, func(dataSourceName string, credentials *generic.Credentials) (driver.Connector, error) {
+		config, err := prepareConfig(ctx, dataSourceName, cfg.DatabaseName, tlsConfig, tlsConfigName, cfg.CloudSQLConfig, f)
+		if err != nil {
+			return nil, err
+		}
+		setCredentials(config, credentials)
+		return newConnector(config, f, sessionStatements)
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	dialect, err := generic.OpenConnector(ctx, "mysql", connector, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer, tableName)
 	if err != nil {
 		return false, nil, err
 	}
+	dialect.DatabaseName = config.DBName
 
-	dialect.LastInsertID = true
+	if len(cfg.ReplicaDataSourceNames) > 0 {
+		connectors, err := replicaConnectors(ctx, cfg.ReplicaDataSourceNames, cfg.DatabaseName, tlsConfig, tlsConfigName, cfg.CloudSQLConfig, f, sessionStatements)
+		if err != nil {
+			return false, nil, err
+		}
+		if err := dialect.OpenReadReplicas(ctx, "mysql", connectors, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer); err != nil {
+			return false, nil, err
+		}
+	}
+
+	if err := configureTable(ctx, dialect, cfg, f, tableName, name); err != nil {
+		return false, nil, err
+	}
+
+	var log logstructured.Log
+	if len(cfg.TablePartitions) > 0 {
+		log, err = cfg.PartitionedLog(ctx, dialect, func(tableName string) (*generic.Generic, error) {
+			poolConfig := cfg.ConnectionPoolConfig
+			poolConfig.DB = dialect.DB
+			partition, err := generic.OpenConnector(ctx, "mysql", connector, poolConfig, "?", false, nil, tableName)
+			if err != nil {
+				return nil, err
+			}
+			partition.DatabaseName = dialect.DatabaseName
+			partition.ReadDBs = dialect.ReadDBs
+			return partition, configureTable(ctx, partition, cfg, f, tableName, name)
+		})
+		if err != nil {
+			return false, nil, err
+		}
+	} else {
+		var allocator sqllog.RevisionAllocator
+		if cfg.MySQLConfig.RevisionSequence {
+			sequence := generic.NewSequenceAllocator(dialect)
+			if cfg.SkipSchemaSetup {
+				if err := sequence.Init(ctx); err != nil {
+					return false, nil, fmt.Errorf("schema setup is skipped, but the revision sequence table could not be read: %w", err)
+				}
+			} else if err := sequence.Setup(ctx); err != nil {
+				return false, nil, err
+			}
+			allocator = sequence
+		}
+
+		logConfig := cfg.SQLLogConfig()
+		logConfig.Allocator = allocator
+		log = sqllog.New(dialect, logConfig)
+	}
+
+	dialect.Migrate(context.Background())
+	return true, logstructured.New(log, cfg.ReadCacheSize, cfg.AdmissionHooks), nil
+}
+
+// configureTable sets the statements and error handling of the dialect for the table, and sets
+// up the table schema, or if schema setup is skipped, checks that it is in place.
+func configureTable(ctx context.Context, dialect *generic.Generic, cfg *drivers.Config, f flavor, tableName string, name nameColumn) error {
+	// MariaDB 10.5+ supports INSERT ... RETURNING, which returns the new revision without
+	// a second round trip to fetch LAST_INSERT_ID().
+	dialect.LastInsertID = !supportsReturning(ctx, dialect.DB)
 	dialect.GetSizeSQL = `
 		SELECT SUM(data_length + index_length)
 		FROM information_schema.TABLES
 		WHERE table_schema = DATABASE() AND table_name = '` + tableName + `'`
-	dialect.CompactSQL = `
-		DELETE kv FROM "` + tableName + `" AS kv
-		INNER JOIN (
-			SELECT kp.prev_revision AS id
-			FROM "` + tableName + `" AS kp
-			WHERE
-				kp.name != 'compact_rev_key' AND
-				kp.prev_revision != 0 AND
-				kp.id <= ?
-			UNION
-			SELECT kd.id AS id
-			FROM "` + tableName + `" AS kd
-			WHERE
-				kd.deleted != 0 AND
-				kd.id <= ?
-		) AS ks
-		ON kv.id = ks.id`
+	if f.defragSQL != nil {
+		dialect.DefragSQL = f.defragSQL(tableName)
+	}
+	dialect.CompactSQL = f.compactSQL(tableName)
+	if timeout := cfg.ConnectionPoolConfig.StatementTimeout; timeout > 0 {
+		// The statement timeout is also enforced on the server for read queries, so that queries
+		// are stopped even if the connection to kine is lost. Compaction is not limited.
+		for _, sql := range []*string{
+			&dialect.GetCurrentSQL,
+			&dialect.ListRevisionStartSQL,
+			&dialect.GetRevisionAfterSQL,
+			&dialect.CountCurrentSQL,
+			&dialect.CountRevisionSQL,
+			&dialect.AfterSQL,
+			&dialect.ListRangeSQL,
+			&dialect.CountRangeSQL,
+			&dialect.ListRevisionSQL,
+		} {
+			*sql = maxExecutionTime(*sql, timeout)
+		}
+	}
+	dialect.Retry = f.retry
+	// 1205: lock wait timeout exceeded
+	// 1213: deadlock found when trying to get lock
+	dialect.RetryErrCodes = []string{"1205", "1213"}
+	dialect.WriteRetryAttempts = cfg.WriteRetryAttempts
+	dialect.WriteRetryBackoff = cfg.WriteRetryBackoff
 	dialect.TranslateErr = func(err error) error {
-		if err, ok := err.(*mysql.MySQLError); ok && err.Number == 1062 {
-			return server.ErrKeyExists
+		if err, ok := err.(*mysql.MySQLError); ok {
+			switch err.Number {
+			case 1062:
+				return server.ErrKeyExists
+			case 1406:
+				// Data too long for column; only returned in strict mode, otherwise the value is truncated.
+				return server.ErrTooLarge
+			}
 		}
 		return err
 	}
@@ -125,29 +375,85 @@ func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error)
 		}
 		return err.Error()
 	}
-	if err := setup(dialect.DB, tableName); err != nil {
-		return false, nil, err
+	valueType := defaultValueType
+	if cfg.MySQLConfig.LongValues {
+		valueType = longValueType
+	}
+	if cfg.SkipSchemaSetup {
+		if err := generic.ValidateSchema(dialect.DB, tableName, f.schema(tableName, name, valueType), indexesSQL); err != nil {
+			return err
+		}
+	} else if err := setup(dialect.DB, tableName, name, valueType, f); err != nil {
+		return err
+	}
+	if cfg.SchemaRequireLatest {
+		if err := generic.CheckSchemaVersion(dialect.DB, tableName, len(f.schemaMigrations(tableName, name, valueType))); err != nil {
+			return err
+		}
+	}
+	// Values too large for the value columns are rejected before they are sent to the server,
+	// which would otherwise silently truncate them unless a strict sql_mode is set.
+	if currentType := valueColumnType(dialect.DB, tableName); currentType != "" {
+		valueType = currentType
 	}
+	dialect.MaxValueSize = maxValueSizes[valueType]
+	if version, err := generic.SchemaVersion(dialect.DB, tableName); err == nil && version > leaseGrantedMigration {
+		dialect.LeaseRemainingSQL = `
+			SELECT kv.id, kv.lease - TIMESTAMPDIFF(SECOND, kv.lease_granted, CURRENT_TIMESTAMP)
+			FROM "` + tableName + `" AS kv
+			WHERE kv.lease > 0 AND kv.deleted = 0 AND kv.lease_granted IS NOT NULL`
+	}
+	return nil
+}
 
-	dialect.Migrate(context.Background())
-	return true, logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), nil
+// indexesSQL lists the indexes on a table in the current database.
+const indexesSQL = `SELECT DISTINCT index_name FROM information_schema.STATISTICS WHERE table_schema = DATABASE() AND table_name = ?`
+
+// existingIndexes returns the lowercased names of the indexes on the table.
+func existingIndexes(db *sql.DB, tableName string) (map[string]bool, error) {
+	rows, err := db.Query(indexesSQL, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	indexes := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		indexes[strings.ToLower(name)] = true
+	}
+	return indexes, rows.Err()
 }
 
-func setup(db *sql.DB, tableName string) error {
+func setup(db *sql.DB, tableName string, name nameColumn, valueType string, f flavor) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 	var exists bool
 	err := db.QueryRow("SELECT 1 FROM information_schema.TABLES WHERE table_schema = DATABASE() AND table_name = ?", tableName).Scan(&exists)
 	if err != nil && err != sql.ErrNoRows {
 		logrus.Warnf("Failed to check existence of database table %s, going to attempt create: %v", tableName, err)
 	}
+	// The table is only known to have been created with the latest schema if it was found not to exist.
+	created := !exists && (err == nil || err == sql.ErrNoRows)
 
-	if !exists {
-		for _, stmt := range getSchema(tableName) {
-			logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-			if _, err := db.Exec(stmt); err != nil {
-				if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
-					return err
-				}
+	// Each statement is run unless the table or index it creates already exists, so that setup
+	// completes the schema if a previous attempt was interrupted after creating the table. MySQL
+	// does not support CREATE INDEX IF NOT EXISTS, so existing indexes are listed first.
+	indexes := map[string]bool{}
+	if exists {
+		if indexes, err = existingIndexes(db, tableName); err != nil {
+			logrus.Warnf("Failed to list indexes of database table %s, going to attempt create: %v", tableName, err)
+		}
+	}
+	for _, stmt := range f.schema(tableName, name, valueType) {
+		if name, ok := generic.IndexName(stmt); ok && indexes[strings.ToLower(name)] {
+			continue
+		}
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
+				return err
 			}
 		}
 	}
@@ -155,19 +461,112 @@ func setup(db *sql.DB, tableName string) error {
 	// Run enabled schama migrations.
 	// Note that the schema created by the `schema` var is always the latest revision;
 	// migrations should handle deltas between prior schema versions.
-	schemaVersion, _ := strconv.ParseUint(os.Getenv("KINE_SCHEMA_MIGRATION"), 10, 64)
-	for i, stmt := range getSchemaMigrations(tableName) {
-		if i >= int(schemaVersion) {
-			break
+	migrations := f.schemaMigrations(tableName, name, valueType)
+	err = generic.RunSchemaMigrations(db, tableName, created, migrations, func(i int, down bool, stmt string) error {
+		if i == valueTypeMigration {
+			currentType := valueColumnType(db, tableName)
+			if !down && (currentType == valueType || currentType == longValueType) {
+				// Only ever widen the value columns; narrowing them could truncate existing values.
+				logrus.Debugf("Skipping migration %d: value column type is already %s", i, currentType)
+				return nil
+			}
+			if down {
+				var longest int64
+				if err := db.QueryRow(`SELECT COALESCE(GREATEST(MAX(LENGTH(value)), MAX(LENGTH(old_value))), 0) FROM "` + tableName + `"`).Scan(&longest); err != nil {
+					return err
+				}
+				if longest > maxValueSizes[defaultValueType] {
+					return fmt.Errorf("cannot revert migration %d: table %s has values larger than %d bytes", i, tableName, maxValueSizes[defaultValueType])
+				}
+			}
 		}
-		if stmt == "" {
-			continue
+		if i == nameLengthMigration {
+			currentLength := nameColumnLength(db, tableName)
+			if !down && currentLength >= name.length {
+				// Only ever widen the name column; shrinking it could truncate existing keys.
+				logrus.Debugf("Skipping migration %d: name column length %d is not less than %d", i, currentLength, name.length)
+				return nil
+			}
+			if down {
+				var longest int
+				if err := db.QueryRow(`SELECT COALESCE(MAX(LENGTH(name)), 0) FROM "` + tableName + `"`).Scan(&longest); err != nil {
+					return err
+				}
+				if longest > defaultNameLength {
+					return fmt.Errorf("cannot revert migration %d: table %s has keys longer than %d characters", i, tableName, defaultNameLength)
+				}
+			}
 		}
-		logrus.Tracef("SETUP EXEC MIGRATION %d: %v", i, util.Stripped(stmt))
-		if _, err := db.Exec(stmt); err != nil {
-			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
+		if i == nameCharsetMigration {
+			charset, collation := nameColumnCharset(db, tableName)
+			if !down && charset == name.charset && (name.collation == "" || collation == name.collation) {
+				logrus.Debugf("Skipping migration %d: name column charset is already %s", i, charset)
+				return nil
+			}
+			if down {
+				// Keys with multibyte characters cannot be converted to ascii.
+				var multibyte int
+				if err := db.QueryRow(`SELECT COUNT(*) FROM "` + tableName + `" WHERE LENGTH(name) != CHAR_LENGTH(name)`).Scan(&multibyte); err != nil {
+					return err
+				}
+				if multibyte > 0 {
+					return fmt.Errorf("cannot revert migration %d: table %s has %d rows with non-ascii keys", i, tableName, multibyte)
+				}
+			}
+		}
+		for _, stmt := range strings.Split(stmt, "; ") {
+			util.TraceSQL("SETUP EXEC MIGRATION", stmt, nil, logrus.Fields{"migration": i, "down": down})
+			if _, err := db.Exec(stmt); err != nil {
+				// 1060: duplicate column name
+				// 1061: duplicate key name
+				if mysqlError, ok := err.(*mysql.MySQLError); !ok || (mysqlError.Number != 1060 && mysqlError.Number != 1061) {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if currentLength := nameColumnLength(db, tableName); currentLength != 0 && currentLength < name.length {
+		logrus.Warnf("Name column length %d is less than the configured length %d; set KINE_SCHEMA_MIGRATION=%d or higher to widen the column", currentLength, name.length, nameLengthMigration+1)
+	}
+	// Migrations are only run once, so if long values are enabled after the value type migration
+	// has been recorded, the value columns are widened here instead.
+	version, err := generic.SchemaVersion(db, tableName)
+	if err != nil {
+		return err
+	}
+	if currentType := valueColumnType(db, tableName); currentType != "" && currentType != valueType && valueType == longValueType {
+		if version > valueTypeMigration {
+			logrus.Infof("Widening value columns to %s, this may take a moment...", valueType)
+			stmt := migrations[valueTypeMigration].Up
+			util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+			if _, err := db.Exec(stmt); err != nil {
+				return err
+			}
+		} else {
+			logrus.Warnf("Value column type %s is narrower than the configured type %s, values larger than 16MB will be rejected; set KINE_SCHEMA_MIGRATION=%d or higher to widen the columns", currentType, valueType, valueTypeMigration+1)
+		}
+	}
+
+	// As with the value columns, an ascii name column is converted here if a different charset is
+	// configured after the charset migration has been recorded. Converting a column back to ascii
+	// could fail on existing keys, so that is only done by reverting the migration.
+	if charset, _ := nameColumnCharset(db, tableName); charset != "" && charset != name.charset {
+		if charset == defaultNameCharset && version > nameCharsetMigration {
+			logrus.Infof("Converting name column to %s, this may take a moment...", name.charset)
+			stmt := migrations[nameCharsetMigration].Up
+			util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+			if _, err := db.Exec(stmt); err != nil {
 				return err
 			}
+		} else if charset == defaultNameCharset {
+			logrus.Warnf("Name column charset is %s, not the configured charset %s; set KINE_SCHEMA_MIGRATION=%d or higher to convert the column", charset, name.charset, nameCharsetMigration+1)
+		} else {
+			logrus.Warnf("Name column charset is %s, not the configured charset %s; set KINE_SCHEMA_MIGRATION_DOWN=%d to convert the column back to %s", charset, name.charset, nameCharsetMigration, defaultNameCharset)
 		}
 	}
 
@@ -175,39 +574,144 @@ func setup(db *sql.DB, tableName string) error {
 	return nil
 }
 
-func createDBIfNotExist(dataSourceName string) error {
-	config, err := mysql.ParseDSN(dataSourceName)
+// valueColumnType returns the current type of the value column, or an empty string if it cannot
+// be determined.
+func valueColumnType(db *sql.DB, tableName string) string {
+	var dataType string
+	err := db.QueryRow("SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'value'", tableName).Scan(&dataType)
 	if err != nil {
-		return err
+		logrus.Warnf("Failed to get type of value column for database table %s: %v", tableName, err)
+		return ""
+	}
+	return strings.ToUpper(dataType)
+}
+
+// nameColumnLength returns the current length of the name column, or 0 if it cannot be determined.
+func nameColumnLength(db *sql.DB, tableName string) int {
+	var length int
+	err := db.QueryRow("SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'name'", tableName).Scan(&length)
+	if err != nil {
+		logrus.Warnf("Failed to get length of name column for database table %s: %v", tableName, err)
+		return 0
+	}
+	return length
+}
+
+// nameColumnCharset returns the current charset and collation of the name column, or empty strings if
+// they cannot be determined.
+func nameColumnCharset(db *sql.DB, tableName string) (string, string) {
+	var charset, collation sql.NullString
+	err := db.QueryRow("SELECT CHARACTER_SET_NAME, COLLATION_NAME FROM information_schema.COLUMNS WHERE table_schema = DATABASE() AND table_name = ? AND column_name = 'name'", tableName).Scan(&charset, &collation)
+	if err != nil {
+		logrus.Warnf("Failed to get charset of name column for database table %s: %v", tableName, err)
+		return "", ""
+	}
+	return strings.ToLower(charset.String), strings.ToLower(collation.String)
+}
+
+// supportsReturning returns true if the server is MariaDB 10.5 or newer, and therefore
+// supports the RETURNING clause on INSERT statements. MySQL does not support RETURNING.
+func supportsReturning(ctx context.Context, db *sql.DB) bool {
+	var version string
+	if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+		logrus.Warnf("Failed to get server version, assuming INSERT ... RETURNING is not supported: %v", err)
+		return false
+	}
+
+	if isMariaDBWithReturning(version) {
+		logrus.Infof("Using INSERT ... RETURNING for MariaDB server version %s", version)
+		return true
+	}
+	return false
+}
+
+// isMariaDBWithReturning parses a server version string, such as "10.11.6-MariaDB-1:10.11.6+maria~ubu2204",
+// and returns true if it is MariaDB 10.5 or newer. Older MariaDB releases may prefix the version with
+// "5.5.5-" for compatibility with MySQL clients.
+func isMariaDBWithReturning(version string) bool {
+	if !strings.Contains(version, "MariaDB") {
+		return false
+	}
+	version = strings.TrimPrefix(version, "5.5.5-")
+
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
 	}
+	return major > 10 || (major == 10 && minor >= 5)
+}
+
+// createDBIfNotExist creates the database named in the config, if it does not already exist.
+// Connections are opened via a connector so that any BeforeConnect hook, such as IAM token
+// generation, is run for each connection. The server is given up to maxWait to begin accepting
+// connections, and each attempt to connect, check for, or create the database is given up to
+// timeout.
+func createDBIfNotExist(ctx context.Context, config *mysql.Config, maxWait, timeout time.Duration) error {
+	config = config.Clone()
 	dbName := config.DBName
 
-	db, err := sql.Open("mysql", dataSourceName)
+	connector, err := mysql.NewConnector(config)
 	if err != nil {
 		return err
 	}
+	db := sql.OpenDB(connector)
 	defer db.Close()
 
+	logrus.WithField("database", dbName).Info("Checking that database exists")
+	err = generic.RetrySetup(ctx, maxWait, timeout, isRetryableConnectError, func(ctx context.Context) error {
+		err := db.PingContext(ctx)
+		if mysqlError, ok := err.(*mysql.MySQLError); ok && mysqlError.Number == 1049 {
+			// The server is accepting connections, but the database does not exist yet.
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
 	var exists bool
-	err = db.QueryRow("SELECT 1 FROM information_schema.SCHEMATA WHERE schema_name = ?", dbName).Scan(&exists)
-	if err != nil && err != sql.ErrNoRows {
-		logrus.Warnf("failed to check existence of database %s, going to attempt create: %v", dbName, err)
+	err = generic.RetrySetup(ctx, maxWait, timeout, isRetryableConnectError, func(ctx context.Context) error {
+		err := db.QueryRowContext(ctx, "SELECT 1 FROM information_schema.SCHEMATA WHERE schema_name = ?", dbName).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		logrus.WithField("database", dbName).Warnf("failed to check existence of database, going to attempt create: %v", err)
 	}
 
 	if !exists {
 		stmt := fmt.Sprintf(createDB, dbName)
-		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-		if _, err = db.Exec(stmt); err != nil {
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		exec := func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, stmt)
+			return err
+		}
+		if err = generic.RetrySetup(ctx, maxWait, timeout, isRetryableConnectError, exec); err != nil {
 			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1049 {
 				return err
 			}
 			config.DBName = ""
-			db, err = sql.Open("mysql", config.FormatDSN())
+			connector, err = mysql.NewConnector(config)
 			if err != nil {
 				return err
 			}
+			db = sql.OpenDB(connector)
 			defer db.Close()
-			if _, err = db.Exec(stmt); err != nil {
+			if err = generic.RetrySetup(ctx, maxWait, timeout, isRetryableConnectError, exec); err != nil {
 				return err
 			}
 		}
@@ -215,7 +719,116 @@ func createDBIfNotExist(dataSourceName string) error {
 	return nil
 }
 
-func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, error) {
+// isRetryableConnectError returns true if the error indicates that the server is not yet ready
+// to accept connections. In addition to network errors, the server may reject connections
+// while starting up or shutting down, or if the connection limit has been reached.
+func isRetryableConnectError(err error) bool {
+	if mysqlError, ok := err.(*mysql.MySQLError); ok {
+		switch mysqlError.Number {
+		case 1040, 1053, 1203:
+			return true
+		}
+		return false
+	}
+	return generic.IsRetryableConnectError(err)
+}
+
+// replicaConnectors returns a connector for each read replica DSN, prepared in the same way as the primary DSN.
+// Replicas may be Cloud SQL read replicas, if named by the DSN; the primary's Cloud SQL instance
+// is not used for replicas.
+func replicaConnectors(ctx context.Context, dataSourceNames []string, dbName string, tlsConfig *cryptotls.Config, tlsConfigName string, cloudSQLConfig drivers.CloudSQLConfig, f flavor, sessionStatements []string) ([]driver.Connector, error) {
+	cloudSQLConfig.Instance = ""
+	connectors := make([]driver.Connector, 0, len(dataSourceNames))
+	for _, dataSourceName := range dataSourceNames {
+		config, err := prepareConfig(ctx, dataSourceName, dbName, tlsConfig, tlsConfigName, cloudSQLConfig, f)
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(dsnFields(config)).Info("Connecting to MySQL datastore read replica")
+		connector, err := newConnector(config, f, sessionStatements)
+		if err != nil {
+			return nil, err
+		}
+		connectors = append(connectors, connector)
+	}
+	return connectors, nil
+}
+
+// setCredentials replaces the username and password in the config with the credentials, if set.
+// A password set for each connection by token authentication takes precedence.
+func setCredentials(config *mysql.Config, credentials *generic.Credentials) {
+	if credentials != nil {
+		config.User = credentials.Username
+		config.Passwd = credentials.Password
+	}
+}
+
+// prepareConfig returns the driver config for the DSN, with the parameters required by kine and
+// the flavor, and with Cloud SQL and token authentication configured if enabled.
+func prepareConfig(ctx context.Context, dataSourceName, dbName string, tlsConfig *cryptotls.Config, tlsConfigName string, cloudSQLConfig drivers.CloudSQLConfig, f flavor) (*mysql.Config, error) {
+	parsedDSN, err := prepareDSN(dataSourceName, dbName, tlsConfig, tlsConfigName)
+	if err != nil {
+		return nil, err
+	}
+	config, err := mysql.ParseDSN(parsedDSN)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range f.params {
+		if existing, ok := config.Params[k]; ok && existing != v {
+			logrus.Warnf("Replacing %s=%s parameter in datastore DSN with %s, as it is required by the server", k, existing, v)
+		}
+		config.Params[k] = v
+	}
+	if err := configureCloudSQL(ctx, config, cloudSQLConfig); err != nil {
+		return nil, err
+	}
+	if iamAuthEnabled() {
+		if err := configureIAMAuth(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	if azureAuthEnabled() {
+		if err := configureAzureAuth(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// newConnector returns a connector for the config, which runs the session statements on each
+// connection if set, and kills statements on the server when their context is cancelled if
+// supported by the flavor.
+func newConnector(config *mysql.Config, f flavor, sessionStatements []string) (driver.Connector, error) {
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessionStatements) > 0 {
+		connector = &sessionConnector{Connector: connector, statements: sessionStatements}
+	}
+	if f.killCancelled {
+		connector = &killConnector{Connector: connector}
+	}
+	return connector, nil
+}
+
+// prepareDSN parses the DSN and sets the parameters required by kine. The database name
+// is taken from dbName if set, otherwise from the DSN, falling back to the default if
+// neither specifies a name.
+//
+// The transport is always taken from the DSN when one is provided. If no DSN is provided,
+// the default is the local unix socket, or the loopback TCP address if TLS is configured.
+// The TLS config, if set, replaces any tls parameter in a TCP DSN, but is not applied to
+// unix socket connections, which are local and are not encrypted by the server; a tls
+// parameter in a unix socket DSN is left as is. The TLS config is registered with the driver
+// under tlsConfigName.
+//
+// All other parameters in the DSN, such as readTimeout, writeTimeout, parseTime, loc and
+// collation, and parameters unknown to the driver, which are set as session variables, are
+// preserved. The sql_mode parameter is kept, with ANSI_QUOTES added if it is not already set, as
+// kine quotes identifiers with double quotes.
+func prepareDSN(dataSourceName, dbName string, tlsConfig *cryptotls.Config, tlsConfigName string) (string, error) {
 	if len(dataSourceName) == 0 {
 		dataSourceName = defaultUnixDSN
 		if tlsConfig != nil {
@@ -234,36 +847,80 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 		config.Params = map[string]string{}
 	}
 
-	if mode, exists := config.Params["sql_mode"]; exists {
-		// check if ANSI_QUOTES is already set
-		if !strings.Contains(strings.ToUpper(mode), "ANSI_QUOTES") {
-			if mode == "" {
-				config.Params["sql_mode"] = "ANSI_QUOTES"
-			} else {
-				config.Params["sql_mode"] = mode + ",ANSI_QUOTES"
-			}
-		}
-	} else {
-		config.Params["sql_mode"] = "ANSI_QUOTES"
+	mode := config.Params["sql_mode"]
+	config.Params["sql_mode"] = withANSIQuotes(mode)
+	if mode != "" && mode != config.Params["sql_mode"] {
+		logrus.Infof("Adding ANSI_QUOTES to sql_mode %s in datastore DSN, as it is required by kine", mode)
 	}
 
 	// setting up tlsConfig
 	if tlsConfig != nil {
-		if err := mysql.RegisterTLSConfig("kine", tlsConfig); err != nil {
-			return "", err
+		if config.Net == "unix" {
+			logrus.Warnf("Ignoring backend TLS configuration for unix socket %s", config.Addr)
+		} else {
+			if err := mysql.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+				return "", err
+			}
+			if config.TLSConfig != "" && config.TLSConfig != tlsConfigName {
+				logrus.Warnf("Replacing tls=%s parameter in datastore DSN with the backend TLS configuration", config.TLSConfig)
+			}
+			config.TLSConfig = tlsConfigName
 		}
-		config.TLSConfig = "kine"
 	}
-	dbName := "kubernetes"
-	if len(config.DBName) > 0 {
-		dbName = config.DBName
+	if len(dbName) > 0 {
+		config.DBName = dbName
+	} else if len(config.DBName) == 0 {
+		config.DBName = defaultDBName
 	}
-	config.DBName = dbName
 	parsedDSN := config.FormatDSN()
 
 	return parsedDSN, nil
 }
 
+// dsnFields returns the effective connection settings of the config for logging, with the
+// password redacted, so that the result of the changes made by prepareDSN, such as the default
+// database name, can be checked.
+func dsnFields(config *mysql.Config) logrus.Fields {
+	redacted := config.Clone()
+	if redacted.Passwd != "" {
+		redacted.Passwd = "xxxxx"
+	}
+	tls := "disabled"
+	if config.TLSConfig != "" && config.TLSConfig != "false" {
+		tls = config.TLSConfig
+	}
+	return logrus.Fields{
+		"dsn":       redacted.FormatDSN(),
+		"database":  config.DBName,
+		"transport": config.Net,
+		"tls":       tls,
+	}
+}
+
+// tlsConfigCount is used to derive a unique TLS config name for each backend.
+var tlsConfigCount uint64
+
+// resolveTLSConfigName returns the configured TLS config name, or a unique name if none is
+// configured. TLS configs are registered with the driver by name for the whole process, so a
+// config registered under the same name by another backend or package would replace ours.
+func resolveTLSConfigName(name string) string {
+	if name != "" {
+		return name
+	}
+	return fmt.Sprintf("kine-%d", atomic.AddUint64(&tlsConfigCount, 1))
+}
+
 func init() {
 	drivers.Register("mysql", New)
 }
+
+// maxExecutionTime adds an optimizer hint limiting the execution time of a SELECT statement to
+// the given timeout. The hint is supported by MySQL 5.7.8+ and TiDB, and is ignored as a comment
+// by MariaDB.
+func maxExecutionTime(sql string, timeout time.Duration) string {
+	ms := timeout.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strings.Replace(sql, "SELECT", fmt.Sprintf("SELECT /*+ MAX_EXECUTION_TIME(%d) */", ms), 1)
+}
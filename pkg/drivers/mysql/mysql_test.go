@@ -0,0 +1,228 @@
+package mysql
+
+import (
+	cryptotls "crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestPrepareDSN(t *testing.T) {
+	tlsConfig := &cryptotls.Config{MinVersion: cryptotls.VersionTLS12}
+	tests := []struct {
+		name      string
+		dsn       string
+		tlsConfig *cryptotls.Config
+		net       string
+		addr      string
+		tls       bool
+	}{
+		{name: "default", net: "unix", addr: "/var/run/mysqld/mysqld.sock"},
+		{name: "default with TLS", tlsConfig: tlsConfig, net: "tcp", addr: "127.0.0.1:3306", tls: true},
+		{name: "socket", dsn: "kine@unix(/tmp/mysql.sock)/kine?timeout=5s", net: "unix", addr: "/tmp/mysql.sock"},
+		{name: "socket with TLS", dsn: "kine@unix(/tmp/mysql.sock)/kine?timeout=5s", tlsConfig: tlsConfig, net: "unix", addr: "/tmp/mysql.sock"},
+		{name: "tcp with TLS", dsn: "kine@tcp(db:3306)/kine", tlsConfig: tlsConfig, net: "tcp", addr: "db:3306", tls: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := prepareDSN(tt.dsn, "", tt.tlsConfig, "kine-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Net != tt.net || config.Addr != tt.addr {
+				t.Errorf("expected %s(%s), got %s(%s)", tt.net, tt.addr, config.Net, config.Addr)
+			}
+			if tls := config.TLSConfig == "kine-test"; tls != tt.tls {
+				t.Errorf("expected TLS %v, got %v", tt.tls, tls)
+			}
+			if config.Params["sql_mode"] != "ANSI_QUOTES" {
+				t.Errorf("expected ANSI_QUOTES sql_mode, got %q", config.Params["sql_mode"])
+			}
+		})
+	}
+}
+
+func TestPrepareDSNParams(t *testing.T) {
+	tlsConfig := &cryptotls.Config{MinVersion: cryptotls.VersionTLS12}
+	dsn, err := prepareDSN("kine@tcp(db:3306)/kine?readTimeout=30s&writeTimeout=10s&parseTime=true&loc=Local&collation=utf8mb4_bin&tls=skip-verify&sql_mode=STRICT_ALL_TABLES&wait_timeout=600", "", tlsConfig, "kine-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ReadTimeout != 30*time.Second || config.WriteTimeout != 10*time.Second {
+		t.Errorf("expected read and write timeouts to be preserved, got %v and %v", config.ReadTimeout, config.WriteTimeout)
+	}
+	if !config.ParseTime || config.Loc != time.Local || config.Collation != "utf8mb4_bin" {
+		t.Errorf("expected parseTime, loc and collation to be preserved, got %v, %v and %s", config.ParseTime, config.Loc, config.Collation)
+	}
+	if config.Params["wait_timeout"] != "600" {
+		t.Errorf("expected session variable to be preserved, got %v", config.Params)
+	}
+	if config.Params["sql_mode"] != "STRICT_ALL_TABLES,ANSI_QUOTES" {
+		t.Errorf("expected ANSI_QUOTES to be added to sql_mode, got %q", config.Params["sql_mode"])
+	}
+	if config.TLSConfig != "kine-test" {
+		t.Errorf("expected tls parameter to be replaced by the backend TLS config, got %q", config.TLSConfig)
+	}
+}
+
+func TestDSNFields(t *testing.T) {
+	dsn, err := prepareDSN("kine:secret@tcp(db.example.com:3306)/", "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := dsnFields(config)
+	if s := fields["dsn"].(string); strings.Contains(s, "secret") || !strings.Contains(s, "kine:xxxxx@tcp(db.example.com:3306)/kubernetes") {
+		t.Errorf("expected redacted DSN with the default database, got %q", s)
+	}
+	if fields["database"] != "kubernetes" || fields["transport"] != "tcp" || fields["tls"] != "disabled" {
+		t.Errorf("unexpected DSN fields %v", fields)
+	}
+	if config.Passwd != "secret" {
+		t.Errorf("expected the config password to be unchanged, got %q", config.Passwd)
+	}
+}
+
+func TestParseIsolationLevel(t *testing.T) {
+	for level, want := range map[string]string{
+		"READ COMMITTED":   "READ COMMITTED",
+		"read-committed":   "READ COMMITTED",
+		"REPEATABLE_READ":  "REPEATABLE READ",
+		" serializable ":   "SERIALIZABLE",
+		"READ-UNCOMMITTED": "READ UNCOMMITTED",
+	} {
+		got, err := parseIsolationLevel(level)
+		if err != nil {
+			t.Errorf("parseIsolationLevel(%q) returned error: %v", level, err)
+		} else if got != want {
+			t.Errorf("parseIsolationLevel(%q) = %q, expected %q", level, got, want)
+		}
+	}
+	for _, level := range []string{"SNAPSHOT", "READ COMMITTED; DROP TABLE kine"} {
+		if _, err := parseIsolationLevel(level); err == nil {
+			t.Errorf("expected error for isolation level %q", level)
+		}
+	}
+}
+
+func TestSessionVariablesSQL(t *testing.T) {
+	got, err := sessionVariablesSQL([]string{"innodb_lock_wait_timeout=10", "Time_Zone=+00:00", "sql_mode=STRICT_ALL_TABLES", "init_connect=it's"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "SET SESSION innodb_lock_wait_timeout = 10, time_zone = '+00:00', sql_mode = 'STRICT_ALL_TABLES,ANSI_QUOTES', init_connect = 'it''s'"
+	if got != want {
+		t.Errorf("sessionVariablesSQL = %q, expected %q", got, want)
+	}
+	if got, err := sessionVariablesSQL(nil); err != nil || got != "" {
+		t.Errorf("expected no statement without session variables, got %q, %v", got, err)
+	}
+	for _, variables := range [][]string{
+		{"wait_timeout"},
+		{"wait_timeout; DROP TABLE kine=1"},
+		{"=1"},
+		{"wait_timeout=1", "WAIT_TIMEOUT=2"},
+		{`time_zone=\'`},
+	} {
+		if _, err := sessionVariablesSQL(variables); err == nil {
+			t.Errorf("expected error for session variables %q", variables)
+		}
+	}
+}
+
+func TestValueTypeMigration(t *testing.T) {
+	for _, f := range []flavor{mysqlFlavor, tidbFlavor} {
+		migrations := f.schemaMigrations("kine", nameColumn{length: defaultNameLength, charset: defaultNameCharset}, longValueType)
+		if len(migrations) != nameCharsetMigration+1 {
+			t.Fatalf("expected %d migrations, got %d", nameCharsetMigration+1, len(migrations))
+		}
+		m := migrations[valueTypeMigration]
+		if !strings.Contains(m.Up, "value "+longValueType) || !strings.Contains(m.Up, "old_value "+longValueType) {
+			t.Errorf("expected up migration to widen value columns to %s, got %q", longValueType, m.Up)
+		}
+		if !strings.Contains(m.Down, "value "+defaultValueType) {
+			t.Errorf("expected down migration to restore %s, got %q", defaultValueType, m.Down)
+		}
+		if m := migrations[leaseGrantedMigration]; !strings.Contains(m.Up, "ADD COLUMN lease_granted") {
+			t.Errorf("expected up migration to add lease_granted column, got %q", m.Up)
+		}
+	}
+}
+
+func TestResolveTLSConfigName(t *testing.T) {
+	if name := resolveTLSConfigName("custom"); name != "custom" {
+		t.Errorf("expected configured name to be used, got %q", name)
+	}
+	if a, b := resolveTLSConfigName(""), resolveTLSConfigName(""); a == b || !strings.HasPrefix(a, "kine-") {
+		t.Errorf("expected unique generated names, got %q and %q", a, b)
+	}
+}
+
+func TestMaxExecutionTime(t *testing.T) {
+	got := maxExecutionTime(`
+		SELECT *
+		FROM (
+			SELECT id FROM kine
+		) AS lkv`, 2500*time.Millisecond)
+	if !strings.Contains(got, "SELECT /*+ MAX_EXECUTION_TIME(2500) */ *") {
+		t.Errorf("expected hint on outer select, got %s", got)
+	}
+	if strings.Count(got, "MAX_EXECUTION_TIME") != 1 {
+		t.Errorf("expected a single hint, got %s", got)
+	}
+}
+
+func TestNameColumn(t *testing.T) {
+	for _, tt := range []struct {
+		length    int
+		charset   string
+		collation string
+		want      string
+	}{
+		{want: "VARCHAR(630) CHARACTER SET ascii"},
+		{length: 3064, charset: "ascii", want: "VARCHAR(3064) CHARACTER SET ascii"},
+		{charset: "UTF8MB4", want: "VARCHAR(630) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin"},
+		{length: 766, charset: "utf8mb4", collation: "utf8mb4_0900_bin", want: "VARCHAR(766) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_bin"},
+	} {
+		name, err := newNameColumn(tt.length, tt.charset, tt.collation)
+		if err != nil {
+			t.Errorf("newNameColumn(%d, %q, %q) returned error: %v", tt.length, tt.charset, tt.collation, err)
+		} else if name.String() != tt.want {
+			t.Errorf("newNameColumn(%d, %q, %q) = %q, expected %q", tt.length, tt.charset, tt.collation, name, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		length    int
+		charset   string
+		collation string
+	}{
+		{length: 3065, charset: "ascii"},
+		{length: 767, charset: "utf8mb4"},
+		{charset: "latin1"},
+		{charset: "utf8mb4", collation: "ascii_bin"},
+		{charset: "utf8mb4", collation: "utf8mb4_bin; DROP TABLE kine"},
+	} {
+		if _, err := newNameColumn(tt.length, tt.charset, tt.collation); err == nil {
+			t.Errorf("expected error for name column %d %q %q", tt.length, tt.charset, tt.collation)
+		}
+	}
+
+	name, _ := newNameColumn(0, "utf8mb4", "")
+	m := getSchemaMigrations("kine", name, defaultValueType)[nameCharsetMigration]
+	if !strings.HasSuffix(m.Up, "MODIFY COLUMN name "+name.String()) || !strings.HasSuffix(m.Down, "MODIFY COLUMN name VARCHAR(630) CHARACTER SET ascii") {
+		t.Errorf("expected migration to convert name column between utf8mb4 and ascii, got %q and %q", m.Up, m.Down)
+	}
+}
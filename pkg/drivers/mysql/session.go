@@ -0,0 +1,93 @@
+package mysql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// sessionVariableNamePattern matches the names of system variables.
+	sessionVariableNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// sessionVariableNumberPattern matches values that are set as numbers rather than strings.
+	sessionVariableNumberPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+)
+
+// sessionVariablesSQL returns the statement that sets the session variables, each given as
+// name=value, or an empty string if there are none. Numeric values are set as numbers and all
+// other values as quoted strings, so that a value cannot add to the statement; keywords such as
+// ON and OFF are accepted as strings by the server. Values may not contain backslashes, as they
+// are only escapes if the NO_BACKSLASH_ESCAPES sql_mode is not set. ANSI_QUOTES is added to
+// sql_mode if it is set and does not include it, as kine quotes identifiers with double quotes.
+func sessionVariablesSQL(variables []string) (string, error) {
+	if len(variables) == 0 {
+		return "", nil
+	}
+	seen := map[string]bool{}
+	assignments := make([]string, 0, len(variables))
+	for _, variable := range variables {
+		name, value, ok := strings.Cut(variable, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || !sessionVariableNamePattern.MatchString(name) {
+			return "", fmt.Errorf("invalid MySQL session variable %q; must be name=value", variable)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("MySQL session variable %s is set more than once", name)
+		}
+		seen[name] = true
+		if strings.Contains(value, `\`) {
+			return "", fmt.Errorf("invalid value for MySQL session variable %s: backslashes are not supported", name)
+		}
+		if name == "sql_mode" {
+			value = withANSIQuotes(value)
+		}
+		if !sessionVariableNumberPattern.MatchString(value) {
+			value = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+		}
+		assignments = append(assignments, name+" = "+value)
+	}
+	return "SET SESSION " + strings.Join(assignments, ", "), nil
+}
+
+// withANSIQuotes returns the sql_mode with ANSI_QUOTES added, if it is not already included.
+func withANSIQuotes(mode string) string {
+	switch {
+	case strings.Contains(strings.ToUpper(mode), "ANSI_QUOTES"):
+		return mode
+	case mode == "":
+		return "ANSI_QUOTES"
+	default:
+		return mode + ",ANSI_QUOTES"
+	}
+}
+
+// sessionConnector runs statements that configure the session on each new connection, such as
+// setting the transaction isolation level and session variables. Pooled connections are opened
+// and closed as needed, so settings must be applied to every connection rather than once. The
+// isolation level is set with a statement instead of the transaction_isolation variable in the
+// DSN, as the variable is named tx_isolation on MariaDB before 11.1.
+type sessionConnector struct {
+	driver.Connector
+	statements []string
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("driver connection %T does not support statements", conn)
+	}
+	for _, statement := range c.statements {
+		if _, err := execer.ExecContext(ctx, statement, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to configure session with %q: %w", statement, err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,122 @@
+package mysql
+
+import (
+	"context"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// tidbFlavor adapts the MySQL driver to TiDB.
+//
+// TiDB stores rows in key order across regions, so a clustered AUTO_INCREMENT primary key sends
+// every insert to the region holding the end of the table. AUTO_RANDOM would spread these writes,
+// but does not produce increasing ids, and kine requires revisions to increase. Instead, the
+// primary key is NONCLUSTERED, so that rows are stored by a hidden row id that is scattered by
+// SHARD_ROW_ID_BITS, with only the much smaller primary key index entries written in id order.
+// AUTO_ID_CACHE 1 enables TiDB's centralized id allocation, which keeps ids increasing across all
+// TiDB servers; the default per-server id cache would allow a later insert to get a lower id.
+var tidbFlavor = flavor{
+	params: map[string]string{
+		// The compactor requests serializable transactions, which TiDB does not support. Allow
+		// TiDB to use snapshot isolation instead; concurrent compactions are still prevented by
+		// the write conflict on the compact_rev_key row.
+		"tidb_skip_isolation_level_check": "1",
+	},
+	schema:           getTiDBSchema,
+	schemaMigrations: getTiDBSchemaMigrations,
+	compactSQL:       getTiDBCompactSQL,
+	retry:            isTiDBRetryable,
+	// Connection ids are only unique to each TiDB server unless global kill is enabled, and a
+	// KILL routed to a different server by a load balancer could kill an unrelated statement,
+	// so cancelled statements are not killed.
+	killCancelled: false,
+}
+
+func getTiDBSchema(tableName string, name nameColumn, valueType string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS "` + tableName + `"
+			(
+				id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+				name ` + name.String() + `,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT UNSIGNED,
+				prev_revision BIGINT UNSIGNED,
+				lease INTEGER,
+				value ` + valueType + `,
+				old_value ` + valueType + `,
+				lease_granted TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (id) NONCLUSTERED
+			) AUTO_ID_CACHE 1 SHARD_ROW_ID_BITS = 4 PRE_SPLIT_REGIONS = 4;`,
+		`CREATE INDEX "` + tableName + `_name_index" ON "` + tableName + `" (name)`,
+		`CREATE INDEX "` + tableName + `_name_id_index" ON "` + tableName + `" (name,id)`,
+		`CREATE INDEX "` + tableName + `_id_deleted_index" ON "` + tableName + `" (id,deleted)`,
+		`CREATE INDEX "` + tableName + `_prev_revision_index" ON "` + tableName + `" (prev_revision)`,
+		`CREATE UNIQUE INDEX "` + tableName + `_name_prev_revision_uindex" ON "` + tableName + `" (name, prev_revision)`,
+	}
+}
+
+// getTiDBSchemaMigrations returns migrations matching those used for MySQL, so that a given value of
+// KINE_SCHEMA_MIGRATION has the same meaning for both. The id column migration is not needed, as
+// no prior release supported TiDB.
+func getTiDBSchemaMigrations(tableName string, name nameColumn, valueType string) []generic.SchemaMigration {
+	return []generic.SchemaMigration{
+		{},
+		{},
+		getNameLengthMigration(tableName, name),
+		getValueTypeMigration(tableName, valueType),
+		getLeaseGrantedMigration(tableName),
+		getNameCharsetMigration(tableName, name),
+	}
+}
+
+// getTiDBCompactSQL returns the compaction statement for TiDB. Unlike MySQL, TiDB allows the table
+// being deleted from to be referenced in a subquery, so the rows are selected with IN, as for
+// CockroachDB, and deleted by primary key rather than through a multi-table DELETE join.
+func getTiDBCompactSQL(tableName string) string {
+	return `
+		DELETE FROM "` + tableName + `"
+		WHERE
+			id IN (
+				SELECT kp.prev_revision AS id
+				FROM "` + tableName + `" AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM "` + tableName + `" AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			) AND
+			(deleted = 0 OR id <= ?)`
+}
+
+// isTiDBRetryable returns true if the statement failed due to a conflict with a concurrent
+// transaction, which TiDB reports at commit time rather than by blocking.
+func isTiDBRetryable(err error) bool {
+	if err, ok := err.(*mysql.MySQLError); ok {
+		switch err.Number {
+		case 8002, 8022, 9007:
+			// 8002: can not retry select for update statement
+			// 8022: transaction commit failed and has been rolled back
+			// 9007: write conflict
+			return true
+		}
+	}
+	return false
+}
+
+// NewTiDB returns a backend for TiDB, using the MySQL driver with a TiDB specific schema.
+func NewTiDB(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	return newBackend(ctx, cfg, tidbFlavor)
+}
+
+func init() {
+	drivers.Register("tidb", NewTiDB)
+}
@@ -3,6 +3,7 @@ package nats
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/server"
@@ -432,3 +433,8 @@ func (b *Backend) Watch(ctx context.Context, prefix string, startRevision int64)
 func (b *Backend) Compact(ctx context.Context, revision int64) (int64, error) {
 	return revision, nil
 }
+
+// Defragment is not implemented. Storage is managed by the jetstream server.
+func (b *Backend) Defragment(ctx context.Context) error {
+	return errors.New("defragment is not supported by the nats driver")
+}
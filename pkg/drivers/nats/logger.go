@@ -125,3 +125,8 @@ func (b *BackendLogger) CurrentRevision(ctx context.Context) (int64, error) {
 func (b *BackendLogger) Compact(ctx context.Context, revision int64) (int64, error) {
 	return revision, nil
 }
+
+// Defragment is not implemented. Storage is managed by the jetstream server.
+func (b *BackendLogger) Defragment(ctx context.Context) error {
+	return b.backend.Defragment(ctx)
+}
@@ -45,6 +45,9 @@ var (
 // New return an implementation of server.Backend using NATS + JetStream.
 // See the `examples/nats.md` file for examples of connection strings.
 func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	if cfg.ValueTransformer != nil {
+		return false, nil, drivers.ErrEncryptionNotSupported
+	}
 	backend, err := newBackend(ctx, cfg.Endpoint, cfg.BackendTLSConfig, false)
 	return true, backend, err
 }
@@ -52,6 +55,9 @@ func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error)
 // NewLegacy return an implementation of server.Backend using NATS + JetStream
 // with legacy jetstream:// behavior, ignoring the embedded server.
 func NewLegacy(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	if cfg.ValueTransformer != nil {
+		return false, nil, drivers.ErrEncryptionNotSupported
+	}
 	backend, err := newBackend(ctx, cfg.DataSourceName, cfg.BackendTLSConfig, true)
 	return true, backend, err
 
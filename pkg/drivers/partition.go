@@ -0,0 +1,88 @@
+package drivers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+)
+
+// partitionSchemes are the schemes of the drivers that support table partitions.
+var partitionSchemes = map[string]bool{
+	"sqlite": true,
+	"mysql":  true,
+}
+
+// validateTablePartitions checks that the prefix of each table partition is a key prefix that
+// does not overlap with that of any other partition, and that each partition has a valid table
+// name of its own.
+func validateTablePartitions(cfg *Config) error {
+	tableName := cfg.TableName
+	if tableName == "" {
+		tableName = "kine"
+	}
+	// The revision sequence table and the schema version tables are named after the tables.
+	tables := map[string]bool{tableName: true, tableName + "_revision": true, tableName + "_schema": true}
+	for i, partition := range cfg.TablePartitions {
+		if !strings.HasPrefix(partition.Prefix, "/") || !strings.HasSuffix(partition.Prefix, "/") {
+			return fmt.Errorf("table partition prefix %q must start and end with /", partition.Prefix)
+		}
+		if err := generic.ValidateTableName(partition.TableName); err != nil {
+			return err
+		}
+		if tables[partition.TableName] || tables[partition.TableName+"_schema"] {
+			return fmt.Errorf("table name %s of partition %s is already in use", partition.TableName, partition.Prefix)
+		}
+		tables[partition.TableName] = true
+		tables[partition.TableName+"_schema"] = true
+		for _, other := range cfg.TablePartitions[:i] {
+			if strings.HasPrefix(partition.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, partition.Prefix) {
+				return fmt.Errorf("table partition prefix %s overlaps with prefix %s", partition.Prefix, other.Prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// PartitionedLog returns a log that stores the keys under the prefix of each table partition in
+// the table opened for it by openTable, and all other keys in the dialect's table. The tables
+// share a single revision space, allocated from a revision sequence that is set up along with
+// them. openTable must set up the schema of the table, unless schema setup is skipped.
+func (c *Config) PartitionedLog(ctx context.Context, dialect *generic.Generic, openTable func(tableName string) (*generic.Generic, error)) (*logstructured.Partitioned, error) {
+	dialects := make([]*generic.Generic, 0, len(c.TablePartitions))
+	for _, partition := range c.TablePartitions {
+		d, err := openTable(partition.TableName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open table %s of partition %s: %w", partition.TableName, partition.Prefix, err)
+		}
+		dialects = append(dialects, d)
+	}
+
+	sequence := generic.NewSequenceAllocator(dialect, dialects...)
+	if c.SkipSchemaSetup {
+		if err := sequence.Init(ctx); err != nil {
+			return nil, fmt.Errorf("schema setup is skipped, but the revision sequence table could not be read: %w", err)
+		}
+	} else if err := sequence.Setup(ctx); err != nil {
+		return nil, err
+	}
+
+	newLog := func(d *generic.Generic) *sqllog.SQLLog {
+		d.UseRevisionSequence(sequence)
+		logConfig := c.SQLLogConfig()
+		logConfig.Allocator = sequence.Share(d)
+		logConfig.SharedRevisions = true
+		return sqllog.New(d, logConfig)
+	}
+	partitions := make([]logstructured.Partition, len(dialects))
+	for i, d := range dialects {
+		partitions[i] = logstructured.Partition{
+			Prefix: c.TablePartitions[i].Prefix,
+			Log:    newLog(d),
+		}
+	}
+	return logstructured.NewPartitioned(newLog(dialect), partitions, c.PollBatchSize, c.WatchBufferSize), nil
+}
@@ -0,0 +1,130 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	syncModes    = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// pragmaConnector opens connections using the underlying driver, and applies PRAGMA statements
+// to each new connection before returning it to the pool. SQLite PRAGMAs are scoped to a single
+// connection, so they must be reapplied every time the pool opens a new one.
+type pragmaConnector struct {
+	driver  driver.Driver
+	dsn     string
+	pragmas []string
+}
+
+func (c *pragmaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, pragma := range c.pragmas {
+		if err := execConn(ctx, conn, pragma); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to apply %s: %w", pragma, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *pragmaConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func execConn(ctx context.Context, conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, query, nil)
+		return err
+	}
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil) //nolint:staticcheck // fallback for drivers that do not implement ExecerContext
+	return err
+}
+
+// newPragmaConnector returns a connector for the named driver that applies the PRAGMAs
+// requested by the config to every connection. A nil connector is returned if no PRAGMAs
+// have been requested.
+func newPragmaConnector(driverName, dataSourceName string, cfg drivers.SQLiteConfig) (driver.Connector, error) {
+	pragmas, err := getPragmas(cfg)
+	if err != nil || len(pragmas) == 0 {
+		return nil, err
+	}
+
+	// database/sql does not expose registered drivers directly, but opening a DB handle
+	// is lazy and does not create any connections.
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	logrus.Infof("Applying SQLite connection settings: %s", strings.Join(pragmas, "; "))
+	return &pragmaConnector{
+		driver:  db.Driver(),
+		dsn:     dataSourceName,
+		pragmas: pragmas,
+	}, nil
+}
+
+func getPragmas(cfg drivers.SQLiteConfig) ([]string, error) {
+	var pragmas []string
+
+	if cfg.BusyTimeout < 0 {
+		return nil, fmt.Errorf("invalid SQLite busy timeout %v: must not be negative", cfg.BusyTimeout)
+	} else if cfg.BusyTimeout > 0 {
+		// busy_timeout should be set first, so that the remaining statements wait on locks
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", cfg.BusyTimeout.Milliseconds()))
+	}
+
+	if cfg.JournalMode != "" {
+		mode := strings.ToUpper(cfg.JournalMode)
+		if !contains(journalModes, mode) {
+			return nil, fmt.Errorf("invalid SQLite journal mode %q: must be one of %s", cfg.JournalMode, strings.Join(journalModes, ", "))
+		}
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+mode)
+	}
+
+	if cfg.Synchronous != "" {
+		mode := strings.ToUpper(cfg.Synchronous)
+		if !contains(syncModes, mode) {
+			return nil, fmt.Errorf("invalid SQLite synchronous mode %q: must be one of %s", cfg.Synchronous, strings.Join(syncModes, ", "))
+		}
+		pragmas = append(pragmas, "PRAGMA synchronous = "+mode)
+	}
+
+	if cfg.WALAutocheckpoint < 0 {
+		return nil, fmt.Errorf("invalid SQLite WAL autocheckpoint %d: must not be negative", cfg.WALAutocheckpoint)
+	} else if cfg.WALAutocheckpoint > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA wal_autocheckpoint = %d", cfg.WALAutocheckpoint))
+	}
+
+	return pragmas, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -51,8 +51,10 @@ func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error)
 func NewVariant(ctx context.Context, driverName string, cfg *drivers.Config) (server.Backend, *generic.Generic, error) {
 	dataSourceName := cfg.DataSourceName
 	if dataSourceName == "" {
-		if err := os.MkdirAll("./db", 0700); err != nil {
-			return nil, nil, err
+		if cfg.ConnectionPoolConfig.DB == nil {
+			if err := os.MkdirAll("./db", 0700); err != nil {
+				return nil, nil, err
+			}
 		}
 		dataSourceName = "./db/state.db?_journal=WAL&cache=shared&_busy_timeout=30000&_txlock=immediate"
 	}
@@ -62,13 +64,57 @@ func NewVariant(ctx context.Context, driverName string, cfg *drivers.Config) (se
 		tableName = "kine"
 	}
 
-	dialect, err := generic.Open(ctx, driverName, dataSourceName, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer, tableName)
+	connector, err := newPragmaConnector(driverName, dataSourceName, cfg.SQLiteConfig)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	var dialect *generic.Generic
+	if connector != nil {
+		dialect, err = generic.OpenConnector(ctx, driverName, connector, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer, tableName)
+	} else {
+		dialect, err = generic.Open(ctx, driverName, dataSourceName, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer, tableName)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	configureDialect(dialect, tableName)
+	if err := setupTable(dialect, tableName, cfg.SkipSchemaSetup); err != nil {
+		return nil, nil, err
+	}
+
+	dialect.Migrate(context.Background())
+	if len(cfg.TablePartitions) == 0 {
+		return logstructured.New(sqllog.New(dialect, cfg.SQLLogConfig()), cfg.ReadCacheSize, cfg.AdmissionHooks), dialect, nil
+	}
+
+	// The size of the database file is shared by all of the tables, so the size of each table is
+	// reported instead.
+	dialect.GetSizeSQL = tableSizeSQL(tableName)
+	log, err := cfg.PartitionedLog(ctx, dialect, func(tableName string) (*generic.Generic, error) {
+		poolConfig := cfg.ConnectionPoolConfig
+		poolConfig.DB = dialect.DB
+		partition, err := generic.Open(ctx, driverName, dataSourceName, poolConfig, "?", false, nil, tableName)
+		if err != nil {
+			return nil, err
+		}
+		configureDialect(partition, tableName)
+		partition.GetSizeSQL = tableSizeSQL(tableName)
+		return partition, setupTable(partition, tableName, cfg.SkipSchemaSetup)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return logstructured.New(log, cfg.ReadCacheSize, cfg.AdmissionHooks), dialect, nil
+}
+
+// configureDialect sets the statements and error handling that are specific to SQLite.
+func configureDialect(dialect *generic.Generic, tableName string) {
 	dialect.LastInsertID = true
 	dialect.GetSizeSQL = `SELECT SUM(pgsize) FROM dbstat`
+	// VACUUM is written through the WAL, so truncate it afterwards to release the space.
+	dialect.DefragSQL = `VACUUM; PRAGMA wal_checkpoint(TRUNCATE)`
 	dialect.CompactSQL = `
 		DELETE FROM "` + tableName + `" AS kv
 		WHERE
@@ -85,7 +131,8 @@ func NewVariant(ctx context.Context, driverName string, cfg *drivers.Config) (se
 				WHERE
 					kd.deleted != 0 AND
 					kd.id <= ?
-			)`
+			) AND
+			(kv.deleted = 0 OR kv.id <= ?)`
 	dialect.PostCompactSQL = `PRAGMA wal_checkpoint(FULL)`
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(sqlite3.Error); ok && err.ExtendedCode == sqlite3.ErrConstraintUnique {
@@ -102,20 +149,30 @@ func NewVariant(ctx context.Context, driverName string, cfg *drivers.Config) (se
 		}
 		return err.Error()
 	}
+}
 
-	if err := setup(dialect.DB, cfg.TableName); err != nil {
-		return nil, nil, errors.Wrap(err, "setup db")
+// setupTable creates the table and its indexes, or if schema setup is skipped, checks that they
+// exist.
+func setupTable(dialect *generic.Generic, tableName string, skipSchemaSetup bool) error {
+	if skipSchemaSetup {
+		return generic.ValidateSchema(dialect.DB, tableName, getSchema(tableName), `SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?`)
+	}
+	if err := setup(dialect.DB, tableName); err != nil {
+		return errors.Wrap(err, "setup db")
 	}
+	return nil
+}
 
-	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect, cfg.CompactInterval, cfg.CompactIntervalJitter, cfg.CompactTimeout, cfg.CompactMinRetain, cfg.CompactBatchSize, cfg.PollBatchSize)), dialect, nil
+// tableSizeSQL selects the size of the pages used by the table and its indexes.
+func tableSizeSQL(tableName string) string {
+	return `SELECT COALESCE(SUM(pgsize), 0) FROM dbstat WHERE name IN (SELECT name FROM sqlite_master WHERE tbl_name = '` + tableName + `')`
 }
 
 func setup(db *sql.DB, tableName string) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 
 	for _, stmt := range getSchema(tableName) {
-		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
 		_, err := db.Exec(stmt)
 		if err != nil {
 			return err
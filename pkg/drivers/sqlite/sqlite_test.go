@@ -0,0 +1,1791 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testConfig returns the config of a backend using a new database in the test's temporary
+// directory, after applying configure to it if it is not nil.
+func testConfig(t *testing.T, configure func(*drivers.Config)) *drivers.Config {
+	cfg := &drivers.Config{
+		DataSourceName:   "file:" + filepath.Join(t.TempDir(), "state.db") + "?_journal=WAL&_txlock=immediate",
+		TableName:        "kine",
+		CompactInterval:  time.Minute,
+		CompactTimeout:   time.Minute,
+		CompactBatchSize: 100,
+		PollBatchSize:    500,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	return cfg
+}
+
+// newTestBackend returns a started backend using the config from testConfig, and its dialect. The
+// backend is stopped when the test completes.
+func newTestBackend(t *testing.T, configure func(*drivers.Config)) (server.Backend, *generic.Generic) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	backend, dialect, err := NewVariant(ctx, "sqlite3", testConfig(t, configure))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return backend, dialect
+}
+
+func TestGetPragmas(t *testing.T) {
+	pragmas, err := getPragmas(drivers.SQLiteConfig{
+		JournalMode:       "wal",
+		BusyTimeout:       5 * time.Second,
+		Synchronous:       "normal",
+		WALAutocheckpoint: 500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = NORMAL",
+		"PRAGMA wal_autocheckpoint = 500",
+	}
+	if fmt.Sprint(pragmas) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, pragmas)
+	}
+
+	if _, err := getPragmas(drivers.SQLiteConfig{JournalMode: "WAL; DROP TABLE kine"}); err == nil {
+		t.Fatal("expected error for invalid journal mode")
+	}
+	if _, err := getPragmas(drivers.SQLiteConfig{Synchronous: "sometimes"}); err == nil {
+		t.Fatal("expected error for invalid synchronous mode")
+	}
+}
+
+// TestConcurrentWritesAndCompaction ensures that writes and compaction running concurrently
+// against a database opened without any locking parameters in the DSN do not fail with
+// "database is locked" errors, when the busy timeout is applied to each connection.
+func TestConcurrentWritesAndCompaction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.DataSourceName = "file:" + filepath.Join(t.TempDir(), "state.db") + "?_txlock=immediate"
+		cfg.SQLiteConfig = drivers.SQLiteConfig{
+			JournalMode: "WAL",
+			BusyTimeout: 30 * time.Second,
+			Synchronous: "NORMAL",
+		}
+	})
+
+	const (
+		writers = 8
+		writes  = 50
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes+1)
+	done := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("/registry/test/%d", w)
+			rev, err := backend.Create(ctx, key, []byte("0"), 0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 1; i < writes; i++ {
+				var ok bool
+				rev, _, ok, err = backend.Update(ctx, key, []byte(fmt.Sprint(i)), rev, 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ok {
+					errs <- fmt.Errorf("update of %s at revision %d failed", key, rev)
+					return
+				}
+			}
+		}(w)
+	}
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			rev, err := backend.CurrentRevision(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if _, err := backend.Compact(ctx, rev); err != nil && !errors.Is(err, server.ErrCompacted) && !errors.Is(err, server.ErrFutureRev) {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	cancel()
+	<-done
+	close(errs)
+
+	for err := range errs {
+		if !errors.Is(err, context.Canceled) {
+			t.Error(err)
+		}
+	}
+}
+
+// TestCountMatchesList ensures that count-only requests return the same number of keys as a
+// full list, for both the current and past revisions.
+func TestCountMatchesList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, nil)
+
+	var (
+		rev int64
+		err error
+	)
+	for i := 0; i < 20; i++ {
+		if rev, err = backend.Create(ctx, fmt.Sprintf("/registry/pods/default/pod-%02d", i), []byte("pod"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Create(ctx, "/registry/services/default/svc", []byte("svc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("/registry/pods/default/pod-%02d", i)
+		_, kv, err := backend.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := backend.Delete(ctx, key, kv.ModRevision); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		prefix, startKey string
+		revision         int64
+	}{
+		{"/registry/pods/", "/registry/pods/", 0},
+		{"/registry/pods/", "/registry/pods/default/pod-10", 0},
+		{"/registry/pods/", "/registry/pods/", rev},
+		{"/registry/pods/", "/registry/pods/default/pod-10", rev},
+		{"/registry/", "/registry/", 0},
+	} {
+		_, kvs, err := backend.List(ctx, tc.prefix, tc.startKey, 0, tc.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, count, err := backend.Count(ctx, tc.prefix, tc.startKey, tc.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(len(kvs)) {
+			t.Errorf("prefix=%s start=%s revision=%d: expected count %d, got %d", tc.prefix, tc.startKey, tc.revision, len(kvs), count)
+		}
+	}
+}
+
+// TestBatchInsert ensures that concurrent creates coalesced into a batch each receive their own
+// revision, and that a conflicting create in a batch does not cause the other creates to fail.
+func TestBatchInsert(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.InsertBatchWindow = 50 * time.Millisecond
+	})
+
+	var (
+		mu     sync.Mutex
+		exists int
+		revs   = map[int64]string{}
+	)
+	create := func(start, end int) {
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := fmt.Sprintf("/registry/configmaps/default/cm-%02d", i)
+				rev, err := backend.Create(ctx, key, []byte(key), 0)
+				mu.Lock()
+				defer mu.Unlock()
+				if errors.Is(err, server.ErrKeyExists) {
+					exists++
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				if other, ok := revs[rev]; ok {
+					t.Errorf("revision %d returned for both %s and %s", rev, key, other)
+				}
+				revs[rev] = key
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	// The first set of creates has no conflicts; the second set overlaps the first by 10 keys.
+	create(0, 40)
+	create(30, 50)
+
+	if exists != 10 {
+		t.Errorf("expected 10 creates to fail with %v, got %d", server.ErrKeyExists, exists)
+	}
+	if len(revs) != 50 {
+		t.Errorf("expected 50 successful creates, got %d", len(revs))
+	}
+	for rev, key := range revs {
+		_, kv, err := backend.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil || kv.ModRevision != rev || string(kv.Value) != key {
+			t.Errorf("expected %s at revision %d, got %+v", key, rev, kv)
+		}
+	}
+}
+
+// TestBatchWrites ensures that updates and deletes batched along with creates are each written at
+// their own revision, and that of two conflicting updates to a key in a batch, only one succeeds.
+func TestBatchWrites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.InsertBatchWindow = 50 * time.Millisecond
+		cfg.InsertBatchWrites = true
+	})
+
+	created := map[string]int64{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("/registry/configmaps/default/cm-%02d", i)
+		rev, err := backend.Create(ctx, key, []byte(key), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created[key] = rev
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		updated = map[string]int64{}
+		revs    = map[int64]string{}
+	)
+	for key, rev := range created {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(key string, rev int64, j int) {
+				defer wg.Done()
+				newRev, kv, ok, err := backend.Update(ctx, key, []byte(fmt.Sprint(j)), rev, 0)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					return
+				}
+				if other, ok := revs[newRev]; ok {
+					t.Errorf("revision %d returned for both %s and %s", newRev, key, other)
+				}
+				if _, ok := updated[key]; ok {
+					t.Errorf("expected only one update of %s to succeed", key)
+				}
+				if kv.ModRevision != newRev {
+					t.Errorf("expected %s to be updated at revision %d, got %+v", key, newRev, kv)
+				}
+				revs[newRev] = key
+				updated[key] = newRev
+			}(key, rev, j)
+		}
+	}
+	wg.Wait()
+
+	if len(updated) != len(created) {
+		t.Fatalf("expected one update of each of %d keys to succeed, got %d", len(created), len(updated))
+	}
+	for key, rev := range updated {
+		_, kv, err := backend.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil || kv.ModRevision != rev {
+			t.Errorf("expected %s at revision %d, got %+v", key, rev, kv)
+		}
+	}
+
+	for key, rev := range updated {
+		wg.Add(1)
+		go func(key string, rev int64) {
+			defer wg.Done()
+			if _, _, deleted, err := backend.Delete(ctx, key, rev); err != nil || !deleted {
+				t.Errorf("expected %s to be deleted, got %v, %v", key, deleted, err)
+			}
+		}(key, rev)
+	}
+	wg.Wait()
+	if _, kvs, err := backend.List(ctx, "/registry/configmaps/", "", 0, 0); err != nil || len(kvs) != 0 {
+		t.Fatalf("expected all keys to be deleted, got %d keys, %v", len(kvs), err)
+	}
+}
+
+// TestDefragment ensures that defragmenting the database after deleting and compacting
+// a large number of keys reduces the size of the database file. The file size is checked
+// directly, as the dbstat table used for size reporting is not enabled in all builds.
+func TestDefragment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dbPath := filepath.Join(t.TempDir(), "state.db")
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.DataSourceName = "file:" + dbPath + "?_journal=WAL&_txlock=immediate"
+		cfg.CompactBatchSize = 1000
+	})
+
+	value := make([]byte, 4096)
+	var (
+		rev int64
+		err error
+	)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("/registry/test/%03d", i)
+		if rev, err = backend.Create(ctx, key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+		if rev, _, _, err = backend.Delete(ctx, key, rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	size := func() int64 {
+		var total int64
+		for _, suffix := range []string{"", "-wal"} {
+			if info, err := os.Stat(dbPath + suffix); err == nil {
+				total += info.Size()
+			}
+		}
+		return total
+	}
+
+	before := size()
+	if err := backend.Defragment(ctx); err != nil {
+		t.Fatal(err)
+	}
+	after := size()
+	if after >= before {
+		t.Fatalf("expected size to decrease after defragment, got %d => %d", before, after)
+	}
+}
+
+func TestCompactDryRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+	})
+
+	value := make([]byte, 1024)
+	var (
+		rev int64
+		err error
+	)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/registry/test/%03d", i)
+		if rev, err = backend.Create(ctx, key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+		if rev, _, _, err = backend.Delete(ctx, key, rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for the poll loop to catch up, so that it does not fill the compacted rows as gaps.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if current, err := backend.CurrentRevision(ctx); err == nil && current >= rev {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for poll")
+		}
+	}
+
+	// Both the created and deleted rows for each key are deletable.
+	rows, size, err := dialect.CompactDryRun(ctx, rev, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 20 || size < 10*int64(len(value)) {
+		t.Fatalf("expected 20 deletable rows of at least %d bytes, got %d rows of %d bytes", 10*len(value), rows, size)
+	}
+
+	// Deleted rows newer than the deleted revision are retained, but are not visible to reads.
+	if rows, _, err = dialect.CompactDryRun(ctx, rev, 0); err != nil || rows != 10 {
+		t.Fatalf("expected 10 deletable rows when retaining deleted rows, got %d: %v", rows, err)
+	}
+	deleted, err := dialect.Compact(ctx, rev, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 10 {
+		t.Fatalf("expected compaction to delete 10 rows when retaining deleted rows, deleted %d", deleted)
+	}
+	if _, kv, err := backend.Get(ctx, "/registry/test/000", "", 0, 0); err != nil || kv != nil {
+		t.Fatalf("expected retained deleted key to not be found, got %v: %v", kv, err)
+	}
+
+	deleted, err = dialect.Compact(ctx, rev, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 10 {
+		t.Fatalf("expected compaction to delete 10 deleted rows, deleted %d", deleted)
+	}
+	if rows, _, err = dialect.CompactDryRun(ctx, rev, rev); err != nil || rows != 0 {
+		t.Fatalf("expected no deletable rows after compaction, got %d: %v", rows, err)
+	}
+}
+
+// TestWatch ensures that watches starting at an old revision receive the events they have missed,
+// while watches starting at the current revision only receive new events.
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+	})
+
+	first, err := backend.Create(ctx, "/registry/test/a", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the poll loop to catch up, so that the new watch starts at the current revision.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if rev, err := backend.CurrentRevision(ctx); err == nil && rev >= first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for poll")
+		}
+	}
+
+	history := backend.Watch(ctx, "/registry/test/", first)
+	current := backend.Watch(ctx, "/registry/test/", 0)
+
+	second, err := backend.Create(ctx, "/registry/test/b", []byte("b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(wr server.WatchResult) []int64 {
+		var revs []int64
+		timeout := time.After(5 * time.Second)
+		for len(revs) == 0 || revs[len(revs)-1] < second {
+			select {
+			case events := <-wr.Events:
+				for _, event := range events {
+					revs = append(revs, event.KV.ModRevision)
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for events, got %v", revs)
+			}
+		}
+		return revs
+	}
+	if revs := next(history); fmt.Sprint(revs) != fmt.Sprint([]int64{first, second}) {
+		t.Errorf("expected events at revisions %d and %d, got %v", first, second, revs)
+	}
+	if revs := next(current); fmt.Sprint(revs) != fmt.Sprint([]int64{second}) {
+		t.Errorf("expected event at revision %d, got %v", second, revs)
+	}
+}
+
+// TestWatchCompacted ensures that watches starting at or before the compact revision, including
+// from the start of the log, report the compact revision so that the client knows to relist.
+func TestWatchCompacted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+	})
+
+	var (
+		rev int64
+		err error
+	)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/registry/test/%d", i)
+		if rev, err = backend.Create(ctx, key, []byte("a"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if rev, _, _, err = backend.Delete(ctx, key, rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	last, err := backend.Create(ctx, "/registry/test/last", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the poll loop to catch up, so that watches are checked against the compact revision
+	// instead of starting at the current revision.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if current, err := backend.CurrentRevision(ctx); err == nil && current >= last {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for poll")
+		}
+	}
+
+	for _, start := range []int64{1, rev / 2, rev} {
+		wr := backend.Watch(ctx, "/registry/test/", start)
+		if wr.CompactRevision != rev || wr.CurrentRevision < last {
+			t.Errorf("expected watch at revision %d to be compacted at %d, current revision >= %d, got compact revision %d, current revision %d", start, rev, last, wr.CompactRevision, wr.CurrentRevision)
+		}
+	}
+
+	wr := backend.Watch(ctx, "/registry/test/", rev+1)
+	if wr.CompactRevision != 0 {
+		t.Fatalf("expected watch after the compact revision to succeed, got compact revision %d", wr.CompactRevision)
+	}
+	select {
+	case events := <-wr.Events:
+		if len(events) == 0 || events[len(events)-1].KV.ModRevision != last {
+			t.Fatalf("expected event at revision %d, got %v", last, events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+}
+
+// TestWatchAcrossCompaction ensures that a watch receives a gap-free stream of events while the
+// log is compacted, both by the server it is watching and by another server sharing the datastore
+// that compacts revisions before the watched server has read them. In the latter case the watch
+// must be cancelled as compacted rather than skip the compacted events.
+func TestWatchAcrossCompaction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "state.db") + "?_journal=WAL&_busy_timeout=30000&_txlock=immediate"
+	newBackend := func() server.Backend {
+		backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+			cfg.DataSourceName = dsn
+			cfg.CompactBatchSize = 10
+		})
+		return backend
+	}
+	watched := newBackend()
+	other := newBackend()
+
+	const (
+		keys    = 4
+		updates = 25
+	)
+	revs := make([]int64, keys)
+	for i := range revs {
+		rev, err := watched.Create(ctx, fmt.Sprintf("/registry/test/%d", i), []byte("0"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs[i] = rev
+	}
+	start := revs[keys-1]
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if rev, err := watched.CurrentRevision(ctx); err == nil && rev >= start {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for poll")
+		}
+	}
+	wr := watched.Watch(ctx, "/registry/test/", start+1)
+
+	// The watched server compacts as far as it can while the writes are made.
+	compactDone := make(chan struct{})
+	compactCtx, compactCancel := context.WithCancel(ctx)
+	go func() {
+		defer close(compactDone)
+		for compactCtx.Err() == nil {
+			rev, err := watched.CurrentRevision(compactCtx)
+			if err != nil {
+				return
+			}
+			if _, err := watched.Compact(compactCtx, rev); err != nil && !errors.Is(err, server.ErrCompacted) && !errors.Is(err, server.ErrFutureRev) && compactCtx.Err() == nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	write := func(backend server.Backend) int64 {
+		for u := 1; u <= updates; u++ {
+			for i := range revs {
+				rev, _, ok, err := backend.Update(ctx, fmt.Sprintf("/registry/test/%d", i), []byte(fmt.Sprint(u)), revs[i], 0)
+				if err != nil || !ok {
+					t.Fatalf("update of key %d at revision %d failed: %v", i, revs[i], err)
+				}
+				revs[i] = rev
+			}
+		}
+		return revs[keys-1]
+	}
+
+	// The first round of updates is written through the watched server, and the second through
+	// the other server, which compacts them before the watched server polls for them.
+	write(watched)
+	last := write(other)
+	if _, err := other.Compact(ctx, last); err != nil && !errors.Is(err, server.ErrCompacted) {
+		t.Fatal(err)
+	}
+
+	next := start + 1
+	timeout := time.After(10 * time.Second)
+	for next <= last {
+		select {
+		case events, ok := <-wr.Events:
+			if !ok {
+				select {
+				case err := <-wr.Errorc:
+					if !errors.Is(err, server.ErrCompacted) {
+						t.Fatalf("expected watch to be cancelled as compacted after revision %d, got %v", next-1, err)
+					}
+				default:
+					t.Fatalf("watch closed without an error after revision %d", next-1)
+				}
+				next = last + 1
+				break
+			}
+			for _, event := range events {
+				if event.KV.ModRevision != next {
+					t.Fatalf("expected event at revision %d, got %d", next, event.KV.ModRevision)
+				}
+				next++
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for event at revision %d", next)
+		}
+	}
+	compactCancel()
+	<-compactDone
+}
+
+func TestKeyExistsMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+	})
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(metrics.KeyExistsTotal)
+	count := func() float64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "operation" && label.GetValue() == "create" {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+	before := count()
+	var err error
+	for i := 0; i < 2; i++ {
+		_, err = dialect.Insert(ctx, "/registry/test", true, false, 0, 0, 0, []byte("value"), nil)
+	}
+	if !errors.Is(err, server.ErrKeyExists) {
+		t.Fatalf("expected ErrKeyExists, got %v", err)
+	}
+	if after := count(); after != before+1 {
+		t.Fatalf("expected create conflict to be counted once, got %v => %v", before, after)
+	}
+
+	// Conflicts on inserts within a transaction are counted too.
+	tx, err := dialect.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.MustRollback()
+	if _, err := tx.Insert(ctx, "/registry/test", true, false, 0, 0, 0, []byte("value"), nil); !errors.Is(err, server.ErrKeyExists) {
+		t.Fatalf("expected ErrKeyExists, got %v", err)
+	}
+	if after := count(); after != before+2 {
+		t.Fatalf("expected transaction create conflict to be counted, got %v => %v", before, after)
+	}
+}
+
+// TestSequenceAllocator ensures that revisions allocated from the sequence table are increasing,
+// and are greater than revisions written without the sequence, such as by a gap fill.
+func TestSequenceAllocator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+	})
+	sequence := generic.NewSequenceAllocator(dialect)
+	if err := sequence.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	backend := logstructured.New(sqllog.New(dialect, sqllog.Config{
+		CompactInterval:  time.Minute,
+		CompactTimeout:   time.Minute,
+		CompactBatchSize: 1000,
+		PollBatchSize:    500,
+		Allocator:        sequence,
+	}), 0, nil)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var last int64
+	for i := 0; i < 3; i++ {
+		rev, err := backend.Create(ctx, fmt.Sprintf("/registry/test/%d", i), []byte("value"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev <= last {
+			t.Fatalf("expected revision greater than %d, got %d", last, rev)
+		}
+		last = rev
+	}
+
+	// Use the next revision without the sequence, as a gap fill would.
+	if err := dialect.Fill(ctx, last+1); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := backend.Create(ctx, "/registry/test/filled", []byte("value"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev <= last+1 {
+		t.Fatalf("expected revision greater than filled revision %d, got %d", last+1, rev)
+	}
+	if _, kv, err := backend.Get(ctx, "/registry/test/filled", "", 0, 0); err != nil || kv == nil || kv.ModRevision != rev {
+		t.Fatalf("expected key at revision %d, got %v, %v", rev, kv, err)
+	}
+
+	// Conflicts on the key are still reported.
+	if _, err := backend.Create(ctx, "/registry/test/filled", []byte("value"), 0); err != server.ErrKeyExists {
+		t.Fatalf("expected ErrKeyExists, got %v", err)
+	}
+}
+
+// TestSequenceAllocatorNodes ensures that revisions allocated by several nodes sharing the sequence
+// table are committed in order, without gaps.
+func TestSequenceAllocatorNodes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+	})
+	var nodes []server.Backend
+	for i := 0; i < 2; i++ {
+		sequence := generic.NewSequenceAllocator(dialect)
+		if err := sequence.Setup(ctx); err != nil {
+			t.Fatal(err)
+		}
+		backend := logstructured.New(sqllog.New(dialect, sqllog.Config{
+			CompactInterval:  time.Minute,
+			CompactTimeout:   time.Minute,
+			CompactBatchSize: 1000,
+			PollBatchSize:    500,
+			Allocator:        sequence,
+		}), 0, nil)
+		if err := backend.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, backend)
+	}
+
+	// Writes alternating between nodes are each at a higher revision than the last, regardless
+	// of which node made the previous write.
+	var last int64
+	for i := 0; i < 6; i++ {
+		rev, err := nodes[i%2].Create(ctx, fmt.Sprintf("/registry/alternate/%d", i), []byte("value"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev <= last {
+			t.Fatalf("expected write %d by node %d at a revision greater than %d, got %d", i, i%2, last, rev)
+		}
+		last = rev
+	}
+
+	// Concurrent writes by both nodes use every revision after the last, once each.
+	const writes = 20
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		revs = map[int64]bool{}
+	)
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rev, err := nodes[i%2].Create(ctx, fmt.Sprintf("/registry/concurrent/%d", i), []byte("value"), 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if revs[rev] {
+				t.Errorf("revision %d allocated twice", rev)
+			}
+			revs[rev] = true
+		}(i)
+	}
+	wg.Wait()
+	for rev := last + 1; rev <= last+writes; rev++ {
+		if !revs[rev] {
+			t.Errorf("expected revision %d to be used by a concurrent write", rev)
+		}
+	}
+}
+
+// TestTablePartitions ensures that keys under a partition prefix are stored in the partition's
+// table, and that reads and watches across the tables see a single revision space.
+func TestTablePartitions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.TablePartitions = []drivers.TablePartition{{Prefix: "/registry/events/", TableName: "kine_events"}}
+	})
+
+	start, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := backend.Watch(ctx, "/registry/", start+1)
+
+	keys := []string{"/registry/pods/a", "/registry/events/a", "/registry/pods/b", "/registry/events/b"}
+	revs := make([]int64, len(keys))
+	for i, key := range keys {
+		if revs[i], err = backend.Create(ctx, key, []byte(key), 0); err != nil {
+			t.Fatal(err)
+		}
+		if revs[i] != start+int64(i)+1 {
+			t.Fatalf("expected %s to be created at revision %d, got %d", key, start+int64(i)+1, revs[i])
+		}
+	}
+
+	// The main table also holds the health check key.
+	for table, expected := range map[string]int{"kine": 3, "kine_events": 2} {
+		var count int
+		if err := dialect.DB.QueryRow(`SELECT COUNT(*) FROM "` + table + `" WHERE name LIKE '/registry/%'`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != expected {
+			t.Errorf("expected %d keys in table %s, got %d", expected, table, count)
+		}
+	}
+	var eventsInMain int
+	if err := dialect.DB.QueryRow(`SELECT COUNT(*) FROM kine WHERE name LIKE '/registry/events/%'`).Scan(&eventsInMain); err != nil || eventsInMain != 0 {
+		t.Errorf("expected no events in main table, got %d: %v", eventsInMain, err)
+	}
+
+	rev, kvs, err := backend.List(ctx, "/registry/", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, kv := range kvs {
+		listed = append(listed, kv.Key)
+	}
+	expected := []string{"/registry/events/a", "/registry/events/b", "/registry/health", "/registry/pods/a", "/registry/pods/b"}
+	if fmt.Sprint(listed) != fmt.Sprint(expected) || rev != revs[3] {
+		t.Errorf("expected %v at revision %d, got %v at revision %d", expected, revs[3], listed, rev)
+	}
+	if _, kvs, err = backend.List(ctx, "/registry/", "", 2, 0); err != nil || len(kvs) != 2 || kvs[1].Key != "/registry/events/b" {
+		t.Errorf("expected limited list to end at /registry/events/b, got %v: %v", kvs, err)
+	}
+	if _, kvs, err = backend.List(ctx, "/registry/", "", 0, revs[1]); err != nil || len(kvs) != 3 {
+		t.Errorf("expected 3 keys at revision %d, got %v: %v", revs[1], kvs, err)
+	}
+	if _, count, err := backend.Count(ctx, "/registry/", "", 0); err != nil || count != 5 {
+		t.Errorf("expected count of 5, got %d: %v", count, err)
+	}
+	if _, kv, err := backend.Get(ctx, "/registry/events/b", "", 1, 0); err != nil || kv == nil || kv.ModRevision != revs[3] {
+		t.Errorf("expected /registry/events/b at revision %d, got %v: %v", revs[3], kv, err)
+	}
+
+	var watched []int64
+	for timeout := time.After(5 * time.Second); len(watched) < len(revs); {
+		select {
+		case events := <-history.Events:
+			for _, event := range events {
+				watched = append(watched, event.KV.ModRevision)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %v", watched)
+		}
+	}
+	if fmt.Sprint(watched) != fmt.Sprint(revs) {
+		t.Errorf("expected events at revisions %v, got %v", revs, watched)
+	}
+
+	// Transactions cannot span tables.
+	_, _, _, err = backend.(*logstructured.LogStructured).WriteBatch(ctx, []*server.Write{
+		{Key: "/registry/pods/c", Value: []byte("c")},
+		{Key: "/registry/events/c", Value: []byte("c")},
+	}, nil)
+	if !errors.Is(err, server.ErrNotSupported) {
+		t.Errorf("expected transaction across tables to be rejected, got %v", err)
+	}
+}
+
+// TestTablePartitionsWatchRace races the start of watches against the polling of writes to
+// several tables. Once an event has been delivered to one watch, the current revision includes it,
+// and a watch started at its revision receives it.
+func TestTablePartitionsWatchRace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.TablePartitions = []drivers.TablePartition{{Prefix: "/registry/events/", TableName: "kine_events"}}
+	})
+	start, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watch := backend.Watch(ctx, "/registry/", start+1)
+
+	const writes = 100
+	go func() {
+		for i := 0; i < writes; i++ {
+			key := fmt.Sprintf("/registry/pods/%d", i)
+			if i%2 == 1 {
+				key = fmt.Sprintf("/registry/events/%d", i)
+			}
+			if _, err := backend.Create(ctx, key, []byte("value"), 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for seen, timeout := 0, time.After(10*time.Second); seen < writes; {
+		select {
+		case events := <-watch.Events:
+			seen += len(events)
+			rev := events[len(events)-1].KV.ModRevision
+			if current, err := backend.CurrentRevision(ctx); err != nil || current < rev {
+				t.Errorf("expected current revision of at least %d once its event was delivered, got %d: %v", rev, current, err)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				watchCtx, watchCancel := context.WithTimeout(ctx, 5*time.Second)
+				defer watchCancel()
+				for events := range backend.Watch(watchCtx, "/registry/", rev).Events {
+					for _, event := range events {
+						if event.KV.ModRevision == rev {
+							return
+						}
+					}
+				}
+				t.Errorf("expected watch started at revision %d to receive its event", rev)
+			}()
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %d", seen)
+		}
+	}
+	wg.Wait()
+}
+
+// TestCompactRevisionRepair ensures that a compact revision greater than the current revision is
+// repaired on startup, so that compaction can proceed.
+func TestCompactRevisionRepair(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "state.db") + "?_journal=WAL&_txlock=immediate"
+	configure := func(cfg *drivers.Config) {
+		cfg.DataSourceName = dsn
+		cfg.CompactBatchSize = 1000
+	}
+	backend, dialect := newTestBackend(t, configure)
+	for i := 0; i < 5; i++ {
+		if _, err := backend.Create(ctx, fmt.Sprintf("/registry/test/%d", i), []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	minRev, err := dialect.MinRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dialect.SetCompactRevision(ctx, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	_, dialect = newTestBackend(t, configure)
+	if compactRev, err := dialect.GetCompactRevision(ctx); err != nil || compactRev != minRev-1 {
+		t.Fatalf("expected compact revision to be repaired to %d, got %d: %v", minRev-1, compactRev, err)
+	}
+}
+
+// TestListRange checks that listing and counting by range follows the etcd range semantics, as
+// covered by etcd's own range tests.
+func TestListRange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, nil)
+	lister, ok := backend.(server.RangeLister)
+	if !ok {
+		t.Fatal("expected backend to implement RangeLister")
+	}
+
+	var (
+		rev int64
+		err error
+	)
+	for _, key := range []string{"f_o", "fao", "foo", "foo/abc", "fop"} {
+		if rev, err = backend.Create(ctx, key, []byte(key), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := backend.Create(ctx, "foz", []byte("foz"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		key, rangeEnd string
+		revision      int64
+		expected      []string
+	}{
+		{name: "single key", key: "foo", expected: []string{"foo"}},
+		{name: "single missing key", key: "fo"},
+		{name: "single key with wildcard", key: "f_o", expected: []string{"f_o"}},
+		{name: "range to next key", key: "foo", rangeEnd: "foo/", expected: []string{"foo"}},
+		{name: "range", key: "foo", rangeEnd: "fop", expected: []string{"foo", "foo/abc"}},
+		{name: "prefix", key: "foo/", rangeEnd: "foo0", expected: []string{"foo/abc"}},
+		{name: "range between keys", key: "fo", rangeEnd: "fop", expected: []string{"foo", "foo/abc"}},
+		{name: "range after key", key: "foo\x00", rangeEnd: "fop", expected: []string{"foo/abc"}},
+		{name: "range through key", key: "foo", rangeEnd: "fop\x00", expected: []string{"foo", "foo/abc", "fop"}},
+		{name: "from key", key: "foo/abc", rangeEnd: "\x00", expected: []string{"foo/abc", "fop", "foz"}},
+		{name: "all keys", key: "\x00", rangeEnd: "\x00", expected: []string{"/registry/health", "f_o", "fao", "foo", "foo/abc", "fop", "foz"}},
+		{name: "all keys from empty key", key: "", rangeEnd: "\x00", expected: []string{"/registry/health", "f_o", "fao", "foo", "foo/abc", "fop", "foz"}},
+		{name: "empty range", key: "fop", rangeEnd: "fop"},
+		{name: "inverted range", key: "fop", rangeEnd: "foo"},
+		{name: "all keys at revision", key: "\x00", rangeEnd: "\x00", revision: rev, expected: []string{"/registry/health", "f_o", "fao", "foo", "foo/abc", "fop"}},
+		{name: "single key at revision", key: "foz", revision: rev},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, kvs, err := lister.ListRange(ctx, tc.key, tc.rangeEnd, 0, tc.revision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, kv := range kvs {
+				keys = append(keys, kv.Key)
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(tc.expected) {
+				t.Errorf("expected keys %v, got %v", tc.expected, keys)
+			}
+			_, count, err := lister.CountRange(ctx, tc.key, tc.rangeEnd, tc.revision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != int64(len(tc.expected)) {
+				t.Errorf("expected count %d, got %d", len(tc.expected), count)
+			}
+		})
+	}
+}
+
+// TestListAtRevision ensures that lists at a past revision return the latest value of each key at
+// that revision, omitting keys that were deleted at or before it.
+func TestListAtRevision(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, nil)
+	lister := backend.(server.RangeLister)
+
+	// Record the expected values of the keys after each write.
+	values := map[string]string{}
+	snapshots := map[int64]map[string]string{}
+	record := func(rev int64) {
+		snapshot := map[string]string{}
+		for k, v := range values {
+			snapshot[k] = v
+		}
+		snapshots[rev] = snapshot
+	}
+	revs := map[string]int64{}
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"/test/a", "/test/b", "/test/c", "/test/d"} {
+			value := fmt.Sprintf("%s-%d", key, i)
+			var (
+				rev int64
+				err error
+			)
+			if revs[key] == 0 {
+				rev, err = backend.Create(ctx, key, []byte(value), 0)
+			} else {
+				rev, _, _, err = backend.Update(ctx, key, []byte(value), revs[key], 0)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			revs[key] = rev
+			values[key] = value
+			record(rev)
+		}
+		key := fmt.Sprintf("/test/%c", 'a'+i)
+		rev, _, _, err := backend.Delete(ctx, key, revs[key])
+		if err != nil {
+			t.Fatal(err)
+		}
+		revs[key] = 0
+		delete(values, key)
+		record(rev)
+	}
+
+	for rev, snapshot := range snapshots {
+		var expected []string
+		for _, key := range []string{"/test/a", "/test/b", "/test/c", "/test/d"} {
+			if value, ok := snapshot[key]; ok {
+				expected = append(expected, key+"="+value)
+			}
+		}
+		list := func(kvs []*server.KeyValue) []string {
+			var result []string
+			for _, kv := range kvs {
+				result = append(result, kv.Key+"="+string(kv.Value))
+			}
+			return result
+		}
+
+		_, kvs, err := lister.ListRange(ctx, "/test/", "/test0", 0, rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := list(kvs); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("expected range at revision %d to return %v, got %v", rev, expected, got)
+		}
+
+		_, kvs, err = backend.List(ctx, "/test/", "", 0, rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := list(kvs); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("expected list at revision %d to return %v, got %v", rev, expected, got)
+		}
+
+		if len(expected) > 1 {
+			_, kvs, err = lister.ListRange(ctx, "/test/", "/test0", 1, rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := list(kvs); fmt.Sprint(got) != fmt.Sprint(expected[:1]) {
+				t.Errorf("expected limited range at revision %d to return %v, got %v", rev, expected[:1], got)
+			}
+			start, _, _ := strings.Cut(expected[0], "=")
+			_, kvs, err = backend.List(ctx, "/test/", start, 0, rev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := list(kvs); fmt.Sprint(got) != fmt.Sprint(expected[1:]) {
+				t.Errorf("expected list after %s at revision %d to return %v, got %v", start, rev, expected[1:], got)
+			}
+		}
+	}
+}
+
+// TestReadCache ensures that cached reads are invalidated by writes through the backend, and by
+// writes from other nodes once they are seen on the watch, and that linearizable reads bypass the
+// cache.
+func TestReadCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.ReadCacheSize = 10
+	})
+
+	key := "/registry/leases/kube-system/kube-scheduler"
+	if _, err := backend.Create(ctx, key, []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	_, kv, err := backend.Get(ctx, key, "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The update is seen on the watch used to invalidate the cache, which would drop the read
+	// below if it arrived later, so wait for the update to be seen on a watch first.
+	wr := backend.Watch(ctx, key, 0)
+	rev, _, updated, err := backend.Update(ctx, key, []byte("b"), kv.ModRevision, 0)
+	if err != nil || !updated {
+		t.Fatalf("expected update to succeed, got updated=%v err=%v", updated, err)
+	}
+	for seen := false; !seen; {
+		select {
+		case events := <-wr.Events:
+			for _, event := range events {
+				seen = seen || event.KV.ModRevision == rev
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for update to be seen on the watch")
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, kv, err = backend.Get(ctx, key, "", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(kv.Value) != "b" {
+		t.Fatalf("expected value b after update, got %s", kv.Value)
+	}
+
+	// Write the key directly, as another node would.
+	if _, err := dialect.Insert(ctx, key, false, false, kv.CreateRevision, kv.ModRevision, 0, []byte("c"), kv.Value); err != nil {
+		t.Fatal(err)
+	}
+	if _, kv, err = backend.Get(ctx, key, "", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(kv.Value) != "b" {
+		t.Fatalf("expected cached value b, got %s", kv.Value)
+	}
+	// Linearizable reads are not served from the cache.
+	if _, primary, err := backend.Get(server.WithPrimaryRead(ctx), key, "", 1, 0); err != nil {
+		t.Fatal(err)
+	} else if string(primary.Value) != "c" {
+		t.Fatalf("expected linearizable read to return value c, got %s", primary.Value)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for string(kv.Value) != "c" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected value c once the write was seen on the watch, got %s", kv.Value)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, kv, err = backend.Get(ctx, key, "", 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAdmissionHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errBlocked := status.Error(codes.PermissionDenied, "blocked")
+	backend, _ := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.AdmissionHooks = []logstructured.AdmissionHook{
+			logstructured.AdmissionHookFunc(func(_ context.Context, req logstructured.WriteRequest) error {
+				if req.ValueSize > 4 {
+					return errors.New("value too large")
+				}
+				return nil
+			}),
+			logstructured.AdmissionHookFunc(func(_ context.Context, req logstructured.WriteRequest) error {
+				if req.Operation == logstructured.OperationDelete && req.Key == "/registry/protected" {
+					return errBlocked
+				}
+				return nil
+			}),
+		}
+	})
+
+	rev, err := backend.Create(ctx, "/registry/protected", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Create(ctx, "/registry/large", []byte("large"), 0); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected create of large value to fail with FailedPrecondition, got %v", err)
+	}
+	if _, _, _, err := backend.Update(ctx, "/registry/protected", []byte("large"), rev, 0); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected update to large value to fail with FailedPrecondition, got %v", err)
+	}
+	if _, _, _, err := backend.Delete(ctx, "/registry/protected", rev); err != errBlocked {
+		t.Fatalf("expected delete to be blocked, got %v", err)
+	}
+	if _, _, updated, err := backend.Update(ctx, "/registry/protected", []byte("b"), rev, 0); err != nil || !updated {
+		t.Fatalf("expected update to succeed, got updated=%v err=%v", updated, err)
+	}
+}
+
+func TestSkipSchemaSetup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := testConfig(t, func(cfg *drivers.Config) {
+		cfg.SkipSchemaSetup = true
+	})
+	if _, _, err := NewVariant(ctx, "sqlite3", cfg); err == nil || !strings.Contains(err.Error(), "table kine") {
+		t.Fatalf("expected error for missing table, got %v", err)
+	}
+
+	cfg.SkipSchemaSetup = false
+	_, dialect, err := NewVariant(ctx, "sqlite3", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialect.DB.Exec(`DROP INDEX kine_name_index`); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.SkipSchemaSetup = true
+	if _, _, err := NewVariant(ctx, "sqlite3", cfg); err == nil || !strings.Contains(err.Error(), "missing index kine_name_index") {
+		t.Fatalf("expected error for missing index, got %v", err)
+	}
+	if _, err := dialect.DB.Exec(`CREATE INDEX kine_name_index ON kine (name)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewVariant(ctx, "sqlite3", cfg); err != nil {
+		t.Fatalf("expected existing schema to be valid, got %v", err)
+	}
+}
+
+// TestCompactBatchDelay checks that compaction pauses between batches, and that each batch is
+// committed as it completes.
+func TestCompactBatchDelay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchDelay = 100 * time.Millisecond
+	})
+
+	var (
+		rev int64
+		err error
+	)
+	for i := 0; i < 250; i++ {
+		if rev, err = backend.Create(ctx, fmt.Sprintf("/key/%d", i), []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = backend.Delete(ctx, fmt.Sprintf("/key/%d", i), rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The revision is read from the database, as the backend's current revision may not yet have
+	// caught up with the last write.
+	rev, err = dialect.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compact the first batch's worth of revisions in the background, and check that it has been
+	// committed while the compaction is paused before the next batch.
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		_, err := backend.Compact(ctx, rev)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if compactRev, err := dialect.GetCompactRevision(ctx); err != nil {
+		t.Fatal(err)
+	} else if compactRev == 0 || compactRev >= rev {
+		t.Errorf("expected first batch to be committed while paused, got compact revision %d of %d", compactRev, rev)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// Five batches of 100 revisions are separated by four delays.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected compaction to pause between batches, completed in %v", elapsed)
+	}
+	if compactRev, err := dialect.GetCompactRevision(ctx); err != nil {
+		t.Fatal(err)
+	} else if compactRev != rev {
+		t.Errorf("expected compact revision %d, got %d", rev, compactRev)
+	}
+}
+
+// TestOmitPrevValue ensures that the previous value is not stored for updates of keys with an
+// omitted prefix, and that watches do not report an empty previous value for them.
+func TestOmitPrevValue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, dialect := newTestBackend(t, func(cfg *drivers.Config) {
+		cfg.CompactBatchSize = 1000
+		cfg.OmitPrevValuePrefixes = []string{"/registry/leases/"}
+	})
+
+	watch := backend.Watch(ctx, "/registry/", 0)
+	var last int64
+	for _, key := range []string{"/registry/leases/a", "/registry/pods/a"} {
+		rev, err := backend.Create(ctx, key, []byte("v1"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev, _, _, err = backend.Update(ctx, key, []byte("v2"), rev, 0); err != nil {
+			t.Fatal(err)
+		}
+		if last, _, _, err = backend.Delete(ctx, key, rev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stored int
+	if err := dialect.DB.QueryRow(`SELECT COUNT(*) FROM kine WHERE name = '/registry/leases/a' AND old_value IS NOT NULL`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Fatalf("expected the previous value to only be stored for the delete, got %d rows", stored)
+	}
+
+	var events []*server.Event
+	for timeout := time.After(5 * time.Second); len(events) == 0 || events[len(events)-1].KV.ModRevision < last; {
+		select {
+		case batch := <-watch.Events:
+			events = append(events, batch...)
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %d", len(events))
+		}
+	}
+	if len(events) != 6 {
+		t.Fatalf("expected 6 events, got %d", len(events))
+	}
+	if events[1].PrevKV != nil {
+		t.Errorf("expected no previous value for update of omitted key, got %v", events[1].PrevKV)
+	}
+	for i, event := range events[2:] {
+		if !event.Create && (event.PrevKV == nil || string(event.PrevKV.Value) == "") {
+			t.Errorf("expected previous value for event %d of %s, got %v", i+2, event.KV.Key, event.PrevKV)
+		}
+	}
+}
+
+// modifyingBackend updates a key just before the first write is applied, as another client would
+// between a transaction comparing the key and applying its writes.
+type modifyingBackend struct {
+	server.Backend
+	t    *testing.T
+	key  string
+	once sync.Once
+}
+
+func (b *modifyingBackend) modify(ctx context.Context) {
+	b.once.Do(func() {
+		_, kv, err := b.Backend.Get(ctx, b.key, "", 1, 0)
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		if _, _, ok, err := b.Backend.Update(ctx, b.key, []byte("modified"), kv.ModRevision, 0); err != nil || !ok {
+			b.t.Fatalf("expected %s to be updated, got %v, %v", b.key, ok, err)
+		}
+	})
+}
+
+func (b *modifyingBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	b.modify(ctx)
+	return b.Backend.Create(ctx, key, value, lease)
+}
+
+func (b *modifyingBackend) WriteBatch(ctx context.Context, writes []*server.Write, conditions []*server.Condition) (int64, []*server.KeyValue, bool, error) {
+	b.modify(ctx)
+	return b.Backend.(server.BatchWriter).WriteBatch(ctx, writes, conditions)
+}
+
+// TestTxnCompareOnlyKeyModified ensures that the writes of a transaction are not applied if a key
+// that it only compares is modified before the writes are applied, and that the transaction is
+// evaluated again against the modified key.
+func TestTxnCompareOnlyKeyModified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, nil)
+	if _, err := backend.Create(ctx, "/a", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range [][]string{{"/b"}, {"/c", "/d"}} {
+		txn := &etcdserverpb.TxnRequest{
+			Compare: []*etcdserverpb.Compare{{
+				Key:         []byte("/a"),
+				Target:      etcdserverpb.Compare_VALUE,
+				Result:      etcdserverpb.Compare_EQUAL,
+				TargetUnion: &etcdserverpb.Compare_Value{Value: []byte("1")},
+			}},
+		}
+		for _, key := range keys {
+			txn.Success = append(txn.Success, &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{
+				RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("x")},
+			}})
+		}
+
+		if _, kv, err := backend.Get(ctx, "/a", "", 1, 0); err != nil || kv == nil {
+			t.Fatalf("expected /a to exist, got %v, %v", kv, err)
+		} else if _, _, ok, err := backend.Update(ctx, "/a", []byte("1"), kv.ModRevision, 0); err != nil || !ok {
+			t.Fatalf("expected /a to be reset, got %v, %v", ok, err)
+		}
+
+		kv := server.New(&modifyingBackend{Backend: backend, t: t, key: "/a"}, server.Config{NotifyInterval: time.Second})
+		resp, err := kv.Txn(ctx, txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Succeeded {
+			t.Errorf("expected txn writing %v to fail once /a was modified", keys)
+		}
+		for _, key := range keys {
+			if _, kv, err := backend.Get(ctx, key, "", 1, 0); err != nil || kv != nil {
+				t.Errorf("expected %s not to be written, got %v, %v", key, kv, err)
+			}
+		}
+	}
+}
+
+// racingDialect calls race once the keys compared by a batch write have been read within its
+// transaction, before the writes are committed.
+type racingDialect struct {
+	*generic.Generic
+	race func()
+}
+
+func (d *racingDialect) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
+	tx, err := d.Generic.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &racingTx{Transaction: tx, race: d.race}, nil
+}
+
+type racingTx struct {
+	server.Transaction
+	race func()
+}
+
+func (t *racingTx) ListRange(ctx context.Context, start, end string) (server.Rows, error) {
+	rows, err := t.Transaction.ListRange(ctx, start, end)
+	if err == nil {
+		t.race()
+	}
+	return rows, err
+}
+
+// TestBatchWriteCompareRace ensures that a key that a batch write compares but does not write
+// cannot be modified by another node between the check of the comparison and the commit of the
+// writes: either the batch is not applied, or the other write is ordered after it.
+func TestBatchWriteCompareRace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	other, dialect := newTestBackend(t, nil)
+	revY, err := other.Create(ctx, "/y", []byte("1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		once    sync.Once
+		updated = make(chan struct{})
+		revB    int64
+		okB     bool
+		errB    error
+	)
+	race := func() {
+		once.Do(func() {
+			go func() {
+				defer close(updated)
+				revB, _, okB, errB = other.Update(ctx, "/y", []byte("2"), revY, 0)
+			}()
+			// Give the other node's write time to commit, if it is not blocked by the batch.
+			select {
+			case <-updated:
+			case <-time.After(200 * time.Millisecond):
+			}
+		})
+	}
+	backend := logstructured.New(sqllog.New(&racingDialect{Generic: dialect, race: race}, sqllog.Config{
+		CompactInterval:  time.Minute,
+		CompactTimeout:   time.Minute,
+		CompactBatchSize: 100,
+		PollBatchSize:    500,
+	}), 0, nil)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rev, _, ok, err := backend.WriteBatch(ctx,
+		[]*server.Write{{Key: "/x", Value: []byte("x")}, {Key: "/z", Value: []byte("z")}},
+		[]*server.Condition{{Key: "/y", Revisions: map[string]int64{"/y": revY}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-updated
+	if errB != nil || !okB {
+		t.Fatalf("expected /y to be updated by the other node, got %v, %v", okB, errB)
+	}
+
+	if !ok {
+		if _, kv, err := other.Get(ctx, "/x", "", 1, 0); err != nil || kv != nil {
+			t.Errorf("expected /x not to be written by the failed batch, got %v, %v", kv, err)
+		}
+		return
+	}
+	if revB <= rev {
+		t.Errorf("expected update of compared key /y at revision %d to be ordered after the batch at revision %d", revB, rev)
+	}
+}
+
+// TestTxnValueCompare evaluates transactions that compare values against the stored keys, as in
+// etcd's transaction tests: the branch is selected by comparing the stored bytes, all of the
+// writes of the selected branch are applied together, and none are applied if any operation in
+// the branch fails. A key that does not exist is compared as an empty value.
+func TestTxnValueCompare(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, _ := newTestBackend(t, nil)
+	large := make([]byte, 1024*1024)
+	for key, value := range map[string][]byte{"/a": []byte("b"), "/large": large} {
+		if _, err := backend.Create(ctx, key, value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kv := server.New(backend, server.Config{NotifyInterval: time.Second})
+
+	put := func(key, value string) *etcdserverpb.RequestOp {
+		return &etcdserverpb.RequestOp{Request: &etcdserverpb.RequestOp_RequestPut{
+			RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte(value)},
+		}}
+	}
+	tests := []struct {
+		key       string
+		result    etcdserverpb.Compare_CompareResult
+		value     []byte
+		succeeded bool
+	}{
+		{"/a", etcdserverpb.Compare_EQUAL, []byte("b"), true},
+		{"/a", etcdserverpb.Compare_EQUAL, []byte("c"), false},
+		{"/a", etcdserverpb.Compare_NOT_EQUAL, []byte("c"), true},
+		{"/a", etcdserverpb.Compare_GREATER, []byte("a"), true},
+		{"/a", etcdserverpb.Compare_GREATER, []byte("b"), false},
+		{"/a", etcdserverpb.Compare_LESS, []byte("c"), true},
+		{"/a", etcdserverpb.Compare_LESS, []byte("b"), false},
+		{"/missing", etcdserverpb.Compare_EQUAL, nil, true},
+		{"/missing", etcdserverpb.Compare_EQUAL, []byte("b"), false},
+		{"/missing", etcdserverpb.Compare_LESS, []byte("b"), true},
+		{"/large", etcdserverpb.Compare_EQUAL, large, true},
+		{"/large", etcdserverpb.Compare_LESS, append(large, 0), true},
+		{"/large", etcdserverpb.Compare_NOT_EQUAL, large, false},
+	}
+	for i, test := range tests {
+		success, failure := fmt.Sprintf("/success/%d", i), fmt.Sprintf("/failure/%d", i)
+		resp, err := kv.Txn(ctx, &etcdserverpb.TxnRequest{
+			Compare: []*etcdserverpb.Compare{{
+				Key:         []byte(test.key),
+				Target:      etcdserverpb.Compare_VALUE,
+				Result:      test.result,
+				TargetUnion: &etcdserverpb.Compare_Value{Value: test.value},
+			}},
+			Success: []*etcdserverpb.RequestOp{put(success+"/1", "x"), put(success+"/2", "y")},
+			Failure: []*etcdserverpb.RequestOp{put(failure+"/1", "x"), put(failure+"/2", "y")},
+		})
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if resp.Succeeded != test.succeeded {
+			t.Errorf("Test %d: expected %s %s compare to succeed: %v, got %v", i, test.key, test.result, test.succeeded, resp.Succeeded)
+		}
+		written, other := success, failure
+		if !test.succeeded {
+			written, other = failure, success
+		}
+		if _, kvs, err := backend.List(ctx, written+"/", "", 0, 0); err != nil || len(kvs) != 2 {
+			t.Errorf("Test %d: expected both writes under %s, got %d, %v", i, written, len(kvs), err)
+		}
+		if _, kvs, err := backend.List(ctx, other+"/", "", 0, 0); err != nil || len(kvs) != 0 {
+			t.Errorf("Test %d: expected no writes under %s, got %d, %v", i, other, len(kvs), err)
+		}
+	}
+
+	// An operation that fails after earlier operations in the branch have been evaluated fails the
+	// whole transaction, without applying any of its writes.
+	_, err := kv.Txn(ctx, &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte("/a"),
+			Target:      etcdserverpb.Compare_VALUE,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_Value{Value: []byte("b")},
+		}},
+		Success: []*etcdserverpb.RequestOp{
+			put("/a", "c"),
+			put("/partial", "x"),
+			{Request: &etcdserverpb.RequestOp_RequestPut{
+				RequestPut: &etcdserverpb.PutRequest{Key: []byte("/missing"), IgnoreValue: true},
+			}},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected txn updating the value of a missing key to fail")
+	}
+	if _, kv, err := backend.Get(ctx, "/a", "", 1, 0); err != nil || kv == nil || string(kv.Value) != "b" {
+		t.Errorf("expected /a to be unchanged, got %v, %v", kv, err)
+	}
+	if _, kv, err := backend.Get(ctx, "/partial", "", 1, 0); err != nil || kv != nil {
+		t.Errorf("expected /partial not to be written, got %v, %v", kv, err)
+	}
+}
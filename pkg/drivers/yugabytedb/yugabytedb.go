@@ -0,0 +1,203 @@
+package yugabytedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // sql driver
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/pgsql"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDSN is the address of a local YugabyteDB YSQL server, with the default credentials.
+const defaultDSN = "yugabyte:yugabyte@localhost:5433/"
+
+// getSchema returns the YugabyteDB table schema. YugabyteDB hash shards tables and indexes on
+// their first column unless an order is given, which would turn the range scans by id and name
+// used for polling, listing and compaction into full table scans, so every key column is range
+// sharded by giving it an explicit order.
+//
+// The id column is backed by an explicit sequence with a cache of one. YugabyteDB caches
+// sequence values on each connection, so that with a larger cache, revisions are not allocated
+// in the order that they are written, and watchers see gaps in the log that have to be filled.
+// Note that the cache size is raised to the ysql_sequence_cache_minval flag of the tablet
+// servers, which must also be set to 1.
+func getSchema(tableName string) []string {
+	return []string{
+		`CREATE SEQUENCE IF NOT EXISTS "` + tableName + `_id_seq" CACHE 1`,
+		`CREATE TABLE IF NOT EXISTS "` + tableName + `"
+			(
+				id BIGINT DEFAULT nextval('"` + tableName + `_id_seq"'),
+				name TEXT COLLATE "C",
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease INTEGER,
+				value BYTEA,
+				old_value BYTEA,
+				CONSTRAINT "` + tableName + `_pkey" PRIMARY KEY (id ASC)
+			)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_name_index" ON "` + tableName + `" (name ASC)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_name_id_index" ON "` + tableName + `" (name ASC, id ASC)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_id_deleted_index" ON "` + tableName + `" (id ASC, deleted ASC)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_prev_revision_index" ON "` + tableName + `" (prev_revision ASC)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "` + tableName + `_name_prev_revision_uindex" ON "` + tableName + `" (name ASC, prev_revision ASC)`,
+		`CREATE INDEX IF NOT EXISTS "` + tableName + `_list_query_index" ON "` + tableName + `" (name ASC, id DESC, deleted ASC)`,
+	}
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (bool, server.Backend, error) {
+	dataSourceName := cfg.DataSourceName
+	if dataSourceName == "" {
+		dataSourceName = defaultDSN
+	}
+	parsedDSN, err := pgsql.PrepareDSN(dataSourceName, cfg.DatabaseName, cfg.BackendTLSConfig, cfg.PostgresConfig)
+	if err != nil {
+		return false, nil, err
+	}
+	credentials, err := generic.FetchCredentials(ctx, cfg.CredentialConfig.Provider)
+	if err != nil {
+		return false, nil, err
+	}
+	if parsedDSN, err = generic.URLCredentials(parsedDSN, credentials); err != nil {
+		return false, nil, err
+	}
+	pgsql.LogDSN("yugabytedb", parsedDSN)
+
+	// An existing connection pool is already connected to the database.
+	if !cfg.SkipSchemaSetup && cfg.ConnectionPoolConfig.DB == nil {
+		if err := pgsql.CreateDBIfNotExist(ctx, parsedDSN, cfg.ConnectionPoolConfig.MaxConnectWait, cfg.ConnectionPoolConfig.SetupTimeout); err != nil {
+			return false, nil, err
+		}
+	}
+
+	tableName := cfg.TableName
+	if tableName == "" {
+		tableName = "kine"
+	}
+
+	connector, err := generic.ReloadingConnector(ctx, cfg.Scheme, dataSourceName, cfg.EndpointFile, cfg.CredentialConfig, func(dataSourceName string, credentials *generic.Credentials) (driver.Connector, error) {
+		parsedDSN, err := pgsql.PrepareDSN(dataSourceName, cfg.DatabaseName, cfg.BackendTLSConfig, cfg.PostgresConfig)
+		if err != nil {
+			return nil, err
+		}
+		if parsedDSN, err = generic.URLCredentials(parsedDSN, credentials); err != nil {
+			return nil, err
+		}
+		return generic.DSNConnector("pgx", parsedDSN)
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	dialect, err := generic.OpenConnector(ctx, "pgx", connector, cfg.ConnectionPoolConfig, "$", true, cfg.MetricsRegisterer, tableName)
+	if err != nil {
+		return false, nil, err
+	}
+	dialect.DatabaseName = pgsql.DatabaseName(parsedDSN)
+
+	// Rows inserted with an explicit id do not advance the id sequence.
+	dialect.AdvanceRevisionSQL = dialect.Rebind(`SELECT setval('"` + tableName + `_id_seq"', GREATEST(?, (SELECT last_value FROM "` + tableName + `_id_seq")))`)
+	// YugabyteDB does not report the size of tables stored in DocDB, so the size is estimated
+	// from the size of the rows, as with the compaction dry run.
+	dialect.GetSizeSQL = `
+		SELECT COALESCE(SUM(LENGTH(kv.name) + COALESCE(LENGTH(kv.value), 0) + COALESCE(LENGTH(kv.old_value), 0)), 0)::BIGINT
+		FROM "` + tableName + `" AS kv`
+	// The multi-table DELETE ... USING join is not pushed down to DocDB, so select the rows to
+	// delete with a subquery instead. Space is reclaimed by DocDB compactions, so there is no
+	// defragmentation statement.
+	dialect.CompactSQL = dialect.Rebind(`
+		DELETE FROM "` + tableName + `"
+		WHERE
+			id IN (
+				SELECT kp.prev_revision AS id
+				FROM "` + tableName + `" AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM "` + tableName + `" AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			) AND
+			(deleted = 0 OR id <= ?)`)
+	dialect.FillRetryDuration = time.Millisecond + 5
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*pgconn.PgError); ok {
+			return err.Code
+		}
+		return err.Error()
+	}
+	// YugabyteDB asks the client to retry transactions that conflict with another transaction,
+	// or that must be restarted to read a consistent snapshot across nodes, with a serialization
+	// failure.
+	dialect.Retry = func(err error) bool {
+		return dialect.ErrCode(err) == pgerrcode.SerializationFailure
+	}
+	dialect.RetryErrCodes = []string{pgerrcode.SerializationFailure, pgerrcode.DeadlockDetected}
+	dialect.WriteRetryAttempts = cfg.WriteRetryAttempts
+	dialect.WriteRetryBackoff = cfg.WriteRetryBackoff
+	dialect.InsertRetry = func(err error) bool {
+		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation && err.ConstraintName == tableName+"_pkey" {
+			return true
+		}
+		return dialect.Retry(err)
+	}
+	dialect.TranslateErr = func(err error) error {
+		if err, ok := err.(*pgconn.PgError); ok && err.Code == pgerrcode.UniqueViolation {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+
+	if cfg.SkipSchemaSetup {
+		if err := generic.ValidateSchema(dialect.DB, tableName, getSchema(tableName), pgsql.IndexesSQL); err != nil {
+			return false, nil, err
+		}
+	} else if err := pgsql.CreateSchemaIfNotExist(ctx, dialect.DB, cfg.PostgresConfig.Schema); err != nil {
+		return false, nil, err
+	} else if err := setup(dialect.DB, tableName); err != nil {
+		return false, nil, err
+	}
+
+	dialect.Migrate(context.Background())
+	return true, logstructured.New(sqllog.New(dialect, cfg.SQLLogConfig()), cfg.ReadCacheSize, cfg.AdmissionHooks), nil
+}
+
+// setup creates the table schema and indexes. LISTEN and NOTIFY are not supported by
+// YugabyteDB, so no insert notification trigger is installed, and changes are discovered by
+// polling.
+func setup(db *sql.DB, tableName string) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	for _, stmt := range getSchema(tableName) {
+		util.TraceSQL("SETUP EXEC", stmt, nil, nil)
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+func init() {
+	drivers.Register("yugabytedb", New)
+}
@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// prefix marks a stored value as encrypted. The full format of an encrypted value is
+// prefix + keyID + ":" + nonce + ciphertext, where the ciphertext includes the GCM tag.
+const prefix = "kine:enc:aesgcm:v1:"
+
+// minSealedSize is the length of the nonce and GCM tag that follow the key ID of every encrypted
+// value.
+const minSealedSize = 12 + 16
+
+// Transformer encrypts values before they are written to the datastore, and decrypts them after
+// they are read. The key name is passed as additional data, so that a stored value cannot be
+// moved to a different key without detection.
+type Transformer interface {
+	Encrypt(key string, value []byte) ([]byte, error)
+	Decrypt(key string, value []byte) ([]byte, error)
+}
+
+// Keyring is an AES-GCM Transformer holding one or more keys. New values are always encrypted
+// with the primary key; the remaining keys are only used to decrypt values written before the
+// primary key was rotated.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring using the provided keys, indexed by key ID. The primary key ID must
+// be present in the key map. Keys must be 16, 24, or 32 bytes long, to select AES-128, AES-192, or AES-256.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{
+		primary: primary,
+		keys:    map[string]cipher.AEAD{},
+	}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key ID %q: must be non-empty and must not contain ':'", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid encryption key %q", id)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid encryption key %q", id)
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[primary]; !ok {
+		return nil, fmt.Errorf("primary encryption key %q not found", primary)
+	}
+	return k, nil
+}
+
+// LoadKeyFile loads a Keyring from a file containing one key per line, in the format
+// <key ID>:<base64-encoded key>. The first key in the file is the primary key.
+// Blank lines and lines starting with '#' are ignored.
+func LoadKeyFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read encryption key file")
+	}
+
+	var primary string
+	keys := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid encryption key on line %d: expected <key ID>:<base64-encoded key>", line)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, fmt.Errorf("duplicate encryption key ID %q on line %d", id, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid encryption key on line %d", line)
+		}
+		if primary == "" {
+			primary = id
+		}
+		keys[id] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read encryption key file")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no keys found in encryption key file")
+	}
+
+	return NewKeyring(primary, keys)
+}
+
+// Encrypt encrypts the value using the primary key. Empty values are stored as-is, as there is
+// nothing to protect and kine relies on empty values for deleted and internal keys.
+func (k *Keyring) Encrypt(key string, value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+
+	aead := k.keys[k.primary]
+	header := prefix + k.primary + ":"
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(value)+aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	return aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+// Decrypt decrypts a value that was encrypted by any of the keys in the keyring. Values without
+// the encryption prefix are returned unmodified, so that existing plaintext rows remain readable
+// after encryption is enabled. Once encryption is enabled, every value that is not empty is
+// encrypted, including values that start with the prefix, so a plaintext value with the prefix
+// can only have been written before encryption was enabled; such values are also returned
+// unmodified if they do not hold a key ID followed by at least a nonce and tag.
+func (k *Keyring) Decrypt(key string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(prefix)) {
+		return value, nil
+	}
+
+	rest := value[len(prefix):]
+	i := bytes.IndexByte(rest, ':')
+	if i <= 0 {
+		return value, nil
+	}
+	id := string(rest[:i])
+	rest = rest[i+1:]
+	aead, ok := k.keys[id]
+	if !ok {
+		if len(rest) < minSealedSize {
+			return value, nil
+		}
+		return nil, fmt.Errorf("failed to decrypt value for key %s: unknown encryption key %q", key, id)
+	}
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return value, nil
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt value for key %s with encryption key %q", key, id)
+	}
+	return plaintext, nil
+}
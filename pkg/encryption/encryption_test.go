@@ -0,0 +1,156 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, primary string, ids ...string) *Keyring {
+	t.Helper()
+	keys := map[string][]byte{}
+	for _, id := range append(ids, primary) {
+		keys[id] = bytes.Repeat([]byte(id[:1]), 32)
+	}
+	k, err := NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := newTestKeyring(t, "a")
+	for _, value := range [][]byte{
+		[]byte("value"),
+		[]byte(prefix),
+		[]byte(prefix + "a:plaintext that looks encrypted"),
+		bytes.Repeat([]byte{0}, 1024*1024),
+	} {
+		encrypted, err := k.Encrypt("/key", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(encrypted, []byte(prefix+"a:")) || bytes.Contains(encrypted[len(prefix)+2:], value) {
+			t.Errorf("expected %.32q to be encrypted with key a, got %.64q", value, encrypted)
+		}
+		decrypted, err := k.Decrypt("/key", encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, value) {
+			t.Errorf("expected %.32q after round trip, got %.32q", value, decrypted)
+		}
+	}
+
+	if encrypted, err := k.Encrypt("/key", nil); err != nil || len(encrypted) != 0 {
+		t.Errorf("expected empty value to be stored as-is, got %q, %v", encrypted, err)
+	}
+}
+
+func TestDecryptPlaintext(t *testing.T) {
+	k := newTestKeyring(t, "a")
+	for _, value := range []string{
+		"value",
+		"",
+		prefix,
+		prefix + "no key ID",
+		prefix + ":empty key ID",
+		prefix + "a:short",
+		prefix + "unknown:short",
+	} {
+		decrypted, err := k.Decrypt("/key", []byte(value))
+		if err != nil {
+			t.Errorf("expected plaintext %q to be returned unmodified, got error %v", value, err)
+		} else if string(decrypted) != value {
+			t.Errorf("expected plaintext %q to be returned unmodified, got %q", value, decrypted)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	encrypted, err := newTestKeyring(t, "a").Encrypt("/key", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A different key with the same ID fails authentication.
+	other, err := NewKeyring("a", map[string][]byte{"a": bytes.Repeat([]byte("z"), 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Decrypt("/key", encrypted); err == nil {
+		t.Error("expected decryption with a different key to fail")
+	}
+
+	// The key name is authenticated, so a value cannot be moved to another key.
+	if _, err := newTestKeyring(t, "a").Decrypt("/other", encrypted); err == nil {
+		t.Error("expected decryption of a value moved to another key to fail")
+	}
+
+	// A value encrypted with a key that is not in the keyring is not returned as plaintext.
+	if _, err := newTestKeyring(t, "b").Decrypt("/key", encrypted); err == nil || !strings.Contains(err.Error(), "unknown encryption key") {
+		t.Errorf("expected unknown encryption key error, got %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, err := newTestKeyring(t, "a").Encrypt("/key", []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestKeyring(t, "b", "a")
+	if decrypted, err := rotated.Decrypt("/key", old); err != nil || string(decrypted) != "old" {
+		t.Errorf("expected value encrypted with the previous key to be decrypted, got %q, %v", decrypted, err)
+	}
+	encrypted, err := rotated.Encrypt("/key", []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(encrypted, []byte(prefix+"b:")) {
+		t.Errorf("expected new value to be encrypted with the primary key, got %q", encrypted)
+	}
+
+	if _, err := newTestKeyring(t, "b").Decrypt("/key", old); err == nil {
+		t.Error("expected value encrypted with a removed key to fail to decrypt")
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("k"), 32))
+	tests := []struct {
+		content string
+		primary string
+		err     string
+	}{
+		{"# keys\n\nb:" + key + "\na:" + key + "\n", "b", ""},
+		{"", "", "no keys found"},
+		{"a" + key, "", "expected <key ID>:<base64-encoded key>"},
+		{"a:" + key + "\na:" + key, "", "duplicate encryption key ID"},
+		{"a:not base64", "", "invalid encryption key on line 1"},
+		{"a:" + base64.StdEncoding.EncodeToString([]byte("short")), "", "invalid encryption key \"a\""},
+	}
+	for i, test := range tests {
+		path := filepath.Join(t.TempDir(), "keys")
+		if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		k, err := LoadKeyFile(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Test %d: expected error containing %q, got %v", i, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if k.primary != test.primary || len(k.keys) != 2 {
+			t.Errorf("Test %d: expected primary key %q of 2 keys, got %q of %d", i, test.primary, k.primary, len(k.keys))
+		}
+	}
+}
@@ -2,6 +2,7 @@ package endpoint
 
 import (
 	"context"
+	"io"
 	"net"
 	"os"
 	"strings"
@@ -9,14 +10,18 @@ import (
 
 	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/encryption"
+	"github.com/k3s-io/kine/pkg/logstructured"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/tracing"
 	"github.com/k3s-io/kine/pkg/util"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/server/v3/embed"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
@@ -29,42 +34,156 @@ const (
 type Config struct {
 	GRPCServer            *grpc.Server
 	Listener              string
+	AdditionalListeners   []ListenerConfig
 	Endpoint              string
+	EndpointFile          string
+	ReplicaEndpoints      []string
 	TableName             string
+	DatabaseName          string
 	ConnectionPoolConfig  generic.ConnectionPoolConfig
+	CredentialConfig      generic.CredentialConfig
 	ServerTLSConfig       tls.Config
 	BackendTLSConfig      tls.Config
 	MetricsRegisterer     prometheus.Registerer
 	NotifyInterval        time.Duration
+	QuotaBackendBytes     int64
+	ReadOnly              bool
+	AdvertiseClientURLs   []string
+	MaxConcurrentReads    int
+	MaxConcurrentWrites   int
+	GRPCMaxRecvMsgSize    int
+	GRPCMaxSendMsgSize    int
+	GRPCKeepAliveInterval time.Duration
+	GRPCKeepAliveTimeout  time.Duration
+	GRPCMaxConnectionIdle time.Duration
 	EmulatedETCDVersion   string
 	CompactInterval       time.Duration
+	CompactMinInterval    time.Duration
 	CompactIntervalJitter int
 	CompactTimeout        time.Duration
 	CompactMinRetain      int64
+	CompactRetention      time.Duration
 	CompactBatchSize      int64
+	CompactMaxBatchSize   int64
+	CompactBatchDelay     time.Duration
+	CompactDryRun         bool
+	CompactRepair         bool
 	PollBatchSize         int64
+	PollMaxInterval       time.Duration
+	OmitPrevValuePrefixes []string
+	InsertBatchWindow     time.Duration
+	InsertBatchWrites     bool
+	KeyPrefixMetricsLimit int
+	WatchBufferSize       int
+	ReadCacheSize         int
+	WriteRetryAttempts    int
+	WriteRetryBackoff     time.Duration
+	WatchReplayBufferSize int
+	WatchCoalesceWindow   time.Duration
+	NameColumnLength      int
+	SkipSchemaSetup       bool
+	SchemaRequireLatest   bool
 	LogFormat             string
+	LogSQLArgs            string
+	EncryptionKeyFile     string
+	AdmissionHooks        []logstructured.AdmissionHook
+	SQLiteConfig          drivers.SQLiteConfig
+	LibSQLConfig          drivers.LibSQLConfig
+	CloudSQLConfig        drivers.CloudSQLConfig
+	MySQLConfig           drivers.MySQLConfig
+	PostgresConfig        drivers.PostgresConfig
+	HealthAddress         string
+	ShutdownTimeout       time.Duration
+
+	// CompactDeletedRetention keeps deleted rows from being compacted until they are older than
+	// this period.
+	CompactDeletedRetention time.Duration
+
+	// TablePartitions store the keys under their prefixes in tables of their own.
+	TablePartitions []drivers.TablePartition
+}
+
+// ListenerConfig is an additional address on which the etcd API is served, with its own server
+// TLS configuration.
+type ListenerConfig struct {
+	Address         string
+	ServerTLSConfig tls.Config
 }
 
 type ETCDConfig struct {
 	Endpoints   []string
 	TLSConfig   tls.Config
 	LeaderElect bool
+	// Stopped is closed once kine has shut down after the context passed to Listen is done.
+	// It is nil if kine is not serving the etcd API itself.
+	Stopped <-chan struct{}
 }
 
 func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
+	if config.EndpointFile != "" {
+		if config.Endpoint != "" {
+			return ETCDConfig{}, errors.New("datastore endpoint and endpoint file cannot both be set")
+		}
+		endpoint, err := generic.ReadEndpointFile(config.EndpointFile)
+		if err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "reading datastore endpoint file")
+		}
+		config.Endpoint = endpoint
+	}
+
+	var transformer encryption.Transformer
+	if config.EncryptionKeyFile != "" {
+		keyring, err := encryption.LoadKeyFile(config.EncryptionKeyFile)
+		if err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "loading encryption keys")
+		}
+		transformer = keyring
+	}
+
 	leaderElect, backend, err := drivers.New(ctx, &drivers.Config{
 		MetricsRegisterer:     config.MetricsRegisterer,
 		Endpoint:              config.Endpoint,
+		EndpointFile:          config.EndpointFile,
+		ReplicaEndpoints:      config.ReplicaEndpoints,
 		TableName:             config.TableName,
+		DatabaseName:          config.DatabaseName,
 		BackendTLSConfig:      config.BackendTLSConfig,
 		ConnectionPoolConfig:  config.ConnectionPoolConfig,
+		CredentialConfig:      config.CredentialConfig,
 		CompactInterval:       config.CompactInterval,
+		CompactMinInterval:    config.CompactMinInterval,
 		CompactIntervalJitter: config.CompactIntervalJitter,
 		CompactTimeout:        config.CompactTimeout,
 		CompactMinRetain:      config.CompactMinRetain,
+		CompactRetention:      config.CompactRetention,
 		CompactBatchSize:      config.CompactBatchSize,
+		CompactMaxBatchSize:   config.CompactMaxBatchSize,
+		CompactBatchDelay:     config.CompactBatchDelay,
+		CompactDryRun:         config.CompactDryRun,
+		CompactRepair:         config.CompactRepair,
 		PollBatchSize:         config.PollBatchSize,
+		PollMaxInterval:       config.PollMaxInterval,
+		OmitPrevValuePrefixes: config.OmitPrevValuePrefixes,
+		InsertBatchWindow:     config.InsertBatchWindow,
+		InsertBatchWrites:     config.InsertBatchWrites,
+		WatchBufferSize:       config.WatchBufferSize,
+		KeyPrefixMetricsLimit: config.KeyPrefixMetricsLimit,
+		ReadCacheSize:         config.ReadCacheSize,
+		WriteRetryAttempts:    config.WriteRetryAttempts,
+		WriteRetryBackoff:     config.WriteRetryBackoff,
+		NameColumnLength:      config.NameColumnLength,
+		SkipSchemaSetup:       config.SkipSchemaSetup,
+		SchemaRequireLatest:   config.SchemaRequireLatest,
+		ValueTransformer:      transformer,
+		AdmissionHooks:        config.AdmissionHooks,
+		SQLiteConfig:          config.SQLiteConfig,
+		LibSQLConfig:          config.LibSQLConfig,
+		CloudSQLConfig:        config.CloudSQLConfig,
+		MySQLConfig:           config.MySQLConfig,
+		PostgresConfig:        config.PostgresConfig,
+
+		CompactDeletedRetention: config.CompactDeletedRetention,
+		TablePartitions:         config.TablePartitions,
 	})
 
 	if err != nil {
@@ -86,23 +205,88 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		}, nil
 	}
 
+	// health checks are made directly against the driver's backend, so that optional
+	// interfaces implemented by the backend are not hidden by the tracing wrapper
+	driverBackend := backend
+	backend = tracing.NewBackend(backend)
+
 	if config.MetricsRegisterer != nil {
 		config.MetricsRegisterer.MustRegister(
 			metrics.SQLTotal,
 			metrics.SQLTime,
 			metrics.CompactTotal,
+			metrics.CompactDuration,
+			metrics.CompactSkippedTotal,
+			metrics.CompactDeletedRowsTotal,
+			metrics.CompactRevisionGap,
+			metrics.CompactInterval,
+			metrics.CompactLastAttemptTimestamp,
+			metrics.CompactLastSuccessTimestamp,
+			metrics.CompactLastError,
+			metrics.CompactNextRunTimestamp,
+			metrics.DBSizeBytes,
 			metrics.InsertErrorsTotal,
+			metrics.KeyExistsTotal,
+			metrics.KeyPrefixWritesTotal,
+			metrics.KeyPrefixWriteBytesTotal,
+			metrics.WatchOverflowTotal,
+			metrics.WatchCoalescedEventsTotal,
+			metrics.CurrentRevision,
+			metrics.RevisionGapSize,
+			metrics.RejectedRequestsTotal,
 		)
 	}
 
-	if err := backend.Start(ctx); err != nil {
+	// The backend is stopped only once the GRPC servers have shut down, so that in-flight
+	// requests can complete.
+	backendCtx, cancelBackend := context.WithCancel(context.WithoutCancel(ctx))
+	if err := backend.Start(backendCtx); err != nil {
+		cancelBackend()
 		return ETCDConfig{}, errors.Wrap(err, "starting kine backend")
 	}
 
+	if config.MySQLConfig.LongValues {
+		maxRecvMsgSize := config.GRPCMaxRecvMsgSize
+		if maxRecvMsgSize <= 0 {
+			maxRecvMsgSize = server.DefaultMaxRecvMsgSize
+		}
+		if maxRecvMsgSize <= 16*1024*1024 {
+			logrus.Warnf("MySQL long values are enabled, but the GRPC max receive message size of %d bytes is too small to receive values larger than 16MB; increase --grpc-max-recv-msg-size to write larger values", maxRecvMsgSize)
+		}
+	}
+
 	// set up GRPC server and register services
-	b := server.New(backend, endpointScheme(config), config.NotifyInterval, config.EmulatedETCDVersion)
+	b := server.New(backend, server.Config{
+		Scheme:                endpointScheme(config),
+		NotifyInterval:        config.NotifyInterval,
+		EmulatedETCDVersion:   config.EmulatedETCDVersion,
+		QuotaBackendBytes:     config.QuotaBackendBytes,
+		MaxRecvMsgSize:        config.GRPCMaxRecvMsgSize,
+		MaxSendMsgSize:        config.GRPCMaxSendMsgSize,
+		WatchReplayBufferSize: config.WatchReplayBufferSize,
+		WatchCoalesceWindow:   config.WatchCoalesceWindow,
+		ClientURLs:            config.AdvertiseClientURLs,
+		MaxConcurrentReads:    config.MaxConcurrentReads,
+		MaxConcurrentWrites:   config.MaxConcurrentWrites,
+	})
+	if err := b.Start(backendCtx); err != nil {
+		cancelBackend()
+		return ETCDConfig{}, errors.Wrap(err, "starting watch replay buffer")
+	}
+	if config.ReadOnly {
+		b.SetReadOnly(true)
+	}
+
+	if config.HealthAddress != "" {
+		if err := serveHealth(ctx, config.HealthAddress, driverBackend, b); err != nil {
+			cancelBackend()
+			return ETCDConfig{}, errors.Wrap(err, "starting health server")
+		}
+	}
+
 	grpcServer, err := grpcServer(config)
 	if err != nil {
+		cancelBackend()
 		return ETCDConfig{}, errors.Wrap(err, "creating GRPC server")
 	}
 	b.Register(grpcServer)
@@ -110,6 +294,7 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 	// Create raw listener and wrap in cmux for protocol switching
 	listener, err := createListener(config)
 	if err != nil {
+		cancelBackend()
 		return ETCDConfig{}, errors.Wrap(err, "creating listener")
 	}
 
@@ -122,15 +307,107 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 	endpoint := endpointURL(config, listener)
 	logrus.Infof("Kine available at %s", endpoint)
 
+	servers, err := serveAdditionalListeners(config, b)
+	if err != nil {
+		cancelBackend()
+		return ETCDConfig{}, err
+	}
+	// A preconfigured GRPC server is owned by the caller, and is not stopped by kine.
+	if config.GRPCServer == nil {
+		servers = append(servers, grpcServer)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdown(b, servers, config.ShutdownTimeout)
+		cancelBackend()
+		if closer, ok := driverBackend.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				logrus.Warnf("Failed to close kine backend: %v", err)
+			}
+		}
+		logrus.Infof("Kine shut down")
+	}()
+
 	return ETCDConfig{
 		LeaderElect: leaderElect,
 		Endpoints:   []string{endpoint},
 		TLSConfig: tls.Config{
 			CAFile: config.ServerTLSConfig.CAFile,
 		},
+		Stopped: stopped,
 	}, nil
 }
 
+// shutdown closes watch streams and gracefully stops the GRPC servers, so that in-flight requests
+// can complete. Once the timeout has passed, the servers are stopped, closing any connections
+// with requests that are still in progress.
+func shutdown(b *server.KVServerBridge, servers []*grpc.Server, timeout time.Duration) {
+	logrus.Infof("Shutting down kine, waiting up to %s for in-flight requests to complete", timeout)
+	b.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, s := range servers {
+			s.GracefulStop()
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		logrus.Warnf("Timed out waiting for in-flight requests to complete, stopping kine")
+		for _, s := range servers {
+			s.Stop()
+		}
+		<-done
+	}
+}
+
+// serveAdditionalListeners serves the etcd API on each additional listener. The listeners share
+// the backend, but each has its own GRPC server, as server TLS credentials are set per server.
+func serveAdditionalListeners(config Config, b *server.KVServerBridge) ([]*grpc.Server, error) {
+	var servers []*grpc.Server
+	for _, additional := range config.AdditionalListeners {
+		listenerConfig := config
+		listenerConfig.GRPCServer = nil
+		listenerConfig.Listener = additional.Address
+		listenerConfig.ServerTLSConfig = additional.ServerTLSConfig
+		// Listeners serving TLS require the same client certificates as the primary listener,
+		// unless they are configured with their own client CA.
+		if listenerConfig.ServerTLSConfig.CertFile != "" && listenerConfig.ServerTLSConfig.ClientCAFile == "" {
+			listenerConfig.ServerTLSConfig.ClientCAFile = config.ServerTLSConfig.ClientCAFile
+			listenerConfig.ServerTLSConfig.AllowedCNs = config.ServerTLSConfig.AllowedCNs
+		}
+
+		additionalServer, err := grpcServer(listenerConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating GRPC server for additional listener %s", additional.Address)
+		}
+		b.Register(additionalServer)
+
+		additionalListener, err := createListener(listenerConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "creating additional listener %s", additional.Address)
+		}
+
+		go func() {
+			if err := additionalServer.Serve(additionalListener); err != nil {
+				logrus.Errorf("Kine GRPC server for additional listener exited: %v", err)
+			}
+		}()
+
+		servers = append(servers, additionalServer)
+		logrus.Infof("Kine also available at %s", endpointURL(listenerConfig, additionalListener))
+	}
+	return servers, nil
+}
+
 // endpointURL returns a URI string suitable for use as a local etcd endpoint.
 // For TCP sockets, it is assumed that the port can be reached via the loopback address.
 func endpointURL(config Config, listener net.Listener) string {
@@ -190,30 +467,53 @@ func createListener(config Config) (ret net.Listener, rerr error) {
 	return net.Listen(scheme, address)
 }
 
-// grpcServer returns either a preconfigured GRPC server, or builds a new GRPC
-// server using upstream keepalive defaults plus the local Server TLS configuration.
+// grpcServer returns either a preconfigured GRPC server, or builds a new GRPC server using the
+// keepalive, Server TLS and message size configuration. Unset keepalive settings use the upstream
+// defaults.
 func grpcServer(config Config) (*grpc.Server, error) {
 	if config.GRPCServer != nil {
 		return config.GRPCServer, nil
 	}
 
+	keepAliveInterval := config.GRPCKeepAliveInterval
+	if keepAliveInterval <= 0 {
+		keepAliveInterval = embed.DefaultGRPCKeepAliveInterval
+	}
+	keepAliveTimeout := config.GRPCKeepAliveTimeout
+	if keepAliveTimeout <= 0 {
+		keepAliveTimeout = embed.DefaultGRPCKeepAliveTimeout
+	}
+
 	gopts := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
 			MinTime:             embed.DefaultGRPCKeepAliveMinTime,
 			PermitWithoutStream: false,
 		}),
 		grpc.KeepaliveParams(keepalive.ServerParameters{
-			Time:    embed.DefaultGRPCKeepAliveInterval,
-			Timeout: embed.DefaultGRPCKeepAliveTimeout,
+			MaxConnectionIdle: config.GRPCMaxConnectionIdle,
+			Time:              keepAliveInterval,
+			Timeout:           keepAliveTimeout,
 		}),
+		// extract trace context propagated by clients, so that backend spans are linked to the caller's trace
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
 	}
 
-	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
-		creds, err := credentials.NewServerTLSFromFile(config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile)
-		if err != nil {
-			return nil, err
+	if config.GRPCMaxRecvMsgSize > 0 {
+		gopts = append(gopts, grpc.MaxRecvMsgSize(config.GRPCMaxRecvMsgSize))
+	}
+	if config.GRPCMaxSendMsgSize > 0 {
+		gopts = append(gopts, grpc.MaxSendMsgSize(config.GRPCMaxSendMsgSize))
+	}
+
+	tlsConfig, err := config.ServerTLSConfig.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if config.ServerTLSConfig.ClientCAFile != "" {
+			logrus.Infof("Requiring client certificates signed by %s", config.ServerTLSConfig.ClientCAFile)
 		}
-		gopts = append(gopts, grpc.Creds(creds))
+		gopts = append(gopts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	}
 
 	return grpc.NewServer(gopts...), nil
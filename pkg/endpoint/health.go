@@ -0,0 +1,133 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// healthResponse is the body returned by the health endpoint.
+type healthResponse struct {
+	Healthy  bool   `json:"healthy"`
+	ReadOnly bool   `json:"readOnly"`
+	Error    string `json:"error,omitempty"`
+	*server.HealthStatus
+}
+
+// readOnlyResponse is the body returned by the read-only endpoint.
+type readOnlyResponse struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// serveHealth serves HTTP health checks for the backend on the provided address until the
+// context is cancelled. /livez reports only that the process is serving requests; /healthz and
+// /readyz check connectivity to the datastore, and return 200 only if it is reachable.
+// /readonly reports whether the server is in read-only mode, and enables or disables it when
+// POSTed to with the enabled query parameter set.
+func serveHealth(ctx context.Context, address string, backend server.Backend, bridge *server.KVServerBridge) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("ok"))
+	})
+	mux.Handle("/healthz", healthHandler(backend, bridge))
+	mux.Handle("/readyz", healthHandler(backend, bridge))
+	mux.Handle("/readonly", readOnlyHandler(bridge))
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: healthCheckTimeout,
+	}
+
+	go func() {
+		logrus.Infof("Health server is starting to listen at %s", address)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Health server exited: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logrus.Errorf("Failed to shut down health server: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func healthHandler(backend server.Backend, bridge *server.KVServerBridge) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+		defer cancel()
+
+		resp := &healthResponse{ReadOnly: bridge.ReadOnly()}
+		if checker, ok := backend.(server.HealthChecker); ok {
+			status, err := checker.Health(ctx)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Healthy = true
+				resp.HealthStatus = status
+			}
+		} else {
+			// Backends that cannot check connectivity directly are considered healthy if they
+			// are able to return the current revision.
+			rev, err := backend.CurrentRevision(ctx)
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				resp.Healthy = true
+				resp.HealthStatus = &server.HealthStatus{CurrentRevision: rev}
+			}
+		}
+
+		code := http.StatusOK
+		if !resp.Healthy {
+			logrus.Warnf("Health check failed: %s", resp.Error)
+			code = http.StatusServiceUnavailable
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
+			logrus.Debugf("Failed to write health check response: %v", err)
+		}
+	}
+}
+
+func readOnlyHandler(bridge *server.KVServerBridge) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			enabled, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(rw, "enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			bridge.SetReadOnly(enabled)
+		default:
+			rw.Header().Set("Allow", "GET, POST, PUT")
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(&readOnlyResponse{ReadOnly: bridge.ReadOnly()}); err != nil {
+			logrus.Debugf("Failed to write read-only response: %v", err)
+		}
+	}
+}
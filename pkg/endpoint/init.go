@@ -2,9 +2,13 @@ package endpoint
 
 import (
 	// Import all the default drivers
+	_ "github.com/k3s-io/kine/pkg/drivers/cockroachdb"
 	_ "github.com/k3s-io/kine/pkg/drivers/http"
+	_ "github.com/k3s-io/kine/pkg/drivers/libsql"
+	_ "github.com/k3s-io/kine/pkg/drivers/mssql"
 	_ "github.com/k3s-io/kine/pkg/drivers/mysql"
 	_ "github.com/k3s-io/kine/pkg/drivers/nats"
 	_ "github.com/k3s-io/kine/pkg/drivers/pgsql"
 	_ "github.com/k3s-io/kine/pkg/drivers/sqlite"
+	_ "github.com/k3s-io/kine/pkg/drivers/yugabytedb"
 )
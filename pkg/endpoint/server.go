@@ -0,0 +1,116 @@
+package endpoint
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+)
+
+// Server runs kine in-process, for programs that embed kine instead of running the kine binary.
+// It wraps Listen, so that the server can be started and stopped explicitly instead of through
+// the lifetime of a context. The configuration should be based on DefaultConfig.
+//
+// An existing database connection pool can be used by setting ConnectionPoolConfig.DB, along with
+// an endpoint whose scheme selects the driver for the database, such as "postgres://". The pool is
+// used as configured by the caller, and is left open when the server is stopped.
+type Server struct {
+	config Config
+
+	mutex   sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	etcd    ETCDConfig
+	started bool
+}
+
+// DefaultConfig returns a configuration with the defaults used by the kine binary, for the
+// settings that are not usable when left unset, such as the compaction interval. The datastore
+// endpoint defaults to SQLite, and the etcd API is served on the kine unix socket.
+func DefaultConfig() Config {
+	return Config{
+		TableName: "kine",
+		ConnectionPoolConfig: generic.ConnectionPoolConfig{
+			MaxConnectWait: 5 * time.Minute,
+			SetupTimeout:   30 * time.Second,
+		},
+		NotifyInterval:      5 * time.Second,
+		GRPCMaxRecvMsgSize:  server.DefaultMaxRecvMsgSize,
+		EmulatedETCDVersion: "3.5.13",
+		CompactInterval:     5 * time.Minute,
+		CompactTimeout:      5 * time.Second,
+		CompactMinRetain:    1000,
+		CompactBatchSize:    1000,
+		PollBatchSize:       500,
+		WatchBufferSize:     100,
+		WriteRetryAttempts:  3,
+		WriteRetryBackoff:   10 * time.Millisecond,
+		NameColumnLength:    630,
+		LibSQLConfig: drivers.LibSQLConfig{
+			SyncInterval: time.Second,
+		},
+		CloudSQLConfig: drivers.CloudSQLConfig{
+			IPType: "PUBLIC",
+		},
+		ShutdownTimeout: 15 * time.Second,
+	}
+}
+
+// New returns a server for the configuration. The server is stopped when Stop is called, or when
+// the context is done.
+func New(ctx context.Context, config Config) (*Server, error) {
+	if config.EndpointFile != "" && config.Endpoint != "" {
+		return nil, errors.New("datastore endpoint and endpoint file cannot both be set")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Server{
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// Start connects to the datastore and starts serving the etcd API. It returns the configuration
+// that etcd clients should use to connect to kine.
+func (s *Server) Start() (ETCDConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return ETCDConfig{}, errors.New("kine server has already been started")
+	}
+	if err := s.ctx.Err(); err != nil {
+		return ETCDConfig{}, errors.Wrap(err, "kine server has been stopped")
+	}
+
+	etcd, err := Listen(s.ctx, s.config)
+	if err != nil {
+		return ETCDConfig{}, err
+	}
+	s.etcd = etcd
+	s.started = true
+	return etcd, nil
+}
+
+// Endpoints returns the addresses at which the etcd API is available, once the server has been
+// started.
+func (s *Server) Endpoints() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.etcd.Endpoints
+}
+
+// Stop shuts down the server, waiting for in-flight requests to complete for up to the configured
+// shutdown timeout, and closes the connection to the datastore.
+func (s *Server) Stop() {
+	s.cancel()
+	s.mutex.Lock()
+	stopped := s.etcd.Stopped
+	s.mutex.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+}
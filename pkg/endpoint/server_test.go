@@ -0,0 +1,289 @@
+//go:build cgo
+// +build cgo
+
+package endpoint
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/tls"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestServerWithDB(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "state.db")+"?_journal=WAL&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	config := DefaultConfig()
+	config.Listener = "tcp://127.0.0.1:0"
+	config.Endpoint = "sqlite://"
+	config.ConnectionPoolConfig.DB = db
+	s, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcd, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Start(); err == nil {
+		t.Fatal("expected error starting server twice")
+	}
+	if len(s.Endpoints()) != 1 {
+		t.Fatalf("expected one endpoint, got %v", s.Endpoints())
+	}
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: etcd.Endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	txn, err := client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("/a"), "=", 0)).Then(clientv3.OpPut("/a", "a")).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !txn.Succeeded {
+		t.Fatal("expected create of /a to succeed")
+	}
+	resp, err := client.Get(ctx, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "a" {
+		t.Fatalf("expected /a=a, got %v", resp.Kvs)
+	}
+
+	s.Stop()
+	// The connection pool belongs to the caller, and is left open.
+	if err := db.Ping(); err != nil {
+		t.Fatalf("expected connection pool to remain open, got %v", err)
+	}
+}
+
+func TestServerTxn(t *testing.T) {
+	config := DefaultConfig()
+	config.Listener = "tcp://127.0.0.1:0"
+	config.Endpoint = "sqlite://" + filepath.Join(t.TempDir(), "state.db") + "?_journal=WAL&_txlock=immediate"
+	s, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcd, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	client, err := clientv3.New(clientv3.Config{Endpoints: etcd.Endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range []string{"a", "b"} {
+		if _, err := client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("/txn/"+key), "=", 0)).Then(clientv3.OpPut("/txn/"+key, key)).Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Operations are applied in order, and observe the writes made by earlier operations.
+	txn, err := client.Txn(ctx).If(
+		clientv3.Compare(clientv3.Value("/txn/a"), "=", "a"),
+		clientv3.Compare(clientv3.CreateRevision("/txn/c"), "=", 0),
+	).Then(
+		clientv3.OpPut("/txn/c", "c"),
+		clientv3.OpDelete("/txn/b", clientv3.WithPrevKV()),
+		clientv3.OpGet("/txn/", clientv3.WithPrefix()),
+		clientv3.OpTxn(nil, []clientv3.Op{clientv3.OpPut("/txn/d", "d")}, nil),
+	).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !txn.Succeeded || len(txn.Responses) != 4 {
+		t.Fatalf("expected txn to succeed with four responses, got %v", txn)
+	}
+	if del := txn.Responses[1].GetResponseDeleteRange(); del.Deleted != 1 || string(del.PrevKvs[0].Value) != "b" {
+		t.Fatalf("expected delete of /txn/b, got %v", del)
+	}
+	kvs := txn.Responses[2].GetResponseRange().Kvs
+	if len(kvs) != 2 || string(kvs[0].Key) != "/txn/a" || string(kvs[1].Key) != "/txn/c" || kvs[1].ModRevision == 0 {
+		t.Fatalf("expected range to return /txn/a and /txn/c, got %v", kvs)
+	}
+	if nested := txn.Responses[3].GetResponseTxn(); !nested.Succeeded || len(nested.Responses) != 1 {
+		t.Fatalf("expected nested txn to succeed, got %v", nested)
+	}
+
+	resp, err := client.Get(ctx, "/txn/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 3 || string(resp.Kvs[0].Key) != "/txn/a" || string(resp.Kvs[1].Key) != "/txn/c" || string(resp.Kvs[2].Key) != "/txn/d" {
+		t.Fatalf("expected /txn/a, /txn/c and /txn/d, got %v", resp.Kvs)
+	}
+	if resp.Kvs[1].ModRevision != kvs[1].ModRevision || resp.Kvs[2].ModRevision != txn.Header.Revision {
+		t.Fatalf("expected txn writes at revisions %d and %d, got %v", kvs[1].ModRevision, txn.Header.Revision, resp.Kvs)
+	}
+
+	// A failed operation rolls back the writes made by the operations before it.
+	if _, err := client.Txn(ctx).Then(
+		clientv3.OpPut("/txn/e", "e"),
+		clientv3.OpPut("/txn/a", "a2", clientv3.WithIgnoreLease()),
+		clientv3.OpPut("/txn/f", "f", clientv3.WithIgnoreValue()),
+	).Commit(); err == nil {
+		t.Fatal("expected txn with put of missing key to fail")
+	}
+	resp, err = client.Get(ctx, "/txn/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 3 || string(resp.Kvs[0].Value) != "a" {
+		t.Fatalf("expected failed txn to make no writes, got %v", resp.Kvs)
+	}
+
+	// The failure branch is applied if a comparison fails.
+	txn, err = client.Txn(ctx).If(
+		clientv3.Compare(clientv3.ModRevision("/txn/").WithPrefix(), "<", resp.Header.Revision),
+	).Then(
+		clientv3.OpDelete("/txn/", clientv3.WithPrefix()),
+	).Else(
+		clientv3.OpPut("/txn/a", "a2"),
+		clientv3.OpDelete("/txn/c"),
+	).Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Succeeded {
+		t.Fatal("expected comparison to fail")
+	}
+	resp, err = client.Get(ctx, "/txn/", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 2 || string(resp.Kvs[0].Value) != "a2" || string(resp.Kvs[1].Key) != "/txn/d" {
+		t.Fatalf("expected /txn/a=a2 and /txn/d, got %v", resp.Kvs)
+	}
+}
+
+func TestServerClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	writeCert(t, dir, "other", ca, caKey)
+
+	config := DefaultConfig()
+	config.Listener = "tcp://127.0.0.1:0"
+	config.Endpoint = "sqlite://" + filepath.Join(dir, "state.db") + "?_journal=WAL&_txlock=immediate"
+	config.ServerTLSConfig = tls.Config{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+		AllowedCNs:   []string{"client"},
+	}
+	s, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etcd, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	get := func(name string) error {
+		clientTLS := tls.Config{CAFile: filepath.Join(dir, "ca.crt")}
+		if name != "" {
+			clientTLS.CertFile = filepath.Join(dir, name+".crt")
+			clientTLS.KeyFile = filepath.Join(dir, name+".key")
+		}
+		tlsConfig, err := clientTLS.ClientConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := clientv3.New(clientv3.Config{Endpoints: etcd.Endpoints, TLS: tlsConfig, DialTimeout: 5 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err = client.Get(ctx, "/a")
+		return err
+	}
+
+	if err := get("client"); err != nil {
+		t.Fatalf("expected request with allowed client certificate to succeed, got %v", err)
+	}
+	if err := get(""); err == nil {
+		t.Fatal("expected request without client certificate to fail")
+	}
+	if err := get("other"); err == nil {
+		t.Fatal("expected request with client certificate for another common name to fail")
+	}
+}
+
+// writeCert writes a certificate and key for the common name to the directory. The certificate is
+// a self-signed CA if no parent is given, and otherwise is signed by the parent for use by both
+// clients and servers on the loopback address.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -0,0 +1,57 @@
+package logstructured
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Operation is the type of write passed to admission hooks.
+type Operation string
+
+const (
+	OperationCreate Operation = "create"
+	OperationUpdate Operation = "update"
+	OperationDelete Operation = "delete"
+)
+
+// WriteRequest describes a write that is being admitted. The value size is zero for deletes.
+type WriteRequest struct {
+	Operation Operation
+	Key       string
+	ValueSize int
+}
+
+// AdmissionHook validates writes before they are made, and may reject a write by returning an
+// error. Errors that are not GRPC status errors are returned to the client with the
+// FailedPrecondition code. Hooks are called for every create, update and delete requested by a
+// client, so they should be cheap, and should not access the datastore. Writes made by kine
+// itself, such as lease checkpoints and deletes of keys whose lease has expired, are not passed to
+// hooks.
+type AdmissionHook interface {
+	Admit(ctx context.Context, req WriteRequest) error
+}
+
+// AdmissionHookFunc allows a function to be used as an admission hook.
+type AdmissionHookFunc func(ctx context.Context, req WriteRequest) error
+
+func (f AdmissionHookFunc) Admit(ctx context.Context, req WriteRequest) error {
+	return f(ctx, req)
+}
+
+// admit runs the admission hooks for the write, returning the first rejection.
+func (l *LogStructured) admit(ctx context.Context, op Operation, key string, valueSize int) error {
+	req := WriteRequest{Operation: op, Key: key, ValueSize: valueSize}
+	for _, hook := range l.admissionHooks {
+		if err := hook.Admit(ctx, req); err != nil {
+			logrus.Debugf("Admission hook rejected %s of key=%s, size=%d: %v", op, key, valueSize, err)
+			if _, ok := status.FromError(err); !ok {
+				err = status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return err
+		}
+	}
+	return nil
+}
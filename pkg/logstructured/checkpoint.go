@@ -0,0 +1,197 @@
+package logstructured
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leaseCheckpointPrefix is the prefix for the internal keys that hold lease checkpoints.
+	// Like compact_rev_key, it does not start with a slash, so it is not visible to clients
+	// listing or watching the root prefix.
+	leaseCheckpointPrefix = "lease_checkpoint_key/"
+	// leaseCheckpointInterval matches the default etcd lease checkpoint interval.
+	leaseCheckpointInterval = 5 * time.Minute
+	// leaseCheckpointBatchSize is the maximum number of keys stored in a single checkpoint record.
+	// Checkpoints for all keys are written in batches each interval, instead of one write per key,
+	// so that large numbers of leases with the same TTL do not cause a burst of writes.
+	leaseCheckpointBatchSize = 1000
+)
+
+// leaseCheckpoint records the remaining TTL of a key, as of the last checkpoint. As with etcd,
+// the remaining TTL is stored instead of an absolute expiration time, so that checkpoints are
+// not affected by clock skew between nodes, and time spent stopped does not count against the TTL.
+type leaseCheckpoint struct {
+	ModRevision  int64 `json:"modRevision"`
+	RemainingTTL int64 `json:"remainingTTL"`
+}
+
+// loadLeaseCheckpoints returns the most recent lease checkpoints for all keys.
+func (l *LogStructured) loadLeaseCheckpoints(ctx context.Context) map[string]leaseCheckpoint {
+	checkpoints := map[string]leaseCheckpoint{}
+
+	_, events, err := l.log.List(ctx, leaseCheckpointPrefix, "", 0, 0, false)
+	if err != nil {
+		logrus.Errorf("Failed to load lease checkpoints: %v", err)
+		return checkpoints
+	}
+
+	for _, event := range events {
+		batch := map[string]leaseCheckpoint{}
+		if err := json.Unmarshal(event.KV.Value, &batch); err != nil {
+			logrus.Errorf("Failed to decode lease checkpoint %s: %v", event.KV.Key, err)
+			continue
+		}
+		for key, checkpoint := range batch {
+			checkpoints[key] = checkpoint
+		}
+	}
+
+	logrus.Tracef("TTL loaded checkpoints for %d keys", len(checkpoints))
+	return checkpoints
+}
+
+// loadLeaseGrants returns the expiry of each revision with a lease, from the time that the lease
+// was granted, if recorded by the log. Revisions written before the grant time was recorded are
+// not included, and fall back to their checkpoint or full lease TTL.
+func (l *LogStructured) loadLeaseGrants(ctx context.Context) map[int64]time.Time {
+	now := time.Now()
+	remaining, err := l.log.LeaseRemaining(ctx)
+	if err != nil {
+		logrus.Errorf("Failed to load lease grant times: %v", err)
+		return nil
+	}
+
+	grants := make(map[int64]time.Time, len(remaining))
+	for revision, ttl := range remaining {
+		grants[revision] = now.Add(time.Duration(ttl) * time.Second)
+	}
+
+	logrus.Tracef("TTL loaded grant times for %d revisions", len(grants))
+	return grants
+}
+
+// leaseCheckpointer periodically persists the remaining TTL of all keys with a lease.
+func (l *LogStructured) leaseCheckpointer(ctx context.Context, rwMutex *sync.RWMutex, store map[string]*ttlEventKV) {
+	t := time.NewTicker(leaseCheckpointInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if l.readOnly.Load() {
+			continue
+		}
+		if err := l.checkpointLeases(ctx, rwMutex, store); err != nil {
+			logrus.Errorf("Failed to checkpoint leases: %v", err)
+		}
+	}
+}
+
+// checkpointLeases writes the remaining TTL of all keys with a lease, in batches of
+// leaseCheckpointBatchSize keys per record. Records left over from a previous checkpoint with
+// more batches are deleted.
+func (l *LogStructured) checkpointLeases(ctx context.Context, rwMutex *sync.RWMutex, store map[string]*ttlEventKV) error {
+	now := time.Now()
+	rwMutex.RLock()
+	keys := make([]string, 0, len(store))
+	for key := range store {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	checkpoints := make([]leaseCheckpoint, 0, len(keys))
+	for _, key := range keys {
+		eventKV := store[key]
+		remaining := int64(math.Ceil(eventKV.expiredAt.Sub(now).Seconds()))
+		if remaining < 1 {
+			remaining = 1
+		}
+		checkpoints = append(checkpoints, leaseCheckpoint{
+			ModRevision:  eventKV.modRevision,
+			RemainingTTL: remaining,
+		})
+	}
+	rwMutex.RUnlock()
+
+	_, existing, err := l.log.List(ctx, leaseCheckpointPrefix, "", 0, 0, false)
+	if err != nil {
+		return err
+	}
+	revisions := map[string]int64{}
+	for _, event := range existing {
+		revisions[event.KV.Key] = event.KV.ModRevision
+	}
+
+	batches := 0
+	for start := 0; start < len(keys); start += leaseCheckpointBatchSize {
+		end := start + leaseCheckpointBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := make(map[string]leaseCheckpoint, end-start)
+		for i := start; i < end; i++ {
+			batch[keys[i]] = checkpoints[i]
+		}
+		value, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+
+		key := leaseCheckpointPrefix + strconv.Itoa(batches)
+		batches++
+		if rev, ok := revisions[key]; ok {
+			delete(revisions, key)
+			if _, _, ok, err := l.update(ctx, key, value, rev, 0); err != nil {
+				return err
+			} else if !ok {
+				// Another node has updated this checkpoint since it was listed; it will be
+				// written again at the next interval.
+				logrus.Debugf("Lease checkpoint %s was modified concurrently, skipping", key)
+			}
+		} else if _, err := l.create(ctx, key, value, 0); err != nil {
+			return err
+		}
+	}
+
+	for key, rev := range revisions {
+		if _, _, _, err := l.delete(ctx, key, rev); err != nil {
+			return err
+		}
+	}
+
+	logrus.Tracef("TTL checkpointed %d keys in %d batches", len(keys), batches)
+	return nil
+}
+
+// leaseTTL returns the time until the key expires. If the time that the lease was granted is known
+// for the current revision of the key, the TTL runs from that time. Otherwise, if a checkpoint
+// exists for the current revision of the key, the remaining TTL from the checkpoint is used instead
+// of the full lease TTL.
+func leaseTTL(checkpoints map[string]leaseCheckpoint, grants map[int64]time.Time, key string, modRevision, lease int64) time.Duration {
+	if expiry, ok := grants[modRevision]; ok {
+		ttl := time.Until(expiry)
+		if ttl < 0 {
+			ttl = 0
+		}
+		if full := time.Duration(lease) * time.Second; ttl > full {
+			ttl = full
+		}
+		return ttl
+	}
+	ttl := lease
+	if checkpoint, ok := checkpoints[key]; ok && checkpoint.ModRevision == modRevision && checkpoint.RemainingTTL < ttl {
+		ttl = checkpoint.RemainingTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
@@ -0,0 +1,157 @@
+package logstructured
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// memoryLog holds the events appended to it in memory, and implements the parts of Log used to
+// read and write keys. Other methods of Log are not implemented.
+type memoryLog struct {
+	Log
+	events []*server.Event
+}
+
+func (m *memoryLog) CurrentRevision(context.Context) (int64, error) {
+	return int64(len(m.events)), nil
+}
+
+// latest returns the latest event of each key, in key order.
+func (m *memoryLog) latest(match func(key string) bool, includeDeletes bool) []*server.Event {
+	latest := map[string]*server.Event{}
+	for _, event := range m.events {
+		if match(event.KV.Key) {
+			latest[event.KV.Key] = event
+		}
+	}
+	var events []*server.Event
+	for _, event := range latest {
+		if includeDeletes || !event.Delete {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].KV.Key < events[j].KV.Key })
+	return events
+}
+
+func (m *memoryLog) List(_ context.Context, prefix, _ string, _, _ int64, includeDeletes bool) (int64, []*server.Event, error) {
+	match := func(key string) bool { return strings.HasPrefix(key, prefix) }
+	return int64(len(m.events)), m.latest(match, includeDeletes), nil
+}
+
+func (m *memoryLog) ListRange(_ context.Context, key, _ string, _, _ int64, includeDeletes bool) (int64, []*server.Event, error) {
+	match := func(name string) bool { return name == key }
+	return int64(len(m.events)), m.latest(match, includeDeletes), nil
+}
+
+func (m *memoryLog) Append(_ context.Context, event *server.Event) (int64, error) {
+	rev := int64(len(m.events)) + 1
+	kv := *event.KV
+	kv.ModRevision = rev
+	if event.Create {
+		kv.CreateRevision = rev
+	}
+	m.events = append(m.events, &server.Event{Create: event.Create, Delete: event.Delete, KV: &kv, PrevKV: event.PrevKV})
+	return rev, nil
+}
+
+// checkpointStore returns a TTL store holding n keys with a lease, which expire after ttl.
+func checkpointStore(n int, ttl time.Duration) map[string]*ttlEventKV {
+	store := map[string]*ttlEventKV{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("/registry/leases/%05d", i)
+		store[key] = &ttlEventKV{
+			key:         key,
+			modRevision: int64(i + 1),
+			lease:       60,
+			expiredAt:   time.Now().Add(ttl),
+		}
+	}
+	return store
+}
+
+// TestLeaseCheckpoints ensures that checkpoints for more keys than fit in a single record are
+// written in batches and loaded again, and that records left over from a checkpoint of more keys
+// are deleted.
+func TestLeaseCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	log := &memoryLog{}
+	l := New(log, 0, nil)
+
+	keys := leaseCheckpointBatchSize + leaseCheckpointBatchSize/2
+	if err := l.checkpointLeases(ctx, &sync.RWMutex{}, checkpointStore(keys, 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, records, _ := log.List(ctx, leaseCheckpointPrefix, "", 0, 0, false); len(records) != 2 {
+		t.Fatalf("expected checkpoints of %d keys in 2 records, got %d", keys, len(records))
+	}
+	checkpoints := l.loadLeaseCheckpoints(ctx)
+	if len(checkpoints) != keys {
+		t.Fatalf("expected checkpoints for %d keys, got %d", keys, len(checkpoints))
+	}
+	for key, checkpoint := range checkpoints {
+		var i int64
+		if _, err := fmt.Sscanf(key, "/registry/leases/%05d", &i); err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint.ModRevision != i+1 || checkpoint.RemainingTTL != 30 {
+			t.Errorf("expected checkpoint of %s at revision %d with 30s remaining, got %+v", key, i+1, checkpoint)
+		}
+	}
+
+	// Once the keys fit in a single record, the second record is deleted.
+	if err := l.checkpointLeases(ctx, &sync.RWMutex{}, checkpointStore(10, 20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, records, _ := log.List(ctx, leaseCheckpointPrefix, "", 0, 0, false); len(records) != 1 || records[0].KV.Key != leaseCheckpointPrefix+"0" {
+		t.Fatalf("expected a single checkpoint record, got %d", len(records))
+	}
+	checkpoints = l.loadLeaseCheckpoints(ctx)
+	if len(checkpoints) != 10 {
+		t.Fatalf("expected checkpoints for 10 keys, got %d", len(checkpoints))
+	}
+	for key, checkpoint := range checkpoints {
+		if checkpoint.RemainingTTL != 20 {
+			t.Errorf("expected checkpoint of %s with 20s remaining, got %+v", key, checkpoint)
+		}
+	}
+}
+
+// TestLeaseCheckpointRestart ensures that a key restored from the log after a restart expires
+// after the remaining TTL from its checkpoint, rather than the full TTL of its lease, unless the
+// checkpoint is for an older revision of the key.
+func TestLeaseCheckpointRestart(t *testing.T) {
+	ctx := context.Background()
+	log := &memoryLog{}
+	store := checkpointStore(2, 15*time.Second)
+	if err := New(log, 0, nil).checkpointLeases(ctx, &sync.RWMutex{}, store); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restarted backend loads the checkpoints written before the restart.
+	checkpoints := New(log, 0, nil).loadLeaseCheckpoints(ctx)
+	restored := map[string]*ttlEventKV{}
+	current := &server.KeyValue{Key: "/registry/leases/00000", ModRevision: 1, Lease: 60}
+	if ttl := storeTTLEventKV(&sync.RWMutex{}, restored, current, checkpoints, nil); ttl != 15*time.Second {
+		t.Errorf("expected key restored at its checkpointed revision to expire after 15s, got %v", ttl)
+	}
+	if expiry := time.Until(restored[current.Key].expiredAt); expiry > 15*time.Second {
+		t.Errorf("expected key restored at its checkpointed revision to expire within 15s, got %v", expiry)
+	}
+
+	// The key has been written again since its checkpoint, so the full lease TTL applies.
+	updated := &server.KeyValue{Key: "/registry/leases/00001", ModRevision: 3, Lease: 60}
+	if ttl := storeTTLEventKV(&sync.RWMutex{}, restored, updated, checkpoints, nil); ttl != time.Minute {
+		t.Errorf("expected key written after its checkpoint to expire after the full lease TTL, got %v", ttl)
+	}
+	if ttl := leaseTTL(checkpoints, nil, "/registry/leases/00002", 1, 60); ttl != time.Minute {
+		t.Errorf("expected key without a checkpoint to expire after the full lease TTL, got %v", ttl)
+	}
+}
@@ -3,7 +3,11 @@ package logstructured
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -14,34 +18,61 @@ import (
 
 const (
 	retryInterval = 250 * time.Millisecond
+	// readOnlyRetryInterval is how often keys whose lease has expired are checked while in
+	// read-only mode, so that they are deleted soon after read-only mode is disabled.
+	readOnlyRetryInterval = 5 * time.Second
 )
 
 type Log interface {
 	Start(ctx context.Context) error
 	CompactRevision(ctx context.Context) (int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
+	LatestRevision(ctx context.Context) (int64, error)
 	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error)
 	Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error)
+	ListRange(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error)
+	CountRange(ctx context.Context, key, rangeEnd string, revision int64) (int64, int64, error)
 	After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error)
-	Watch(ctx context.Context, prefix string) <-chan []*server.Event
+	Watch(ctx context.Context, prefix string) server.WatchResult
 	Append(ctx context.Context, event *server.Event) (int64, error)
+	AppendBatch(ctx context.Context, events []*server.Event, conditions []*server.Condition) ([]int64, error)
+	Import(ctx context.Context, revision int64, events []*server.Event) error
 	DbSize(ctx context.Context) (int64, error)
 	Compact(ctx context.Context, revision int64) (int64, error)
+	Defragment(ctx context.Context) error
+	Health(ctx context.Context) (*server.HealthStatus, error)
+	LeaseRemaining(ctx context.Context) (map[int64]int64, error)
 }
 
 type ttlEventKV struct {
 	key         string
 	modRevision int64
+	lease       int64
 	expiredAt   time.Time
 }
 
 type LogStructured struct {
 	log Log
+	// ttlMutex guards ttlStore, which holds the expiry of all keys with a lease.
+	ttlMutex sync.RWMutex
+	ttlStore map[string]*ttlEventKV
+	// readCache holds recent point reads, if enabled.
+	readCache *readCache
+	// admissionHooks validate writes requested by clients.
+	admissionHooks []AdmissionHook
+	// readOnly pauses the deletion of expired keys and lease checkpoints.
+	readOnly atomic.Bool
 }
 
-func New(log Log) *LogStructured {
+// New returns a backend that stores keys in the log. If readCacheSize is greater than zero, up to
+// that many serializable point reads are cached until the key is next written. Writes requested by clients are
+// rejected if any of the admission hooks returns an error.
+func New(log Log, readCacheSize int, admissionHooks []AdmissionHook) *LogStructured {
 	return &LogStructured{
-		log: log,
+		log:            log,
+		ttlStore:       map[string]*ttlEventKV{},
+		readCache:      newReadCache(readCacheSize),
+		admissionHooks: admissionHooks,
 	}
 }
 
@@ -49,8 +80,16 @@ func (l *LogStructured) Start(ctx context.Context) error {
 	if err := l.log.Start(ctx); err != nil {
 		return err
 	}
+	if l.readCache != nil {
+		// The watch is started before any reads are cached, so that no writes are missed.
+		watch := l.log.Watch(ctx, "/")
+		if watch.Events == nil {
+			return errors.New("failed to start read cache watch")
+		}
+		go l.invalidateWatched(ctx, watch.Events)
+	}
 	// See https://github.com/kubernetes/kubernetes/blob/442a69c3bdf6fe8e525b05887e57d89db1e2f3a5/staging/src/k8s.io/apiserver/pkg/storage/storagebackend/factory/etcd3.go#L97
-	if _, err := l.Create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0); err != nil {
+	if _, err := l.create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0); err != nil {
 		if err != server.ErrKeyExists {
 			logrus.Errorf("Failed to create health check key: %v", err)
 		}
@@ -59,21 +98,60 @@ func (l *LogStructured) Start(ctx context.Context) error {
 	return nil
 }
 
+// Close closes the log, if supported.
+func (l *LogStructured) Close() error {
+	if closer, ok := l.log.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (l *LogStructured) Health(ctx context.Context) (*server.HealthStatus, error) {
+	return l.log.Health(ctx)
+}
+
+// SetReadOnly pauses or resumes background writes. Keys whose lease expires while in read-only
+// mode are deleted once read-only mode is disabled.
+func (l *LogStructured) SetReadOnly(readOnly bool) {
+	l.readOnly.Store(readOnly)
+	if setter, ok := l.log.(server.ReadOnlySetter); ok {
+		setter.SetReadOnly(readOnly)
+	}
+}
+
 func (l *LogStructured) Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (revRet int64, kvRet *server.KeyValue, errRet error) {
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
 		logrus.Tracef("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
 	}()
 
+	// Linearizable reads and the comparisons of transactions must observe every completed write,
+	// including those by other nodes that have not yet been seen on the watch, so they are never
+	// served from the cache.
+	cacheable := l.readCache != nil && rangeEnd == "" && !server.IsPrimaryRead(ctx)
+	var generation uint64
+	if cacheable {
+		var (
+			kv     *server.KeyValue
+			cached bool
+		)
+		if revRet, kv, generation, cached = l.readCache.get(key, revision); cached {
+			return revRet, kv, nil
+		}
+	}
+
 	rev, event, err := l.get(ctx, key, rangeEnd, limit, revision, false)
 	if event == nil {
 		return rev, nil, err
 	}
+	if cacheable && err == nil {
+		l.readCache.add(key, revision, generation, rev, event.KV)
+	}
 	return rev, event.KV, err
 }
 
 func (l *LogStructured) get(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeletes bool) (int64, *server.Event, error) {
-	rev, events, err := l.log.List(ctx, key, rangeEnd, limit, revision, includeDeletes)
+	rev, events, err := l.log.ListRange(ctx, key, rangeEnd, limit, revision, includeDeletes)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -86,6 +164,16 @@ func (l *LogStructured) get(ctx context.Context, key, rangeEnd string, limit, re
 	return rev, events[0], nil
 }
 
+// append appends the event to the log, and invalidates any cached reads of the key. Reads are
+// invalidated even if the append fails, as the key may have been written by another node.
+func (l *LogStructured) append(ctx context.Context, event *server.Event) (int64, error) {
+	rev, err := l.log.Append(ctx, event)
+	if l.readCache != nil {
+		l.readCache.invalidate(event.KV.Key)
+	}
+	return rev, err
+}
+
 func (l *LogStructured) adjustRevision(ctx context.Context, rev *int64) {
 	if *rev != 0 {
 		return
@@ -96,7 +184,19 @@ func (l *LogStructured) adjustRevision(ctx context.Context, rev *int64) {
 	}
 }
 
-func (l *LogStructured) Create(ctx context.Context, key string, value []byte, lease int64) (revRet int64, errRet error) {
+func (l *LogStructured) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	if len(l.admissionHooks) > 0 {
+		if err := l.admit(ctx, OperationCreate, key, len(value)); err != nil {
+			return 0, err
+		}
+	}
+	return l.create(ctx, key, value, lease)
+}
+
+// create creates the key without running admission hooks, as is done for keys written by kine.
+func (l *LogStructured) create(ctx context.Context, key string, value []byte, lease int64) (revRet int64, errRet error) {
+	// the existence check must see the latest write, so it cannot be served from a replica
+	ctx = server.WithPrimaryRead(ctx)
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
 		logrus.Tracef("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
@@ -124,11 +224,23 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 		createEvent.PrevKV = prevEvent.KV
 	}
 
-	revRet, errRet = l.log.Append(ctx, createEvent)
+	revRet, errRet = l.append(ctx, createEvent)
 	return
 }
 
-func (l *LogStructured) Delete(ctx context.Context, key string, revision int64) (revRet int64, kvRet *server.KeyValue, deletedRet bool, errRet error) {
+func (l *LogStructured) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	if len(l.admissionHooks) > 0 {
+		if err := l.admit(ctx, OperationDelete, key, 0); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	return l.delete(ctx, key, revision)
+}
+
+// delete deletes the key without running admission hooks, as is done for keys written by kine and
+// keys whose lease has expired.
+func (l *LogStructured) delete(ctx context.Context, key string, revision int64) (revRet int64, kvRet *server.KeyValue, deletedRet bool, errRet error) {
+	ctx = server.WithPrimaryRead(ctx)
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
 		logrus.Tracef("DELETE %s, rev=%d => rev=%d, kv=%v, deleted=%v, err=%v", key, revision, revRet, kvRet != nil, deletedRet, errRet)
@@ -157,7 +269,7 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 		PrevKV: event.KV,
 	}
 
-	rev, err = l.log.Append(ctx, deleteEvent)
+	rev, err = l.append(ctx, deleteEvent)
 	if err != nil {
 		// If error on Append we assume it's a UNIQUE constraint error, so we fetch the latest (if we can)
 		// and return that the delete failed
@@ -183,8 +295,10 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 		// if no revision is requested and no events are returned, then
 		// get the current revision and relist.  Relist is required because
 		// between now and getting the current revision something could have
-		// been created.
-		currentRev, err := l.log.CurrentRevision(ctx)
+		// been created.  The latest revision in the database is used, as the
+		// poll loop may not yet have seen writes that have already been
+		// acknowledged, such as deletes of the keys that were not returned.
+		currentRev, err := l.log.LatestRevision(ctx)
 		if err != nil {
 			return currentRev, nil, err
 		}
@@ -206,22 +320,77 @@ func (l *LogStructured) Count(ctx context.Context, prefix, startKey string, revi
 	}()
 	rev, count, err := l.log.Count(ctx, prefix, startKey, revision)
 	if err != nil {
-		return 0, 0, err
+		return rev, 0, err
 	}
 
-	if count == 0 {
-		// if count is zero, then so is revision, so now get the current revision and re-count at that revision
-		currentRev, err := l.log.CurrentRevision(ctx)
+	// Report the requested revision in the header, as List does.
+	if revision != 0 {
+		rev = revision
+	}
+	l.adjustRevision(ctx, &rev)
+	return rev, count, nil
+}
+
+// ListRange lists the keys in the range selected by key and rangeEnd, following etcd range
+// semantics.
+func (l *LogStructured) ListRange(ctx context.Context, key, rangeEnd string, limit, revision int64) (revRet int64, kvRet []*server.KeyValue, errRet error) {
+	defer func() {
+		logrus.Tracef("LISTRANGE %s, end=%s, limit=%d, rev=%d => rev=%d, kvs=%d, err=%v", key, rangeEnd, limit, revision, revRet, len(kvRet), errRet)
+	}()
+
+	rev, events, err := l.log.ListRange(ctx, key, rangeEnd, limit, revision, false)
+	if err != nil {
+		return rev, nil, err
+	}
+	if revision == 0 && len(events) == 0 {
+		// As in List, relist at the latest revision so that the revision is consistent with
+		// the empty result.
+		currentRev, err := l.log.LatestRevision(ctx)
 		if err != nil {
-			return 0, 0, err
+			return currentRev, nil, err
 		}
-		rev, rows, err := l.List(ctx, prefix, prefix, 1000, currentRev)
-		return rev, int64(len(rows)), err
+		return l.ListRange(ctx, key, rangeEnd, limit, currentRev)
+	} else if revision != 0 {
+		rev = revision
+	}
+
+	kvs := make([]*server.KeyValue, 0, len(events))
+	for _, event := range events {
+		kvs = append(kvs, event.KV)
 	}
+	return rev, kvs, nil
+}
+
+// CountRange counts the keys in the range selected by key and rangeEnd, following etcd range
+// semantics.
+func (l *LogStructured) CountRange(ctx context.Context, key, rangeEnd string, revision int64) (revRet int64, count int64, err error) {
+	defer func() {
+		logrus.Tracef("COUNTRANGE %s, end=%s, rev=%d => rev=%d, count=%d, err=%v", key, rangeEnd, revision, revRet, count, err)
+	}()
+	rev, count, err := l.log.CountRange(ctx, key, rangeEnd, revision)
+	if err != nil {
+		return rev, 0, err
+	}
+
+	if revision != 0 {
+		rev = revision
+	}
+	l.adjustRevision(ctx, &rev)
 	return rev, count, nil
 }
 
-func (l *LogStructured) Update(ctx context.Context, key string, value []byte, revision, lease int64) (revRet int64, kvRet *server.KeyValue, updateRet bool, errRet error) {
+func (l *LogStructured) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	if len(l.admissionHooks) > 0 {
+		if err := l.admit(ctx, OperationUpdate, key, len(value)); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	return l.update(ctx, key, value, revision, lease)
+}
+
+// update updates the key without running admission hooks, as is done for keys written by kine.
+func (l *LogStructured) update(ctx context.Context, key string, value []byte, revision, lease int64) (revRet int64, kvRet *server.KeyValue, updateRet bool, errRet error) {
+	ctx = server.WithPrimaryRead(ctx)
 	defer func() {
 		l.adjustRevision(ctx, &revRet)
 		kvRev := int64(0)
@@ -254,7 +423,7 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		PrevKV: event.KV,
 	}
 
-	rev, err = l.log.Append(ctx, updateEvent)
+	rev, err = l.append(ctx, updateEvent)
 	if err != nil {
 		rev, event, err := l.get(ctx, key, "", 1, 0, false)
 		if event == nil {
@@ -267,14 +436,165 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 	return rev, updateEvent.KV, true, err
 }
 
+// Import writes the keys to an empty log at their own revisions, in mod revision order, and
+// compacts the log at the revision. The log must not have been started.
+func (l *LogStructured) Import(ctx context.Context, revision int64, kvs []*server.KeyValue) error {
+	sorted := make([]*server.KeyValue, len(kvs))
+	copy(sorted, kvs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ModRevision < sorted[j].ModRevision })
+
+	events := make([]*server.Event, 0, len(sorted))
+	for _, kv := range sorted {
+		if kv.ModRevision > revision {
+			return fmt.Errorf("key %s at revision %d is after revision %d", kv.Key, kv.ModRevision, revision)
+		}
+		events = append(events, &server.Event{
+			Create: kv.CreateRevision == kv.ModRevision,
+			KV:     kv,
+		})
+	}
+	return l.log.Import(ctx, revision, events)
+}
+
+// WriteBatch applies the writes atomically, appending an event for each write to the log in a
+// single transaction. No writes are applied if the current revision of any of the keys does not
+// match the revision that its write is conditional on, or if any of the conditions does not hold,
+// in which case false is returned.
+func (l *LogStructured) WriteBatch(ctx context.Context, writes []*server.Write, conditions []*server.Condition) (revRet int64, kvsRet []*server.KeyValue, okRet bool, errRet error) {
+	ctx = server.WithPrimaryRead(ctx)
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Tracef("WRITEBATCH writes=%d => rev=%d, ok=%v, err=%v", len(writes), revRet, okRet, errRet)
+	}()
+
+	if len(l.admissionHooks) > 0 {
+		for _, write := range writes {
+			op, size := OperationUpdate, len(write.Value)
+			if write.Delete {
+				op, size = OperationDelete, 0
+			} else if write.Revision == 0 {
+				op = OperationCreate
+			}
+			if err := l.admit(ctx, op, write.Key, size); err != nil {
+				return 0, nil, false, err
+			}
+		}
+	}
+
+	events, rev, ok, err := l.batchEvents(ctx, writes, conditions)
+	if err != nil || !ok {
+		return rev, nil, false, err
+	}
+
+	revs, err := l.log.AppendBatch(ctx, events, conditions)
+	if l.readCache != nil {
+		for _, write := range writes {
+			l.readCache.invalidate(write.Key)
+		}
+	}
+	if err != nil {
+		// As in update, a failed append is assumed to be caused by a conflicting write, which is
+		// reported as such if any of the keys have since been modified.
+		if _, rev, ok, latestErr := l.batchEvents(ctx, writes, conditions); latestErr == nil && !ok {
+			return rev, nil, false, nil
+		}
+		return 0, nil, false, err
+	}
+
+	kvs := make([]*server.KeyValue, len(events))
+	for i, event := range events {
+		if event.Delete {
+			kvs[i] = event.PrevKV
+			continue
+		}
+		event.KV.ModRevision = revs[i]
+		if event.Create {
+			event.KV.CreateRevision = revs[i]
+		}
+		kvs[i] = event.KV
+	}
+	return revs[len(revs)-1], kvs, true, nil
+}
+
+// batchEvents returns the events that apply the writes to the current value of each key, or false
+// if the current revision of any of the keys does not match the revision that its write is
+// conditional on, or if any of the conditions does not hold. The conditions are checked again by
+// the log when the events are appended.
+func (l *LogStructured) batchEvents(ctx context.Context, writes []*server.Write, conditions []*server.Condition) ([]*server.Event, int64, bool, error) {
+	var rev int64
+	events := make([]*server.Event, 0, len(writes))
+	for _, write := range writes {
+		getRev, prevEvent, err := l.get(ctx, write.Key, "", 1, 0, true)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if getRev > rev {
+			rev = getRev
+		}
+		exists := prevEvent != nil && !prevEvent.Delete
+		if (write.Revision == 0 && exists) || (write.Revision != 0 && (!exists || prevEvent.KV.ModRevision != write.Revision)) {
+			return nil, rev, false, nil
+		}
+
+		event := &server.Event{
+			KV: &server.KeyValue{
+				Key:   write.Key,
+				Value: write.Value,
+				Lease: write.Lease,
+			},
+			PrevKV: &server.KeyValue{
+				ModRevision: getRev,
+			},
+		}
+		switch {
+		case write.Delete:
+			if !exists {
+				return nil, rev, false, nil
+			}
+			event.Delete = true
+			event.KV = prevEvent.KV
+			event.PrevKV = prevEvent.KV
+		case exists:
+			event.KV.CreateRevision = prevEvent.KV.CreateRevision
+			event.PrevKV = prevEvent.KV
+		default:
+			event.Create = true
+			if prevEvent != nil {
+				event.PrevKV = prevEvent.KV
+			}
+		}
+		events = append(events, event)
+	}
+	for _, condition := range conditions {
+		listRev, listEvents, err := l.log.ListRange(ctx, condition.Key, condition.RangeEnd, 0, 0, false)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if listRev > rev {
+			rev = listRev
+		}
+		kvs := make([]*server.KeyValue, 0, len(listEvents))
+		for _, event := range listEvents {
+			kvs = append(kvs, event.KV)
+		}
+		if !condition.Holds(kvs) {
+			return nil, rev, false, nil
+		}
+	}
+	return events, rev, true, nil
+}
+
 func (l *LogStructured) ttl(ctx context.Context) {
 	queue := workqueue.NewDelayingQueue()
-	rwMutex := &sync.RWMutex{}
-	ttlEventKVMap := make(map[string]*ttlEventKV)
+	rwMutex := &l.ttlMutex
+	ttlEventKVMap := l.ttlStore
+	checkpoints := l.loadLeaseCheckpoints(ctx)
+	grants := l.loadLeaseGrants(ctx)
 	go func() {
 		for l.handleTTLEvents(ctx, rwMutex, queue, ttlEventKVMap) {
 		}
 	}()
+	go l.leaseCheckpointer(ctx, rwMutex, ttlEventKVMap)
 
 	for {
 		select {
@@ -286,17 +606,24 @@ func (l *LogStructured) ttl(ctx context.Context) {
 
 		for event := range l.ttlEvents(ctx) {
 			if event.Delete {
+				// Keys deleted before they expire no longer hold their lease. The delete is
+				// ignored if the key has since been recreated.
+				rwMutex.Lock()
+				if eventKV := ttlEventKVMap[event.KV.Key]; eventKV != nil && eventKV.modRevision < event.KV.ModRevision {
+					delete(ttlEventKVMap, event.KV.Key)
+				}
+				rwMutex.Unlock()
 				continue
 			}
 
 			eventKV := loadTTLEventKV(rwMutex, ttlEventKVMap, event.KV.Key)
 			if eventKV == nil {
-				expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV)
+				expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV, checkpoints, grants)
 				logrus.Tracef("TTL add event key=%v, modRev=%v, ttl=%v", event.KV.Key, event.KV.ModRevision, expires)
 				queue.AddAfter(event.KV.Key, expires)
 			} else {
 				if event.KV.ModRevision > eventKV.modRevision {
-					expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV)
+					expires := storeTTLEventKV(rwMutex, ttlEventKVMap, event.KV, checkpoints, grants)
 					logrus.Tracef("TTL update event key=%v, modRev=%v, ttl=%v", event.KV.Key, event.KV.ModRevision, expires)
 					queue.AddAfter(event.KV.Key, expires)
 				}
@@ -315,7 +642,7 @@ func (l *LogStructured) handleTTLEvents(ctx context.Context, rwMutex *sync.RWMut
 
 	eventKV := loadTTLEventKV(rwMutex, store, key.(string))
 	if eventKV == nil {
-		logrus.Errorf("TTL event not found for key=%v", key)
+		logrus.Tracef("TTL event not found for key=%v, key was deleted", key)
 		return true
 	}
 
@@ -325,8 +652,14 @@ func (l *LogStructured) handleTTLEvents(ctx context.Context, rwMutex *sync.RWMut
 		return true
 	}
 
+	if l.readOnly.Load() {
+		logrus.Tracef("TTL expired for key=%v in read-only mode, requeuing", key)
+		queue.AddAfter(key, readOnlyRetryInterval)
+		return true
+	}
+
 	logrus.Tracef("TTL delete key=%v, modRev=%v", eventKV.key, eventKV.modRevision)
-	if _, _, _, err := l.Delete(ctx, eventKV.key, eventKV.modRevision); err != nil {
+	if _, _, _, err := l.delete(ctx, eventKV.key, eventKV.modRevision); err != nil {
 		logrus.Errorf("TTL delete trigger failed for key=%v: %v, requeuing", eventKV.key, err)
 		queue.AddAfter(eventKV.key, retryInterval)
 		return true
@@ -389,26 +722,57 @@ func loadTTLEventKV(rwMutex *sync.RWMutex, store map[string]*ttlEventKV, key str
 	return store[key]
 }
 
-func storeTTLEventKV(rwMutex *sync.RWMutex, store map[string]*ttlEventKV, eventKV *server.KeyValue) time.Duration {
+func storeTTLEventKV(rwMutex *sync.RWMutex, store map[string]*ttlEventKV, eventKV *server.KeyValue, checkpoints map[string]leaseCheckpoint, grants map[int64]time.Time) time.Duration {
 	rwMutex.Lock()
 	defer rwMutex.Unlock()
-	expires := time.Duration(eventKV.Lease) * time.Second
+	expires := leaseTTL(checkpoints, grants, eventKV.Key, eventKV.ModRevision, eventKV.Lease)
 	store[eventKV.Key] = &ttlEventKV{
 		key:         eventKV.Key,
 		modRevision: eventKV.ModRevision,
+		lease:       eventKV.Lease,
 		expiredAt:   time.Now().Add(expires),
 	}
 	return expires
 }
 
+// Leases returns the keys attached to each lease, from the expiry tracked for TTL handling, sorted
+// by lease ID. Keys that have expired but not yet been deleted by the TTL handler are included.
+func (l *LogStructured) Leases(ctx context.Context) ([]server.Lease, error) {
+	now := time.Now()
+	leases := map[int64]*server.Lease{}
+
+	l.ttlMutex.RLock()
+	for _, eventKV := range l.ttlStore {
+		lease, ok := leases[eventKV.lease]
+		if !ok {
+			lease = &server.Lease{ID: eventKV.lease}
+			leases[eventKV.lease] = lease
+		}
+		if ttl := eventKV.expiredAt.Sub(now); ttl > lease.TTL {
+			lease.TTL = ttl
+		}
+		lease.Keys = append(lease.Keys, eventKV.key)
+	}
+	l.ttlMutex.RUnlock()
+
+	result := make([]server.Lease, 0, len(leases))
+	for _, lease := range leases {
+		sort.Strings(lease.Keys)
+		result = append(result, *lease)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
 func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64) server.WatchResult {
 	logrus.Tracef("WATCH %s, revision=%d", prefix, revision)
 
 	// starting watching right away so we don't miss anything
 	ctx, cancel := context.WithCancel(ctx)
-	readChan := l.log.Watch(ctx, prefix)
+	readWatch := l.log.Watch(ctx, prefix)
 
 	// include the current revision in list
+	startRevision := revision
 	if revision > 0 {
 		revision--
 	}
@@ -417,22 +781,60 @@ func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64
 	errc := make(chan error, 1)
 	wr := server.WatchResult{Events: result, Errorc: errc}
 
-	rev, kvs, err := l.log.After(ctx, prefix, revision, 0)
-	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			logrus.Errorf("Failed to list %s for revision %d: %v", prefix, revision, err)
-			if err == server.ErrCompacted {
-				compact, _ := l.log.CompactRevision(ctx)
-				wr.CompactRevision = compact
-				wr.CurrentRevision = rev
-			} else {
+	var (
+		rev int64
+		kvs []*server.Event
+		err error
+	)
+
+	// Events after the revision most recently read by the shared poll loop are delivered to all
+	// watches through the subscription above, so only watches starting at an older revision need
+	// to list the events they have missed. A watch without a start revision begins at the current
+	// revision.
+	currentRev, cerr := l.log.CurrentRevision(ctx)
+	if cerr == nil && (startRevision == 0 || revision >= currentRev) {
+		logrus.Tracef("WATCH %s, revision=%d, currentRev=%d, skipping list", prefix, revision, currentRev)
+		if revision < currentRev {
+			revision = currentRev
+		}
+	} else {
+		rev, kvs, err = l.log.After(ctx, prefix, revision, 0)
+		if err != nil {
+			if errors.Is(err, server.ErrCompacted) {
+				// As with etcd, a watch that starts at a compacted revision is cancelled with the
+				// compact revision, so that the client knows to relist. If the compact revision
+				// cannot be read, the watch fails instead of being closed without a reason.
+				if compact, cerr := l.log.CompactRevision(ctx); cerr != nil {
+					logrus.Errorf("Failed to get compact revision for watch of %s at revision %d: %v", prefix, startRevision, cerr)
+					errc <- server.ErrGRPCUnhealthy
+				} else {
+					logrus.Debugf("WATCH %s, revision=%d is compacted, compactRev=%d, currentRev=%d", prefix, startRevision, compact, rev)
+					wr.CompactRevision = compact
+					wr.CurrentRevision = rev
+				}
+			} else if !errors.Is(err, context.Canceled) {
+				logrus.Errorf("Failed to list %s for revision %d: %v", prefix, revision, err)
 				errc <- server.ErrGRPCUnhealthy
 			}
+			cancel()
 		}
-		cancel()
-	}
 
-	logrus.Tracef("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, len(kvs))
+		// The list may include rows after the revision read by the poll loop, past revisions that
+		// have not yet been written or filled. Those events are left to the subscription, which
+		// delivers them in order once any gaps are resolved, rather than being listed out of order
+		// and then dropped from the subscription as already seen.
+		if err == nil && cerr == nil {
+			for i, event := range kvs {
+				if event.KV.ModRevision > currentRev {
+					kvs = kvs[:i]
+					break
+				}
+			}
+			rev = currentRev
+		}
+
+		logrus.Tracef("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, len(kvs))
+	}
 
 	go func() {
 		lastRevision := revision
@@ -445,9 +847,17 @@ func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64
 		}
 
 		// always ensure we fully read the channel
-		for i := range readChan {
+		for i := range readWatch.Events {
 			result <- filter(i, lastRevision)
 		}
+		select {
+		case err := <-readWatch.Errorc:
+			select {
+			case errc <- err:
+			default:
+			}
+		default:
+		}
 		close(result)
 		cancel()
 	}()
@@ -467,6 +877,15 @@ func (l *LogStructured) DbSize(ctx context.Context) (int64, error) {
 	return l.log.DbSize(ctx)
 }
 
+// DbSizeInUse estimates the size of the datastore that is in use, if supported by the log.
+func (l *LogStructured) DbSizeInUse(ctx context.Context) (int64, error) {
+	reporter, ok := l.log.(server.SizeInUseReporter)
+	if !ok {
+		return 0, errors.New("log does not support size in use reporting")
+	}
+	return reporter.DbSizeInUse(ctx)
+}
+
 func (l *LogStructured) CurrentRevision(ctx context.Context) (int64, error) {
 	return l.log.CurrentRevision(ctx)
 }
@@ -474,3 +893,7 @@ func (l *LogStructured) CurrentRevision(ctx context.Context) (int64, error) {
 func (l *LogStructured) Compact(ctx context.Context, revision int64) (int64, error) {
 	return l.log.Compact(ctx, revision)
 }
+
+func (l *LogStructured) Defragment(ctx context.Context) error {
+	return l.log.Defragment(ctx)
+}
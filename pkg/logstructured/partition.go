@@ -0,0 +1,673 @@
+package logstructured
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// partitionPollInterval is how often the partitions are polled for new rows, when no rows have
+// been written through this server.
+const partitionPollInterval = time.Second
+
+// Partition stores the keys under a prefix in a log of its own.
+type Partition struct {
+	// Prefix selects the keys stored in the partition, such as /registry/events/. It must end
+	// with a slash.
+	Prefix string
+	Log    Log
+}
+
+// PolledRevisionSetter is implemented by logs that do not compact revisions until they have been
+// delivered to watches, so that a Partitioned log can tell them which revisions it has delivered.
+type PolledRevisionSetter interface {
+	SetPolledRevision(revision int64)
+}
+
+// Partitioned is a log that stores each key in the log of the partition whose prefix it has, or in
+// a default log if it is not under the prefix of any partition, so that writes and compaction of
+// keys with a high rate of change, such as events, do not contend with the rest of the keys.
+//
+// The logs share a single revision space, such as a revision sequence shared by their tables:
+// each revision is written to one of the logs, and the current revision of every log is the
+// latest revision written to any of them. Reads that span several logs are made at a single
+// revision, and the logs are polled together so that watches receive events from all of them in
+// revision order. The logs must not be watched themselves, and must not fill the gaps in their
+// own revisions, which belong to the other logs. Transactions may not span several logs.
+type Partitioned struct {
+	fallback Log
+	// partitions are sorted by descending prefix length, so that the first partition matching a
+	// key is the one with the longest prefix.
+	partitions    []Partition
+	broadcaster   broadcaster.Broadcaster
+	ctx           context.Context
+	notify        chan int64
+	pollBatchSize int64
+	// currentRev is the newest revision that the poll loop has delivered to watches, or 0 if the
+	// poll loop has not been started.
+	currentRev atomic.Int64
+}
+
+// NewPartitioned returns a log that stores the keys under the prefix of each partition in its
+// log, and all other keys in the fallback log. Up to pollBatchSize rows are read from each log
+// when polling for watches, and watchBufferSize events are buffered for each watch.
+func NewPartitioned(fallback Log, partitions []Partition, pollBatchSize int64, watchBufferSize int) *Partitioned {
+	sorted := make([]Partition, len(partitions))
+	copy(sorted, partitions)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+
+	p := &Partitioned{
+		fallback:      fallback,
+		partitions:    sorted,
+		notify:        make(chan int64, 1024),
+		pollBatchSize: pollBatchSize,
+	}
+	p.broadcaster.BufferSize = watchBufferSize
+	return p
+}
+
+// logs returns the fallback log followed by the log of each partition.
+func (p *Partitioned) logs() []Log {
+	logs := make([]Log, 0, len(p.partitions)+1)
+	logs = append(logs, p.fallback)
+	for _, partition := range p.partitions {
+		logs = append(logs, partition.Log)
+	}
+	return logs
+}
+
+// route returns the log that stores the key.
+func (p *Partitioned) route(key string) Log {
+	for _, partition := range p.partitions {
+		if strings.HasPrefix(key, partition.Prefix) {
+			return partition.Log
+		}
+	}
+	return p.fallback
+}
+
+// rangeLogs returns the logs that may store keys in the range selected by key and rangeEnd,
+// following etcd range semantics.
+func (p *Partitioned) rangeLogs(key, rangeEnd string) []Log {
+	if rangeEnd == "" {
+		return []Log{p.route(key)}
+	}
+	for _, partition := range p.partitions {
+		if strings.HasPrefix(key, partition.Prefix) && rangeEnd != "\x00" && rangeEnd <= prefixEnd(partition.Prefix) {
+			return []Log{partition.Log}
+		}
+	}
+	logs := []Log{p.fallback}
+	for _, partition := range p.partitions {
+		if (rangeEnd == "\x00" || partition.Prefix < rangeEnd) && prefixEnd(partition.Prefix) > key {
+			logs = append(logs, partition.Log)
+		}
+	}
+	return logs
+}
+
+// prefixLogs returns the logs that may store keys matching the prefix, as passed to List. A prefix
+// that does not end with a slash selects a single key.
+func (p *Partitioned) prefixLogs(prefix string) []Log {
+	if !strings.HasSuffix(prefix, "/") {
+		return []Log{p.route(prefix)}
+	}
+	return p.rangeLogs(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the first key after all of the keys with the prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// Start starts each of the logs. Keys under the prefix of a partition that are stored in the
+// fallback log, such as those written before the partition was configured, could not be read, so
+// the log is not started if there are any.
+func (p *Partitioned) Start(ctx context.Context) error {
+	p.ctx = ctx
+	for _, log := range p.logs() {
+		if err := log.Start(ctx); err != nil {
+			return err
+		}
+	}
+	for _, partition := range p.partitions {
+		_, count, err := p.fallback.Count(ctx, partition.Prefix, partition.Prefix, 0)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("found %d keys under partition prefix %s that are not stored in the partition; partitions must be configured before any keys are written under their prefix", count, partition.Prefix)
+		}
+	}
+	return nil
+}
+
+// Close closes each of the logs, if supported. The fallback log is closed last, as the other logs
+// may share its database connections.
+func (p *Partitioned) Close() error {
+	var errs []error
+	for _, partition := range p.partitions {
+		if closer, ok := partition.Log.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	if closer, ok := p.fallback.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// SetReadOnly pauses or resumes background writes by each of the logs, if supported.
+func (p *Partitioned) SetReadOnly(readOnly bool) {
+	for _, log := range p.logs() {
+		if setter, ok := log.(server.ReadOnlySetter); ok {
+			setter.SetReadOnly(readOnly)
+		}
+	}
+}
+
+// CompactRevision returns the highest compact revision of any of the logs, as reads at or before
+// it may find that the history of some keys has been compacted.
+func (p *Partitioned) CompactRevision(ctx context.Context) (int64, error) {
+	var compactRev int64
+	for _, log := range p.logs() {
+		rev, err := log.CompactRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		compactRev = max(compactRev, rev)
+	}
+	return compactRev, nil
+}
+
+func (p *Partitioned) CurrentRevision(ctx context.Context) (int64, error) {
+	if rev := p.currentRev.Load(); rev != 0 {
+		return rev, nil
+	}
+	return p.fallback.LatestRevision(ctx)
+}
+
+// LatestRevision returns the latest revision written to any of the logs, which may be ahead of
+// CurrentRevision until the poll loop has caught up with the latest writes.
+func (p *Partitioned) LatestRevision(ctx context.Context) (int64, error) {
+	return p.fallback.LatestRevision(ctx)
+}
+
+// readRevision returns the revision at which a read spanning several logs is made, so that the
+// keys read from each log are consistent: the requested revision, or if none, the latest revision.
+func (p *Partitioned) readRevision(ctx context.Context, revision int64) (int64, error) {
+	if revision != 0 {
+		return revision, nil
+	}
+	return p.LatestRevision(ctx)
+}
+
+func (p *Partitioned) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error) {
+	logs := p.prefixLogs(prefix)
+	if len(logs) == 1 {
+		return logs[0].List(ctx, prefix, startKey, limit, revision, includeDeletes)
+	}
+	return p.listLogs(ctx, logs, limit, revision, func(log Log, revision int64) (int64, []*server.Event, error) {
+		return log.List(ctx, prefix, startKey, limit, revision, includeDeletes)
+	})
+}
+
+func (p *Partitioned) ListRange(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error) {
+	logs := p.rangeLogs(key, rangeEnd)
+	if len(logs) == 1 {
+		return logs[0].ListRange(ctx, key, rangeEnd, limit, revision, includeDeletes)
+	}
+	return p.listLogs(ctx, logs, limit, revision, func(log Log, revision int64) (int64, []*server.Event, error) {
+		return log.ListRange(ctx, key, rangeEnd, limit, revision, includeDeletes)
+	})
+}
+
+// listLogs lists the keys from each of the logs at the same revision, and merges them in key order,
+// up to the limit. If no revision is requested, the keys are listed at the latest revision, which
+// is returned.
+func (p *Partitioned) listLogs(ctx context.Context, logs []Log, limit, revision int64, list func(Log, int64) (int64, []*server.Event, error)) (int64, []*server.Event, error) {
+	readRev, err := p.readRevision(ctx, revision)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		rev    int64
+		result []*server.Event
+	)
+	for _, log := range logs {
+		logRev, events, err := list(log, readRev)
+		if err != nil {
+			return logRev, nil, err
+		}
+		rev = max(rev, logRev)
+		result = append(result, events...)
+	}
+
+	// Each key is stored in only one of the logs, so the merged keys are unique.
+	sort.SliceStable(result, func(i, j int) bool { return result[i].KV.Key < result[j].KV.Key })
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	if revision == 0 {
+		rev = readRev
+	}
+	return rev, result, nil
+}
+
+func (p *Partitioned) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error) {
+	logs := p.prefixLogs(prefix)
+	if len(logs) == 1 {
+		return logs[0].Count(ctx, prefix, startKey, revision)
+	}
+	return p.countLogs(ctx, logs, revision, func(log Log, revision int64) (int64, int64, error) {
+		return log.Count(ctx, prefix, startKey, revision)
+	})
+}
+
+func (p *Partitioned) CountRange(ctx context.Context, key, rangeEnd string, revision int64) (int64, int64, error) {
+	logs := p.rangeLogs(key, rangeEnd)
+	if len(logs) == 1 {
+		return logs[0].CountRange(ctx, key, rangeEnd, revision)
+	}
+	return p.countLogs(ctx, logs, revision, func(log Log, revision int64) (int64, int64, error) {
+		return log.CountRange(ctx, key, rangeEnd, revision)
+	})
+}
+
+// countLogs counts the keys in each of the logs at the same revision, as listLogs lists them.
+func (p *Partitioned) countLogs(ctx context.Context, logs []Log, revision int64, count func(Log, int64) (int64, int64, error)) (int64, int64, error) {
+	readRev, err := p.readRevision(ctx, revision)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rev, total int64
+	for _, log := range logs {
+		logRev, n, err := count(log, readRev)
+		if err != nil {
+			return logRev, 0, err
+		}
+		rev = max(rev, logRev)
+		total += n
+	}
+	if revision == 0 {
+		rev = readRev
+	}
+	return rev, total, nil
+}
+
+func (p *Partitioned) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	logs := p.prefixLogs(prefix)
+	if len(logs) == 1 {
+		return logs[0].After(ctx, prefix, revision, limit)
+	}
+	rev, events, _, err := p.afterLogs(ctx, logs, prefix, revision, limit)
+	return rev, events, err
+}
+
+// afterLogs returns the events after the revision from each of the logs, merged in revision order.
+// If a limit is set and any of the logs returned that many events, the events are cut off after
+// the last event returned by that log, as the events that it did not return would otherwise be
+// missing from the result, and true is returned.
+func (p *Partitioned) afterLogs(ctx context.Context, logs []Log, prefix string, revision, limit int64) (int64, []*server.Event, bool, error) {
+	var (
+		rev       int64
+		result    []*server.Event
+		truncated bool
+		lastRev   int64
+	)
+	for _, log := range logs {
+		logRev, events, err := log.After(ctx, prefix, revision, limit)
+		if err != nil {
+			return logRev, nil, false, err
+		}
+		rev = max(rev, logRev)
+		result = append(result, events...)
+		if limit > 0 && int64(len(events)) >= limit {
+			if last := events[len(events)-1].KV.ModRevision; !truncated || last < lastRev {
+				lastRev = last
+			}
+			truncated = true
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].KV.ModRevision < result[j].KV.ModRevision })
+	if truncated {
+		result = cutAfter(result, lastRev)
+	}
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	return rev, result, truncated, nil
+}
+
+// cutAfter returns the events up to and including the revision. The events must be in revision
+// order.
+func cutAfter(events []*server.Event, revision int64) []*server.Event {
+	for i, event := range events {
+		if event.KV.ModRevision > revision {
+			return events[:i]
+		}
+	}
+	return events
+}
+
+// Watch returns the events for keys matching the prefix, from all of the logs, in revision order.
+// As with a single log, if the watch does not keep up with the events, the events channel is
+// closed after ErrWatchOverflow is sent on the error channel; if events were compacted before they
+// could be delivered, it is closed after ErrCompacted is sent.
+func (p *Partitioned) Watch(ctx context.Context, prefix string) server.WatchResult {
+	res := make(chan []*server.Event, 100)
+	errc := make(chan error, 1)
+	values, err := p.broadcaster.Subscribe(ctx, p.startWatch)
+	if err != nil {
+		return server.WatchResult{}
+	}
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			if i == broadcaster.ErrOverflow {
+				logrus.Warnf("Watch of %s did not keep up with events, dropping it", prefix)
+				metrics.WatchOverflowTotal.Inc()
+				errc <- server.ErrWatchOverflow
+				return
+			}
+			if i == server.ErrCompacted {
+				errc <- server.ErrCompacted
+				return
+			}
+			if events := matchPrefix(i.([]*server.Event), checkPrefix, prefix); len(events) > 0 {
+				res <- events
+			}
+		}
+	}()
+
+	return server.WatchResult{Events: res, Errorc: errc}
+}
+
+// matchPrefix returns the events for keys matching the prefix, or the single key if checkPrefix is
+// not set.
+func matchPrefix(events []*server.Event, checkPrefix bool, prefix string) []*server.Event {
+	matched := make([]*server.Event, 0, len(events))
+	for _, event := range events {
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+func (p *Partitioned) startWatch() (chan interface{}, error) {
+	pollStart, err := p.LatestRevision(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan interface{})
+	p.setCurrentRevision(pollStart)
+	go p.poll(c)
+	return c, nil
+}
+
+// setCurrentRevision records the revision up to which events have been delivered to watches, and
+// passes it on to the logs, so that they do not compact revisions that have not been delivered.
+func (p *Partitioned) setCurrentRevision(rev int64) {
+	p.currentRev.Store(rev)
+	metrics.CurrentRevision.Set(float64(rev))
+	for _, log := range p.logs() {
+		if setter, ok := log.(PolledRevisionSetter); ok {
+			setter.SetPolledRevision(rev)
+		}
+	}
+}
+
+// poll reads new rows from all of the logs, and delivers them to watches in revision order. Before
+// the logs are read, the latest revision is read; every revision up to it has been committed to one
+// of the logs, so the events up to it are delivered, and any later events are left for the next
+// poll, as earlier revisions may not yet have been committed to the other logs.
+func (p *Partitioned) poll(result chan interface{}) {
+	wait := time.NewTicker(partitionPollInterval)
+	defer wait.Stop()
+	defer close(result)
+
+	waitForMore := true
+	for {
+		if waitForMore {
+			select {
+			case <-p.ctx.Done():
+				return
+			case check := <-p.notify:
+				if check <= p.currentRev.Load() {
+					continue
+				}
+			case <-wait.C:
+			}
+		}
+		waitForMore = true
+
+		currentRev := p.currentRev.Load()
+		latestRev, err := p.LatestRevision(p.ctx)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logrus.Errorf("fail to get latest revision: %v", err)
+			}
+			continue
+		}
+		if latestRev <= currentRev {
+			continue
+		}
+
+		_, events, truncated, err := p.afterLogs(p.ctx, p.logs(), "%", currentRev, p.pollBatchSize)
+		if errors.Is(err, server.ErrCompacted) {
+			// Revisions were compacted, by another server, before they were delivered. Watches
+			// are told to relist instead of continuing with a gap in their events.
+			compactRev, cerr := p.CompactRevision(p.ctx)
+			if cerr != nil {
+				logrus.Errorf("fail to get compact revision: %v", cerr)
+				continue
+			}
+			logrus.Warnf("Revisions after %d were compacted before they were delivered to watches, cancelling watches as compacted", currentRev)
+			result <- server.ErrCompacted
+			p.setCurrentRevision(max(compactRev, currentRev))
+			waitForMore = false
+			continue
+		} else if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				logrus.Errorf("fail to list latest changes: %v", err)
+			}
+			continue
+		}
+
+		rev := latestRev
+		if truncated && len(events) > 0 {
+			rev = min(rev, events[len(events)-1].KV.ModRevision)
+			waitForMore = false
+		}
+		events = cutAfter(events, rev)
+
+		logrus.Tracef("POLL AFTER %d, latest=%d, events=%d", currentRev, latestRev, len(events))
+
+		// As in sqllog, the current revision is stored before the events are delivered, so that a
+		// watch that subscribes after they have been delivered lists them instead of missing them.
+		p.setCurrentRevision(rev)
+		if len(events) > 0 {
+			result <- events
+		}
+	}
+}
+
+func (p *Partitioned) Append(ctx context.Context, event *server.Event) (int64, error) {
+	var key string
+	if event.KV != nil {
+		key = event.KV.Key
+	}
+	rev, err := p.route(key).Append(ctx, event)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case p.notify <- rev:
+	default:
+	}
+	return rev, nil
+}
+
+// AppendBatch appends the events to the log that stores their keys, in a single transaction.
+// Transactions cannot span several logs, so ErrNotSupported is returned if the keys of the events
+// or conditions are stored in more than one log.
+func (p *Partitioned) AppendBatch(ctx context.Context, events []*server.Event, conditions []*server.Condition) ([]int64, error) {
+	var logs []Log
+	for _, event := range events {
+		var key string
+		if event.KV != nil {
+			key = event.KV.Key
+		}
+		logs = append(logs, p.route(key))
+	}
+	for _, condition := range conditions {
+		logs = append(logs, p.rangeLogs(condition.Key, condition.RangeEnd)...)
+	}
+	if len(logs) == 0 {
+		logs = append(logs, p.fallback)
+	}
+	for _, log := range logs[1:] {
+		if log != logs[0] {
+			return nil, server.ErrNotSupported
+		}
+	}
+
+	revs, err := logs[0].AppendBatch(ctx, events, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if len(revs) > 0 {
+		select {
+		case p.notify <- revs[len(revs)-1]:
+		default:
+		}
+	}
+	return revs, nil
+}
+
+func (p *Partitioned) Import(ctx context.Context, revision int64, events []*server.Event) error {
+	return errors.New("import is not supported when keys are partitioned")
+}
+
+// DbSize returns the total size of the logs.
+func (p *Partitioned) DbSize(ctx context.Context) (int64, error) {
+	var size int64
+	for _, log := range p.logs() {
+		n, err := log.DbSize(ctx)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// DbSizeInUse returns the total size in use of the logs, if supported by all of them.
+func (p *Partitioned) DbSizeInUse(ctx context.Context) (int64, error) {
+	var size int64
+	for _, log := range p.logs() {
+		reporter, ok := log.(server.SizeInUseReporter)
+		if !ok {
+			return 0, errors.New("log does not support size in use reporting")
+		}
+		n, err := reporter.DbSizeInUse(ctx)
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// Compact compacts each of the logs up to the revision. ErrCompacted is only returned if all of
+// the logs have already been compacted to the revision.
+func (p *Partitioned) Compact(ctx context.Context, revision int64) (int64, error) {
+	var (
+		compactRev int64
+		compacted  = true
+	)
+	for _, log := range p.logs() {
+		rev, err := log.Compact(ctx, revision)
+		if err != nil && !errors.Is(err, server.ErrCompacted) {
+			return rev, err
+		}
+		compacted = compacted && err != nil
+		compactRev = max(compactRev, rev)
+	}
+	if compacted {
+		return compactRev, server.ErrCompacted
+	}
+	return compactRev, nil
+}
+
+func (p *Partitioned) Defragment(ctx context.Context) error {
+	for _, log := range p.logs() {
+		if err := log.Defragment(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Health checks each of the logs, and reports the compaction status of the fallback log, unless
+// the most recent compaction of a partition failed.
+func (p *Partitioned) Health(ctx context.Context) (*server.HealthStatus, error) {
+	status, err := p.fallback.Health(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, partition := range p.partitions {
+		partitionStatus, err := partition.Log.Health(ctx)
+		if err != nil {
+			return nil, err
+		}
+		status.CompactRevision = max(status.CompactRevision, partitionStatus.CompactRevision)
+		if partitionStatus.LastCompact != nil && !partitionStatus.LastCompactSuccess && status.LastCompactError == "" {
+			status.LastCompactSuccess = false
+			status.LastCompactError = fmt.Sprintf("partition %s: %s", partition.Prefix, partitionStatus.LastCompactError)
+		}
+	}
+	return status, nil
+}
+
+// LeaseRemaining returns the remaining TTL of each row with a lease in any of the logs, by
+// revision.
+func (p *Partitioned) LeaseRemaining(ctx context.Context) (map[int64]int64, error) {
+	remaining := map[int64]int64{}
+	for _, log := range p.logs() {
+		logRemaining, err := log.LeaseRemaining(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for rev, ttl := range logRemaining {
+			remaining[rev] = ttl
+		}
+	}
+	return remaining, nil
+}
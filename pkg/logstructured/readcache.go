@@ -0,0 +1,160 @@
+package logstructured
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// readCacheKey identifies a cached read of a key, at the requested revision. Reads of the current
+// revision are cached with revision 0.
+type readCacheKey struct {
+	name     string
+	revision int64
+}
+
+type readCacheEntry struct {
+	key readCacheKey
+	rev int64
+	kv  *server.KeyValue
+}
+
+// readCache is a bounded LRU cache of point reads, for keys that are read far more often than
+// they are written, such as leader election leases. Cached reads of a key are invalidated when the
+// key is written by this node, or when a write by another node is seen on the watch. Serializable
+// reads of the current revision may therefore return a value that has been replaced by another
+// node for up to the poll interval, as reads from a lagging etcd member may; writes are still
+// checked against the datastore, so a stale read causes a conditional update to fail rather than
+// overwrite the newer value. Reads that must be served by the primary, such as linearizable reads
+// and the comparisons of transactions, are not cached.
+//
+// Only keys that start with a slash are cached, as internal keys are not seen on the watch.
+type readCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[readCacheKey]*list.Element
+	names   map[string][]readCacheKey
+	lru     *list.List
+	// generation is incremented by every invalidation, so that a read that started before a write
+	// is not cached after the write has invalidated the key.
+	generation uint64
+}
+
+func newReadCache(size int) *readCache {
+	if size <= 0 {
+		return nil
+	}
+	return &readCache{
+		size:    size,
+		entries: map[readCacheKey]*list.Element{},
+		names:   map[string][]readCacheKey{},
+		lru:     list.New(),
+	}
+}
+
+// get returns the cached read of the key at the revision, and the current generation, which must
+// be passed to add if the read is not cached.
+func (c *readCache) get(name string, revision int64) (int64, *server.KeyValue, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[readCacheKey{name: name, revision: revision}]
+	if !ok {
+		return 0, nil, c.generation, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*readCacheEntry)
+	return entry.rev, entry.kv, c.generation, true
+}
+
+// add caches a read of the key at the revision, unless any key has been invalidated since the
+// read started.
+func (c *readCache) add(name string, revision int64, generation uint64, rev int64, kv *server.KeyValue) {
+	if !strings.HasPrefix(name, "/") {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || c.size == 0 {
+		return
+	}
+	key := readCacheKey{name: name, revision: revision}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		elem.Value = &readCacheEntry{key: key, rev: rev, kv: kv}
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&readCacheEntry{key: key, rev: rev, kv: kv})
+	c.names[name] = append(c.names[name], key)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back().Value.(*readCacheEntry).key)
+	}
+}
+
+// invalidate drops all cached reads of the key.
+func (c *readCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	for _, key := range c.names[name] {
+		if elem, ok := c.entries[key]; ok {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+	delete(c.names, name)
+}
+
+// disable drops all cached reads, and stops any further reads from being cached.
+func (c *readCache) disable() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = 0
+	c.generation++
+	c.entries = map[readCacheKey]*list.Element{}
+	c.names = map[string][]readCacheKey{}
+	c.lru.Init()
+}
+
+func (c *readCache) remove(key readCacheKey) {
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+	keys := c.names[key.name]
+	for i, k := range keys {
+		if k == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(c.names, key.name)
+	} else {
+		c.names[key.name] = keys
+	}
+}
+
+// invalidateWatched invalidates cached reads of keys written by other nodes, as they are seen on
+// the watch, until the context is cancelled.
+func (l *LogStructured) invalidateWatched(ctx context.Context, watch <-chan []*server.Event) {
+	for events := range watch {
+		for _, event := range events {
+			l.readCache.invalidate(event.KV.Key)
+		}
+	}
+	if ctx.Err() == nil {
+		// Reads can no longer be invalidated by writes from other nodes, so stop caching them.
+		logrus.Errorf("Read cache watch channel closed, disabling read cache")
+	}
+	l.readCache.disable()
+}
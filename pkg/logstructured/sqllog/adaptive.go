@@ -0,0 +1,78 @@
+package sqllog
+
+import (
+	"time"
+)
+
+const (
+	// compactGrowthPercent is the growth in the size of the database between compactions, as a
+	// percentage of its size, above which adaptive compaction runs more often.
+	compactGrowthPercent = 5
+	// compactStablePercent is the growth in the size of the database between compactions, as a
+	// percentage of its size, below which adaptive compaction backs off.
+	compactStablePercent = 1
+)
+
+// adaptiveCompaction adjusts the interval between compactions and the number of revisions
+// compacted in each batch to the pressure on the database. When the database grows quickly, or
+// more than a batch of revisions has built up since the previous compaction, the interval is
+// halved and the batch size doubled, so that compaction keeps up with bursts of writes. When the
+// size of the database is stable and the backlog fits in a single batch, the interval is doubled
+// and the batch size halved, so that little effort is spent compacting an idle database. The
+// interval stays between minInterval and maxInterval, and the batch size between minBatchSize and
+// maxBatchSize.
+type adaptiveCompaction struct {
+	minInterval  time.Duration
+	maxInterval  time.Duration
+	minBatchSize int64
+	maxBatchSize int64
+	interval     time.Duration
+	batchSize    int64
+	// lastSize is the size of the database after the previous compaction, or 0 if not known.
+	lastSize int64
+}
+
+// newAdaptiveCompaction returns a controller that starts at the maximum interval and minimum
+// batch size, or nil if minInterval is not less than maxInterval, in which case the interval and
+// batch size are fixed.
+func newAdaptiveCompaction(minInterval, maxInterval time.Duration, minBatchSize, maxBatchSize int64) *adaptiveCompaction {
+	if minInterval <= 0 || minInterval >= maxInterval {
+		return nil
+	}
+	return &adaptiveCompaction{
+		minInterval:  minInterval,
+		maxInterval:  maxInterval,
+		minBatchSize: minBatchSize,
+		maxBatchSize: max(maxBatchSize, minBatchSize),
+		interval:     maxInterval,
+		batchSize:    minBatchSize,
+	}
+}
+
+// observe records the result of a compaction: the number of revisions that were due to be
+// compacted when it started, and the size of the database after it, or a negative size if the
+// dialect does not report its size. The interval until the next compaction is returned.
+func (a *adaptiveCompaction) observe(backlog, size int64) time.Duration {
+	var growing, stable bool
+	if size >= 0 && a.lastSize > 0 {
+		growth := (size - a.lastSize) * 100
+		growing = growth > a.lastSize*compactGrowthPercent
+		stable = growth <= a.lastSize*compactStablePercent
+	} else {
+		// Without a size, only the backlog is used.
+		stable = true
+	}
+	if size > 0 {
+		a.lastSize = size
+	}
+
+	switch {
+	case growing || backlog > a.batchSize:
+		a.interval = max(a.interval/2, a.minInterval)
+		a.batchSize = min(a.batchSize*2, a.maxBatchSize)
+	case stable:
+		a.interval = min(a.interval*2, a.maxInterval)
+		a.batchSize = max(a.batchSize/2, a.minBatchSize)
+	}
+	return a.interval
+}
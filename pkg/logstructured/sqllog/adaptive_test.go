@@ -0,0 +1,45 @@
+package sqllog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveCompaction(t *testing.T) {
+	if a := newAdaptiveCompaction(0, 5*time.Minute, 1000, 4000); a != nil {
+		t.Fatal("expected fixed interval without a minimum interval")
+	}
+	if a := newAdaptiveCompaction(5*time.Minute, 5*time.Minute, 1000, 4000); a != nil {
+		t.Fatal("expected fixed interval with a minimum interval equal to the interval")
+	}
+
+	a := newAdaptiveCompaction(time.Minute, 5*time.Minute, 1000, 4000)
+	for i, step := range []struct {
+		backlog   int64
+		size      int64
+		interval  time.Duration
+		batchSize int64
+	}{
+		// The first size is only recorded.
+		{0, 1000, 5 * time.Minute, 1000},
+		// Fast growth speeds up compaction, down to the minimum interval and up to the maximum batch size.
+		{0, 1100, 150 * time.Second, 2000},
+		{0, 1200, 75 * time.Second, 4000},
+		{0, 1300, time.Minute, 4000},
+		// Moderate growth holds the current interval.
+		{0, 1330, time.Minute, 4000},
+		// A stable size backs off.
+		{0, 1330, 2 * time.Minute, 2000},
+		// More than a batch of revisions compacted at once speeds up compaction even if the
+		// size is stable.
+		{2500, 1330, time.Minute, 4000},
+		// Without a size, only the backlog is used.
+		{0, -1, 2 * time.Minute, 2000},
+		{0, -1, 4 * time.Minute, 1000},
+		{0, -1, 5 * time.Minute, 1000},
+	} {
+		if interval := a.observe(step.backlog, step.size); interval != step.interval || a.batchSize != step.batchSize {
+			t.Errorf("step %d: expected interval %v and batch size %d, got %v and %d", i, step.interval, step.batchSize, interval, a.batchSize)
+		}
+	}
+}
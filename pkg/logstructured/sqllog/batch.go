@@ -0,0 +1,126 @@
+package sqllog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// maxInsertBatchSize limits the number of rows in a single batch insert, to keep the statement
+// well below the bound parameter and packet size limits of the supported databases.
+const maxInsertBatchSize = 100
+
+type insertResult struct {
+	rev int64
+	err error
+}
+
+type pendingInsert struct {
+	ctx    context.Context
+	row    *server.InsertRow
+	result chan insertResult
+}
+
+// insertBatcher coalesces concurrent inserts that arrive within a short window into a single
+// multi-row insert. Each caller still receives the revision assigned to its own row.
+type insertBatcher struct {
+	sync.Mutex
+	d      server.Dialect
+	window time.Duration
+	// writes is set if updates and deletes are batched along with creates, so that all writes
+	// made within the window are committed together.
+	writes  bool
+	pending []*pendingInsert
+}
+
+func newInsertBatcher(d server.Dialect, window time.Duration, writes bool) *insertBatcher {
+	return &insertBatcher{
+		d:      d,
+		window: window,
+		writes: writes,
+	}
+}
+
+// batches returns true if the row for a create, or for an update or delete, should be inserted with
+// the next batch. Creates are always batched, as they are the bulk of writes when restoring or
+// bootstrapping a cluster. Updates and deletes are only batched if enabled, as concurrent writes to
+// the same key are more likely to conflict, which causes the whole batch to be retried as
+// individual inserts.
+func (b *insertBatcher) batches(create bool) bool {
+	return create || b.writes
+}
+
+// insert queues the row for insertion with the next batch, and waits for the batch to complete.
+func (b *insertBatcher) insert(ctx context.Context, row *server.InsertRow) (int64, error) {
+	p := &pendingInsert{
+		ctx:    ctx,
+		row:    row,
+		result: make(chan insertResult, 1),
+	}
+
+	b.Lock()
+	b.pending = append(b.pending, p)
+	if len(b.pending) == 1 {
+		time.AfterFunc(b.window, b.flush)
+	} else if len(b.pending) >= maxInsertBatchSize {
+		go b.run(b.take())
+	}
+	b.Unlock()
+
+	select {
+	case r := <-p.result:
+		return r.rev, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// take removes and returns all pending inserts. The caller must hold the lock.
+func (b *insertBatcher) take() []*pendingInsert {
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+func (b *insertBatcher) flush() {
+	b.Lock()
+	batch := b.take()
+	b.Unlock()
+	b.run(batch)
+}
+
+// run inserts a batch of rows. If the batch insert fails, nothing has been written, and each row
+// is retried individually so that every caller receives the result for its own row - for example,
+// only the callers whose rows violate the unique index receive ErrKeyExists.
+func (b *insertBatcher) run(batch []*pendingInsert) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if len(batch) > 1 {
+		rows := make([]*server.InsertRow, len(batch))
+		for i, p := range batch {
+			rows[i] = p.row
+		}
+		// The batch is not tied to any single caller, so it must not be cancelled if
+		// the caller that started it goes away.
+		ids, err := b.d.InsertBatch(context.WithoutCancel(batch[0].ctx), rows)
+		if err == nil {
+			logrus.Tracef("INSERT BATCH rows=%d", len(batch))
+			for i, p := range batch {
+				p.result <- insertResult{rev: ids[i]}
+			}
+			return
+		}
+		logrus.Debugf("Batch insert of %d rows failed, retrying individually: %v", len(batch), err)
+	}
+
+	for _, p := range batch {
+		row := p.row
+		rev, err := b.d.Insert(p.ctx, row.Key, row.Create, row.Delete, row.CreateRevision, row.PreviousRevision, row.TTL, row.Value, row.PrevValue)
+		p.result <- insertResult{rev: rev, err: err}
+	}
+}
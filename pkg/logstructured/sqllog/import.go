@@ -0,0 +1,94 @@
+package sqllog
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Import writes the events to the log at their own revisions, as when restoring a snapshot taken
+// from another datastore, and then compacts the log at the given revision, as the history of the
+// imported keys is not available. If the revision is after the last event, a gap fill row is
+// written at it, so that the log resumes from the revision of the snapshot.
+//
+// The log must not have been started, and must not hold any rows other than the compact revision
+// key. The events must be creates or updates, in increasing revision order, and their revisions
+// must be greater than the revision of the compact revision key. The events are written in a single
+// transaction, so nothing is imported if any of them cannot be written.
+func (s *SQLLog) Import(ctx context.Context, revision int64, events []*server.Event) error {
+	if s.allocator != nil {
+		return errors.New("import is not supported when revisions are allocated by kine")
+	}
+	if err := s.compactStart(ctx); err != nil {
+		return errors.Wrap(err, "failed to create compact revision key")
+	}
+
+	rows, err := s.d.After(ctx, "%", 0, 2)
+	if err != nil {
+		return err
+	}
+	_, _, existing, err := s.rowsToEvents(rows)
+	if err != nil {
+		return err
+	}
+	last := int64(0)
+	for _, event := range existing {
+		if event.KV.Key != "compact_rev_key" {
+			return fmt.Errorf("datastore is not empty: found key %s at revision %d", event.KV.Key, event.KV.ModRevision)
+		}
+		last = event.KV.ModRevision
+	}
+
+	t, err := s.d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer t.MustRollback()
+
+	for _, event := range events {
+		e := *event
+		if e.Delete || e.KV == nil {
+			return errors.New("only creates and updates can be imported")
+		}
+		if e.KV.ModRevision <= last {
+			return fmt.Errorf("key %s at revision %d is not after revision %d", e.KV.Key, e.KV.ModRevision, last)
+		}
+		e.PrevKV = &server.KeyValue{}
+		value, _, err := s.encryptValues(&e)
+		if err != nil {
+			return err
+		}
+		create := e.KV.CreateRevision == 0 || e.KV.CreateRevision == e.KV.ModRevision
+		createRevision := e.KV.CreateRevision
+		if create {
+			createRevision = 0
+		}
+		if err := t.InsertRevision(ctx, e.KV.ModRevision, e.KV.Key, create, false, createRevision, 0, e.KV.Lease, value, nil); err != nil {
+			return errors.Wrapf(err, "failed to import key %s at revision %d", e.KV.Key, e.KV.ModRevision)
+		}
+		last = e.KV.ModRevision
+	}
+	if revision > last {
+		if err := t.InsertRevision(ctx, revision, fmt.Sprintf("gap-%d", revision), false, true, 0, 0, 0, nil, nil); err != nil {
+			return errors.Wrapf(err, "failed to fill revision %d", revision)
+		}
+		last = revision
+	}
+	if err := t.SetCompactRevision(ctx, last); err != nil {
+		return errors.Wrap(err, "failed to set compact revision")
+	}
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	// Rows were inserted with explicit ids, which does not advance the id sequence of all
+	// databases; it is advanced so that new rows are written after the imported revisions.
+	if err := s.d.AdvanceRevision(ctx, last); err != nil {
+		return errors.Wrap(err, "failed to advance revision")
+	}
+	logrus.Infof("Imported %d keys, compacted at revision %d", len(events), last)
+	return nil
+}
@@ -0,0 +1,76 @@
+package sqllog
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// otherKeyPrefix is the prefix that writes are recorded under once the prefix limit is reached.
+const otherKeyPrefix = "other"
+
+// keyPrefixMetrics records the number of writes and the size of values written for each key
+// prefix, such as /registry/pods. The number of prefixes is bounded by the limit, to avoid
+// unbounded metric cardinality; writes to prefixes first seen after the limit is reached are
+// recorded under the "other" prefix.
+type keyPrefixMetrics struct {
+	mu       sync.RWMutex
+	limit    int
+	prefixes map[string]struct{}
+}
+
+func newKeyPrefixMetrics(limit int) *keyPrefixMetrics {
+	if limit <= 0 {
+		return nil
+	}
+	return &keyPrefixMetrics{limit: limit, prefixes: map[string]struct{}{}}
+}
+
+// observe records a write of the event, with a value of the given size.
+func (m *keyPrefixMetrics) observe(event *server.Event, size int) {
+	prefix := m.prefix(event.KV.Key)
+	operation := "update"
+	if event.Create {
+		operation = "create"
+	} else if event.Delete {
+		operation = "delete"
+	}
+	metrics.KeyPrefixWritesTotal.WithLabelValues(prefix, operation).Inc()
+	metrics.KeyPrefixWriteBytesTotal.WithLabelValues(prefix, operation).Add(float64(size))
+}
+
+// prefix returns the prefix that writes to the key are recorded under.
+func (m *keyPrefixMetrics) prefix(key string) string {
+	prefix := keyPrefix(key)
+
+	m.mu.RLock()
+	_, ok := m.prefixes[prefix]
+	m.mu.RUnlock()
+	if ok {
+		return prefix
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.prefixes[prefix]; ok {
+		return prefix
+	}
+	if len(m.prefixes) >= m.limit {
+		return otherKeyPrefix
+	}
+	m.prefixes[prefix] = struct{}{}
+	return prefix
+}
+
+// keyPrefix returns the first two segments of keys that start with a slash, such as
+// /registry/pods, or the first segment of other keys.
+func keyPrefix(key string) string {
+	if !strings.HasPrefix(key, "/") {
+		prefix, _, _ := strings.Cut(key, "/")
+		return prefix
+	}
+	parts := strings.SplitN(key, "/", 4)
+	return strings.Join(parts[:min(len(parts), 3)], "/")
+}
@@ -0,0 +1,40 @@
+package sqllog
+
+import (
+	"testing"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	for key, expected := range map[string]string{
+		"/registry/pods/default/nginx": "/registry/pods",
+		"/registry/health":             "/registry/health",
+		"/registry":                    "/registry",
+		"lease_checkpoint_key/0":       "lease_checkpoint_key",
+		"compact_rev_key":              "compact_rev_key",
+	} {
+		if prefix := keyPrefix(key); prefix != expected {
+			t.Errorf("expected prefix %s for key %s, got %s", expected, key, prefix)
+		}
+	}
+}
+
+func TestKeyPrefixMetricsLimit(t *testing.T) {
+	if newKeyPrefixMetrics(0) != nil {
+		t.Fatal("expected key prefix metrics to be disabled with a limit of 0")
+	}
+	m := newKeyPrefixMetrics(2)
+	for key, expected := range map[string]string{
+		"/registry/pods/default/a":   "/registry/pods",
+		"/registry/events/default/a": "/registry/events",
+	} {
+		if prefix := m.prefix(key); prefix != expected {
+			t.Fatalf("expected prefix %s for key %s, got %s", expected, key, prefix)
+		}
+	}
+	if prefix := m.prefix("/registry/leases/default/a"); prefix != otherKeyPrefix {
+		t.Fatalf("expected prefix %s once the limit is reached, got %s", otherKeyPrefix, prefix)
+	}
+	if prefix := m.prefix("/registry/pods/default/b"); prefix != "/registry/pods" {
+		t.Fatalf("expected known prefix to be recorded after the limit is reached, got %s", prefix)
+	}
+}
@@ -0,0 +1,22 @@
+package sqllog
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// RevisionAllocator allocates revisions for new rows. If no allocator is provided, revisions are
+// assigned by the database when rows are inserted, using the auto-increment id column.
+//
+// Revisions must be committed in order by every node writing to the table: a revision is greater
+// than that of every committed row, and no other transaction may be allocated a revision until
+// the transaction it was allocated in has committed or rolled back.
+type RevisionAllocator interface {
+	// NextRevision allocates the revision of a row inserted by the transaction.
+	NextRevision(ctx context.Context, tx server.Transaction) (int64, error)
+	// Insert inserts a row at a newly allocated revision, in a transaction of its own, and
+	// returns the revision.
+	//nolint:revive
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
+}
@@ -3,48 +3,172 @@ package sqllog
 import (
 	"context"
 	"database/sql"
+	"io"
 	"math/rand/v2"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/encryption"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// defragTimeout is the maximum time allowed for the database to be defragmented.
+const defragTimeout = 30 * time.Minute
+
+// reclaimableCheckInterval is the minimum time between estimates of the space that compaction
+// would reclaim. Estimating requires scanning the table, so it is not done on every status request.
+const reclaimableCheckInterval = time.Minute
+
+// pollInterval is how often the table is polled for new rows, when rows are being written.
+const pollInterval = time.Second
+
 type SQLLog struct {
-	d                     server.Dialect
-	broadcaster           broadcaster.Broadcaster
-	ctx                   context.Context
-	notify                chan int64
-	currentRev            int64
-	compactInterval       time.Duration
-	compactIntervalJitter int
-	compactTimeout        time.Duration
-	compactMinRetain      int64
-	compactBatchSize      int64
-	pollBatchSize         int64
-}
-
-func New(d server.Dialect, compactInterval time.Duration, compactIntervalJitter int, compactTimeout time.Duration, compactMinRetain int64, compactBatchSize int64, pollBatchSize int64) *SQLLog {
+	// compactMutex ensures that the background compactor and manual compaction
+	// requests do not run at the same time.
+	compactMutex            sync.Mutex
+	compactStatusMutex      sync.RWMutex
+	lastCompact             time.Time
+	lastCompactErr          error
+	lastCompactSuccess      time.Time
+	nextCompact             time.Time
+	d                       server.Dialect
+	broadcaster             broadcaster.Broadcaster
+	ctx                     context.Context
+	notify                  chan int64
+	compactInterval         time.Duration
+	compactMinInterval      time.Duration
+	compactIntervalJitter   int
+	compactTimeout          time.Duration
+	compactMinRetain        int64
+	compactRetention        time.Duration
+	compactDeletedRetention time.Duration
+	compactBatchSize        int64
+	compactMaxBatchSize     int64
+	compactBatchDelay       time.Duration
+	compactDryRun           bool
+	compactRepair           bool
+	pollBatchSize           int64
+	pollMaxInterval         time.Duration
+	omitPrevValuePrefixes   []string
+	transformer             encryption.Transformer
+	allocator               RevisionAllocator
+	sharedRevisions         bool
+	insertBatcher           *insertBatcher
+	keyPrefixMetrics        *keyPrefixMetrics
+	// reclaimableMutex guards the most recent estimate of the space that compaction would reclaim.
+	reclaimableMutex   sync.Mutex
+	reclaimableChecked time.Time
+	reclaimable        int64
+	// readOnly pauses the background compactor.
+	readOnly atomic.Bool
+	// currentRev is the newest revision that the poll loop has delivered to watches, or 0 if the
+	// poll loop has not been started. If the table shares its revisions with other tables, it is
+	// set by SetPolledRevision instead.
+	currentRev atomic.Int64
+	// deletedRetainedRev is the newest revision at which deleted rows may be compacted, if
+	// compactDeletedRetention is set. It is updated by the background compactor.
+	deletedRetainedRev atomic.Int64
+}
+
+// Config holds the settings of a SQLLog, which are built from the driver configuration.
+type Config struct {
+	CompactInterval         time.Duration
+	CompactMinInterval      time.Duration
+	CompactIntervalJitter   int
+	CompactTimeout          time.Duration
+	CompactMinRetain        int64
+	CompactRetention        time.Duration
+	CompactDeletedRetention time.Duration
+	CompactBatchSize        int64
+	CompactMaxBatchSize     int64
+	CompactBatchDelay       time.Duration
+	CompactDryRun           bool
+	CompactRepair           bool
+	PollBatchSize           int64
+	PollMaxInterval         time.Duration
+	OmitPrevValuePrefixes   []string
+	Transformer             encryption.Transformer
+	// Allocator allocates the revisions of new rows, if set; otherwise, revisions are assigned
+	// by the database.
+	Allocator             RevisionAllocator
+	InsertBatchWindow     time.Duration
+	InsertBatchWrites     bool
+	KeyPrefixMetricsLimit int
+	WatchBufferSize       int
+	// SharedRevisions is set if the table shares its revisions with the tables of other logs,
+	// such as the partitions of a logstructured.Partitioned log, which polls all of the tables
+	// and delivers their rows to watches in revision order. Revisions missing from the table
+	// were written to the other tables, so the log neither polls the table for watches nor fills
+	// the gaps in it; the revision delivered to watches is set with SetPolledRevision instead.
+	SharedRevisions bool
+}
+
+func New(d server.Dialect, config Config) *SQLLog {
 	l := &SQLLog{
-		d:                     d,
-		notify:                make(chan int64, 1024),
-		compactInterval:       compactInterval,
-		compactIntervalJitter: compactIntervalJitter,
-		compactTimeout:        compactTimeout,
-		compactMinRetain:      compactMinRetain,
-		compactBatchSize:      compactBatchSize,
-		pollBatchSize:         pollBatchSize,
+		d:                       d,
+		notify:                  make(chan int64, 1024),
+		compactInterval:         config.CompactInterval,
+		compactMinInterval:      config.CompactMinInterval,
+		compactIntervalJitter:   config.CompactIntervalJitter,
+		compactTimeout:          config.CompactTimeout,
+		compactMinRetain:        config.CompactMinRetain,
+		compactRetention:        config.CompactRetention,
+		compactDeletedRetention: config.CompactDeletedRetention,
+		compactBatchSize:        config.CompactBatchSize,
+		compactMaxBatchSize:     config.CompactMaxBatchSize,
+		compactBatchDelay:       config.CompactBatchDelay,
+		compactDryRun:           config.CompactDryRun,
+		compactRepair:           config.CompactRepair,
+		pollBatchSize:           config.PollBatchSize,
+		pollMaxInterval:         config.PollMaxInterval,
+		omitPrevValuePrefixes:   config.OmitPrevValuePrefixes,
+		transformer:             config.Transformer,
+		allocator:               config.Allocator,
+		sharedRevisions:         config.SharedRevisions,
+		keyPrefixMetrics:        newKeyPrefixMetrics(config.KeyPrefixMetricsLimit),
+	}
+	l.broadcaster.BufferSize = config.WatchBufferSize
+	// Batched rows are assigned revisions by the database, so inserts are not batched when
+	// revisions are allocated by kine.
+	if config.InsertBatchWindow > 0 && config.Allocator == nil {
+		l.insertBatcher = newInsertBatcher(d, config.InsertBatchWindow, config.InsertBatchWrites)
 	}
 	return l
 }
 
 func (s *SQLLog) Start(ctx context.Context) error {
 	s.ctx = ctx
-	return s.compactStart(s.ctx)
+	if err := s.compactStart(s.ctx); err != nil {
+		return err
+	}
+	if err := s.checkCompactRevision(s.ctx); err != nil {
+		return err
+	}
+	if s.sharedRevisions {
+		// The table is not polled by this log, so the compactor is started along with the log,
+		// rather than with the first watch. Revisions after the current revision are not
+		// compacted until they have been delivered to watches.
+		currentRev, err := s.d.CurrentRevision(s.ctx)
+		if err != nil {
+			return err
+		}
+		s.currentRev.Store(currentRev)
+		go s.compactor(s.compactorInterval())
+	}
+	return nil
+}
+
+// SetPolledRevision records the revision up to which the rows of the table have been delivered to
+// watches, if the table shares its revisions with other tables and is polled along with them.
+// Revisions after it are not compacted.
+func (s *SQLLog) SetPolledRevision(revision int64) {
+	s.currentRev.Store(revision)
 }
 
 func (s *SQLLog) compactStart(ctx context.Context) error {
@@ -55,7 +179,7 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 		return err
 	}
 
-	_, _, events, err := RowsToEvents(rows)
+	_, _, events, err := s.rowsToEvents(rows)
 	if err != nil {
 		return err
 	}
@@ -105,11 +229,63 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 	return t.Commit()
 }
 
+// checkCompactRevision checks that the compact revision is consistent with the rows in the table,
+// and repairs it if not. A compact revision above the current revision, such as after restoring
+// a backup taken before the compact revision was last updated, would otherwise prevent the
+// compactor from ever running again. The compact revision is reset to just below the lowest
+// revision in the table, as no revisions below that can be read; the compactor then compacts
+// forward from there. If compactRepair is set, the compact revision is reset even if it appears
+// to be consistent.
+func (s *SQLLog) checkCompactRevision(ctx context.Context) error {
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get compact revision")
+	}
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get current revision")
+	}
+	minRev, err := s.d.MinRevision(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get minimum revision")
+	}
+
+	repairedRev := int64(0)
+	if minRev > 0 {
+		repairedRev = minRev - 1
+	}
+
+	fields := logrus.Fields{
+		"compactRev":  compactRev,
+		"currentRev":  currentRev,
+		"minRev":      minRev,
+		"repairedRev": repairedRev,
+	}
+	switch {
+	case compactRev > currentRev:
+		logrus.WithFields(fields).Warn("Compact revision is greater than the current revision, repairing")
+	case s.compactRepair:
+		logrus.WithFields(fields).Info("Repair of compact revision requested")
+	default:
+		return nil
+	}
+
+	if err := s.d.SetCompactRevision(ctx, repairedRev); err != nil {
+		return errors.Wrap(err, "failed to repair compact revision")
+	}
+	return nil
+}
+
 // compactor periodically compacts historical versions of keys.
-// It will compact keys with versions older than given interval, but never within the last 1000 revisions.
+// It will compact keys with versions older than given interval, but never within the last compactMinRetain revisions.
 // In other words, after compaction, it will only contain key revisions set during last interval.
+// If compactRetention is set, revisions that were current within the retention window are also kept.
+// If compactDeletedRetention is set, rows recording the deletion of a key within that window are kept,
+// so that the final value of deleted keys can be found in the table, although it cannot be read.
 // Any API call for the older versions of keys will return error.
 // Interval is the time interval between each compaction. The first compaction happens after "interval".
+// If compactMinInterval is set, the interval and batch size adapt to the growth of the database
+// between compactMinInterval and interval; see adaptiveCompaction.
 // This logic is directly cribbed from k8s.io/apiserver/pkg/storage/etcd3/compact.go
 func (s *SQLLog) compactor(interval time.Duration) {
 	t := time.NewTicker(interval)
@@ -118,11 +294,34 @@ func (s *SQLLog) compactor(interval time.Duration) {
 	targetCompactRev, _ := s.CurrentRevision(s.ctx)
 	logrus.Tracef("COMPACT starting compactRev=%d targetCompactRev=%d", compactRev, targetCompactRev)
 
+	// history records the current revision at each interval, so that revisions that were current
+	// within the retention window are not compacted. It is not persisted, so after a restart no
+	// revisions are compacted until the server has been running for the retention window.
+	history := []revisionSample{{time: time.Now(), revision: targetCompactRev}}
+	deletedHistory := []revisionSample{history[0]}
+	adaptive := newAdaptiveCompaction(s.compactMinInterval, interval, s.compactBatchSize, s.compactMaxBatchSize)
+	if adaptive == nil && s.compactMinInterval > 0 {
+		logrus.Warnf("COMPACT minimum interval %v is not less than the interval %v; compacting at a fixed interval", s.compactMinInterval, interval)
+	}
+	batchSize := s.compactBatchSize
+	metrics.CompactInterval.Set(interval.Seconds())
+	s.scheduleCompact(time.Now().Add(interval))
+
 	for {
+		var tick time.Time
 		select {
 		case <-s.ctx.Done():
 			return
-		case <-t.C:
+		case tick = <-t.C:
+		}
+		// If a run takes longer than the interval, the ticker has already fired and the next run
+		// starts as soon as this one finishes.
+		next := tick.Add(interval)
+
+		if s.readOnly.Load() {
+			skipCompact(metrics.SkippedReadOnly, 1, "while in read-only mode")
+			s.scheduleCompact(next)
+			continue
 		}
 
 		// Break up the compaction into smaller batches to avoid locking the database with excessively
@@ -146,18 +345,64 @@ func (s *SQLLog) compactor(interval time.Duration) {
 		iterStart = time.Now()
 		iterCount = 0
 
-		for iterCompactRev < targetCompactRev {
-			// Set move iteration target compactBatchSize revisions forward, or
+		maxCompactRev := targetCompactRev
+		if s.compactRetention > 0 || s.compactDeletedRetention > 0 {
+			rev, cerr := s.CurrentRevision(s.ctx)
+			sample := revisionSample{time: iterStart, revision: rev}
+			if s.compactRetention > 0 {
+				if cerr == nil {
+					history = append(history, sample)
+				}
+				var retainedRev int64
+				retainedRev, history = retainedCompactRev(history, iterStart.Add(-s.compactRetention))
+				if retainedRev < maxCompactRev {
+					maxCompactRev = retainedRev
+				}
+			}
+			if s.compactDeletedRetention > 0 {
+				if cerr == nil {
+					deletedHistory = append(deletedHistory, sample)
+				}
+				var retainedRev int64
+				retainedRev, deletedHistory = retainedCompactRev(deletedHistory, iterStart.Add(-s.compactDeletedRetention))
+				s.deletedRetainedRev.Store(retainedRev)
+			}
+		}
+
+		// In dry run mode, only report what would be deleted. The compact revision is not moved,
+		// so each interval reports all rows that could be deleted up to the current target.
+		if s.compactDryRun {
+			if dbCompactRev, current, derr := s.compactDryRunReport(s.ctx, maxCompactRev, s.compactMinRetain); derr != nil {
+				logrus.Errorf("Compact dry run failed: %v", derr)
+			} else {
+				compactRev = dbCompactRev
+				targetCompactRev = current
+			}
+			s.observeCompactState(compactRev, targetCompactRev)
+			s.scheduleCompact(next)
+			continue
+		}
+
+		// A manual compaction or defragmentation may still be running; rather than wait for it,
+		// this cycle is skipped, as it has already compacted or will be followed by the next cycle.
+		if !s.compactMutex.TryLock() {
+			skipCompact(metrics.SkippedRunning, 1, "while a manual compaction or defragmentation is running")
+			s.scheduleCompact(next)
+			continue
+		}
+
+		for iterCompactRev < maxCompactRev {
+			// Set move iteration target batchSize revisions forward, or
 			// just as far as we need to hit the compaction target if that would
 			// overshoot it.
-			iterCompactRev += s.compactBatchSize
-			if iterCompactRev > targetCompactRev {
-				iterCompactRev = targetCompactRev
+			iterCompactRev += batchSize
+			if iterCompactRev > maxCompactRev {
+				iterCompactRev = maxCompactRev
 			}
 
 			// only update the compacted and current revisions if they are valid,
 			// but break out of the inner loop on any error.
-			compacted, current, cerr := s.compact(compactedRev, iterCompactRev)
+			compacted, current, cerr := s.compact(s.ctx, compactedRev, iterCompactRev, s.compactMinRetain)
 			if compacted != 0 && current != 0 {
 				compactedRev = compacted
 				currentRev = current
@@ -167,22 +412,38 @@ func (s *SQLLog) compactor(interval time.Duration) {
 				break
 			}
 			iterCount++
+			if iterCompactRev < maxCompactRev && !s.compactBatchWait(s.ctx) {
+				break
+			}
 		}
 
 		if iterCount > 0 {
-			logrus.Infof("COMPACT compacted from %d to %d in %d transactions over %s", compactRev, compactedRev, iterCount, time.Now().Sub(iterStart).Round(time.Millisecond))
+			logrus.WithFields(logrus.Fields{
+				"compactRev":   compactRev,
+				"compactedRev": compactedRev,
+				"transactions": iterCount,
+				"duration":     time.Since(iterStart).Round(time.Millisecond),
+			}).Info("COMPACT completed")
 
 			// post-compact operation errors are not critical, but should be reported
-			if perr := s.postCompact(); perr != nil {
+			if perr := s.postCompact(s.ctx); perr != nil {
 				logrus.Errorf("Post-compact operations failed: %v", perr)
 			}
 		}
+		s.compactMutex.Unlock()
+
+		// The ticker holds a single tick, so the ticks of any further intervals that passed while
+		// this cycle was running were dropped.
+		if missed := int64(time.Since(tick)/interval) - 1; missed > 0 {
+			skipCompact(metrics.SkippedRunning, missed, "as the previous compaction was still running")
+		}
 
 		// Only store the final results for this compact interval if currentRev is
 		// updated to the current compact revision.
 		//
 		// Note that one or more of the small-batch compact transactions may have
 		// succeeded and moved the compact revision forward, even if err is non-nil.
+		compactedRevs := compactedRev - compactRev
 		if currentRev > 0 {
 			compactRev = compactedRev
 			targetCompactRev = currentRev
@@ -194,12 +455,141 @@ func (s *SQLLog) compactor(interval time.Duration) {
 			logrus.Errorf("Compact failed: %v", err)
 			resultLabel = metrics.ResultError
 		}
+		if resultLabel == metrics.ResultSuccess {
+			err = nil
+		}
+		size := s.observeCompactState(compactRev, targetCompactRev)
+		if adaptive != nil {
+			if adapted := adaptive.observe(compactedRevs, size); adapted != interval {
+				logrus.WithFields(logrus.Fields{
+					"interval":  adapted,
+					"batchSize": adaptive.batchSize,
+				}).Info("COMPACT adjusted interval")
+				interval = adapted
+				t.Reset(interval)
+				next = time.Now().Add(interval)
+				metrics.CompactInterval.Set(interval.Seconds())
+			}
+			batchSize = adaptive.batchSize
+		}
+		s.recordCompactResult(iterStart, err)
+		s.scheduleCompact(next)
 		metrics.CompactTotal.WithLabelValues(resultLabel).Inc()
+		metrics.CompactDuration.WithLabelValues(resultLabel).Observe(time.Since(iterStart).Seconds())
+		s.logCompactStatus(compactRev, targetCompactRev)
+	}
+}
+
+// skipCompact records that count compaction cycles were skipped for the reason.
+func skipCompact(reason string, count int64, msg string) {
+	logrus.WithField("cycles", count).Debugf("COMPACT skipped %s", msg)
+	metrics.CompactSkippedTotal.WithLabelValues(reason).Add(float64(count))
+}
+
+// recordCompactResult records the start time and result of the most recent compaction, for health
+// reporting and metrics.
+func (s *SQLLog) recordCompactResult(start time.Time, err error) {
+	s.compactStatusMutex.Lock()
+	defer s.compactStatusMutex.Unlock()
+	s.lastCompact = start
+	s.lastCompactErr = err
+	metrics.CompactLastAttemptTimestamp.Set(float64(start.Unix()))
+	if err == nil {
+		s.lastCompactSuccess = start
+		metrics.CompactLastSuccessTimestamp.Set(float64(start.Unix()))
+		metrics.CompactLastError.Set(0)
+	} else {
+		metrics.CompactLastError.Set(1)
 	}
 }
 
+// scheduleCompact records the time at which compaction is next due to run.
+func (s *SQLLog) scheduleCompact(next time.Time) {
+	s.compactStatusMutex.Lock()
+	defer s.compactStatusMutex.Unlock()
+	s.nextCompact = next
+	metrics.CompactNextRunTimestamp.Set(float64(next.Unix()))
+}
+
+// logCompactStatus logs the result of the most recent compaction, along with the time of the last
+// successful compaction and of the next run, so that stalled compaction can be spotted in the logs.
+func (s *SQLLog) logCompactStatus(compactRev, currentRev int64) {
+	s.compactStatusMutex.RLock()
+	defer s.compactStatusMutex.RUnlock()
+	fields := logrus.Fields{
+		"compactRev": compactRev,
+		"currentRev": currentRev,
+		"nextRun":    s.nextCompact.Format(time.RFC3339),
+	}
+	if !s.lastCompactSuccess.IsZero() {
+		fields["lastSuccess"] = s.lastCompactSuccess.Format(time.RFC3339)
+	}
+	if s.lastCompactErr != nil {
+		logrus.WithFields(fields).WithError(s.lastCompactErr).Warn("COMPACT cycle failed")
+		return
+	}
+	logrus.WithFields(fields).Info("COMPACT cycle finished")
+}
+
+// Close closes the dialect's database connections, if supported.
+func (s *SQLLog) Close() error {
+	if closer, ok := s.d.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SetReadOnly pauses or resumes the background compactor. Compactions that are in progress are
+// not interrupted.
+func (s *SQLLog) SetReadOnly(readOnly bool) {
+	s.readOnly.Store(readOnly)
+}
+
+// Health checks connectivity to the database, and returns the current and compact revisions
+// along with the result of the most recent compaction.
+func (s *SQLLog) Health(ctx context.Context) (*server.HealthStatus, error) {
+	if err := s.d.Ping(ctx); err != nil {
+		return nil, err
+	}
+
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &server.HealthStatus{
+		CurrentRevision: currentRev,
+		CompactRevision: compactRev,
+	}
+
+	s.compactStatusMutex.RLock()
+	defer s.compactStatusMutex.RUnlock()
+	if !s.lastCompact.IsZero() {
+		lastCompact := s.lastCompact
+		status.LastCompact = &lastCompact
+		status.LastCompactSuccess = s.lastCompactErr == nil
+		if s.lastCompactErr != nil {
+			status.LastCompactError = s.lastCompactErr.Error()
+		}
+	}
+	if !s.lastCompactSuccess.IsZero() {
+		lastCompactSuccess := s.lastCompactSuccess
+		status.LastSuccessfulCompact = &lastCompactSuccess
+	}
+	if !s.nextCompact.IsZero() {
+		nextCompact := s.nextCompact
+		status.NextCompact = &nextCompact
+	}
+	return status, nil
+}
+
 // compact removes deleted or replaced rows from the database, and updates the compact rev key.
 // compactRev is the current compact revision; targetCompactRev is the revision to compact to.
+// The most recent compactMinRetain revisions are never compacted.
 // If compactRev does not match what's in the database, we know that someone else has compacted and we don't need to do it.
 // Deletion of rows and update of the compact rev key is done within a single transaction. The transaction is rolled back on any error.
 //
@@ -209,8 +599,8 @@ func (s *SQLLog) compactor(interval time.Duration) {
 // On any other error, the returned compact and current revisions should not be used.
 //
 // This logic is cribbed from k8s.io/apiserver/pkg/storage/etcd3/compact.go
-func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64, error) {
-	ctx, cancel := context.WithTimeout(s.ctx, s.compactTimeout)
+func (s *SQLLog) compact(ctx context.Context, compactRev int64, targetCompactRev int64, compactMinRetain int64) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.compactTimeout)
 	defer cancel()
 
 	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
@@ -219,24 +609,33 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	}
 	defer t.MustRollback()
 
-	currentRev, err := t.CurrentRevision(s.ctx)
+	currentRev, err := t.CurrentRevision(ctx)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "failed to get current revision")
 	}
 
-	dbCompactRev, err := t.GetCompactRevision(s.ctx)
+	dbCompactRev, err := t.GetCompactRevision(ctx)
 	if err != nil {
 		return 0, 0, errors.Wrap(err, "failed to get compact revision")
 	}
 
 	// Check to see if another node already compacted. This is normal on a multi-server cluster.
 	if compactRev != dbCompactRev {
-		logrus.Infof("COMPACT compact revision changed since last iteration: %d => %d", compactRev, dbCompactRev)
+		logrus.WithFields(logrus.Fields{
+			"compactRev":   compactRev,
+			"dbCompactRev": dbCompactRev,
+		}).Info("COMPACT compact revision changed since last iteration")
 		return dbCompactRev, currentRev, server.ErrCompacted
 	}
 
-	// Ensure that we never compact the most recent 1000 revisions
-	targetCompactRev = safeCompactRev(targetCompactRev, currentRev, s.compactMinRetain)
+	// Ensure that we never compact the most recent revisions
+	targetCompactRev = safeCompactRev(targetCompactRev, currentRev, compactMinRetain)
+
+	// Revisions that the poll loop has not yet delivered to watches are not compacted, so that
+	// watches do not miss events that are removed before they are read.
+	if polledRev := s.currentRev.Load(); polledRev != 0 && targetCompactRev > polledRev {
+		targetCompactRev = polledRev
+	}
 
 	// Don't bother compacting to a revision that has already been compacted
 	if targetCompactRev <= compactRev {
@@ -244,15 +643,19 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 		return dbCompactRev, currentRev, server.ErrCompacted
 	}
 
-	logrus.Infof("COMPACT compactRev=%d targetCompactRev=%d currentRev=%d", compactRev, targetCompactRev, currentRev)
+	logrus.WithFields(logrus.Fields{
+		"compactRev":       compactRev,
+		"targetCompactRev": targetCompactRev,
+		"currentRev":       currentRev,
+	}).Info("COMPACT starting batch")
 
 	start := time.Now()
-	deletedRows, err := t.Compact(s.ctx, targetCompactRev)
+	deletedRows, err := t.Compact(ctx, targetCompactRev, s.deletedCompactRev(targetCompactRev))
 	if err != nil {
 		return 0, 0, errors.Wrapf(err, "failed to compact to revision %d", targetCompactRev)
 	}
 
-	if err := t.SetCompactRevision(s.ctx, targetCompactRev); err != nil {
+	if err := t.SetCompactRevision(ctx, targetCompactRev); err != nil {
 		return 0, 0, errors.Wrap(err, "failed to record compact revision")
 	}
 
@@ -260,23 +663,95 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	// updating the compact revision without any errors. The deferred rollback
 	// becomes a no-op if the transaction is committed.
 	t.MustCommit()
-	logrus.Infof("COMPACT deleted %d rows from %d revisions in %s - compacted to %d/%d", deletedRows, (targetCompactRev - compactRev), time.Since(start), targetCompactRev, currentRev)
+	metrics.CompactDeletedRowsTotal.Add(float64(deletedRows))
+	logrus.WithFields(logrus.Fields{
+		"deletedRows":      deletedRows,
+		"revisions":        targetCompactRev - compactRev,
+		"duration":         time.Since(start),
+		"targetCompactRev": targetCompactRev,
+		"currentRev":       currentRev,
+	}).Info("COMPACT batch completed")
 
 	return targetCompactRev, currentRev, nil
 }
 
+// compactDryRunReport logs the number and approximate size of the rows that would be deleted by
+// compacting to targetCompactRev, without deleting them. As with compact, the most recent
+// compactMinRetain revisions are excluded. The compact and current revisions from the database are
+// returned.
+func (s *SQLLog) compactDryRunReport(ctx context.Context, targetCompactRev int64, compactMinRetain int64) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.compactTimeout)
+	defer cancel()
+
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to get current revision")
+	}
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to get compact revision")
+	}
+
+	targetCompactRev = safeCompactRev(targetCompactRev, currentRev, compactMinRetain)
+	if targetCompactRev <= compactRev {
+		logrus.Tracef("COMPACT dry run revision %d has already been compacted", targetCompactRev)
+		return compactRev, currentRev, nil
+	}
+
+	start := time.Now()
+	rows, size, err := s.d.CompactDryRun(ctx, targetCompactRev, s.deletedCompactRev(targetCompactRev))
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "failed to select rows to compact to revision %d", targetCompactRev)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"deletableRows":    rows,
+		"deletableBytes":   size,
+		"revisions":        targetCompactRev - compactRev,
+		"duration":         time.Since(start),
+		"compactRev":       compactRev,
+		"targetCompactRev": targetCompactRev,
+		"currentRev":       currentRev,
+	}).Info("COMPACT dry run completed")
+
+	return compactRev, currentRev, nil
+}
+
+// observeCompactState updates the compaction gauges with the gap between the current and compact
+// revisions, and the current database size. The size is returned, or -1 if it is not known.
+func (s *SQLLog) observeCompactState(compactRev, currentRev int64) int64 {
+	if currentRev > 0 {
+		metrics.CompactRevisionGap.Set(float64(currentRev - compactRev))
+	}
+	// not all drivers support size reporting, so errors are only logged at trace level
+	size, err := s.d.GetSize(s.ctx)
+	if err != nil {
+		logrus.Tracef("COMPACT failed to get database size: %v", err)
+		return -1
+	}
+	metrics.DBSizeBytes.Set(float64(size))
+	return size
+}
+
 // postCompact executes any post-compact database cleanup - vacuuming, WAL truncate, etc.
-func (s *SQLLog) postCompact() error {
-	return s.d.PostCompact(s.ctx)
+func (s *SQLLog) postCompact(ctx context.Context) error {
+	return s.d.PostCompact(ctx)
 }
 
 func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
-	if s.currentRev != 0 {
-		return s.currentRev, nil
+	if rev := s.currentRev.Load(); rev != 0 {
+		return rev, nil
 	}
 	return s.d.CurrentRevision(ctx)
 }
 
+// LatestRevision returns the latest revision written to the database, which may be ahead of
+// CurrentRevision until the poll loop has caught up with the latest writes.
+func (s *SQLLog) LatestRevision(ctx context.Context) (int64, error) {
+	return s.d.CurrentRevision(ctx)
+}
+
 func (s *SQLLog) CompactRevision(ctx context.Context) (int64, error) {
 	return s.d.GetCompactRevision(ctx)
 }
@@ -291,9 +766,9 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 		return 0, nil, err
 	}
 
-	rev, compact, result, err := RowsToEvents(rows)
+	rev, compact, result, err := s.rowsToEvents(rows)
 
-	if revision > 0 && len(result) == 0 {
+	if len(result) == 0 {
 		// a zero length result won't have the compact or current revisions so get them manually
 		rev, err = s.CurrentRevision(ctx)
 		if err != nil {
@@ -305,7 +780,9 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 		}
 	}
 
-	if revision > 0 && revision < compact {
+	// Events at or before the compact revision may have been removed, so listing events after any
+	// earlier revision, including from the start of the log, would silently skip them.
+	if revision < compact {
 		return rev, nil, server.ErrCompacted
 	}
 
@@ -314,8 +791,11 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 
 func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
 	var (
-		rows *sql.Rows
+		rows server.Rows
 		err  error
+
+		listPrefix   = prefix
+		listStartKey = startKey
 	)
 
 	// It's assumed that when there is a start key that that key exists.
@@ -339,14 +819,46 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		return 0, nil, err
 	}
 
-	rev, compact, result, err := RowsToEvents(rows)
+	rev, result, err := s.listResult(ctx, rows, revision)
+	if err == server.ErrFutureRev && !server.IsPrimaryRead(ctx) {
+		// A read replica may not have caught up to a revision that the client has already
+		// seen from the primary; retry against the primary before reporting a future revision.
+		return s.List(server.WithPrimaryRead(ctx), listPrefix, listStartKey, limit, revision, includeDeleted)
+	}
+	return rev, result, err
+}
+
+// ListRange returns the latest event for each key in the range selected by key and rangeEnd,
+// following etcd range semantics: an empty rangeEnd selects the single key, a rangeEnd of "\x00"
+// selects all keys greater than or equal to key, and any other rangeEnd selects the keys greater
+// than or equal to key and less than rangeEnd.
+func (s *SQLLog) ListRange(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	start, end := keyRange(key, rangeEnd)
+	rows, err := s.d.ListRange(ctx, start, end, limit, revision, includeDeleted)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rev, result, err := s.listResult(ctx, rows, revision)
+	if err == server.ErrFutureRev && !server.IsPrimaryRead(ctx) {
+		return s.ListRange(server.WithPrimaryRead(ctx), key, rangeEnd, limit, revision, includeDeleted)
+	}
+	return rev, result, err
+}
+
+// listResult reads the events from the rows of a list, and checks that the requested revision
+// has been neither compacted nor not yet written.
+func (s *SQLLog) listResult(ctx context.Context, rows server.Rows, revision int64) (int64, []*server.Event, error) {
+	rev, compact, result, err := s.rowsToEvents(rows)
 	if err != nil {
 		return 0, nil, err
 	}
 
 	if revision > 0 && len(result) == 0 {
-		// a zero length result won't have the compact or current revisions so get them manually
-		rev, err = s.CurrentRevision(ctx)
+		// a zero length result won't have the compact or current revisions so get them manually.
+		// The current revision is read from the database, as it is for other results, rather
+		// than taken from the poll loop, which may not have caught up with the latest writes.
+		rev, err = s.d.CurrentRevision(ctx)
 		if err != nil {
 			return 0, nil, err
 		}
@@ -372,7 +884,17 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 	return rev, result, err
 }
 
-func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
+// keyRange returns the bounds of the range selected by an etcd key and range_end, as passed to
+// the dialect. A single key is selected by the range from the key to the key followed by a NUL,
+// which is the next possible key.
+func keyRange(key, rangeEnd string) (string, string) {
+	if rangeEnd == "" {
+		return key, key + "\x00"
+	}
+	return key, rangeEnd
+}
+
+func RowsToEvents(rows server.Rows) (int64, int64, []*server.Event, error) {
 	var (
 		result  []*server.Event
 		rev     int64
@@ -391,11 +913,46 @@ func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
 	return rev, compact, result, nil
 }
 
-func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+// rowsToEvents converts rows to events, decrypting values if encryption at rest is enabled.
+func (s *SQLLog) rowsToEvents(rows server.Rows) (int64, int64, []*server.Event, error) {
+	rev, compact, result, err := RowsToEvents(rows)
+	if err != nil || (s.transformer == nil && len(s.omitPrevValuePrefixes) == 0) {
+		return rev, compact, result, err
+	}
+
+	for _, event := range result {
+		if event.PrevKV != nil && !event.Delete && s.omitPrevValue(event.KV.Key) {
+			// The previous value is not stored, so none is reported, rather than an empty value.
+			event.PrevKV = nil
+		}
+		if s.transformer == nil {
+			continue
+		}
+		// PrevKV.Key is not populated from the row, but always matches the current key
+		event.KV.Value, err = s.transformer.Decrypt(event.KV.Key, event.KV.Value)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if event.PrevKV != nil {
+			event.PrevKV.Value, err = s.transformer.Decrypt(event.KV.Key, event.PrevKV.Value)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+		}
+	}
+
+	return rev, compact, result, nil
+}
+
+// Watch returns the events for keys matching the prefix. If the watch does not keep up with the
+// events, the events channel is closed after ErrWatchOverflow is sent on the error channel; if
+// events were compacted before they could be delivered, it is closed after ErrCompacted is sent.
+func (s *SQLLog) Watch(ctx context.Context, prefix string) server.WatchResult {
 	res := make(chan []*server.Event, 100)
+	errc := make(chan error, 1)
 	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
 	if err != nil {
-		return nil
+		return server.WatchResult{}
 	}
 
 	checkPrefix := strings.HasSuffix(prefix, "/")
@@ -403,6 +960,16 @@ func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Even
 	go func() {
 		defer close(res)
 		for i := range values {
+			if i == broadcaster.ErrOverflow {
+				logrus.Warnf("Watch of %s did not keep up with events, dropping it", prefix)
+				metrics.WatchOverflowTotal.Inc()
+				errc <- server.ErrWatchOverflow
+				return
+			}
+			if i == server.ErrCompacted {
+				errc <- server.ErrCompacted
+				return
+			}
 			events, ok := filter(i, checkPrefix, prefix)
 			if ok {
 				res <- events
@@ -410,7 +977,7 @@ func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Even
 		}
 	}()
 
-	return res
+	return server.WatchResult{Events: res, Errorc: errc}
 }
 
 func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Event, bool) {
@@ -427,6 +994,10 @@ func filter(events interface{}, checkPrefix bool, prefix string) ([]*server.Even
 }
 
 func (s *SQLLog) startWatch() (chan interface{}, error) {
+	if s.sharedRevisions {
+		return nil, errors.New("table shares its revisions with other tables, and must be watched along with them")
+	}
+
 	pollStart, err := s.d.CurrentRevision(s.ctx)
 	if err != nil {
 		return nil, err
@@ -434,29 +1005,58 @@ func (s *SQLLog) startWatch() (chan interface{}, error) {
 
 	c := make(chan interface{})
 
+	// start compaction and polling at the same time to watch starts
+	// at the oldest revision, but compaction doesn't create gaps
+	s.currentRev.Store(pollStart)
+	go s.compactor(s.compactorInterval())
+	go s.poll(c)
+	go s.listen()
+	return c, nil
+}
+
+// compactorInterval returns the compact interval, adjusted by a random jitter of up to
+// compactIntervalJitter percent, so that servers sharing the datastore do not compact in step.
+func (s *SQLLog) compactorInterval() time.Duration {
 	if s.compactIntervalJitter < 0 || s.compactIntervalJitter > 100 {
 		panic("jitterPercent must be between 0 and 100")
 	}
 	maxJitter := float64(s.compactIntervalJitter) / 100.0 * float64(s.compactInterval)
-	jitter := time.Duration(rand.Float64()*2*maxJitter - maxJitter)
-
-	// start compaction and polling at the same time to watch starts
-	// at the oldest revision, but compaction doesn't create gaps
-	go s.compactor(s.compactInterval + jitter)
-	go s.poll(c, pollStart)
-	return c, nil
+	return s.compactInterval + time.Duration(rand.Float64()*2*maxJitter-maxJitter)
 }
 
-func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
-	s.currentRev = pollStart
+// listen wakes the poll loop as soon as the driver reports that a new row has been inserted,
+// instead of waiting for the next poll interval. If the notification connection fails it is
+// re-established after a delay; polling continues in the meantime.
+func (s *SQLLog) listen() {
+	for {
+		err := s.d.Listen(s.ctx, s.notify)
+		if err == nil || s.ctx.Err() != nil {
+			return
+		}
+		logrus.Warnf("Insert notification listener failed, falling back to polling: %v", err)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
 
+func (s *SQLLog) poll(result chan interface{}) {
 	var (
 		skip        int64
 		skipTime    time.Time
 		waitForMore = true
+		// gapEnd is the revision after the last gap that was observed, so that the gap is not
+		// observed again as each of its revisions is filled.
+		gapEnd int64
+		// idlePolls is the number of consecutive polls that found no new rows, and skippedTicks
+		// is the number of ticks since the last poll.
+		idlePolls    int64
+		skippedTicks int64
 	)
 
-	wait := time.NewTicker(time.Second)
+	wait := time.NewTicker(pollInterval)
 	defer wait.Stop()
 	defer close(result)
 
@@ -466,15 +1066,19 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 			case <-s.ctx.Done():
 				return
 			case check := <-s.notify:
-				if check <= s.currentRev {
+				if check <= s.currentRev.Load() {
 					continue
 				}
 			case <-wait.C:
+				if skippedTicks++; skippedTicks < s.pollTicks(idlePolls) {
+					continue
+				}
 			}
 		}
 		waitForMore = true
+		skippedTicks = 0
 
-		rows, err := s.d.After(s.ctx, "%", s.currentRev, s.pollBatchSize)
+		rows, err := s.d.After(s.ctx, "%", s.currentRev.Load(), s.pollBatchSize)
 		if err != nil {
 			if !errors.Is(err, context.Canceled) {
 				logrus.Errorf("fail to list latest changes: %v", err)
@@ -482,24 +1086,27 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 			continue
 		}
 
-		_, _, events, err := RowsToEvents(rows)
+		_, compactRev, events, err := s.rowsToEvents(rows)
 		if err != nil {
 			logrus.Errorf("fail to convert rows changes: %v", err)
 			continue
 		}
 
-		logrus.Tracef("POLL AFTER %d, limit=%d, events=%d", s.currentRev, s.pollBatchSize, len(events))
+		logrus.Tracef("POLL AFTER %d, limit=%d, events=%d", s.currentRev.Load(), s.pollBatchSize, len(events))
 
 		if len(events) == 0 {
+			idlePolls++
 			continue
 		}
 
+		idlePolls = 0
 		waitForMore = len(events) < 100
 
-		rev := s.currentRev
+		rev := s.currentRev.Load()
 		var (
 			sequential []*server.Event
 			saveLast   bool
+			compacted  bool
 		)
 
 		for _, event := range events {
@@ -508,13 +1115,24 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 			// we don't want to notify row 4 because 3 is essentially dropped forever.
 			if event.KV.ModRevision != next {
 				logrus.Tracef("MODREVISION GAP: expected %v, got %v", next, event.KV.ModRevision)
-				if canSkipRevision(next, skip, skipTime) {
+				if next <= compactRev {
+					// The missing revisions were compacted, by another server, before they
+					// were delivered. They cannot be waited for or filled, so watches are
+					// told to relist instead of continuing with a gap in their events.
+					logrus.Warnf("Revisions %d to %d were compacted before they were delivered to watches, cancelling watches as compacted", next, event.KV.ModRevision-1)
+					compacted = true
+					break
+				} else if canSkipRevision(next, skip, skipTime) {
 					// This situation should never happen, but we have it here as a fallback just for unknown reasons
 					// we don't want to pause all watches forever
 					logrus.Errorf("GAP %s, revision=%d, delete=%v, next=%d", event.KV.Key, event.KV.ModRevision, event.Delete, next)
 				} else if skip != next {
 					// This is the first time we have encountered this missing revision, so record time start
 					// and trigger a quick retry for simple out of order events
+					if next > gapEnd {
+						gapEnd = event.KV.ModRevision
+						observeRevisionGap(next, gapEnd)
+					}
 					skip = next
 					skipTime = time.Now()
 					select {
@@ -558,11 +1176,41 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 		}
 
 		if saveLast {
-			s.currentRev = rev
+			s.currentRev.Store(rev)
+			metrics.CurrentRevision.Set(float64(rev))
 			if len(sequential) > 0 {
 				result <- sequential
 			}
 		}
+		if compacted {
+			result <- server.ErrCompacted
+			s.currentRev.Store(compactRev)
+			metrics.CurrentRevision.Set(float64(compactRev))
+			waitForMore = false
+		}
+	}
+}
+
+// pollTicks returns the number of poll intervals to wait before polling again, after the given
+// number of consecutive polls found no new rows. If a max poll interval is set, the wait doubles
+// with each idle poll until it reaches the max, and returns to a single interval as soon as a poll
+// finds new rows. Rows written through this server, or reported by the driver's insert listener,
+// are polled for immediately, so only rows written by other servers are delayed by the backoff.
+func (s *SQLLog) pollTicks(idlePolls int64) int64 {
+	maxTicks := int64(s.pollMaxInterval / pollInterval)
+	if maxTicks <= 1 || idlePolls == 0 {
+		return 1
+	}
+	return min(int64(1)<<min(idlePolls, 32), maxTicks)
+}
+
+// observeRevisionGap records the size of a gap between the next expected revision and the revision
+// that was found instead, logging a warning if the gap is large.
+func observeRevisionGap(next, found int64) {
+	size := found - next
+	metrics.RevisionGapSize.Observe(float64(size))
+	if metrics.RevisionGapWarningThreshold > 0 && size >= metrics.RevisionGapWarningThreshold {
+		logrus.Warnf("Found gap of %d revisions between revision %d and %d; the datastore may be skipping sequence values for rolled back inserts", size, next-1, found)
 	}
 }
 
@@ -570,15 +1218,80 @@ func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
 	return rev == skip && time.Since(skipTime) > time.Second
 }
 
+// Count returns the number of keys that List would return for the same prefix, start key, and
+// revision, without fetching the rows.
 func (s *SQLLog) Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error) {
+	var (
+		rev   int64
+		count int64
+		err   error
+
+		listPrefix   = prefix
+		listStartKey = startKey
+	)
+
+	// The start key is handled the same as in List, so that the count matches a full list.
 	if strings.HasSuffix(prefix, "/") {
+		if prefix == startKey {
+			startKey = ""
+		}
 		prefix += "%"
+	} else {
+		startKey = ""
 	}
 
 	if revision == 0 {
 		return s.d.CountCurrent(ctx, prefix, startKey)
 	}
-	return s.d.Count(ctx, prefix, startKey, revision)
+
+	rev, count, err = s.d.Count(ctx, prefix, startKey, revision)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if revision > rev {
+		if !server.IsPrimaryRead(ctx) {
+			return s.Count(server.WithPrimaryRead(ctx), listPrefix, listStartKey, revision)
+		}
+		return rev, 0, server.ErrFutureRev
+	}
+
+	compact, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if revision < compact {
+		return rev, 0, server.ErrCompacted
+	}
+
+	return rev, count, nil
+}
+
+// CountRange returns the number of keys that ListRange would return for the same range and
+// revision, without fetching the rows.
+func (s *SQLLog) CountRange(ctx context.Context, key, rangeEnd string, revision int64) (int64, int64, error) {
+	start, end := keyRange(key, rangeEnd)
+	rev, count, err := s.d.CountRange(ctx, start, end, revision)
+	if err != nil || revision == 0 {
+		return rev, count, err
+	}
+
+	if revision > rev {
+		if !server.IsPrimaryRead(ctx) {
+			return s.CountRange(server.WithPrimaryRead(ctx), key, rangeEnd, revision)
+		}
+		return rev, 0, server.ErrFutureRev
+	}
+
+	compact, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if revision < compact {
+		return rev, 0, server.ErrCompacted
+	}
+
+	return rev, count, nil
 }
 
 func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error) {
@@ -590,18 +1303,53 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 		e.PrevKV = &server.KeyValue{}
 	}
 
-	rev, err := s.d.Insert(ctx, e.KV.Key,
-		e.Create,
-		e.Delete,
-		e.KV.CreateRevision,
-		e.PrevKV.ModRevision,
-		e.KV.Lease,
-		e.KV.Value,
-		e.PrevKV.Value,
-	)
+	value, prevValue, err := s.encryptValues(&e)
+	if err != nil {
+		return 0, err
+	}
+	if !e.Delete && s.omitPrevValue(e.KV.Key) {
+		prevValue = nil
+	}
+
+	var rev int64
+	if s.allocator != nil {
+		rev, err = s.allocator.Insert(ctx, e.KV.Key,
+			e.Create,
+			e.Delete,
+			e.KV.CreateRevision,
+			e.PrevKV.ModRevision,
+			e.KV.Lease,
+			value,
+			prevValue,
+		)
+	} else if s.insertBatcher != nil && s.insertBatcher.batches(e.Create) {
+		rev, err = s.insertBatcher.insert(ctx, &server.InsertRow{
+			Key:              e.KV.Key,
+			Create:           e.Create,
+			Delete:           e.Delete,
+			CreateRevision:   e.KV.CreateRevision,
+			PreviousRevision: e.PrevKV.ModRevision,
+			TTL:              e.KV.Lease,
+			Value:            value,
+			PrevValue:        prevValue,
+		})
+	} else {
+		rev, err = s.d.Insert(ctx, e.KV.Key,
+			e.Create,
+			e.Delete,
+			e.KV.CreateRevision,
+			e.PrevKV.ModRevision,
+			e.KV.Lease,
+			value,
+			prevValue,
+		)
+	}
 	if err != nil {
 		return 0, err
 	}
+	if s.keyPrefixMetrics != nil {
+		s.keyPrefixMetrics.observe(&e, len(value))
+	}
 	select {
 	case s.notify <- rev:
 	default:
@@ -609,7 +1357,154 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 	return rev, nil
 }
 
-func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error {
+// WriteRetrier is implemented by dialects that retry writes which fail with transient errors, such
+// as deadlocks or serialization failures caused by concurrent writes.
+type WriteRetrier interface {
+	RetryWrite(ctx context.Context, key string, fn func() error) error
+}
+
+// AppendBatch appends the events to the log in a single transaction, returning the revision of
+// each event. If any event cannot be appended, for example because another write to its key has
+// taken the previous revision, or if any of the conditions does not hold when checked within the
+// transaction, the transaction is rolled back and none of the events are appended. The transaction
+// is serializable, so that keys that are compared but not written cannot be modified by another
+// node between the check and the commit; if the dialect supports it, transactions that fail to
+// serialize are retried.
+func (s *SQLLog) AppendBatch(ctx context.Context, events []*server.Event, conditions []*server.Condition) ([]int64, error) {
+	var (
+		entries []server.Event
+		sizes   []int
+		revs    []int64
+	)
+	appendBatch := func() (err error) {
+		entries, sizes, revs, err = s.appendBatch(ctx, events, conditions)
+		return err
+	}
+	var err error
+	if retrier, ok := s.d.(WriteRetrier); ok && len(events) > 0 && events[0].KV != nil {
+		err = retrier.RetryWrite(ctx, events[0].KV.Key, appendBatch)
+	} else {
+		err = appendBatch()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.keyPrefixMetrics != nil {
+		for i := range entries {
+			s.keyPrefixMetrics.observe(&entries[i], sizes[i])
+		}
+	}
+	if len(revs) > 0 {
+		select {
+		case s.notify <- revs[len(revs)-1]:
+		default:
+		}
+	}
+	return revs, nil
+}
+
+// appendBatch appends the events in a single transaction, after checking the conditions within
+// it, and returns the appended events along with the size of each value and its revision.
+func (s *SQLLog) appendBatch(ctx context.Context, events []*server.Event, conditions []*server.Condition) ([]server.Event, []int, []int64, error) {
+	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer t.MustRollback()
+
+	for _, condition := range conditions {
+		start, end := keyRange(condition.Key, condition.RangeEnd)
+		rows, err := t.ListRange(ctx, start, end)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		_, _, current, err := RowsToEvents(rows)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		kvs := make([]*server.KeyValue, 0, len(current))
+		for _, event := range current {
+			kvs = append(kvs, event.KV)
+		}
+		if !condition.Holds(kvs) {
+			return nil, nil, nil, errors.Errorf("keys in range %q to %q have been modified", condition.Key, condition.RangeEnd)
+		}
+	}
+
+	entries := make([]server.Event, 0, len(events))
+	sizes := make([]int, 0, len(events))
+	revs := make([]int64, 0, len(events))
+	for _, event := range events {
+		e := *event
+		if e.KV == nil {
+			e.KV = &server.KeyValue{}
+		}
+		if e.PrevKV == nil {
+			e.PrevKV = &server.KeyValue{}
+		}
+		value, prevValue, err := s.encryptValues(&e)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !e.Delete && s.omitPrevValue(e.KV.Key) {
+			prevValue = nil
+		}
+
+		var rev int64
+		if s.allocator != nil {
+			if rev, err = s.allocator.NextRevision(ctx, t); err != nil {
+				return nil, nil, nil, err
+			}
+			if err = t.InsertRevision(ctx, rev, e.KV.Key, e.Create, e.Delete, e.KV.CreateRevision, e.PrevKV.ModRevision, e.KV.Lease, value, prevValue); err != nil {
+				return nil, nil, nil, err
+			}
+		} else {
+			if rev, err = t.Insert(ctx, e.KV.Key, e.Create, e.Delete, e.KV.CreateRevision, e.PrevKV.ModRevision, e.KV.Lease, value, prevValue); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		entries = append(entries, e)
+		sizes = append(sizes, len(value))
+		revs = append(revs, rev)
+	}
+	if err := t.Commit(); err != nil {
+		return nil, nil, nil, err
+	}
+	return entries, sizes, revs, nil
+}
+
+// omitPrevValue returns true if the previous value is not stored for creates and updates of the
+// key. Watches of such keys do not receive the previous value of updates, even if requested; the
+// previous value is still stored for deletes, as clients such as the Kubernetes apiserver require
+// it for delete events.
+func (s *SQLLog) omitPrevValue(key string) bool {
+	for _, prefix := range s.omitPrevValuePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptValues returns the value and previous value of the event, encrypted if a transformer is
+// configured.
+func (s *SQLLog) encryptValues(e *server.Event) ([]byte, []byte, error) {
+	value, prevValue := e.KV.Value, e.PrevKV.Value
+	if s.transformer == nil {
+		return value, prevValue, nil
+	}
+	var err error
+	if value, err = s.transformer.Encrypt(e.KV.Key, value); err != nil {
+		return nil, nil, err
+	}
+	if prevValue, err = s.transformer.Encrypt(e.KV.Key, prevValue); err != nil {
+		return nil, nil, err
+	}
+	return value, prevValue, nil
+}
+
+func scan(rows server.Rows, rev *int64, compact *int64, event *server.Event) error {
 	event.KV = &server.KeyValue{}
 	event.PrevKV = &server.KeyValue{}
 
@@ -641,6 +1536,39 @@ func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error
 	return nil
 }
 
+// revisionSample records the current revision at a point in time.
+type revisionSample struct {
+	time     time.Time
+	revision int64
+}
+
+// retainedCompactRev returns the newest sampled revision that was current at or before the cutoff
+// time, or zero if there is none. Any older samples are no longer needed, and are removed from the
+// returned history.
+func retainedCompactRev(history []revisionSample, cutoff time.Time) (int64, []revisionSample) {
+	idx := -1
+	for i, sample := range history {
+		if sample.time.After(cutoff) {
+			break
+		}
+		idx = i
+	}
+	if idx < 0 {
+		return 0, history
+	}
+	return history[idx].revision, history[idx:]
+}
+
+// deletedCompactRev returns the newest revision at which deleted rows may be compacted when
+// compacting to targetCompactRev. Until the compactor has been running for the deleted row
+// retention window, no deleted rows are compacted.
+func (s *SQLLog) deletedCompactRev(targetCompactRev int64) int64 {
+	if s.compactDeletedRetention <= 0 {
+		return targetCompactRev
+	}
+	return min(targetCompactRev, s.deletedRetainedRev.Load())
+}
+
 // safeCompactRev ensures that we never compact the most recent 1000 revisions.
 func safeCompactRev(targetCompactRev int64, currentRev int64, compactMinRetain int64) int64 {
 	safeRev := currentRev - compactMinRetain
@@ -657,6 +1585,172 @@ func (s *SQLLog) DbSize(ctx context.Context) (int64, error) {
 	return s.d.GetSize(ctx)
 }
 
+// LeaseRemaining returns the remaining TTL in seconds of each row with a lease, by revision, if
+// the dialect records the time that rows are written.
+func (s *SQLLog) LeaseRemaining(ctx context.Context) (map[int64]int64, error) {
+	return s.d.LeaseRemaining(ctx)
+}
+
+// DbSizeInUse estimates the size of the database that is in use, as the size of the database less
+// the size of the rows that compacting to the current revision would remove. Space freed by
+// previous compactions that has not been released by defragmenting is counted as in use, as its
+// size is not known.
+func (s *SQLLog) DbSizeInUse(ctx context.Context) (int64, error) {
+	size, err := s.d.GetSize(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	s.reclaimableMutex.Lock()
+	defer s.reclaimableMutex.Unlock()
+	if time.Since(s.reclaimableChecked) >= reclaimableCheckInterval {
+		rev, err := s.d.CurrentRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		_, reclaimable, err := s.d.CompactDryRun(ctx, rev, s.deletedCompactRev(rev))
+		if err != nil {
+			return 0, err
+		}
+		s.reclaimable = reclaimable
+		s.reclaimableChecked = time.Now()
+	}
+	return max(size-s.reclaimable, 0), nil
+}
+
+// Defragment rebuilds the database to release space freed by compaction. It is not run at the
+// same time as compaction, and is not interrupted if the caller goes away, as some databases
+// cannot safely cancel a rebuild part way through; instead it is bounded by defragTimeout.
+func (s *SQLLog) Defragment(ctx context.Context) error {
+	s.compactMutex.Lock()
+	defer s.compactMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defragTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.d.Defragment(ctx); err != nil {
+		return errors.Wrap(err, "failed to defragment database")
+	}
+	logrus.WithField("duration", time.Since(start).Round(time.Millisecond)).Info("DEFRAGMENT completed")
+	return nil
+}
+
+// compactBatchWait pauses between compaction batches for the configured delay, so that writes
+// waiting on locks held by the previous batch can proceed. False is returned if the context is
+// done before the delay has passed.
+func (s *SQLLog) compactBatchWait(ctx context.Context) bool {
+	if s.compactBatchDelay <= 0 {
+		return true
+	}
+	t := time.NewTimer(s.compactBatchDelay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// waitForPoll waits until the poll loop has delivered the revision to watches, as revisions are
+// not compacted until they have been, for up to the compact timeout. False is returned if the
+// context is done first.
+func (s *SQLLog) waitForPoll(ctx context.Context, revision int64) bool {
+	if s.currentRev.Load() == 0 {
+		return true
+	}
+	t := time.NewTimer(s.compactTimeout)
+	defer t.Stop()
+	wait := time.NewTicker(10 * time.Millisecond)
+	defer wait.Stop()
+	for s.currentRev.Load() < revision {
+		select {
+		case s.notify <- revision:
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+			logrus.Warnf("COMPACT timed out waiting for revision %d to be delivered to watches; compacting to revision %d", revision, s.currentRev.Load())
+			return true
+		case <-wait.C:
+		}
+	}
+	return true
+}
+
+// Compact synchronously compacts the log up to the requested revision, in batches of
+// compactBatchSize revisions. Unlike the background compactor, the minimum retained revision
+// count is not enforced, as the caller has explicitly asked for this revision to be compacted.
+// On success, the new compact revision is returned.
 func (s *SQLLog) Compact(ctx context.Context, revision int64) (int64, error) {
-	return s.d.Compact(ctx, revision)
+	s.compactMutex.Lock()
+	defer s.compactMutex.Unlock()
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get compact revision")
+	}
+
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get current revision")
+	}
+
+	if revision > currentRev {
+		return currentRev, server.ErrFutureRev
+	}
+
+	if revision <= compactRev {
+		return compactRev, server.ErrCompacted
+	}
+
+	if !s.waitForPoll(ctx, revision) {
+		return compactRev, ctx.Err()
+	}
+	// If the poll loop did not catch up, only the revisions that it has delivered are compacted.
+	if polledRev := s.currentRev.Load(); polledRev != 0 && revision > polledRev {
+		revision = polledRev
+	}
+
+	start := time.Now()
+	iterCompactRev := compactRev
+	iterCount := 0
+	for iterCompactRev < revision {
+		iterCompactRev += s.compactBatchSize
+		if iterCompactRev > revision {
+			iterCompactRev = revision
+		}
+
+		compacted, _, err := s.compact(ctx, compactRev, iterCompactRev, 0)
+		if err != nil {
+			s.recordCompactResult(start, err)
+			metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			return compactRev, err
+		}
+		compactRev = compacted
+		iterCount++
+		if iterCompactRev < revision && !s.compactBatchWait(ctx) {
+			s.recordCompactResult(start, ctx.Err())
+			metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			return compactRev, ctx.Err()
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"compactedRev": compactRev,
+		"transactions": iterCount,
+		"duration":     time.Since(start).Round(time.Millisecond),
+	}).Info("COMPACT manual compaction completed")
+	if perr := s.postCompact(ctx); perr != nil {
+		logrus.Errorf("Post-compact operations failed: %v", perr)
+	}
+	s.recordCompactResult(start, nil)
+	metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+	metrics.CompactDuration.WithLabelValues(metrics.ResultSuccess).Observe(time.Since(start).Seconds())
+	s.observeCompactState(compactRev, currentRev)
+
+	return compactRev, nil
 }
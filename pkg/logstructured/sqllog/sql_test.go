@@ -0,0 +1,20 @@
+package sqllog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollTicks(t *testing.T) {
+	s := &SQLLog{}
+	if ticks := s.pollTicks(10); ticks != 1 {
+		t.Fatalf("expected no backoff without a max poll interval, got %d ticks", ticks)
+	}
+
+	s.pollMaxInterval = 30 * time.Second
+	for idlePolls, want := range map[int64]int64{0: 1, 1: 2, 2: 4, 4: 16, 5: 30, 100: 30} {
+		if ticks := s.pollTicks(idlePolls); ticks != want {
+			t.Errorf("expected %d ticks after %d idle polls, got %d", want, idlePolls, ticks)
+		}
+	}
+}
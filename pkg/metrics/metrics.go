@@ -11,6 +11,11 @@ import (
 const (
 	ResultSuccess = "success"
 	ResultError   = "error"
+
+	// SkippedReadOnly and SkippedRunning are the reasons that a compaction cycle is skipped: the
+	// server is in read-only mode, or a compaction, or a defragmentation, is still running.
+	SkippedReadOnly = "read_only"
+	SkippedRunning  = "running"
 )
 
 var (
@@ -31,17 +36,114 @@ var (
 		Help: "Total number of compactions",
 	}, []string{"result"})
 
+	CompactDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kine_compact_duration_seconds",
+		Help:    "Length of time per compaction run",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"result"})
+
+	CompactSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_compact_skipped_total",
+		Help: "Total number of compaction cycles skipped, by reason",
+	}, []string{"reason"})
+
+	CompactDeletedRowsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_compact_deleted_rows_total",
+		Help: "Total number of rows deleted by compaction",
+	})
+
+	CompactRevisionGap = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_revision_gap",
+		Help: "Number of revisions between the current revision and the compact revision, as of the last compaction run",
+	})
+
+	CompactInterval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_interval_seconds",
+		Help: "Interval between compaction runs, as adjusted by adaptive compaction",
+	})
+
+	CompactLastAttemptTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_last_attempt_timestamp_seconds",
+		Help: "Unix time at which the last compaction run started",
+	})
+
+	CompactLastSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_last_success_timestamp_seconds",
+		Help: "Unix time at which the last successful compaction run started",
+	})
+
+	CompactLastError = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_last_error",
+		Help: "1 if the last compaction run failed, 0 otherwise",
+	})
+
+	CompactNextRunTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_compact_next_run_timestamp_seconds",
+		Help: "Unix time at which the next compaction run is scheduled",
+	})
+
+	DBSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_db_size_bytes",
+		Help: "Size of the database table in bytes, as of the last compaction run",
+	})
+
 	InsertErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_insert_errors_total",
 		Help: "Total number of insert retries due to unique constraint violations",
 	}, []string{"retriable"})
+
+	KeyExistsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_key_exists_total",
+		Help: "Total number of inserts rejected because the key or revision already exists",
+	}, []string{"operation"})
+
+	WatchOverflowTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_watch_overflow_total",
+		Help: "Total number of watches dropped because they did not keep up with events",
+	})
+
+	WatchCoalescedEventsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_watch_coalesced_events_total",
+		Help: "Total number of watch events not sent because they were merged with a later update of the same key",
+	})
+
+	KeyPrefixWritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_key_prefix_writes_total",
+		Help: "Total number of writes by key prefix, if enabled",
+	}, []string{"prefix", "operation"})
+
+	KeyPrefixWriteBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_key_prefix_write_bytes_total",
+		Help: "Total size in bytes of values written by key prefix, if enabled",
+	}, []string{"prefix", "operation"})
+
+	CurrentRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_current_revision",
+		Help: "Latest revision that has been sent to watchers",
+	})
+
+	RejectedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_rejected_requests_total",
+		Help: "Total number of requests rejected because the limit on concurrent requests of their kind was reached",
+	}, []string{"kind"})
+
+	RevisionGapSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kine_revision_gap_size",
+		Help:    "Number of missing revisions in each gap found between sequential revisions, such as those left by rolled back inserts",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+	})
 )
 
 var (
-	// SlowSQLThreshold is a duration which SQL executed longer than will be logged.
-	// This can be directly modified to override the default value when kine is used as a library.
-	SlowSQLThreshold        = time.Second
-	SlowSQLWarningThreshold = 5 * time.Second
+	// SlowSQLThreshold is a duration which SQL executed longer than will be logged at warn level.
+	// Slow SQL is not logged if it is <= 0, which is the default. This can be directly modified to
+	// override the default value when kine is used as a library.
+	SlowSQLThreshold time.Duration
+	// Deprecated: SlowSQLWarningThreshold is ignored, as all slow SQL is logged at warn level.
+	SlowSQLWarningThreshold time.Duration
+	// RevisionGapWarningThreshold is the number of missing revisions in a gap at or above which a
+	// warning is logged. Gaps are not logged if it is <= 0.
+	RevisionGapWarningThreshold int64 = 100
 )
 
 func ObserveSQL(start time.Time, errCode string, sql util.Stripped, args ...interface{}) {
@@ -49,16 +151,20 @@ func ObserveSQL(start time.Time, errCode string, sql util.Stripped, args ...inte
 	duration := time.Since(start)
 	SQLTime.WithLabelValues(errCode).Observe(duration.Seconds())
 	if SlowSQLThreshold > 0 && duration >= SlowSQLThreshold {
-		instrumentedLogger := logrus.WithField("duration", duration)
+		instrumentedLogger := logrus.WithFields(logrus.Fields{
+			"started":     start,
+			"duration":    duration,
+			"duration_ms": duration.Milliseconds(),
+			"sql":         sql.String(),
+			"args_count":  len(args),
+		})
 
 		if logrus.GetLevel() == logrus.TraceLevel {
-			instrumentedLogger.WithField("args", args)
+			if logged, ok := util.LoggedSQLArgs(args); ok {
+				instrumentedLogger = instrumentedLogger.WithField("args", logged)
+			}
 		}
 
-		if duration < SlowSQLWarningThreshold {
-			instrumentedLogger.Infof("Slow SQL (started: %v) (total time: %v): %s", start, duration, sql)
-		} else {
-			instrumentedLogger.Warnf("Slow SQL (started: %v) (total time: %v): %s", start, duration, sql)
-		}
+		instrumentedLogger.Warn("Slow SQL")
 	}
 }
@@ -15,6 +15,9 @@ type Config struct {
 	ServerAddress   string
 	ServerTLSConfig tls.Config
 	EnableProfiling bool
+	// ProfilingAddress is the address of a separate server for the net/http/pprof handlers.
+	// If empty, the separate profiling server is not started.
+	ProfilingAddress string
 }
 
 const (
@@ -30,12 +33,6 @@ func Serve(ctx context.Context, config Config) {
 		return
 	}
 
-	logrus.Infof("metrics server is starting to listen at %s", config.ServerAddress)
-	listener, err := net.Listen("tcp", config.ServerAddress)
-	if err != nil {
-		logrus.Fatalf("error creating the metrics listener: %v", err)
-	}
-
 	handler := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
 		ErrorHandling: promhttp.HTTPErrorOnError,
 	})
@@ -43,32 +40,60 @@ func Serve(ctx context.Context, config Config) {
 	mux.Handle(metricsPath, handler)
 
 	if config.EnableProfiling {
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		registerProfiling(mux)
+	}
+
+	logrus.Infof("starting metrics server path %s", metricsPath)
+	serve(ctx, "metrics", config.ServerAddress, config.ServerTLSConfig, mux)
+}
+
+// ServeProfiling serves the net/http/pprof handlers on the profiling address, if one is set.
+// This allows profiles to be captured without also enabling profiling on the metrics server,
+// which is commonly exposed to a wider audience.
+func ServeProfiling(ctx context.Context, config Config) {
+	if config.ProfilingAddress == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	registerProfiling(mux)
+	serve(ctx, "profiling", config.ProfilingAddress, config.ServerTLSConfig, mux)
+}
+
+func registerProfiling(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// serve serves the handler on the given address until the context is cancelled.
+func serve(ctx context.Context, name, address string, tlsConfig tls.Config, handler http.Handler) {
+	logrus.Infof("%s server is starting to listen at %s", name, address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		logrus.Fatalf("error creating the %s listener: %v", name, err)
 	}
 
 	server := http.Server{
-		Handler: mux,
+		Handler: handler,
 	}
 
 	go func() {
-		logrus.Infof("starting metrics server path %s", metricsPath)
 		var err error
-		if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
-			err = server.ServeTLS(listener, config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile)
+		if tlsConfig.CertFile != "" && tlsConfig.KeyFile != "" {
+			err = server.ServeTLS(listener, tlsConfig.CertFile, tlsConfig.KeyFile)
 		} else {
 			err = server.Serve(listener)
 		}
 		if err != nil && err != http.ErrServerClosed {
-			logrus.Fatalf("error starting the metrics server: %v", err)
+			logrus.Fatalf("error starting the %s server: %v", name, err)
 		}
 	}()
 
 	<-ctx.Done()
 	if err := server.Shutdown(context.Background()); err != nil {
-		logrus.Fatalf("error shutting down the metrics server: %v", err)
+		logrus.Fatalf("error shutting down the %s server: %v", name, err)
 	}
 }
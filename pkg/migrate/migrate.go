@@ -0,0 +1,189 @@
+// Package migrate copies the current contents of one kine backend into another, so that a
+// cluster can be moved between datastores.
+package migrate
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultBatchSize = 500
+
+// Options control which keys are copied, and how.
+type Options struct {
+	// Prefix limits the copy to keys under this prefix. Defaults to "/", which covers all
+	// keys written through the etcd API.
+	Prefix string
+	// StartKey resumes a previous copy after the given key. Keys sorting before it, and the key
+	// itself, are not copied. The key reported by the last Progress callback of an interrupted
+	// copy may be used.
+	StartKey string
+	// BatchSize is the number of keys read from the source at a time.
+	BatchSize int64
+	// Progress, if set, is called after each batch of keys has been written to the destination.
+	Progress func(Progress)
+}
+
+// Progress reports the state of a copy.
+type Progress struct {
+	// Revision is the source revision that keys are being read at.
+	Revision int64
+	// LastKey is the last key that was written to the destination.
+	LastKey string
+	// Created is the number of keys that did not exist in the destination.
+	Created int64
+	// Updated is the number of keys that existed in the destination with a different value or lease.
+	Updated int64
+	// Unchanged is the number of keys that already existed in the destination with the same
+	// value and lease, such as those copied by an earlier run.
+	Unchanged int64
+}
+
+// Migrate copies all live keys at the current revision of the source backend into the destination,
+// preserving each key's value and lease. Keys are read from a consistent snapshot of the source,
+// and copied in key order.
+//
+// The destination must not have been started; it is started by Migrate. If the destination
+// implements server.Importer, holds no keys, and the copy is not being resumed, the keys are
+// imported before the destination is started, at their original create and mod revisions, and the
+// destination is compacted at the source revision. Clients can then resume watches against the
+// destination from the revisions they last saw, as long as no writes were made to the source after
+// the copy.
+//
+// Otherwise, the destination is started, and each key is written to it at a revision assigned by
+// the destination, so the create and mod revisions of copied keys will not match the source.
+// Clients that cache revisions, such as the Kubernetes apiserver and its informers, must be
+// restarted against the destination so that they relist rather than attempting to resume watches
+// from source revisions. This copy is idempotent, so it can be resumed by running it again,
+// optionally with Options.StartKey set to skip keys that have already been copied. Keys that
+// already exist in the destination are updated if their value or lease differ.
+func Migrate(ctx context.Context, src, dst server.Backend, opts Options) (Progress, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "/"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	progress := Progress{}
+	rev, err := src.CurrentRevision(ctx)
+	if err != nil {
+		return progress, errors.Wrap(err, "getting source revision")
+	}
+	progress.Revision = rev
+
+	if importer, ok := dst.(server.Importer); ok && opts.StartKey == "" {
+		_, count, err := dst.Count(ctx, "/", "", 0)
+		if err != nil {
+			return progress, errors.Wrap(err, "counting destination keys")
+		}
+		if count == 0 {
+			if err := importKeys(ctx, src, importer, opts, &progress); err != nil {
+				return progress, err
+			}
+			if err := dst.Start(ctx); err != nil {
+				return progress, errors.Wrap(err, "starting destination")
+			}
+			return progress, nil
+		}
+		logrus.Infof("Destination is not empty, copying keys without preserving their revisions")
+	}
+
+	// The destination is started before keys are copied, so that it is initialized and expires
+	// copied keys when their leases run out.
+	if err := dst.Start(ctx); err != nil {
+		return progress, errors.Wrap(err, "starting destination")
+	}
+	startKey := opts.StartKey
+	for {
+		_, kvs, err := src.List(ctx, opts.Prefix, startKey, opts.BatchSize, rev)
+		if err != nil {
+			return progress, errors.Wrapf(err, "listing source keys after %q at revision %d", startKey, rev)
+		}
+		if len(kvs) == 0 {
+			return progress, nil
+		}
+
+		for _, kv := range kvs {
+			if err := copyKey(ctx, dst, kv, &progress); err != nil {
+				return progress, errors.Wrapf(err, "copying key %q", kv.Key)
+			}
+			progress.LastKey = kv.Key
+		}
+		startKey = progress.LastKey
+
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+}
+
+// importKeys reads all of the keys from the source at the revision of the progress, and imports
+// them into the destination at their original revisions, in a single transaction. Progress is
+// reported once, after the keys have been imported.
+func importKeys(ctx context.Context, src server.Backend, importer server.Importer, opts Options, progress *Progress) error {
+	var kvs []*server.KeyValue
+	startKey := ""
+	for {
+		_, batch, err := src.List(ctx, opts.Prefix, startKey, opts.BatchSize, progress.Revision)
+		if err != nil {
+			return errors.Wrapf(err, "listing source keys after %q at revision %d", startKey, progress.Revision)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		kvs = append(kvs, batch...)
+		startKey = batch[len(batch)-1].Key
+	}
+
+	if err := importer.Import(ctx, progress.Revision, kvs); err != nil {
+		return errors.Wrapf(err, "importing %d keys at revision %d", len(kvs), progress.Revision)
+	}
+	progress.Created = int64(len(kvs))
+	progress.LastKey = startKey
+	if opts.Progress != nil {
+		opts.Progress(*progress)
+	}
+	return nil
+}
+
+// copyKey writes a single key to the destination, creating it if it does not exist, and
+// otherwise updating it if the value or lease differ.
+func copyKey(ctx context.Context, dst server.Backend, kv *server.KeyValue, progress *Progress) error {
+	for {
+		_, err := dst.Create(ctx, kv.Key, kv.Value, kv.Lease)
+		if err == nil {
+			progress.Created++
+			return nil
+		} else if err != server.ErrKeyExists {
+			return err
+		}
+
+		_, existing, err := dst.Get(ctx, kv.Key, "", 1, 0)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			// deleted since the create failed; try again
+			continue
+		}
+		if bytes.Equal(existing.Value, kv.Value) && existing.Lease == kv.Lease {
+			progress.Unchanged++
+			return nil
+		}
+
+		_, _, ok, err := dst.Update(ctx, kv.Key, kv.Value, existing.ModRevision, kv.Lease)
+		if err != nil {
+			return err
+		}
+		if ok {
+			progress.Updated++
+			return nil
+		}
+		logrus.Debugf("Key %s was modified in the destination while being copied; retrying", kv.Key)
+	}
+}
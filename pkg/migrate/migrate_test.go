@@ -0,0 +1,185 @@
+//go:build cgo
+// +build cgo
+
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// newBackend returns a backend for the database at path, which is only started if start is set.
+func newBackend(ctx context.Context, t *testing.T, path string, start bool) server.Backend {
+	backend, _, err := sqlite.NewVariant(ctx, "sqlite3", &drivers.Config{
+		DataSourceName:  "file:" + path + "?_journal=WAL&_busy_timeout=30000&_txlock=immediate",
+		TableName:       "kine",
+		CompactInterval: time.Minute,
+		CompactTimeout:  time.Minute,
+		PollBatchSize:   500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start {
+		if err := backend.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return backend
+}
+
+// waitForRevision waits for the backend to observe all writes up to the revision.
+func waitForRevision(ctx context.Context, t *testing.T, backend server.Backend, rev int64) {
+	for {
+		current, err := backend.CurrentRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current >= rev {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	src := newBackend(ctx, t, filepath.Join(dir, "src.db"), true)
+	dstPath := filepath.Join(dir, "dst.db")
+
+	for i := 0; i < 25; i++ {
+		if _, err := src.Create(ctx, fmt.Sprintf("/registry/test/%02d", i), []byte(fmt.Sprint(i)), int64(i%2)*60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keys outside the prefix, and deleted keys, must not be copied.
+	if _, err := src.Create(ctx, "other/key", []byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+	rev, err := src.Create(ctx, "/registry/deleted", []byte("x"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := src.Delete(ctx, "/registry/deleted", rev); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the source to observe all of the writes, so that they are included in the copy.
+	waitForRevision(ctx, t, src, rev+1)
+
+	// A key already present in the destination with a different value is updated. As the
+	// destination is not empty, keys are copied rather than imported.
+	if _, err := newBackend(ctx, t, dstPath, true).Create(ctx, "/registry/test/03", []byte("stale"), 0); err != nil {
+		t.Fatal(err)
+	}
+	dst := newBackend(ctx, t, dstPath, false)
+
+	var batches int
+	p, err := Migrate(ctx, src, dst, Options{
+		BatchSize: 10,
+		Progress:  func(Progress) { batches++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The health check key created when each backend is started is identical in both.
+	if p.Created != 24 || p.Updated != 1 || p.Unchanged != 1 || batches != 3 {
+		t.Fatalf("unexpected progress %+v after %d batches", p, batches)
+	}
+
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("/registry/test/%02d", i)
+		_, kv, err := dst.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil || string(kv.Value) != fmt.Sprint(i) || kv.Lease != int64(i%2)*60 {
+			t.Fatalf("unexpected value for %s: %+v", key, kv)
+		}
+	}
+	for _, key := range []string{"other/key", "/registry/deleted"} {
+		if _, kv, err := dst.Get(ctx, key, "", 1, 0); err != nil || kv != nil {
+			t.Fatalf("expected %s to not be copied, got %+v, %v", key, kv, err)
+		}
+	}
+
+	// Resuming after a key must leave already copied keys unchanged.
+	p, err = Migrate(ctx, src, newBackend(ctx, t, dstPath, false), Options{StartKey: "/registry/test/20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Created != 0 || p.Updated != 0 || p.Unchanged != 4 {
+		t.Fatalf("unexpected progress %+v on resume", p)
+	}
+}
+
+// TestMigrateRevisions ensures that keys are imported into an empty destination at their original
+// create and mod revisions, and that new writes to the destination follow the source revision.
+func TestMigrateRevisions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	src := newBackend(ctx, t, filepath.Join(dir, "src.db"), true)
+	for i := 0; i < 5; i++ {
+		if _, err := src.Create(ctx, fmt.Sprintf("/registry/test/%d", i), []byte("created"), int64(i%2)*60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Updated keys have a mod revision after their create revision.
+	var rev int64
+	for i := 0; i < 5; i += 2 {
+		key := fmt.Sprintf("/registry/test/%d", i)
+		_, kv, err := src.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev, _, _, err = src.Update(ctx, key, []byte("updated"), kv.ModRevision, kv.Lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForRevision(ctx, t, src, rev)
+	srcRev, srcKVs, err := src.List(ctx, "/", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newBackend(ctx, t, filepath.Join(dir, "dst.db"), false)
+	p, err := Migrate(ctx, src, dst, Options{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Revision != srcRev || p.Created != int64(len(srcKVs)) {
+		t.Fatalf("expected %d keys imported at revision %d, got %+v", len(srcKVs), srcRev, p)
+	}
+
+	dstRev, dstKVs, err := dst.List(ctx, "/", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstRev < srcRev || len(dstKVs) != len(srcKVs) {
+		t.Fatalf("expected %d keys at revision %d, got %d at revision %d", len(srcKVs), srcRev, len(dstKVs), dstRev)
+	}
+	for i, kv := range srcKVs {
+		got := dstKVs[i]
+		if got.Key != kv.Key || string(got.Value) != string(kv.Value) || got.Lease != kv.Lease ||
+			got.CreateRevision != kv.CreateRevision || got.ModRevision != kv.ModRevision {
+			t.Errorf("expected %s=%s with lease %d at revisions %d/%d, got %s=%s with lease %d at revisions %d/%d",
+				kv.Key, kv.Value, kv.Lease, kv.CreateRevision, kv.ModRevision,
+				got.Key, got.Value, got.Lease, got.CreateRevision, got.ModRevision)
+		}
+	}
+
+	if rev, err := dst.Create(ctx, "/registry/test/new", []byte("new"), 0); err != nil || rev <= srcRev {
+		t.Fatalf("expected new key to be created after revision %d, got %d: %v", srcRev, rev, err)
+	}
+}
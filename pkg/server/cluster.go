@@ -12,6 +12,25 @@ import (
 // explicit interface check
 var _ etcdserverpb.ClusterServer = (*KVServerBridge)(nil)
 
+// Kine is presented as a single member cluster, with fixed cluster and member IDs. The member is
+// always the leader, and as there are no elections, the raft term never changes.
+const (
+	clusterID  uint64 = 0x6b696e65636c7573 // "kineclus"
+	memberID   uint64 = 0x6b696e65         // "kine"
+	memberName        = "kine"
+	raftTerm   uint64 = 1
+)
+
+// memberHeader returns a response header identifying the member, at the given revision.
+func memberHeader(rev int64) *etcdserverpb.ResponseHeader {
+	return &etcdserverpb.ResponseHeader{
+		ClusterId: clusterID,
+		MemberId:  memberID,
+		Revision:  rev,
+		RaftTerm:  raftTerm,
+	}
+}
+
 func (s *KVServerBridge) MemberAdd(context.Context, *etcdserverpb.MemberAddRequest) (*etcdserverpb.MemberAddResponse, error) {
 	return nil, fmt.Errorf("member add is not supported")
 }
@@ -24,15 +43,25 @@ func (s *KVServerBridge) MemberUpdate(context.Context, *etcdserverpb.MemberUpdat
 	return nil, fmt.Errorf("member update is not supported")
 }
 
+// MemberList returns the single synthetic member that represents kine. There are no peers, so the
+// client URLs are also reported as the peer URLs, for clients that expect them to be set.
 func (s *KVServerBridge) MemberList(ctx context.Context, r *etcdserverpb.MemberListRequest) (*etcdserverpb.MemberListResponse, error) {
-	listenURL := authorityURL(ctx, s.limited.scheme)
+	urls := s.clientURLs
+	if len(urls) == 0 {
+		urls = []string{authorityURL(ctx, s.limited.scheme)}
+	}
+	rev, err := s.limited.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &etcdserverpb.MemberListResponse{
-		Header: &etcdserverpb.ResponseHeader{},
+		Header: memberHeader(rev),
 		Members: []*etcdserverpb.Member{
 			{
-				Name:       "kine",
-				ClientURLs: []string{listenURL},
-				PeerURLs:   []string{listenURL},
+				ID:         memberID,
+				Name:       memberName,
+				ClientURLs: urls,
+				PeerURLs:   urls,
 			},
 		},
 	}, nil
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestMemberList(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "kine.example:2379"))
+	s := New(&sizeBackend{size: 100, rev: 5}, Config{Scheme: "https", EmulatedETCDVersion: "3.5.13"})
+
+	resp, err := s.MemberList(ctx, &etcdserverpb.MemberListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Members) != 1 {
+		t.Fatalf("expected one member, got %v", resp.Members)
+	}
+	member := resp.Members[0]
+	if member.ID != memberID || member.Name != memberName || len(member.ClientURLs) != 1 || member.ClientURLs[0] != "https://kine.example:2379" {
+		t.Fatalf("expected kine member with client URL https://kine.example:2379, got %v", member)
+	}
+	if resp.Header.ClusterId != clusterID || resp.Header.MemberId != memberID || resp.Header.Revision != 5 {
+		t.Fatalf("expected header for kine member at revision 5, got %v", resp.Header)
+	}
+
+	// The member list and status agree on the identity of the member.
+	status, err := s.Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Header.ClusterId != resp.Header.ClusterId || status.Header.MemberId != member.ID || status.Leader != member.ID || status.Header.RaftTerm != resp.Header.RaftTerm {
+		t.Fatalf("expected status header %v and leader %d to match member list header %v", status.Header, status.Leader, resp.Header)
+	}
+
+	s = New(&sizeBackend{size: 100, rev: 5}, Config{Scheme: "https", ClientURLs: []string{"https://10.0.0.1:2379", "https://10.0.0.2:2379"}})
+	resp, err = s.MemberList(ctx, &etcdserverpb.MemberListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if urls := resp.Members[0].ClientURLs; len(urls) != 2 || urls[0] != "https://10.0.0.1:2379" || urls[1] != "https://10.0.0.2:2379" {
+		t.Fatalf("expected configured client URLs, got %v", urls)
+	}
+}
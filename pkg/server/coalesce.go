@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+)
+
+// collectEvents adds events received within the window to the batch, returning the batch, the
+// number of reads from the channel, and false if the channel was closed.
+func collectEvents(ctx context.Context, events []*Event, ch <-chan []*Event, window time.Duration) ([]*Event, int, bool) {
+	var reads int
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			reads++
+			events = append(events, e...)
+			if !ok {
+				return events, reads, false
+			}
+		case <-timer.C:
+			return events, reads, true
+		case <-ctx.Done():
+			return events, reads, true
+		}
+	}
+}
+
+// coalesceEvents replaces consecutive updates of each key with a single event, which holds the
+// latest value of the key and the previous value from before the first update. Events are
+// returned in order of the revision of their latest value. Creates and deletes are kept, and
+// updates are not merged with those before a create or delete of the key, as clients such as the
+// Kubernetes apiserver expect every event that is not a create to have a previous value.
+func coalesceEvents(events []*Event) []*Event {
+	if len(events) < 2 {
+		return events
+	}
+	coalesced := make([]*Event, 0, len(events))
+	updates := map[string]int{}
+	var merged int
+	for _, event := range events {
+		if event.Delete || event.Create {
+			delete(updates, event.KV.Key)
+			coalesced = append(coalesced, event)
+			continue
+		}
+		if i, ok := updates[event.KV.Key]; ok {
+			first := coalesced[i]
+			coalesced[i] = nil
+			event = &Event{KV: event.KV, PrevKV: first.PrevKV}
+			merged++
+		}
+		updates[event.KV.Key] = len(coalesced)
+		coalesced = append(coalesced, event)
+	}
+	if merged == 0 {
+		return events
+	}
+	metrics.WatchCoalescedEventsTotal.Add(float64(merged))
+
+	result := coalesced[:0]
+	for _, event := range coalesced {
+		if event != nil {
+			result = append(result, event)
+		}
+	}
+	return result
+}
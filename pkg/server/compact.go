@@ -3,11 +3,36 @@ package server
 import (
 	"context"
 
+	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
 )
 
+// Compact compacts the backend up to the requested revision. If the request is for a physical
+// compaction, the response is not sent until the compaction has completed; otherwise the
+// compaction runs in the background and the response is sent immediately, matching etcd.
 func (l *LimitedServer) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	if err := l.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	if !r.Physical {
+		rev, err := l.backend.CurrentRevision(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if r.Revision > rev {
+			return nil, ErrFutureRev
+		}
+		go func() {
+			if _, err := l.backend.Compact(context.WithoutCancel(ctx), r.Revision); err != nil && err != ErrCompacted {
+				logrus.Errorf("error in background compact to revision %d: %v", r.Revision, err)
+			}
+		}()
+		return &etcdserverpb.CompactionResponse{
+			Header: txnHeader(rev),
+		}, nil
+	}
+
 	rev, err := l.backend.Compact(ctx, r.Revision)
 	return &etcdserverpb.CompactionResponse{
 		Header: &etcdserverpb.ResponseHeader{
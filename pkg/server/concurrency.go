@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLimit caps the number of requests of one kind that are served at once. Requests beyond
+// the limit are rejected with ErrTooManyRequests rather than queued, so that a client making many
+// concurrent requests sheds load instead of exhausting the datastore connection pool for others.
+// A nil limit does not cap requests.
+type requestLimit struct {
+	kind  string
+	slots chan struct{}
+}
+
+func newRequestLimit(kind string, limit int) *requestLimit {
+	if limit <= 0 {
+		return nil
+	}
+	return &requestLimit{kind: kind, slots: make(chan struct{}, limit)}
+}
+
+// acquire reserves a slot for a request, returning a func that must be called to release it once
+// the request has been served, or ErrTooManyRequests if all slots are in use.
+func (r *requestLimit) acquire() (func(), error) {
+	if r == nil {
+		return func() {}, nil
+	}
+	select {
+	case r.slots <- struct{}{}:
+		return r.release, nil
+	default:
+		metrics.RejectedRequestsTotal.WithLabelValues(r.kind).Inc()
+		logrus.Debugf("Rejecting %s request: %d %s requests are already in progress", r.kind, cap(r.slots), r.kind)
+		return nil, ErrTooManyRequests
+	}
+}
+
+func (r *requestLimit) release() {
+	<-r.slots
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// blockingBackend blocks reads of /blocked until unblock is closed.
+type blockingBackend struct {
+	Backend
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingBackend) Get(ctx context.Context, key, _ string, _, _ int64) (int64, *KeyValue, error) {
+	if key == "/blocked" {
+		b.started <- struct{}{}
+		<-b.unblock
+	}
+	return 1, &KeyValue{Key: key, Value: []byte("a"), ModRevision: 1}, nil
+}
+
+func (b *blockingBackend) Create(context.Context, string, []byte, int64) (int64, error) {
+	return 2, nil
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingBackend{started: make(chan struct{}), unblock: make(chan struct{})}
+	s := New(backend, Config{Scheme: "http", MaxConcurrentReads: 1, MaxConcurrentWrites: 1})
+
+	errs := make(chan error)
+	go func() {
+		_, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/blocked")})
+		errs <- err
+	}()
+	<-backend.started
+
+	// The read limit is reached, but writes are limited separately.
+	if _, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")}); err != ErrTooManyRequests {
+		t.Fatalf("expected ErrTooManyRequests for range beyond the read limit, got %v", err)
+	}
+	create := &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte("/b"),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 0},
+		}},
+		Success: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("/b"), Value: []byte("b")}},
+		}},
+	}
+	if resp, err := s.Txn(ctx, create); err != nil || !resp.Succeeded {
+		t.Fatalf("expected create within the write limit to succeed, got %v, %v", resp, err)
+	}
+
+	close(backend.unblock)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	// The slot is released once the request completes.
+	if _, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")}); err != nil {
+		t.Fatalf("expected range after the blocked range completed to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import "context"
+
+type primaryReadKey struct{}
+
+// WithPrimaryRead returns a context indicating that any reads made with it require
+// read-after-write consistency, and must not be served by a read replica.
+func WithPrimaryRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+// IsPrimaryRead returns true if reads made with the context must be served by the primary.
+func IsPrimaryRead(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadKey{}).(bool)
+	return primary
+}
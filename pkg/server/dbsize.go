@@ -1,7 +1,52 @@
 package server
 
-import "context"
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
 
 func (l *LimitedServer) dbSize(ctx context.Context) (int64, error) {
-	return l.backend.DbSize(ctx)
+	size, err := l.backend.DbSize(ctx)
+	if err == nil {
+		l.quota.record(size)
+	}
+	return size, err
+}
+
+// dbSizeInUse returns the estimated size of the datastore that is in use, or the full size if the
+// backend cannot estimate it.
+func (l *LimitedServer) dbSizeInUse(ctx context.Context, size int64) int64 {
+	reporter, ok := l.backend.(SizeInUseReporter)
+	if !ok {
+		return size
+	}
+	inUse, err := reporter.DbSizeInUse(ctx)
+	if err != nil {
+		logrus.Debugf("Failed to get datastore size in use: %v", err)
+		return size
+	}
+	return min(inUse, size)
+}
+
+// defragment asks the backend to release unused space, and logs the change in size.
+// Not all backends support size reporting, so failure to get the size is not an error.
+func (l *LimitedServer) defragment(ctx context.Context) error {
+	if err := l.checkReadOnly(); err != nil {
+		return err
+	}
+	before, beforeErr := l.backend.DbSize(ctx)
+	if err := l.backend.Defragment(ctx); err != nil {
+		return err
+	}
+	after, afterErr := l.backend.DbSize(ctx)
+	if afterErr == nil {
+		l.quota.record(after)
+	}
+	if beforeErr == nil && afterErr == nil {
+		logrus.Infof("Defragmented datastore: size %d => %d bytes, reclaimed %d bytes", before, after, before-after)
+	} else {
+		logrus.Infof("Defragmented datastore")
+	}
+	return nil
 }
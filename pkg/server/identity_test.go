@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+func TestClientIdentity(t *testing.T) {
+	if _, ok := ClientIdentity(context.Background()); ok {
+		t.Fatal("expected no identity without a peer")
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "kube-apiserver"}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+	if identity, ok := ClientIdentity(ctx); !ok || identity != "kube-apiserver" {
+		t.Fatalf("expected identity kube-apiserver, got %q", identity)
+	}
+
+	ctx = peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	if _, ok := ClientIdentity(ctx); ok {
+		t.Fatal("expected no identity without a verified client certificate")
+	}
+}
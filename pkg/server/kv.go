@@ -13,58 +13,69 @@ import (
 var _ etcdserverpb.KVServer = (*KVServerBridge)(nil)
 
 func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	if err := checkRangeRequest(r); err != nil {
+		return nil, err
+	}
+
+	release, err := k.reads.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := k.limited.Range(ctx, r)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			logrus.Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
+		}
+		return nil, err
+	}
+
+	rangeResponse := &etcdserverpb.RangeResponse{
+		More:   resp.More,
+		Count:  resp.Count,
+		Header: resp.Header,
+		Kvs:    toKVs(resp.Kvs...),
+	}
+
+	return rangeResponse, nil
+}
+
+// checkRangeRequest returns an error if the range request uses options that are not supported.
+func checkRangeRequest(r *etcdserverpb.RangeRequest) error {
 	if r.KeysOnly {
-		return nil, unsupported("keysOnly")
+		return unsupported("keysOnly")
 	}
 
 	if r.MaxCreateRevision != 0 {
-		return nil, unsupported("maxCreateRevision")
+		return unsupported("maxCreateRevision")
 	}
 
 	if r.SortOrder != 0 {
-		return nil, unsupported("sortOrder")
+		return unsupported("sortOrder")
 	}
 
 	if r.SortTarget != 0 {
-		return nil, unsupported("sortTarget")
-	}
-
-	if r.Serializable {
-		return nil, unsupported("serializable")
+		return unsupported("sortTarget")
 	}
 
 	if r.MinModRevision != 0 {
-		return nil, unsupported("minModRevision")
+		return unsupported("minModRevision")
 	}
 
 	if r.MinCreateRevision != 0 {
-		return nil, unsupported("minCreateRevision")
+		return unsupported("minCreateRevision")
 	}
 
 	if r.MaxCreateRevision != 0 {
-		return nil, unsupported("maxCreateRevision")
+		return unsupported("maxCreateRevision")
 	}
 
 	if r.MaxModRevision != 0 {
-		return nil, unsupported("maxModRevision")
+		return unsupported("maxModRevision")
 	}
 
-	resp, err := k.limited.Range(ctx, r)
-	if err != nil {
-		if !errors.Is(err, context.Canceled) {
-			logrus.Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
-		}
-		return nil, err
-	}
-
-	rangeResponse := &etcdserverpb.RangeResponse{
-		More:   resp.More,
-		Count:  resp.Count,
-		Header: resp.Header,
-		Kvs:    toKVs(resp.Kvs...),
-	}
-
-	return rangeResponse, nil
+	return nil
 }
 
 func toKVs(kvs ...*KeyValue) []*mvccpb.KeyValue {
@@ -104,9 +115,19 @@ func (k *KVServerBridge) DeleteRange(ctx context.Context, r *etcdserverpb.Delete
 }
 
 func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	limit := k.reads
+	if txnHasMutation(r) {
+		limit = k.writes
+	}
+	release, err := limit.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	res, err := k.limited.Txn(ctx, r)
 	if err != nil {
-		if !errors.Is(err, context.Canceled) {
+		if !errors.Is(err, context.Canceled) && err != ErrReadOnly {
 			logrus.Errorf("error in txn %s: %v", r, err)
 		}
 	}
@@ -114,6 +135,12 @@ func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*
 }
 
 func (k *KVServerBridge) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	release, err := k.writes.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	res, err := k.limited.Compact(ctx, r)
 	if err != nil {
 		logrus.Errorf("error in compact %s: %v", r, err)
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"math"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
@@ -26,10 +27,54 @@ func (s *KVServerBridge) LeaseKeepAlive(etcdserverpb.Lease_LeaseKeepAliveServer)
 	return fmt.Errorf("lease keep alive is not supported")
 }
 
-func (s *KVServerBridge) LeaseTimeToLive(context.Context, *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
-	return nil, fmt.Errorf("lease time to live is not supported")
+// LeaseTimeToLive returns the remaining TTL of a lease, and optionally the keys attached to it. As
+// with etcd, a TTL of -1 is returned if no keys are attached to the lease.
+func (s *KVServerBridge) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	leases, err := s.limited.leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.LeaseTimeToLiveResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		ID:     req.ID,
+		TTL:    -1,
+	}
+	for _, lease := range leases {
+		if lease.ID != req.ID {
+			continue
+		}
+		resp.TTL = int64(math.Ceil(lease.TTL.Seconds()))
+		resp.GrantedTTL = lease.ID
+		if req.Keys {
+			for _, key := range lease.Keys {
+				resp.Keys = append(resp.Keys, []byte(key))
+			}
+		}
+	}
+	return resp, nil
+}
+
+// LeaseLeases lists the leases that have keys attached to them.
+func (s *KVServerBridge) LeaseLeases(ctx context.Context, req *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
+	leases, err := s.limited.leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.LeaseLeasesResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}
+	for _, lease := range leases {
+		resp.Leases = append(resp.Leases, &etcdserverpb.LeaseStatus{ID: lease.ID})
+	}
+	return resp, nil
 }
 
-func (s *KVServerBridge) LeaseLeases(context.Context, *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
-	return nil, fmt.Errorf("lease leases is not supported")
+func (l *LimitedServer) leases(ctx context.Context) ([]Lease, error) {
+	lister, ok := l.backend.(LeaseLister)
+	if !ok {
+		return nil, unsupported("leases")
+	}
+	return lister.Leases(ctx)
 }
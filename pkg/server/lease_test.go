@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+type leaseBackend struct {
+	Backend
+	leases []Lease
+}
+
+func (b *leaseBackend) Leases(context.Context) ([]Lease, error) {
+	return b.leases, nil
+}
+
+func TestLeaseTimeToLive(t *testing.T) {
+	ctx := context.Background()
+	s := New(&leaseBackend{leases: []Lease{
+		{ID: 60, TTL: 30500 * time.Millisecond, Keys: []string{"/a", "/b"}},
+		{ID: 3600, TTL: time.Hour, Keys: []string{"/c"}},
+	}}, Config{Scheme: "http"})
+
+	resp, err := s.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: 60, Keys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TTL != 31 || resp.GrantedTTL != 60 || len(resp.Keys) != 2 || string(resp.Keys[1]) != "/b" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	resp, err = s.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TTL != 3600 || len(resp.Keys) != 0 {
+		t.Fatalf("expected no keys unless requested, got %+v", resp)
+	}
+
+	resp, err = s.LeaseTimeToLive(ctx, &etcdserverpb.LeaseTimeToLiveRequest{ID: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TTL != -1 {
+		t.Fatalf("expected TTL -1 for unknown lease, got %d", resp.TTL)
+	}
+
+	leases, err := s.LeaseLeases(ctx, &etcdserverpb.LeaseLeasesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases.Leases) != 2 || leases.Leases[0].ID != 60 || leases.Leases[1].ID != 3600 {
+		t.Fatalf("unexpected leases %+v", leases.Leases)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
@@ -11,9 +12,37 @@ type LimitedServer struct {
 	notifyInterval time.Duration
 	backend        Backend
 	scheme         string
+	quota          quota
+	readOnly       atomic.Bool
+	maxRecvMsgSize int
+	maxSendMsgSize int
+}
+
+// fragmentSize returns the size above which watch responses are fragmented for clients that
+// request it. Fragments are kept below the maximum message size by the grpc overhead, so that
+// they can be received by clients using the same limit as the server, and sent by the server
+// if a lower send limit is configured.
+func (l *LimitedServer) fragmentSize() int {
+	size := l.maxRecvMsgSize
+	if size <= 0 {
+		size = DefaultMaxRecvMsgSize
+	}
+	if l.maxSendMsgSize > 0 && l.maxSendMsgSize < size {
+		size = l.maxSendMsgSize
+	}
+	if size > 2*grpcOverheadBytes {
+		return size - grpcOverheadBytes
+	}
+	return size / 2
 }
 
 func (l *LimitedServer) Range(ctx context.Context, r *etcdserverpb.RangeRequest) (*RangeResponse, error) {
+	// Linearizable reads must observe every write completed before the request was made, so they are
+	// served by the primary. Serializable reads may be served from a read replica that is behind the
+	// primary, as with reads from an etcd member that is behind the leader.
+	if !r.Serializable {
+		ctx = WithPrimaryRead(ctx)
+	}
 	if len(r.RangeEnd) == 0 {
 		return l.get(ctx, r)
 	}
@@ -27,19 +56,37 @@ func txnHeader(rev int64) *etcdserverpb.ResponseHeader {
 }
 
 func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	// Comparisons and reads within a transaction are always linearizable.
+	ctx = WithPrimaryRead(ctx)
+	if !isCompact(txn) && txnHasMutation(txn) {
+		if err := l.checkReadOnly(); err != nil {
+			return nil, err
+		}
+	}
 	if put := isCreate(txn); put != nil {
+		if err := l.checkQuota(ctx); err != nil {
+			return nil, err
+		}
 		return l.create(ctx, put)
 	}
 	if rev, key, ok := isDelete(txn); ok {
 		return l.delete(ctx, key, rev)
 	}
 	if rev, key, value, lease, ok := isUpdate(txn); ok {
+		if err := l.checkQuota(ctx); err != nil {
+			return nil, err
+		}
 		return l.update(ctx, rev, key, value, lease)
 	}
 	if isCompact(txn) {
 		return l.compact()
 	}
-	return nil, ErrNotSupported
+	if txnHasPut(txn) {
+		if err := l.checkQuota(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return l.txn(ctx, txn)
 }
 
 type ResponseHeader struct {
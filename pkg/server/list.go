@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"strings"
@@ -15,15 +14,11 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 		return nil, fmt.Errorf("invalid range end length of 0")
 	}
 
-	prefix := string(append(r.RangeEnd[:len(r.RangeEnd)-1], r.RangeEnd[len(r.RangeEnd)-1]-1))
-	if !strings.HasSuffix(prefix, "/") {
-		prefix = prefix + "/"
-	}
-	start := string(bytes.TrimRight(r.Key, "\x00"))
+	key, rangeEnd := string(r.Key), string(r.RangeEnd)
 	revision := r.Revision
 
 	if r.CountOnly {
-		rev, count, err := l.backend.Count(ctx, prefix, start, revision)
+		rev, count, err := CountRange(ctx, l.backend, key, rangeEnd, revision)
 		resp := &RangeResponse{
 			Header: txnHeader(rev),
 			Count:  count,
@@ -37,7 +32,7 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 		limit++
 	}
 
-	rev, kvs, err := l.backend.List(ctx, prefix, start, limit, revision)
+	rev, kvs, err := ListRange(ctx, l.backend, key, rangeEnd, limit, revision)
 	logrus.Tracef("LIST key=%s, end=%s, revision=%d, currentRev=%d count=%d, limit=%d", r.Key, r.RangeEnd, revision, rev, len(kvs), r.Limit)
 	resp := &RangeResponse{
 		Header: txnHeader(rev),
@@ -54,10 +49,42 @@ func (l *LimitedServer) list(ctx context.Context, r *etcdserverpb.RangeRequest)
 			revision = rev
 		}
 
-		rev, resp.Count, err = l.backend.Count(ctx, prefix, start, revision)
+		rev, resp.Count, err = CountRange(ctx, l.backend, key, rangeEnd, revision)
 		logrus.Tracef("LIST COUNT key=%s, end=%s, revision=%d, currentRev=%d count=%d", r.Key, r.RangeEnd, revision, rev, resp.Count)
 		resp.Header = txnHeader(rev)
 	}
 
 	return resp, err
 }
+
+// ListRange lists the keys in the range selected by key and rangeEnd, using the backend's
+// ListRange if it implements RangeLister, or List by the prefix of the range otherwise.
+func ListRange(ctx context.Context, backend Backend, key, rangeEnd string, limit, revision int64) (int64, []*KeyValue, error) {
+	if lister, ok := backend.(RangeLister); ok {
+		return lister.ListRange(ctx, key, rangeEnd, limit, revision)
+	}
+	prefix, start := prefixRange(key, rangeEnd)
+	return backend.List(ctx, prefix, start, limit, revision)
+}
+
+// CountRange counts the keys in the range selected by key and rangeEnd, using the backend's
+// CountRange if it implements RangeLister, or Count by the prefix of the range otherwise.
+func CountRange(ctx context.Context, backend Backend, key, rangeEnd string, revision int64) (int64, int64, error) {
+	if lister, ok := backend.(RangeLister); ok {
+		return lister.CountRange(ctx, key, rangeEnd, revision)
+	}
+	prefix, start := prefixRange(key, rangeEnd)
+	return backend.Count(ctx, prefix, start, revision)
+}
+
+// prefixRange returns the prefix and start key used to list a range with List. Backends that
+// only list by prefix assume that the range end is the end of a prefix range, as used by
+// Kubernetes, and that the prefix ends with a slash.
+func prefixRange(key, rangeEnd string) (string, string) {
+	end := []byte(rangeEnd)
+	prefix := string(append(end[:len(end)-1], end[len(end)-1]-1))
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return prefix, strings.TrimRight(key, "\x00")
+}
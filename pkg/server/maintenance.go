@@ -10,8 +10,29 @@ import (
 // explicit interface check
 var _ etcdserverpb.MaintenanceServer = (*KVServerBridge)(nil)
 
-func (s *KVServerBridge) Alarm(context.Context, *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
-	return nil, fmt.Errorf("alarm is not supported")
+// Alarm reports the NOSPACE alarm raised when the datastore exceeds its size quota. The alarm
+// cannot be raised manually, and deactivating it only succeeds once the size is within the quota;
+// the size is checked immediately rather than waiting for the next periodic check.
+func (s *KVServerBridge) Alarm(ctx context.Context, r *etcdserverpb.AlarmRequest) (*etcdserverpb.AlarmResponse, error) {
+	resp := &etcdserverpb.AlarmResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}
+	switch r.Action {
+	case etcdserverpb.AlarmRequest_GET:
+		resp.Alarms = s.limited.quota.alarms(ctx, s.limited.backend, false)
+	case etcdserverpb.AlarmRequest_DEACTIVATE:
+		if r.Alarm != etcdserverpb.AlarmType_NOSPACE && r.Alarm != etcdserverpb.AlarmType_NONE {
+			break
+		}
+		before := s.limited.quota.alarms(ctx, s.limited.backend, false)
+		if len(s.limited.quota.alarms(ctx, s.limited.backend, true)) == 0 {
+			// report the alarms that were cleared
+			resp.Alarms = before
+		}
+	default:
+		return nil, fmt.Errorf("alarm %s is not supported", r.Action)
+	}
+	return resp, nil
 }
 
 func (s *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
@@ -19,15 +40,34 @@ func (s *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusReque
 	if err != nil {
 		return nil, err
 	}
-	return &etcdserverpb.StatusResponse{
-		Header:  &etcdserverpb.ResponseHeader{},
-		DbSize:  size,
-		Version: s.emulatedETCDVersion,
-	}, nil
+	rev, err := s.limited.backend.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// There is no raft log, so the revision is reported as the committed and applied index.
+	resp := &etcdserverpb.StatusResponse{
+		Header:           memberHeader(rev),
+		DbSize:           size,
+		DbSizeInUse:      s.limited.dbSizeInUse(ctx, size),
+		Leader:           memberID,
+		RaftIndex:        uint64(rev),
+		RaftTerm:         raftTerm,
+		RaftAppliedIndex: uint64(rev),
+		Version:          s.emulatedETCDVersion,
+	}
+	for _, alarm := range s.limited.quota.alarms(ctx, s.limited.backend, false) {
+		resp.Errors = append(resp.Errors, alarm.String())
+	}
+	return resp, nil
 }
 
-func (s *KVServerBridge) Defragment(context.Context, *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
-	return nil, fmt.Errorf("defragment is not supported")
+func (s *KVServerBridge) Defragment(ctx context.Context, r *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
+	if err := s.limited.defragment(ctx); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.DefragmentResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}, nil
 }
 
 func (s *KVServerBridge) Hash(context.Context, *etcdserverpb.HashRequest) (*etcdserverpb.HashResponse, error) {
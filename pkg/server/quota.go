@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// quotaCheckInterval is the minimum time between checks of the datastore size. Getting the size
+// may require scanning table statistics, so it is not done on every write.
+const quotaCheckInterval = 5 * time.Second
+
+// quota tracks the size of the datastore against the configured limit, and raises a NOSPACE
+// alarm when the limit is exceeded. The alarm is cleared once the size drops below the limit,
+// for example after compacting and defragmenting the datastore.
+type quota struct {
+	limit int64
+
+	mu      sync.Mutex
+	checked time.Time
+	size    int64
+	noSpace bool
+}
+
+// record updates the alarm state from the current datastore size.
+func (q *quota) record(size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.recordLocked(size)
+}
+
+func (q *quota) recordLocked(size int64) {
+	q.checked = time.Now()
+	q.size = size
+	if q.limit <= 0 {
+		return
+	}
+	noSpace := size > q.limit
+	if noSpace && !q.noSpace {
+		logrus.Errorf("Datastore size %d bytes exceeds quota of %d bytes; raising NOSPACE alarm. Writes will be rejected until the datastore is compacted and defragmented.", size, q.limit)
+	} else if !noSpace && q.noSpace {
+		logrus.Infof("Datastore size %d bytes is within quota of %d bytes; clearing NOSPACE alarm", size, q.limit)
+	}
+	q.noSpace = noSpace
+}
+
+// exceeded returns true if the NOSPACE alarm is raised, checking the size of the datastore if it
+// has not been checked recently or force is set. If the size cannot be determined, the previous
+// alarm state is kept.
+func (q *quota) exceeded(ctx context.Context, backend Backend, force bool) bool {
+	if q.limit <= 0 {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if force || time.Since(q.checked) >= quotaCheckInterval {
+		size, err := backend.DbSize(ctx)
+		if err != nil {
+			logrus.Warnf("Failed to get datastore size for quota check: %v", err)
+			q.checked = time.Now()
+		} else {
+			q.recordLocked(size)
+		}
+	}
+	return q.noSpace
+}
+
+// alarms returns the currently raised alarms.
+func (q *quota) alarms(ctx context.Context, backend Backend, force bool) []*etcdserverpb.AlarmMember {
+	if q.exceeded(ctx, backend, force) {
+		return []*etcdserverpb.AlarmMember{{Alarm: etcdserverpb.AlarmType_NOSPACE}}
+	}
+	return nil
+}
+
+// checkQuota returns ErrNoSpace if the NOSPACE alarm is raised. It is called before any operation
+// that writes a new value; deletes and compaction are always allowed so that space can be freed.
+func (l *LimitedServer) checkQuota(ctx context.Context) error {
+	if l.quota.exceeded(ctx, l.backend, false) {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// txnHasPut returns true if any of the transaction's operations, including those of nested
+// transactions, write a value.
+func txnHasPut(txn *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if op.GetRequestPut() != nil {
+				return true
+			}
+			if nested := op.GetRequestTxn(); nested != nil && txnHasPut(nested) {
+				return true
+			}
+		}
+	}
+	return false
+}
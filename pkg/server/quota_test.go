@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+type sizeBackend struct {
+	Backend
+	size int64
+	rev  int64
+}
+
+func (b *sizeBackend) DbSize(context.Context) (int64, error) {
+	return b.size, nil
+}
+
+func (b *sizeBackend) CurrentRevision(context.Context) (int64, error) {
+	return b.rev, nil
+}
+
+type sizeInUseBackend struct {
+	sizeBackend
+	inUse int64
+}
+
+func (b *sizeInUseBackend) DbSizeInUse(context.Context) (int64, error) {
+	return b.inUse, nil
+}
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	resp, err := New(&sizeBackend{size: 100, rev: 5}, Config{Scheme: "http", EmulatedETCDVersion: "3.5.13"}).Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DbSize != 100 || resp.DbSizeInUse != 100 || resp.Header.Revision != 5 || resp.RaftIndex != 5 || resp.Version != "3.5.13" {
+		t.Fatalf("expected size, revision and version in status, got %+v", resp)
+	}
+	if resp.Leader == 0 || resp.Leader != resp.Header.MemberId || resp.RaftTerm == 0 {
+		t.Fatalf("expected member to be the leader in status, got %+v", resp)
+	}
+
+	resp, err = New(&sizeInUseBackend{sizeBackend: sizeBackend{size: 100, rev: 5}, inUse: 40}, Config{Scheme: "http"}).Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DbSize != 100 || resp.DbSizeInUse != 40 {
+		t.Fatalf("expected size in use from backend in status, got %+v", resp)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	ctx := context.Background()
+	backend := &sizeBackend{size: 100}
+	s := New(backend, Config{Scheme: "http", QuotaBackendBytes: 1000})
+
+	if err := s.limited.checkQuota(ctx); err != nil {
+		t.Fatalf("expected no error within quota, got %v", err)
+	}
+
+	backend.size = 2000
+	resp, err := s.Status(ctx, &etcdserverpb.StatusRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.DbSize != 2000 || len(resp.Errors) != 1 {
+		t.Fatalf("expected size and NOSPACE error in status, got %+v", resp)
+	}
+	if err := s.limited.checkQuota(ctx); err != ErrNoSpace {
+		t.Fatalf("expected %v once over quota, got %v", ErrNoSpace, err)
+	}
+	// Deletes must be allowed so that space can be freed.
+	del := &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{}}}}}
+	put := &etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{}}}}}
+	if txnHasPut(del) || !txnHasPut(put) {
+		t.Fatal("unexpected result from txnHasPut")
+	}
+
+	alarms, err := s.Alarm(ctx, &etcdserverpb.AlarmRequest{Action: etcdserverpb.AlarmRequest_DEACTIVATE, Alarm: etcdserverpb.AlarmType_NOSPACE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms.Alarms) != 0 {
+		t.Fatalf("expected alarm to remain active while over quota, got %+v", alarms.Alarms)
+	}
+
+	backend.size = 500
+	alarms, err = s.Alarm(ctx, &etcdserverpb.AlarmRequest{Action: etcdserverpb.AlarmRequest_DEACTIVATE, Alarm: etcdserverpb.AlarmType_NOSPACE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alarms.Alarms) != 1 || alarms.Alarms[0].Alarm != etcdserverpb.AlarmType_NOSPACE {
+		t.Fatalf("expected NOSPACE alarm to be deactivated, got %+v", alarms.Alarms)
+	}
+	if err := s.limited.checkQuota(ctx); err != nil {
+		t.Fatalf("expected no error after size dropped, got %v", err)
+	}
+}
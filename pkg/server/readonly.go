@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// SetReadOnly enables or disables read-only mode. In read-only mode, reads and watches are served
+// as usual, but client writes and compaction requests are rejected with ErrReadOnly, and the
+// backend pauses background writes if it supports doing so.
+func (k *KVServerBridge) SetReadOnly(readOnly bool) {
+	if k.limited.readOnly.Swap(readOnly) == readOnly {
+		return
+	}
+	if setter, ok := k.limited.backend.(ReadOnlySetter); ok {
+		setter.SetReadOnly(readOnly)
+	}
+	if readOnly {
+		logrus.Warnf("Kine is in read-only mode; writes will be rejected until read-only mode is disabled")
+	} else {
+		logrus.Infof("Kine read-only mode disabled; accepting writes")
+	}
+}
+
+// ReadOnly returns true if the server is in read-only mode.
+func (k *KVServerBridge) ReadOnly() bool {
+	return k.limited.readOnly.Load()
+}
+
+// checkReadOnly returns ErrReadOnly if the server is in read-only mode. It is called before any
+// operation that writes to the datastore.
+func (l *LimitedServer) checkReadOnly() error {
+	if l.readOnly.Load() {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// txnHasMutation returns true if any of the transaction's operations, including those of nested
+// transactions, write or delete a value.
+func txnHasMutation(txn *etcdserverpb.TxnRequest) bool {
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if op.GetRequestPut() != nil || op.GetRequestDeleteRange() != nil {
+				return true
+			}
+			if nested := op.GetRequestTxn(); nested != nil && txnHasMutation(nested) {
+				return true
+			}
+		}
+	}
+	return false
+}
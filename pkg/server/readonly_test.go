@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+type readOnlyBackend struct {
+	Backend
+	readOnly bool
+	creates  int
+}
+
+func (b *readOnlyBackend) SetReadOnly(readOnly bool) {
+	b.readOnly = readOnly
+}
+
+func (b *readOnlyBackend) Create(context.Context, string, []byte, int64) (int64, error) {
+	b.creates++
+	return 2, nil
+}
+
+func (b *readOnlyBackend) Get(context.Context, string, string, int64, int64) (int64, *KeyValue, error) {
+	return 1, &KeyValue{Key: "/a", Value: []byte("a"), ModRevision: 1}, nil
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	backend := &readOnlyBackend{}
+	s := New(backend, Config{Scheme: "http"})
+
+	create := &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte("/a"),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 0},
+		}},
+		Success: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("/a"), Value: []byte("a")}},
+		}},
+	}
+
+	s.SetReadOnly(true)
+	if !s.ReadOnly() || !backend.readOnly {
+		t.Fatal("expected server and backend to be in read-only mode")
+	}
+	if _, err := s.Txn(ctx, create); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly for create, got %v", err)
+	}
+	if _, err := s.Compact(ctx, &etcdserverpb.CompactionRequest{Revision: 1, Physical: true}); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly for compact, got %v", err)
+	}
+	if backend.creates != 0 {
+		t.Fatalf("expected no creates in read-only mode, got %d", backend.creates)
+	}
+	resp, err := s.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")})
+	if err != nil {
+		t.Fatalf("expected range to succeed in read-only mode, got %v", err)
+	}
+	if len(resp.Kvs) != 1 {
+		t.Fatalf("expected one key from range, got %d", len(resp.Kvs))
+	}
+
+	s.SetReadOnly(false)
+	if s.ReadOnly() || backend.readOnly {
+		t.Fatal("expected server and backend to leave read-only mode")
+	}
+	if _, err := s.Txn(ctx, create); err != nil {
+		t.Fatalf("expected create to succeed, got %v", err)
+	}
+	if backend.creates != 1 {
+		t.Fatalf("expected one create, got %d", backend.creates)
+	}
+
+	if txnHasMutation(&etcdserverpb.TxnRequest{Success: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestRange{}}}}) {
+		t.Fatal("expected read-only transaction to have no mutations")
+	}
+	if !txnHasMutation(&etcdserverpb.TxnRequest{Failure: []*etcdserverpb.RequestOp{{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{}}}}}) {
+		t.Fatal("expected transaction with delete to have a mutation")
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// replayBuffer is a bounded ring buffer of the most recent events, used to resume watches whose
+// start revision has been compacted, but is recent enough that every event since the start
+// revision is still held in memory. This allows clients that reconnect shortly after a compaction
+// to continue watching, instead of relisting.
+//
+// Only keys that start with a slash are buffered, as internal keys are not seen on the watch.
+type replayBuffer struct {
+	mu     sync.RWMutex
+	events []*Event
+	next   int
+	count  int
+	// revision is the revision after which every event is held in the buffer, and latest is the
+	// revision of the most recent event. Events after latest have not yet been buffered.
+	revision int64
+	latest   int64
+	ready    bool
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	if size <= 0 {
+		return nil
+	}
+	return &replayBuffer{events: make([]*Event, size)}
+}
+
+// start buffers events from the backend, starting after the current revision, until the context
+// is cancelled.
+func (b *replayBuffer) start(ctx context.Context, backend Backend) error {
+	rev, err := backend.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+	wr := backend.Watch(ctx, "/", rev+1)
+	if wr.CompactRevision != 0 {
+		return ErrCompacted
+	}
+
+	b.mu.Lock()
+	b.revision = rev
+	b.latest = rev
+	b.ready = true
+	b.mu.Unlock()
+
+	go func() {
+		for events := range wr.Events {
+			b.add(events)
+		}
+		if ctx.Err() == nil {
+			// Events can no longer be buffered without a gap, so stop replaying them.
+			logrus.Errorf("Watch replay buffer channel closed, disabling watch replay")
+		}
+		b.mu.Lock()
+		b.ready = false
+		b.events = nil
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// add appends events to the buffer, replacing the oldest events once the buffer is full.
+func (b *replayBuffer) add(events []*Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, event := range events {
+		if event.KV.ModRevision <= b.latest {
+			continue
+		}
+		if b.count == len(b.events) {
+			b.revision = b.events[b.next].KV.ModRevision
+		} else {
+			b.count++
+		}
+		b.events[b.next] = event
+		b.next = (b.next + 1) % len(b.events)
+		b.latest = event.KV.ModRevision
+	}
+}
+
+// since returns the buffered events for the watched key after the given revision, and the
+// revision up to which the buffer is complete. False is returned if events after the revision
+// have been dropped from the buffer, or the key cannot be buffered.
+func (b *replayBuffer) since(key string, revision int64) ([]*Event, int64, bool) {
+	if !strings.HasPrefix(key, "/") {
+		return nil, 0, false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if !b.ready || revision < b.revision {
+		return nil, 0, false
+	}
+
+	checkPrefix := strings.HasSuffix(key, "/")
+	var events []*Event
+	for i := 0; i < b.count; i++ {
+		event := b.events[(b.next-b.count+i+len(b.events))%len(b.events)]
+		if event.KV.ModRevision <= revision {
+			continue
+		}
+		if (checkPrefix && strings.HasPrefix(event.KV.Key, key)) || event.KV.Key == key {
+			events = append(events, event)
+		}
+	}
+	return events, b.latest, true
+}
+
+// replay attempts to resume a watch whose start revision has been compacted from the events in
+// the buffer, returning the buffered events followed by events from a new watch starting after
+// the buffer. False is returned if the start revision is not covered by the buffer.
+func (b *replayBuffer) replay(ctx context.Context, backend Backend, key string, startRevision int64) (WatchResult, bool) {
+	if b == nil || startRevision <= 0 {
+		return WatchResult{}, false
+	}
+	events, latest, ok := b.since(key, startRevision-1)
+	if !ok {
+		return WatchResult{}, false
+	}
+	wr := backend.Watch(ctx, key, latest+1)
+	if wr.CompactRevision != 0 {
+		return WatchResult{}, false
+	}
+	logrus.Tracef("WATCH REPLAY key=%s, revision=%d, latest=%d, events=%d", key, startRevision, latest, len(events))
+
+	result := make(chan []*Event, 100)
+	go func() {
+		defer close(result)
+		if len(events) > 0 {
+			result <- events
+		}
+		for events := range wr.Events {
+			result <- events
+		}
+	}()
+	return WatchResult{Events: result, Errorc: wr.Errorc}, true
+}
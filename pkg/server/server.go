@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
@@ -13,19 +15,86 @@ import (
 type KVServerBridge struct {
 	emulatedETCDVersion string
 	limited             *LimitedServer
+	replay              *replayBuffer
+	shutdown            chan struct{}
+	shutdownOnce        sync.Once
+	clientURLs          []string
+	reads               *requestLimit
+	writes              *requestLimit
+	coalesceWindow      time.Duration
 }
 
-func New(backend Backend, scheme string, notifyInterval time.Duration, emulatedETCDVersion string) *KVServerBridge {
+// Config holds the settings of a KVServerBridge.
+type Config struct {
+	// Scheme is the scheme of the URL that clients connect to, used when no client URLs are set.
+	Scheme              string
+	NotifyInterval      time.Duration
+	EmulatedETCDVersion string
+	// QuotaBackendBytes is the datastore size above which writes are rejected with the NOSPACE
+	// alarm; 0 disables the quota.
+	QuotaBackendBytes int64
+	// MaxRecvMsgSize and MaxSendMsgSize are the GRPC message size limits of the server, which
+	// bound the size of range and watch responses.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// WatchReplayBufferSize is the number of recent events buffered for watches that start at a
+	// past revision; 0 disables the buffer.
+	WatchReplayBufferSize int
+	// WatchCoalesceWindow is how long each watch waits after receiving events for more events to
+	// send along with them, so that repeated updates to a key within the window are sent as a
+	// single event holding its latest value. Creates and deletes are always sent, and updates are
+	// never merged across them. A window <= 0 sends every event as soon as it is received.
+	WatchCoalesceWindow time.Duration
+	// ClientURLs are the URLs that clients are told to connect to, in the member list. If no URLs
+	// are set, the URL that the client connected to is used.
+	ClientURLs []string
+	// MaxConcurrentReads and MaxConcurrentWrites are the maximum number of read and write
+	// requests that are served at once; requests beyond the limit are rejected with
+	// ErrTooManyRequests. Ranges and transactions without writes are reads; transactions with
+	// writes, and compactions, are writes. Watches are not limited. A limit <= 0 disables the
+	// limit.
+	MaxConcurrentReads  int
+	MaxConcurrentWrites int
+}
+
+func New(backend Backend, config Config) *KVServerBridge {
 	return &KVServerBridge{
-		emulatedETCDVersion: emulatedETCDVersion,
+		emulatedETCDVersion: config.EmulatedETCDVersion,
 		limited: &LimitedServer{
-			notifyInterval: notifyInterval,
+			notifyInterval: config.NotifyInterval,
 			backend:        backend,
-			scheme:         scheme,
+			scheme:         config.Scheme,
+			quota:          quota{limit: config.QuotaBackendBytes},
+			maxRecvMsgSize: config.MaxRecvMsgSize,
+			maxSendMsgSize: config.MaxSendMsgSize,
 		},
+		replay:         newReplayBuffer(config.WatchReplayBufferSize),
+		shutdown:       make(chan struct{}),
+		clientURLs:     config.ClientURLs,
+		reads:          newRequestLimit("read", config.MaxConcurrentReads),
+		writes:         newRequestLimit("write", config.MaxConcurrentWrites),
+		coalesceWindow: config.WatchCoalesceWindow,
 	}
 }
 
+// Start starts buffering recent events for watch replay, if enabled, until the context is
+// cancelled.
+func (k *KVServerBridge) Start(ctx context.Context) error {
+	if k.replay == nil {
+		return nil
+	}
+	return k.replay.start(ctx, k.limited.backend)
+}
+
+// Shutdown closes all watch streams, after sending a final progress notification to streams
+// whose watches are synced. Watch streams opened after Shutdown is called are closed immediately.
+// Unary requests are not affected, and should be drained by gracefully stopping the GRPC server.
+func (k *KVServerBridge) Shutdown() {
+	k.shutdownOnce.Do(func() {
+		close(k.shutdown)
+	})
+}
+
 func (k *KVServerBridge) Register(server *grpc.Server) {
 	etcdserverpb.RegisterLeaseServer(server, k)
 	etcdserverpb.RegisterWatchServer(server, k)
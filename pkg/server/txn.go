@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxTxnRetries is the number of times a transaction will be re-evaluated if one of the keys that
+// it writes is modified while the transaction is running.
+const maxTxnRetries = 10
+
+var errTxnConflict = status.New(codes.Aborted, "etcdserver: too many conflicting writes while evaluating txn").Err()
+
+// compareValue evaluates a value comparison against the current value of a key.
+// A key that does not exist is treated as having an empty value.
+func compareValue(kv *KeyValue, c *etcdserverpb.Compare) bool {
+	var value []byte
+	if kv != nil {
+		value = kv.Value
+	}
+	return compareResult(bytes.Compare(value, c.GetValue()), c.Result)
+}
+
+// compareInt evaluates a comparison of a revision or lease against the current key value.
+func compareInt(actual, target int64, result etcdserverpb.Compare_CompareResult) bool {
+	switch {
+	case actual < target:
+		return compareResult(-1, result)
+	case actual > target:
+		return compareResult(1, result)
+	}
+	return compareResult(0, result)
+}
+
+func compareResult(result int, c etcdserverpb.Compare_CompareResult) bool {
+	switch c {
+	case etcdserverpb.Compare_EQUAL:
+		return result == 0
+	case etcdserverpb.Compare_NOT_EQUAL:
+		return result != 0
+	case etcdserverpb.Compare_GREATER:
+		return result > 0
+	case etcdserverpb.Compare_LESS:
+		return result < 0
+	}
+	return false
+}
+
+// compare evaluates a comparison against a key value, which is nil if the key does not exist.
+// Kine does not track the number of times a key has been written, so versions can only be
+// compared against zero, which is the version of a key that does not exist.
+func compare(kv *KeyValue, c *etcdserverpb.Compare) (bool, error) {
+	if c.Target == etcdserverpb.Compare_VALUE {
+		return compareValue(kv, c), nil
+	}
+	if kv == nil {
+		kv = &KeyValue{}
+	}
+	switch c.Target {
+	case etcdserverpb.Compare_MOD:
+		return compareInt(kv.ModRevision, c.GetModRevision(), c.Result), nil
+	case etcdserverpb.Compare_CREATE:
+		return compareInt(kv.CreateRevision, c.GetCreateRevision(), c.Result), nil
+	case etcdserverpb.Compare_LEASE:
+		return compareInt(kv.Lease, c.GetLease(), c.Result), nil
+	case etcdserverpb.Compare_VERSION:
+		if c.GetVersion() != 0 {
+			return false, unsupported("version comparison")
+		}
+		var version int64
+		if kv.ModRevision != 0 {
+			version = 1
+		}
+		return compareInt(version, 0, c.Result), nil
+	}
+	return false, ErrNotSupported
+}
+
+// inRange returns true if the key is within the range selected by start and rangeEnd, using etcd
+// range_end semantics.
+func inRange(key, start, rangeEnd string) bool {
+	if rangeEnd == "" {
+		return key == start
+	}
+	if rangeEnd == "\x00" {
+		return key >= start
+	}
+	return key >= start && key < rangeEnd
+}
+
+// txnWrite is a write made by a transaction. Its key value is completed with the revision at
+// which it was written once the writes have been applied.
+type txnWrite struct {
+	Write
+	kv *KeyValue
+}
+
+// txnState holds the keys read and written while evaluating a transaction, so that operations
+// observe the writes made by earlier operations in the same transaction.
+type txnState struct {
+	l   *LimitedServer
+	rev int64
+	// kvs holds the value of each key as seen by the transaction, which is nil if the key does
+	// not exist.
+	kvs map[string]*KeyValue
+	// revisions holds the mod revision of each key when it was first read, which is zero if the
+	// key did not exist. Writes are conditional on the key still being at this revision.
+	revisions map[string]int64
+	writes    []*txnWrite
+	written   map[string]bool
+	// conditions holds the keys and ranges that were compared, so that the writes are only
+	// applied if they are unchanged.
+	conditions []*Condition
+	// branches records whether the comparisons of the transaction and each nested transaction
+	// succeeded.
+	branches map[*etcdserverpb.TxnRequest]bool
+	// finish builds the responses once the writes have been applied and their revisions are
+	// known.
+	finish []func(rev int64)
+}
+
+// txn evaluates a transaction with any combination of comparisons and operations, including nested
+// transactions. As with etcd, all comparisons are evaluated against the keys as they were when the
+// transaction started, and operations are applied in order, each observing the writes made by the
+// operations before it. The writes are applied atomically once all of the operations have been
+// evaluated, conditional on none of the compared or written keys having been modified in the
+// meantime; if one has, the transaction is re-evaluated. Each write is recorded in the log at its own revision, so
+// the response header holds the revision of the last write.
+func (l *LimitedServer) txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	for i := 0; i < maxTxnRetries; i++ {
+		resp, ok, err := l.tryTxn(ctx, txn)
+		if err != nil || ok {
+			return resp, err
+		}
+	}
+	return nil, errTxnConflict
+}
+
+// tryTxn makes a single attempt at evaluating a transaction. False is returned if a conflicting
+// write was detected, in which case no writes have been applied.
+func (l *LimitedServer) tryTxn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, bool, error) {
+	s := &txnState{
+		l:         l,
+		kvs:       map[string]*KeyValue{},
+		revisions: map[string]int64{},
+		written:   map[string]bool{},
+		branches:  map[*etcdserverpb.TxnRequest]bool{},
+	}
+	if err := s.evaluate(ctx, txn); err != nil {
+		return nil, false, err
+	}
+	resp, err := s.apply(ctx, txn)
+	if err != nil {
+		return nil, false, err
+	}
+
+	rev, ok, err := s.commit(ctx)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+	for _, f := range s.finish {
+		f(rev)
+	}
+	return resp, true, nil
+}
+
+// evaluate evaluates the comparisons of the transaction and the nested transactions in the branch
+// that is selected, before any operations are applied.
+func (s *txnState) evaluate(ctx context.Context, txn *etcdserverpb.TxnRequest) error {
+	succeeded := true
+	for _, c := range txn.Compare {
+		ok, err := s.compare(ctx, c)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			succeeded = false
+		}
+	}
+	s.branches[txn] = succeeded
+
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+	for _, op := range ops {
+		if nested := op.GetRequestTxn(); nested != nil {
+			if err := s.evaluate(ctx, nested); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compare evaluates a comparison. Comparisons against a range succeed if every key in the range
+// satisfies the comparison; an empty range is compared as a key that does not exist.
+func (s *txnState) compare(ctx context.Context, c *etcdserverpb.Compare) (bool, error) {
+	condition := &Condition{Key: string(c.Key), RangeEnd: string(c.RangeEnd), Revisions: map[string]int64{}}
+	s.conditions = append(s.conditions, condition)
+
+	if len(c.RangeEnd) == 0 {
+		kv, err := s.get(ctx, string(c.Key))
+		if err != nil {
+			return false, err
+		}
+		if kv != nil {
+			condition.Revisions[kv.Key] = kv.ModRevision
+		}
+		return compare(kv, c)
+	}
+
+	kvs, err := s.list(ctx, string(c.Key), string(c.RangeEnd))
+	if err != nil {
+		return false, err
+	}
+	for _, kv := range kvs {
+		condition.Revisions[kv.Key] = kv.ModRevision
+	}
+	if len(kvs) == 0 {
+		return compare(nil, c)
+	}
+	for _, kv := range kvs {
+		if ok, err := compare(kv, c); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// apply evaluates the operations of the branch selected for the transaction, returning the
+// response that is completed once the writes have been applied.
+func (s *txnState) apply(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	succeeded := s.branches[txn]
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+
+	resp := &etcdserverpb.TxnResponse{
+		Succeeded: succeeded,
+		Responses: make([]*etcdserverpb.ResponseOp, 0, len(ops)),
+	}
+	s.finish = append(s.finish, func(rev int64) {
+		resp.Header = txnHeader(rev)
+	})
+
+	for _, op := range ops {
+		var (
+			respOp *etcdserverpb.ResponseOp
+			err    error
+		)
+		switch {
+		case op.GetRequestPut() != nil:
+			respOp, err = s.put(ctx, op.GetRequestPut())
+		case op.GetRequestDeleteRange() != nil:
+			respOp, err = s.deleteRange(ctx, op.GetRequestDeleteRange())
+		case op.GetRequestRange() != nil:
+			respOp, err = s.rangeOp(ctx, op.GetRequestRange())
+		case op.GetRequestTxn() != nil:
+			var nested *etcdserverpb.TxnResponse
+			if nested, err = s.apply(ctx, op.GetRequestTxn()); err == nil {
+				respOp = &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseTxn{ResponseTxn: nested}}
+			}
+		default:
+			return nil, ErrNotSupported
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.Responses = append(resp.Responses, respOp)
+	}
+	return resp, nil
+}
+
+func (s *txnState) put(ctx context.Context, put *etcdserverpb.PutRequest) (*etcdserverpb.ResponseOp, error) {
+	key := string(put.Key)
+	prev, err := s.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, lease := put.Value, put.Lease
+	if put.IgnoreValue || put.IgnoreLease {
+		if prev == nil {
+			return nil, rpctypes.ErrGRPCKeyNotFound
+		}
+		if put.IgnoreValue {
+			value = prev.Value
+		}
+		if put.IgnoreLease {
+			lease = prev.Lease
+		}
+	}
+
+	kv := &KeyValue{Key: key, Value: value, Lease: lease}
+	if err := s.write(key, &txnWrite{Write: Write{Key: key, Value: value, Lease: lease}, kv: kv}); err != nil {
+		return nil, err
+	}
+	s.kvs[key] = kv
+
+	resp := &etcdserverpb.PutResponse{}
+	if put.PrevKv && prev != nil {
+		resp.PrevKv = toKV(prev)
+	}
+	s.finish = append(s.finish, func(rev int64) {
+		resp.Header = txnHeader(rev)
+	})
+	return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponsePut{ResponsePut: resp}}, nil
+}
+
+func (s *txnState) deleteRange(ctx context.Context, del *etcdserverpb.DeleteRangeRequest) (*etcdserverpb.ResponseOp, error) {
+	var kvs []*KeyValue
+	if len(del.RangeEnd) == 0 {
+		kv, err := s.get(ctx, string(del.Key))
+		if err != nil {
+			return nil, err
+		}
+		if kv != nil {
+			kvs = append(kvs, kv)
+		}
+	} else {
+		var err error
+		if kvs, err = s.list(ctx, string(del.Key), string(del.RangeEnd)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kv := range kvs {
+		if err := s.write(kv.Key, &txnWrite{Write: Write{Key: kv.Key, Delete: true}}); err != nil {
+			return nil, err
+		}
+		s.kvs[kv.Key] = nil
+	}
+
+	resp := &etcdserverpb.DeleteRangeResponse{Deleted: int64(len(kvs))}
+	if del.PrevKv {
+		resp.PrevKvs = toKVs(kvs...)
+	}
+	s.finish = append(s.finish, func(rev int64) {
+		resp.Header = txnHeader(rev)
+	})
+	return &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: resp}}, nil
+}
+
+func (s *txnState) rangeOp(ctx context.Context, rng *etcdserverpb.RangeRequest) (*etcdserverpb.ResponseOp, error) {
+	if err := checkRangeRequest(rng); err != nil {
+		return nil, err
+	}
+
+	resp := &etcdserverpb.RangeResponse{}
+	respOp := &etcdserverpb.ResponseOp{Response: &etcdserverpb.ResponseOp_ResponseRange{ResponseRange: resp}}
+
+	// Reads of past revisions, and of ranges that have not been written by the transaction, are
+	// served by the backend, which applies the limit and count more efficiently.
+	if rng.Revision != 0 || !s.rangeWritten(string(rng.Key), string(rng.RangeEnd)) {
+		r, err := s.l.Range(ctx, rng)
+		if err != nil {
+			return nil, err
+		}
+		resp.More, resp.Count = r.More, r.Count
+		s.finish = append(s.finish, func(rev int64) {
+			resp.Header = txnHeader(rev)
+			resp.Kvs = toKVs(r.Kvs...)
+		})
+		return respOp, nil
+	}
+
+	var kvs []*KeyValue
+	if len(rng.RangeEnd) == 0 {
+		kv, err := s.get(ctx, string(rng.Key))
+		if err != nil {
+			return nil, err
+		}
+		if kv != nil {
+			kvs = append(kvs, kv)
+		}
+	} else {
+		var err error
+		if kvs, err = s.list(ctx, string(rng.Key), string(rng.RangeEnd)); err != nil {
+			return nil, err
+		}
+	}
+
+	resp.Count = int64(len(kvs))
+	if rng.CountOnly {
+		kvs = nil
+	} else if rng.Limit > 0 && int64(len(kvs)) > rng.Limit {
+		kvs = kvs[:rng.Limit]
+		resp.More = true
+	}
+	// Key values written by the transaction do not have a revision until the writes are applied.
+	s.finish = append(s.finish, func(rev int64) {
+		resp.Header = txnHeader(rev)
+		resp.Kvs = toKVs(kvs...)
+	})
+	return respOp, nil
+}
+
+// write records a write to the key. As with etcd, a transaction may not write to the same key
+// more than once.
+func (s *txnState) write(key string, write *txnWrite) error {
+	if s.written[key] {
+		return rpctypes.ErrGRPCDuplicateKey
+	}
+	s.written[key] = true
+	write.Revision = s.revisions[key]
+	s.writes = append(s.writes, write)
+	return nil
+}
+
+// rangeWritten returns true if the transaction has written any keys within the range.
+func (s *txnState) rangeWritten(key, rangeEnd string) bool {
+	for written := range s.written {
+		if inRange(written, key, rangeEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the key value as seen by the transaction, reading it from the backend if it has not
+// already been read.
+func (s *txnState) get(ctx context.Context, key string) (*KeyValue, error) {
+	if kv, ok := s.kvs[key]; ok {
+		return kv, nil
+	}
+	rev, kv, err := s.l.backend.Get(ctx, key, "", 1, 0)
+	if err != nil {
+		return nil, err
+	}
+	s.observe(rev, key, kv)
+	return kv, nil
+}
+
+// list returns the key values in the range as seen by the transaction, sorted by key. Keys that
+// have already been read or written by the transaction are not read again.
+func (s *txnState) list(ctx context.Context, key, rangeEnd string) ([]*KeyValue, error) {
+	rev, kvs, err := ListRange(ctx, s.l.backend, key, rangeEnd, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range kvs {
+		if _, ok := s.kvs[kv.Key]; !ok {
+			s.observe(rev, kv.Key, kv)
+		}
+	}
+
+	result := make([]*KeyValue, 0, len(kvs))
+	for k, kv := range s.kvs {
+		if kv != nil && inRange(k, key, rangeEnd) {
+			result = append(result, kv)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// observe records the key value read from the backend at the revision.
+func (s *txnState) observe(rev int64, key string, kv *KeyValue) {
+	if rev > s.rev {
+		s.rev = rev
+	}
+	s.kvs[key] = kv
+	if kv != nil {
+		s.revisions[key] = kv.ModRevision
+	}
+}
+
+// commit applies the writes, returning the revision of the transaction. A single write to a key
+// that is the only key compared is applied directly; otherwise, the writes are applied atomically
+// by the backend, conditional on the compared keys and ranges being unchanged. False is returned
+// without applying any writes if a compared or written key has been modified since it was read.
+func (s *txnState) commit(ctx context.Context) (int64, bool, error) {
+	// Comparisons of single keys that are written are already enforced by the revision that the
+	// write is conditional on.
+	var conditions []*Condition
+	for _, condition := range s.conditions {
+		if condition.RangeEnd != "" || !s.written[condition.Key] {
+			conditions = append(conditions, condition)
+		}
+	}
+
+	switch {
+	case len(s.writes) == 0:
+		if s.rev == 0 {
+			rev, err := s.l.backend.CurrentRevision(ctx)
+			return rev, err == nil, err
+		}
+		return s.rev, true, nil
+	case len(s.writes) == 1 && len(conditions) == 0:
+		return s.commitOne(ctx, s.writes[0])
+	}
+
+	writer, ok := s.l.backend.(BatchWriter)
+	if !ok {
+		return 0, false, ErrNotSupported
+	}
+	writes := make([]*Write, len(s.writes))
+	for i, w := range s.writes {
+		writes[i] = &w.Write
+	}
+	rev, kvs, ok, err := writer.WriteBatch(ctx, writes, conditions)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	for i, w := range s.writes {
+		if w.kv != nil {
+			w.kv.ModRevision = kvs[i].ModRevision
+			w.kv.CreateRevision = kvs[i].CreateRevision
+		}
+	}
+	return rev, true, nil
+}
+
+func (s *txnState) commitOne(ctx context.Context, w *txnWrite) (int64, bool, error) {
+	switch {
+	case w.Delete:
+		rev, _, ok, err := s.l.backend.Delete(ctx, w.Key, w.Revision)
+		return rev, ok && err == nil, err
+	case w.Revision == 0:
+		rev, err := s.l.backend.Create(ctx, w.Key, w.Value, w.Lease)
+		if err == ErrKeyExists {
+			return 0, false, nil
+		} else if err != nil {
+			return 0, false, err
+		}
+		w.kv.ModRevision, w.kv.CreateRevision = rev, rev
+		return rev, true, nil
+	default:
+		rev, kv, ok, err := s.l.backend.Update(ctx, w.Key, w.Value, w.Revision, w.Lease)
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		w.kv.ModRevision, w.kv.CreateRevision = kv.ModRevision, kv.CreateRevision
+		return rev, true, nil
+	}
+}
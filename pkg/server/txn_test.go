@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+func TestCompareValue(t *testing.T) {
+	large := make([]byte, 16*1024*1024)
+	largeMore := append(append([]byte{}, large...), 0)
+
+	tests := []struct {
+		KV       *KeyValue
+		Result   etcdserverpb.Compare_CompareResult
+		Value    []byte
+		Expected bool
+	}{
+		{&KeyValue{Value: []byte("a")}, etcdserverpb.Compare_EQUAL, []byte("a"), true},
+		{&KeyValue{Value: []byte("a")}, etcdserverpb.Compare_EQUAL, []byte("b"), false},
+		{&KeyValue{Value: []byte("a")}, etcdserverpb.Compare_NOT_EQUAL, []byte("b"), true},
+		{&KeyValue{Value: []byte("a")}, etcdserverpb.Compare_NOT_EQUAL, []byte("a"), false},
+		{&KeyValue{Value: []byte("b")}, etcdserverpb.Compare_GREATER, []byte("a"), true},
+		{&KeyValue{Value: []byte("a")}, etcdserverpb.Compare_GREATER, []byte("b"), false},
+		{&KeyValue{Value: []byte("a")}, etcdserverpb.Compare_LESS, []byte("b"), true},
+		{&KeyValue{Value: []byte("b")}, etcdserverpb.Compare_LESS, []byte("a"), false},
+		{nil, etcdserverpb.Compare_EQUAL, nil, true},
+		{nil, etcdserverpb.Compare_EQUAL, []byte("a"), false},
+		{nil, etcdserverpb.Compare_LESS, []byte("a"), true},
+		{&KeyValue{Value: large}, etcdserverpb.Compare_EQUAL, large, true},
+		{&KeyValue{Value: large}, etcdserverpb.Compare_LESS, largeMore, true},
+	}
+
+	for i, test := range tests {
+		c := &etcdserverpb.Compare{
+			Target:      etcdserverpb.Compare_VALUE,
+			Result:      test.Result,
+			TargetUnion: &etcdserverpb.Compare_Value{Value: test.Value},
+		}
+		if got := compareValue(test.KV, c); got != test.Expected {
+			t.Errorf("Test %d: expected %v for %s compare, got %v", i, test.Expected, test.Result, got)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc/codes"
@@ -16,6 +18,16 @@ var (
 	ErrCompacted     = rpctypes.ErrGRPCCompacted
 	ErrFutureRev     = rpctypes.ErrGRPCFutureRev
 	ErrGRPCUnhealthy = rpctypes.ErrGRPCUnhealthy
+	ErrNoSpace       = rpctypes.ErrGRPCNoSpace
+	ErrTooLarge      = rpctypes.ErrGRPCRequestTooLarge
+	ErrReadOnly      = status.New(codes.Unavailable, "etcdserver: kine is in read-only mode").Err()
+
+	// ErrTooManyRequests is returned when the limit on concurrent requests of a kind is reached.
+	ErrTooManyRequests = rpctypes.ErrGRPCRequestTooManyRequests
+
+	// ErrWatchOverflow is sent on a watch's error channel when the watch is dropped because it did
+	// not keep up with the event stream. Events have been missed, so the client must relist.
+	ErrWatchOverflow = errors.New("watch did not keep up with events")
 )
 
 type Backend interface {
@@ -30,28 +42,63 @@ type Backend interface {
 	DbSize(ctx context.Context) (int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
 	Compact(ctx context.Context, revision int64) (int64, error)
+	Defragment(ctx context.Context) error
+}
+
+// Rows are the rows returned by a query of a Dialect, which are read with Next and Scan as with
+// sql.Rows. Rows must be closed once they have been read, to release the resources of the query.
+type Rows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
 }
 
 type Dialect interface {
-	ListCurrent(ctx context.Context, prefix, startKey string, limit int64, includeDeleted bool) (*sql.Rows, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error)
+	ListCurrent(ctx context.Context, prefix, startKey string, limit int64, includeDeleted bool) (Rows, error)
+	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (Rows, error)
 	CountCurrent(ctx context.Context, prefix, startKey string) (int64, int64, error)
 	Count(ctx context.Context, prefix, startKey string, revision int64) (int64, int64, error)
+	ListRange(ctx context.Context, start, end string, limit, revision int64, includeDeleted bool) (Rows, error)
+	CountRange(ctx context.Context, start, end string, revision int64) (int64, int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
-	After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error)
+	MinRevision(ctx context.Context) (int64, error)
+	After(ctx context.Context, prefix string, rev, limit int64) (Rows, error)
 	//nolint:revive
 	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
-	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
+	//nolint:revive
+	InsertRevision(ctx context.Context, revision int64, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) error
+	GetRevision(ctx context.Context, revision int64) (Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Compact(ctx context.Context, revision int64) (int64, error)
+	AdvanceRevision(ctx context.Context, revision int64) error
+	Compact(ctx context.Context, revision, deletedRevision int64) (int64, error)
+	CompactDryRun(ctx context.Context, revision, deletedRevision int64) (int64, int64, error)
 	PostCompact(ctx context.Context) error
 	Fill(ctx context.Context, revision int64) error
 	IsFill(key string) bool
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (Transaction, error)
 	GetSize(ctx context.Context) (int64, error)
+	Defragment(ctx context.Context) error
 	FillRetryDelay(ctx context.Context)
+	Listen(ctx context.Context, notify chan<- int64) error
+	Ping(ctx context.Context) error
+	InsertBatch(ctx context.Context, rows []*InsertRow) ([]int64, error)
+	LeaseRemaining(ctx context.Context) (map[int64]int64, error)
+}
+
+// InsertRow holds the fields of a single row for Dialect.InsertBatch.
+// They correspond to the arguments of Dialect.Insert.
+type InsertRow struct {
+	Key              string
+	Create           bool
+	Delete           bool
+	CreateRevision   int64
+	PreviousRevision int64
+	TTL              int64
+	Value            []byte
+	PrevValue        []byte
 }
 
 type Transaction interface {
@@ -61,10 +108,15 @@ type Transaction interface {
 	MustRollback()
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Compact(ctx context.Context, revision int64) (int64, error)
-	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
+	Compact(ctx context.Context, revision, deletedRevision int64) (int64, error)
+	GetRevision(ctx context.Context, revision int64) (Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	CurrentRevision(ctx context.Context) (int64, error)
+	//nolint:revive
+	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
+	//nolint:revive
+	InsertRevision(ctx context.Context, revision int64, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) error
+	ListRange(ctx context.Context, start, end string) (Rows, error)
 }
 
 type KeyValue struct {
@@ -89,6 +141,111 @@ type WatchResult struct {
 	Errorc          <-chan error
 }
 
+// HealthChecker is implemented by backends that can check connectivity to their datastore.
+type HealthChecker interface {
+	Health(ctx context.Context) (*HealthStatus, error)
+}
+
+// RangeLister is implemented by backends that can list and count the keys in an arbitrary range,
+// using etcd key and range_end semantics. Ranges are listed by prefix on other backends.
+type RangeLister interface {
+	ListRange(ctx context.Context, key, rangeEnd string, limit, revision int64) (int64, []*KeyValue, error)
+	CountRange(ctx context.Context, key, rangeEnd string, revision int64) (int64, int64, error)
+}
+
+// SizeInUseReporter is implemented by backends that can estimate how much of the datastore size is
+// in use, rather than held by data that would be removed by compaction.
+type SizeInUseReporter interface {
+	DbSizeInUse(ctx context.Context) (int64, error)
+}
+
+// ReadOnlySetter is implemented by backends that make writes in the background, such as compaction
+// and the deletion of keys whose lease has expired, so that they can be paused in read-only mode.
+type ReadOnlySetter interface {
+	SetReadOnly(readOnly bool)
+}
+
+// BatchWriter is implemented by backends that can apply several writes atomically, as required by
+// transactions with more than one write operation, or with comparisons of keys that they do not
+// write. Either all of the writes are applied, or none are; false is returned without applying any
+// writes if a key has been modified since the revision that the write is conditional on, or if any
+// of the conditions no longer holds. The conditions are checked in the same database transaction
+// as the writes are applied in.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, writes []*Write, conditions []*Condition) (int64, []*KeyValue, bool, error)
+}
+
+// Condition requires the keys in a range to be unchanged for a batch of writes to be applied. The
+// range is selected by Key and RangeEnd using etcd range_end semantics, and Revisions holds the
+// mod revision of each key in the range that existed when the range was read.
+type Condition struct {
+	Key       string
+	RangeEnd  string
+	Revisions map[string]int64
+}
+
+// Holds returns true if the key values currently in the range of the condition are those that
+// existed when it was read, at the same mod revisions. A key that does not exist is treated as
+// being at revision zero.
+func (c *Condition) Holds(kvs []*KeyValue) bool {
+	if len(kvs) != len(c.Revisions) {
+		return false
+	}
+	for _, kv := range kvs {
+		if rev, ok := c.Revisions[kv.Key]; !ok || rev != kv.ModRevision {
+			return false
+		}
+	}
+	return true
+}
+
+// Write is a single write in a batch. It creates or updates the key, or deletes it if Delete is
+// set, and is only applied if the mod revision of the key is Revision, or if Revision is zero, if
+// the key does not exist. The key value returned for each write holds the revision at which it
+// was written; for deletes, it is the deleted key value.
+type Write struct {
+	Key      string
+	Value    []byte
+	Lease    int64
+	Delete   bool
+	Revision int64
+}
+
+// Importer is implemented by backends that can write keys at their original revisions, as when
+// restoring a snapshot. Import must be called before the backend is started, and fails if the
+// backend already holds any keys. The backend is compacted at the given revision, which must not
+// be before the mod revision of any of the keys.
+type Importer interface {
+	Import(ctx context.Context, revision int64, kvs []*KeyValue) error
+}
+
+// LeaseLister is implemented by backends that track the expiry of keys with a lease.
+type LeaseLister interface {
+	Leases(ctx context.Context) ([]Lease, error)
+}
+
+// Lease describes the keys attached to a lease. As lease IDs are the TTL the lease was granted
+// with, all keys created with the same TTL share a lease, but expire independently; the remaining
+// TTL of the lease is the time until the last of its keys expires.
+type Lease struct {
+	ID   int64
+	TTL  time.Duration
+	Keys []string
+}
+
+// HealthStatus reports the state of the backend datastore. LastCompact is the start time of the
+// most recent compaction, and is nil if compaction has not run since the backend was started;
+// LastSuccessfulCompact is nil if no compaction has succeeded since then.
+type HealthStatus struct {
+	CurrentRevision       int64      `json:"currentRevision"`
+	CompactRevision       int64      `json:"compactRevision"`
+	LastCompact           *time.Time `json:"lastCompact,omitempty"`
+	LastCompactSuccess    bool       `json:"lastCompactSuccess"`
+	LastCompactError      string     `json:"lastCompactError,omitempty"`
+	LastSuccessfulCompact *time.Time `json:"lastSuccessfulCompact,omitempty"`
+	NextCompact           *time.Time `json:"nextCompact,omitempty"`
+}
+
 func unsupported(field string) error {
 	return status.New(codes.Unimplemented, field+" is not implemented by kine").Err()
 }
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"sync"
 	"sync/atomic"
@@ -16,6 +17,14 @@ import (
 
 var watchID int64
 
+const (
+	// DefaultMaxRecvMsgSize is the default maximum size of a message received by a grpc client or server.
+	DefaultMaxRecvMsgSize = 4 * 1024 * 1024
+	// grpcOverheadBytes is the space reserved below the maximum message size for grpc framing when
+	// fragmenting watch responses, as used by etcd.
+	grpcOverheadBytes = 512 * 1024
+)
+
 // explicit interface check
 var _ etcdserverpb.WatchServer = (*KVServerBridge)(nil)
 
@@ -24,50 +33,75 @@ func (s *KVServerBridge) getProgressReportInterval() time.Duration {
 	// add rand(1/10*notifyInterval) as jitter so that kine will not
 	// send progress notifications to watchers at the same time even when watchers
 	// are created at the same time.
-	jitter := time.Duration(rand.Int63n(int64(s.limited.notifyInterval) / 10))
+	var jitter time.Duration
+	if n := int64(s.limited.notifyInterval) / 10; n > 0 {
+		jitter = time.Duration(rand.Int63n(n))
+	}
 	return s.limited.notifyInterval + jitter
 }
 
 func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 	w := watcher{
-		server:   ws,
-		backend:  s.limited.backend,
-		watches:  map[int64]func(){},
-		progress: map[int64]chan<- int64{},
+		server:         ws,
+		backend:        s.limited.backend,
+		replay:         s.replay,
+		fragmentSize:   s.limited.fragmentSize(),
+		coalesceWindow: s.coalesceWindow,
+		watches:        map[int64]func(){},
+		progress:       map[int64]chan<- int64{},
 	}
 	defer w.Close()
 
 	logrus.Tracef("WATCH SERVER CREATE")
 
-	go util.PollWithContext(ws.Context(), s.getProgressReportInterval(), w.ProgressIfSynced)
+	if s.limited.notifyInterval > 0 {
+		go util.PollWithContext(ws.Context(), s.getProgressReportInterval(), w.ProgressIfSynced)
+	}
 
-	for {
-		msg, err := ws.Recv()
-		if err != nil {
-			return err
-		}
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := ws.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
 
-		if cr := msg.GetCreateRequest(); cr != nil {
-			w.Start(ws.Context(), cr)
-		}
-		if cr := msg.GetCancelRequest(); cr != nil {
-			logrus.Tracef("WATCH CANCEL REQ id=%d", cr.WatchId)
-			w.Cancel(cr.WatchId, 0, 0, nil)
-		}
-		if pr := msg.GetProgressRequest(); pr != nil {
-			w.Progress(ws.Context())
+			if cr := msg.GetCreateRequest(); cr != nil {
+				w.Start(ws.Context(), cr)
+			}
+			if cr := msg.GetCancelRequest(); cr != nil {
+				logrus.Tracef("WATCH CANCEL REQ id=%d", cr.WatchId)
+				w.Cancel(cr.WatchId, 0, 0, nil)
+			}
+			if pr := msg.GetProgressRequest(); pr != nil {
+				w.Progress(ws.Context())
+			}
 		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-s.shutdown:
+		w.Drain(ws.Context())
+		return nil
 	}
 }
 
 type watcher struct {
 	sync.RWMutex
 
-	wg       sync.WaitGroup
-	backend  Backend
-	server   etcdserverpb.Watch_WatchServer
-	watches  map[int64]func()
-	progress map[int64]chan<- int64
+	wg           sync.WaitGroup
+	backend      Backend
+	replay       *replayBuffer
+	server       etcdserverpb.Watch_WatchServer
+	fragmentSize int
+	// coalesceWindow is how long to wait for more events after receiving events, so that
+	// repeated updates to a key are sent as one event.
+	coalesceWindow time.Duration
+	watches        map[int64]func()
+	progress       map[int64]chan<- int64
 }
 
 func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest) {
@@ -94,7 +128,7 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 		w.progress[id] = progressCh
 	}
 
-	logrus.Tracef("WATCH START id=%d, key=%s, revision=%d, progressNotify=%v, watchCount=%d", id, key, startRevision, r.ProgressNotify, len(w.watches))
+	logrus.Tracef("WATCH START id=%d, key=%s, revision=%d, progressNotify=%v, fragment=%v, watchCount=%d", id, key, startRevision, r.ProgressNotify, r.Fragment, len(w.watches))
 
 	go func() {
 		defer w.wg.Done()
@@ -110,14 +144,30 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 		wr := w.backend.Watch(ctx, key, startRevision)
 
 		// If the watch result has a non-zero CompactRevision, then the watch request failed due to
-		// the requested start revision having been compacted.  Pass the current and and compact
-		// revision to the client via the cancel response, along with the correct error message.
+		// the requested start revision having been compacted. The watch is resumed from the replay
+		// buffer if it still holds every event since the start revision; otherwise pass the current
+		// and compact revision to the client via the cancel response, along with the correct error
+		// message.
 		if wr.CompactRevision != 0 {
-			w.Cancel(id, wr.CurrentRevision, wr.CompactRevision, ErrCompacted)
-			return
+			replayed, ok := w.replay.replay(ctx, w.backend, key, startRevision)
+			if !ok {
+				w.Cancel(id, wr.CurrentRevision, wr.CompactRevision, ErrCompacted)
+				return
+			}
+			wr = replayed
+		}
+
+		// Large responses are split into fragments if requested by the client, so that they do
+		// not exceed the client's maximum message size.
+		send := w.server.Send
+		if r.Fragment {
+			send = func(wr *etcdserverpb.WatchResponse) error {
+				return sendFragments(wr, w.fragmentSize, w.server.Send)
+			}
 		}
 
 		trace := logrus.IsLevelEnabled(logrus.TraceLevel)
+		idle := true
 		outer := true
 		for outer {
 			var reads int
@@ -144,8 +194,20 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 						inner = false
 					}
 				}
+				if outer && w.coalesceWindow > 0 {
+					var more int
+					events, more, outer = collectEvents(ctx, events, wr.Events, w.coalesceWindow)
+					reads += more
+				}
 			case revision = <-progressCh:
-				// have been requested to send progress with no events
+				// have been requested to send progress with no events. As with etcd, periodic progress
+				// notifications are only sent if no events have been sent since the previous notification.
+				if revision != 0 {
+					if !idle {
+						revision = 0
+					}
+					idle = true
+				}
 			}
 
 			// get max revision from collected events
@@ -158,15 +220,32 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 				}
 			}
 
+			// Updates are merged before filtering, so that deletes removed by the filters still
+			// prevent merging across them.
+			if w.coalesceWindow > 0 {
+				events = coalesceEvents(events)
+			}
+
+			// As with etcd, nothing is sent if all events were removed by the watch filters.
+			if len(events) > 0 && len(r.Filters) > 0 {
+				if events = filterEvents(events, r.Filters); len(events) == 0 {
+					continue
+				}
+			}
+
 			// send response. note that there are no events if this is a progress response.
-			if revision >= startRevision {
+			// A zero revision indicates that there is nothing to send.
+			if revision != 0 && revision >= startRevision {
+				if len(events) > 0 {
+					idle = false
+				}
 				wr := &etcdserverpb.WatchResponse{
 					Header:  txnHeader(revision),
 					WatchId: id,
 					Events:  toEvents(events...),
 				}
 				logrus.Tracef("WATCH SEND id=%d, key=%s, revision=%d, events=%d, size=%d, reads=%d", id, key, revision, len(wr.Events), wr.Size(), reads)
-				if err := w.server.Send(wr); err != nil {
+				if err := send(wr); err != nil {
 					w.Cancel(id, 0, 0, err)
 				}
 			}
@@ -174,7 +253,19 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 
 		select {
 		case err := <-wr.Errorc:
-			w.Cancel(id, 0, 0, err)
+			if errors.Is(err, ErrWatchOverflow) || errors.Is(err, ErrCompacted) {
+				// Events were dropped or compacted, so cancel the watch as compacted at the current
+				// revision to force the client to relist, instead of letting it resume with a gap in
+				// its events. A compacted response must carry a non-zero compact revision, or the
+				// client cannot tell that it needs to relist.
+				if errors.Is(err, ErrWatchOverflow) {
+					logrus.Warnf("WATCH id=%d, key=%s did not keep up with events, cancelling as compacted", id, key)
+				}
+				rev, _ := w.backend.CurrentRevision(ctx)
+				w.Cancel(id, rev, max(rev, 1), ErrCompacted)
+			} else {
+				w.Cancel(id, 0, 0, err)
+			}
 		default:
 			w.Cancel(id, 0, 0, nil)
 		}
@@ -182,6 +273,65 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 	}()
 }
 
+// sendFragments sends a watch response, splitting it into multiple fragments if it is larger
+// than maxSize. All but the last fragment have the Fragment field set, and clients that requested
+// fragmentation will reassemble them into a single response. Events are never split, so a
+// fragment containing a single event may still exceed maxSize. This matches the behavior of etcd.
+func sendFragments(wr *etcdserverpb.WatchResponse, maxSize int, send func(*etcdserverpb.WatchResponse) error) error {
+	if maxSize <= 0 || wr.Size() < maxSize || len(wr.Events) < 2 {
+		return send(wr)
+	}
+
+	var idx int
+	for {
+		fragment := &etcdserverpb.WatchResponse{
+			Header:   wr.Header,
+			WatchId:  wr.WatchId,
+			Fragment: true,
+		}
+		for _, event := range wr.Events[idx:] {
+			fragment.Events = append(fragment.Events, event)
+			if len(fragment.Events) > 1 && fragment.Size() >= maxSize {
+				fragment.Events = fragment.Events[:len(fragment.Events)-1]
+				break
+			}
+			idx++
+		}
+		if idx == len(wr.Events) {
+			fragment.Fragment = false
+		}
+		logrus.Tracef("WATCH SEND FRAGMENT id=%d, events=%d, size=%d, more=%v", wr.WatchId, len(fragment.Events), fragment.Size(), fragment.Fragment)
+		if err := send(fragment); err != nil {
+			return err
+		}
+		if !fragment.Fragment {
+			return nil
+		}
+	}
+}
+
+// filterEvents returns the events that are not removed by any of the watch filters.
+func filterEvents(events []*Event, filters []etcdserverpb.WatchCreateRequest_FilterType) []*Event {
+	var noPut, noDelete bool
+	for _, filter := range filters {
+		switch filter {
+		case etcdserverpb.WatchCreateRequest_NOPUT:
+			noPut = true
+		case etcdserverpb.WatchCreateRequest_NODELETE:
+			noDelete = true
+		}
+	}
+
+	filtered := make([]*Event, 0, len(events))
+	for _, event := range events {
+		if (event.Delete && noDelete) || (!event.Delete && noPut) {
+			continue
+		}
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
 func toEvents(events ...*Event) []*mvccpb.Event {
 	ret := make([]*mvccpb.Event, 0, len(events))
 	for _, e := range events {
@@ -252,11 +402,30 @@ func (w *watcher) Close() {
 // Progress sends a progress report if all watchers are synced.
 // Ref: https://github.com/etcd-io/etcd/blob/v3.5.11/server/mvcc/watchable_store.go#L500-L504
 func (w *watcher) Progress(ctx context.Context) {
+	logrus.Tracef("WATCH REQUEST PROGRESS")
+	if wr := w.progressResponse(ctx); wr != nil {
+		go w.server.Send(wr)
+	}
+}
+
+// Drain sends a final progress report if all watchers are synced, and then cancels all watches,
+// so that clients can resume their watches from the latest revision on another server.
+func (w *watcher) Drain(ctx context.Context) {
+	logrus.Tracef("WATCH SERVER DRAIN")
+	if wr := w.progressResponse(ctx); wr != nil {
+		if err := w.server.Send(wr); err != nil {
+			logrus.Debugf("WATCH Failed to send final progress notification: %v", err)
+		}
+	}
+	w.Close()
+}
+
+// progressResponse returns a broadcast progress report with the current revision, or nil if
+// any watcher is not synced.
+func (w *watcher) progressResponse(ctx context.Context) *etcdserverpb.WatchResponse {
 	w.RLock()
 	defer w.RUnlock()
 
-	logrus.Tracef("WATCH REQUEST PROGRESS")
-
 	// All synced watchers will be blocked in the outer loop and able to receive on the progress channel.
 	// If any cannot be sent to, then it is not synced and has pending events to be sent.
 	// Send revision 0, as we don't actually want the watchers to send a progress response if they do receive.
@@ -265,7 +434,7 @@ func (w *watcher) Progress(ctx context.Context) {
 		case progressCh <- 0:
 		default:
 			logrus.Tracef("WATCH SEND PROGRESS FAILED NOT SYNCED id=%d ", id)
-			return
+			return nil
 		}
 	}
 
@@ -274,11 +443,11 @@ func (w *watcher) Progress(ctx context.Context) {
 	rev, err := w.backend.CurrentRevision(ctx)
 	if err != nil {
 		logrus.Errorf("Failed to get current revision for ProgressNotify: %v", err)
-		return
+		return nil
 	}
 
 	logrus.Tracef("WATCH SEND PROGRESS id=%d, revision=%d", id, rev)
-	go w.server.Send(&etcdserverpb.WatchResponse{Header: txnHeader(rev), WatchId: id})
+	return &etcdserverpb.WatchResponse{Header: txnHeader(rev), WatchId: id}
 }
 
 // ProgressIfSynced sends a progress report on any channels that are synced and blocked on the outer loop
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc"
+)
+
+func TestSendFragments(t *testing.T) {
+	wr := &etcdserverpb.WatchResponse{
+		Header:  txnHeader(10),
+		WatchId: 1,
+	}
+	for i := 0; i < 5; i++ {
+		wr.Events = append(wr.Events, &mvccpb.Event{
+			Kv: &mvccpb.KeyValue{Key: []byte(fmt.Sprintf("/key/%d", i)), Value: make([]byte, 1024), ModRevision: int64(i + 6)},
+		})
+	}
+
+	var sent []*etcdserverpb.WatchResponse
+	send := func(wr *etcdserverpb.WatchResponse) error {
+		sent = append(sent, wr)
+		return nil
+	}
+
+	if err := sendFragments(wr, wr.Size()+1, send); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].Fragment {
+		t.Fatalf("expected a single unfragmented response, got %d", len(sent))
+	}
+
+	sent = nil
+	if err := sendFragments(wr, 2500, send); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 3 {
+		t.Fatalf("expected 3 fragments, got %d", len(sent))
+	}
+	var events int
+	for i, fragment := range sent {
+		if fragment.Size() >= 2500 {
+			t.Errorf("fragment %d size %d exceeds limit", i, fragment.Size())
+		}
+		if last := i == len(sent)-1; fragment.Fragment == last {
+			t.Errorf("fragment %d has Fragment=%v", i, fragment.Fragment)
+		}
+		if fragment.WatchId != wr.WatchId || fragment.Header.Revision != wr.Header.Revision {
+			t.Errorf("fragment %d has unexpected watch id or header", i)
+		}
+		for _, event := range fragment.Events {
+			if event != wr.Events[events] {
+				t.Fatalf("fragment %d has events out of order", i)
+			}
+			events++
+		}
+	}
+	if events != len(wr.Events) {
+		t.Fatalf("expected %d events in fragments, got %d", len(wr.Events), events)
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	events := []*Event{
+		{Create: true, KV: &KeyValue{Key: "/a", ModRevision: 1}},
+		{KV: &KeyValue{Key: "/a", ModRevision: 2}},
+		{Delete: true, KV: &KeyValue{Key: "/a", ModRevision: 3}},
+	}
+
+	if filtered := filterEvents(events, []etcdserverpb.WatchCreateRequest_FilterType{etcdserverpb.WatchCreateRequest_NOPUT}); len(filtered) != 1 || !filtered[0].Delete {
+		t.Errorf("expected only the delete event with NOPUT, got %d events", len(filtered))
+	}
+	if filtered := filterEvents(events, []etcdserverpb.WatchCreateRequest_FilterType{etcdserverpb.WatchCreateRequest_NODELETE}); len(filtered) != 2 || filtered[0].Delete || filtered[1].Delete {
+		t.Errorf("expected only the put events with NODELETE, got %d events", len(filtered))
+	}
+	if filtered := filterEvents(events, []etcdserverpb.WatchCreateRequest_FilterType{etcdserverpb.WatchCreateRequest_NOPUT, etcdserverpb.WatchCreateRequest_NODELETE}); len(filtered) != 0 {
+		t.Errorf("expected no events with both filters, got %d events", len(filtered))
+	}
+}
+
+func TestCoalesceEvents(t *testing.T) {
+	kv := func(key string, rev int64) *KeyValue {
+		return &KeyValue{Key: key, ModRevision: rev}
+	}
+	events := []*Event{
+		{Create: true, KV: kv("/a", 1)},
+		{KV: kv("/a", 2), PrevKV: kv("/a", 1)},
+		{KV: kv("/b", 3), PrevKV: kv("/b", 0)},
+		{KV: kv("/a", 4), PrevKV: kv("/a", 2)},
+		{KV: kv("/b", 5), PrevKV: kv("/b", 3)},
+		{Delete: true, KV: kv("/a", 6), PrevKV: kv("/a", 4)},
+		{Create: true, KV: kv("/a", 7)},
+		{KV: kv("/a", 8), PrevKV: kv("/a", 7)},
+	}
+
+	// The create and delete of /a are kept, and the updates of each key between them are merged
+	// into the latest, with the previous value from before the first.
+	want := []struct {
+		rev, prevRev int64
+		create, del  bool
+	}{
+		{rev: 1, create: true},
+		{rev: 4, prevRev: 1},
+		{rev: 5, prevRev: 0},
+		{rev: 6, prevRev: 4, del: true},
+		{rev: 7, create: true},
+		{rev: 8, prevRev: 7},
+	}
+	got := coalesceEvents(events)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d coalesced events, got %d", len(want), len(got))
+	}
+	for i, w := range want {
+		e := got[i]
+		if e.KV.ModRevision != w.rev || e.Create != w.create || e.Delete != w.del || (!w.create && e.PrevKV.ModRevision != w.prevRev) {
+			t.Errorf("expected event %d at revision %d with previous revision %d, got %+v with previous %+v", i, w.rev, w.prevRev, e.KV, e.PrevKV)
+		}
+	}
+}
+
+type watchBackend struct {
+	Backend
+}
+
+func (b *watchBackend) Watch(ctx context.Context, key string, revision int64) WatchResult {
+	events := make(chan []*Event)
+	go func() {
+		<-ctx.Done()
+		close(events)
+	}()
+	return WatchResult{Events: events, Errorc: make(chan error)}
+}
+
+func (b *watchBackend) CurrentRevision(context.Context) (int64, error) {
+	return 5, nil
+}
+
+type watchStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv chan *etcdserverpb.WatchRequest
+	sent chan *etcdserverpb.WatchResponse
+}
+
+func (s *watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *watchStream) Recv() (*etcdserverpb.WatchRequest, error) {
+	select {
+	case req := <-s.recv:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *watchStream) Send(wr *etcdserverpb.WatchResponse) error {
+	s.sent <- wr
+	return nil
+}
+
+func TestWatchShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(&watchBackend{}, Config{Scheme: "http"})
+	stream := &watchStream{
+		ctx:  ctx,
+		recv: make(chan *etcdserverpb.WatchRequest),
+		sent: make(chan *etcdserverpb.WatchResponse, 10),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Watch(stream)
+	}()
+
+	stream.recv <- &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+		CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), WatchId: clientv3.AutoWatchID},
+	}}
+	created := <-stream.sent
+	if !created.Created {
+		t.Fatalf("expected created response, got %+v", created)
+	}
+
+	s.Shutdown()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("expected watch stream to be closed cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for watch stream to close")
+	}
+
+	progress := <-stream.sent
+	if progress.WatchId != clientv3.InvalidWatchID || progress.Header.Revision != 5 {
+		t.Fatalf("expected final progress notification at revision 5, got %+v", progress)
+	}
+	canceled := <-stream.sent
+	if !canceled.Canceled || canceled.WatchId != created.WatchId {
+		t.Fatalf("expected watch %d to be canceled, got %+v", created.WatchId, canceled)
+	}
+}
+
+// overflowBackend returns watches that are immediately dropped for not keeping up with events.
+type overflowBackend struct {
+	watchBackend
+}
+
+func (b *overflowBackend) Watch(ctx context.Context, key string, revision int64) WatchResult {
+	events := make(chan []*Event)
+	errc := make(chan error, 1)
+	errc <- ErrWatchOverflow
+	close(events)
+	return WatchResult{Events: events, Errorc: errc}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := New(&overflowBackend{}, Config{Scheme: "http"})
+	stream := &watchStream{
+		ctx:  ctx,
+		recv: make(chan *etcdserverpb.WatchRequest),
+		sent: make(chan *etcdserverpb.WatchResponse, 10),
+	}
+	go s.Watch(stream)
+
+	stream.recv <- &etcdserverpb.WatchRequest{RequestUnion: &etcdserverpb.WatchRequest_CreateRequest{
+		CreateRequest: &etcdserverpb.WatchCreateRequest{Key: []byte("/a"), WatchId: clientv3.AutoWatchID},
+	}}
+	created := <-stream.sent
+	if !created.Created {
+		t.Fatalf("expected created response, got %+v", created)
+	}
+
+	// The client is told that the watch was compacted, so that it relists.
+	canceled := <-stream.sent
+	if !canceled.Canceled || canceled.WatchId != created.WatchId || canceled.CompactRevision != 5 || canceled.CancelReason != ErrCompacted.Error() {
+		t.Fatalf("expected watch %d to be canceled as compacted at revision 5, got %+v", created.WatchId, canceled)
+	}
+}
+
+func TestReplayBuffer(t *testing.T) {
+	b := newReplayBuffer(3)
+	b.revision, b.latest, b.ready = 10, 10, true
+	b.add([]*Event{
+		{Create: true, KV: &KeyValue{Key: "/a/1", ModRevision: 11}},
+		{Create: true, KV: &KeyValue{Key: "/b/1", ModRevision: 12}},
+		{KV: &KeyValue{Key: "/a/1", ModRevision: 13}},
+	})
+
+	events, latest, ok := b.since("/a/", 10)
+	if !ok || latest != 13 || len(events) != 2 || events[0].KV.ModRevision != 11 || events[1].KV.ModRevision != 13 {
+		t.Fatalf("expected events 11 and 13 up to revision 13, got ok=%v latest=%d events=%d", ok, latest, len(events))
+	}
+	if events, _, ok := b.since("/a/1", 11); !ok || len(events) != 1 || events[0].KV.ModRevision != 13 {
+		t.Fatalf("expected event 13 for exact key, got ok=%v events=%d", ok, len(events))
+	}
+
+	// Adding a fourth event drops the oldest, so revision 10 can no longer be replayed.
+	b.add([]*Event{{Delete: true, KV: &KeyValue{Key: "/a/1", ModRevision: 14}}})
+	if _, _, ok := b.since("/a/", 10); ok {
+		t.Fatal("expected replay from dropped revision to fail")
+	}
+	if events, latest, ok := b.since("/a/", 11); !ok || latest != 14 || len(events) != 2 || !events[1].Delete {
+		t.Fatalf("expected events 13 and 14 up to revision 14, got ok=%v latest=%d events=%d", ok, latest, len(events))
+	}
+	if _, _, ok := b.since("compact_rev_key", 11); ok {
+		t.Fatal("expected replay of internal key to fail")
+	}
+}
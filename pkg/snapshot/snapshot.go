@@ -0,0 +1,392 @@
+// Package snapshot saves the contents of a kine backend to a file in the etcd snapshot format, and
+// restores a backend from one, so that the same backup tooling can be used for kine and etcd.
+//
+// Snapshots are bbolt databases laid out as by etcd's mvcc store, followed by a sha256 hash of the
+// database, as written by "etcdctl snapshot save". They can be inspected with "etcdutl snapshot
+// status" and restored into an etcd member with "etcdutl snapshot restore", and snapshots taken
+// from etcd can be restored into kine.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/server/v3/lease/leasepb"
+	"go.etcd.io/etcd/server/v3/mvcc/backend"
+	"go.etcd.io/etcd/server/v3/mvcc/buckets"
+)
+
+const (
+	defaultBatchSize = 500
+	// revBytesLen is the length of a revision in the key bucket: the big-endian main revision,
+	// an underscore, and the big-endian sub revision. Tombstones are marked with a trailing 't'.
+	revBytesLen   = 8 + 1 + 8
+	markTombstone = 't'
+)
+
+var (
+	finishedCompactKeyName  = []byte("finishedCompactRev")
+	scheduledCompactKeyName = []byte("scheduledCompactRev")
+
+	// allBuckets are created in saved snapshots, so that they have the same layout as snapshots
+	// taken from etcd.
+	allBuckets = []backend.Bucket{
+		buckets.Key, buckets.Meta, buckets.Lease, buckets.Alarm, buckets.Cluster,
+		buckets.Members, buckets.MembersRemoved, buckets.Auth, buckets.AuthUsers, buckets.AuthRoles,
+	}
+)
+
+// Options control which keys are saved, and how.
+type Options struct {
+	// Prefix limits the snapshot to keys under this prefix. Defaults to "/", which covers all
+	// keys written through the etcd API.
+	Prefix string
+	// BatchSize is the number of keys read from the backend at a time.
+	BatchSize int64
+}
+
+// Info describes a saved or restored snapshot.
+type Info struct {
+	// Revision is the revision of the snapshot.
+	Revision int64
+	// Keys is the number of keys in the snapshot.
+	Keys int64
+}
+
+// Save writes all live keys at the current revision of the backend to a snapshot file at path,
+// preserving each key's create and mod revision, value and lease. The file is written in place
+// only once complete, so an existing snapshot at path is not lost if the save fails.
+//
+// kine does not keep a version count for keys, so all keys are saved with a version of 1. Leases
+// are saved with an ID and TTL of the TTL that keys were written with, as kine does not track
+// leases separately. The snapshot is compacted at its revision, as only the latest value of each
+// key is saved.
+func Save(ctx context.Context, b server.Backend, path string, opts Options) (Info, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = "/"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	info := Info{}
+	rev, err := b.CurrentRevision(ctx)
+	if err != nil {
+		return info, errors.Wrap(err, "getting current revision")
+	}
+	info.Revision = rev
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".part")
+	if err != nil {
+		return info, err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	db, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return info, err
+	}
+	defer db.Close()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range allBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket.Name()); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(buckets.Meta.Name())
+		if err := meta.Put(finishedCompactKeyName, revToBytes(rev)); err != nil {
+			return err
+		}
+		return meta.Put(scheduledCompactKeyName, revToBytes(rev))
+	}); err != nil {
+		return info, err
+	}
+
+	startKey := ""
+	for {
+		_, kvs, err := b.List(ctx, opts.Prefix, startKey, opts.BatchSize, rev)
+		if err != nil {
+			return info, errors.Wrapf(err, "listing keys after %q at revision %d", startKey, rev)
+		}
+		if len(kvs) == 0 {
+			break
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return putKeys(tx, kvs)
+		}); err != nil {
+			return info, err
+		}
+		info.Keys += int64(len(kvs))
+		startKey = kvs[len(kvs)-1].Key
+		logrus.Debugf("Saved %d keys through %s at revision %d", info.Keys, startKey, rev)
+	}
+
+	if err := db.Close(); err != nil {
+		return info, err
+	}
+	if err := appendHash(tmpPath); err != nil {
+		return info, err
+	}
+	return info, os.Rename(tmpPath, path)
+}
+
+// putKeys writes the keys, and the leases that they are attached to, to the snapshot.
+func putKeys(tx *bolt.Tx, kvs []*server.KeyValue) error {
+	keys := tx.Bucket(buckets.Key.Name())
+	leases := tx.Bucket(buckets.Lease.Name())
+	for _, kv := range kvs {
+		data, err := (&mvccpb.KeyValue{
+			Key:            []byte(kv.Key),
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    kv.ModRevision,
+			Version:        1,
+			Value:          kv.Value,
+			Lease:          kv.Lease,
+		}).Marshal()
+		if err != nil {
+			return err
+		}
+		if err := keys.Put(revToBytes(kv.ModRevision), data); err != nil {
+			return err
+		}
+		if kv.Lease <= 0 {
+			continue
+		}
+		data, err = (&leasepb.Lease{ID: kv.Lease, TTL: kv.Lease}).Marshal()
+		if err != nil {
+			return err
+		}
+		if err := leases.Put(int64ToBytes(kv.Lease), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore imports the live keys in the snapshot file at path into the backend, at their original
+// revisions, and compacts the backend at the revision of the snapshot. The backend must implement
+// server.Importer, must be empty, and must not have been started.
+//
+// Leases are not restored, but keys attached to a lease are written with the lease's TTL, from
+// which kine expires them as it does other keys with a lease. kine writes a single key at each
+// revision, so snapshots in which a transaction wrote several keys at the same revision cannot be
+// restored.
+func Restore(ctx context.Context, b server.Backend, path string) (Info, error) {
+	info := Info{}
+	importer, ok := b.(server.Importer)
+	if !ok {
+		return info, errors.New("backend does not support importing keys")
+	}
+
+	dbPath, err := verifiedCopy(path)
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(dbPath)
+
+	db, err := bolt.Open(dbPath, 0400, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return info, errors.Wrap(err, "opening snapshot")
+	}
+	defer db.Close()
+
+	var kvs []*server.KeyValue
+	if err := db.View(func(tx *bolt.Tx) error {
+		kvs, info.Revision, err = readKeys(tx)
+		return err
+	}); err != nil {
+		return info, err
+	}
+	info.Keys = int64(len(kvs))
+
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].ModRevision == kvs[i-1].ModRevision {
+			return info, fmt.Errorf("keys %s and %s were both written at revision %d, which cannot be restored into kine", kvs[i-1].Key, kvs[i].Key, kvs[i].ModRevision)
+		}
+	}
+	return info, importer.Import(ctx, info.Revision, kvs)
+}
+
+// readKeys returns the live keys in the snapshot in mod revision order, along with the revision of
+// the snapshot.
+func readKeys(tx *bolt.Tx) ([]*server.KeyValue, int64, error) {
+	keys := tx.Bucket(buckets.Key.Name())
+	if keys == nil {
+		return nil, 0, errors.New("snapshot has no key bucket")
+	}
+
+	var revision int64
+	if meta := tx.Bucket(buckets.Meta.Name()); meta != nil {
+		for _, name := range [][]byte{finishedCompactKeyName, scheduledCompactKeyName} {
+			if v := meta.Get(name); len(v) == revBytesLen {
+				revision = max(revision, bytesToRev(v))
+			}
+		}
+	}
+	ttls := map[int64]int64{}
+	if leases := tx.Bucket(buckets.Lease.Name()); leases != nil {
+		if err := leases.ForEach(func(_, v []byte) error {
+			lease := &leasepb.Lease{}
+			if err := lease.Unmarshal(v); err != nil {
+				return err
+			}
+			ttls[lease.ID] = lease.TTL
+			return nil
+		}); err != nil {
+			return nil, 0, errors.Wrap(err, "reading leases")
+		}
+	}
+
+	// Keys are stored in revision order, so the last entry for each key is its current value, or
+	// a tombstone if it has been deleted.
+	latest := map[string]*server.KeyValue{}
+	if err := keys.ForEach(func(k, v []byte) error {
+		if len(k) != revBytesLen && !(len(k) == revBytesLen+1 && k[revBytesLen] == markTombstone) {
+			return fmt.Errorf("invalid revision %x", k)
+		}
+		revision = max(revision, bytesToRev(k))
+		kv := &mvccpb.KeyValue{}
+		if err := kv.Unmarshal(v); err != nil {
+			return err
+		}
+		if len(k) > revBytesLen {
+			delete(latest, string(kv.Key))
+			return nil
+		}
+		lease := int64(0)
+		if kv.Lease != 0 {
+			if lease = ttls[kv.Lease]; lease == 0 {
+				logrus.Warnf("Lease %x of key %s was not found in the snapshot; restoring the key without a lease", kv.Lease, kv.Key)
+			}
+		}
+		latest[string(kv.Key)] = &server.KeyValue{
+			Key:            string(kv.Key),
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    kv.ModRevision,
+			Value:          kv.Value,
+			Lease:          lease,
+		}
+		return nil
+	}); err != nil {
+		return nil, 0, errors.Wrap(err, "reading keys")
+	}
+
+	kvs := make([]*server.KeyValue, 0, len(latest))
+	for _, kv := range latest {
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		if kvs[i].ModRevision == kvs[j].ModRevision {
+			return kvs[i].Key < kvs[j].Key
+		}
+		return kvs[i].ModRevision < kvs[j].ModRevision
+	})
+	return kvs, revision, nil
+}
+
+// appendHash appends the sha256 hash of the database file to it, as etcd does when sending a
+// snapshot, so that the integrity of the snapshot can be verified when it is restored.
+func appendHash(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// verifiedCopy copies the database from the snapshot file at path to a temporary file, returning
+// its path. If the snapshot ends with a hash of the database, as those written by etcdctl and Save
+// do, the hash is checked and removed. As with etcdutl, the snapshot is considered to have a hash
+// if its size is 32 bytes more than a multiple of 512, since database files are a whole number of
+// pages.
+func verifiedCopy(path string) (dbPath string, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := stat.Size()
+	hasHash := size%512 == sha256.Size
+	if hasHash {
+		size -= sha256.Size
+	}
+
+	dst, err := os.CreateTemp("", "kine-snapshot-*.db")
+	if err != nil {
+		return "", err
+	}
+	dbPath = dst.Name()
+	defer func() {
+		dst.Close()
+		if err != nil {
+			os.Remove(dbPath)
+		}
+	}()
+
+	h := sha256.New()
+	if _, err = io.CopyN(io.MultiWriter(dst, h), src, size); err != nil {
+		return "", errors.Wrap(err, "reading snapshot")
+	}
+	if hasHash {
+		sum := make([]byte, sha256.Size)
+		if _, err = io.ReadFull(src, sum); err != nil {
+			return "", errors.Wrap(err, "reading snapshot hash")
+		}
+		if !bytes.Equal(sum, h.Sum(nil)) {
+			return "", errors.New("snapshot hash does not match its contents")
+		}
+	} else {
+		logrus.Warnf("Snapshot %s does not have a hash, so its integrity cannot be verified", path)
+	}
+	if err = dst.Close(); err != nil {
+		return "", err
+	}
+	return dbPath, nil
+}
+
+func revToBytes(rev int64) []byte {
+	b := make([]byte, revBytesLen)
+	binary.BigEndian.PutUint64(b, uint64(rev))
+	b[8] = '_'
+	return b
+}
+
+func bytesToRev(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b[:8]))
+}
+
+func int64ToBytes(n int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
@@ -0,0 +1,137 @@
+//go:build cgo
+// +build cgo
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func newBackend(ctx context.Context, t *testing.T, name string) server.Backend {
+	backend, _, err := sqlite.NewVariant(ctx, "sqlite3", &drivers.Config{
+		DataSourceName:  "file:" + filepath.Join(t.TempDir(), name+".db") + "?_journal=WAL&_busy_timeout=30000&_txlock=immediate",
+		TableName:       "kine",
+		CompactInterval: time.Minute,
+		CompactTimeout:  time.Minute,
+		PollBatchSize:   500,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestSaveRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := newBackend(ctx, t, "src")
+	if err := src.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if _, err := src.Create(ctx, fmt.Sprintf("/registry/test/%02d", i), []byte(fmt.Sprint(i)), int64(i%2)*60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rev, _, _, err := src.Update(ctx, "/registry/test/03", []byte("updated"), 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, err = src.Create(ctx, "/registry/deleted", []byte("x"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev, _, _, err = src.Delete(ctx, "/registry/deleted", rev); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the source to observe all of the writes, so that they are included in the snapshot.
+	for {
+		current, err := src.CurrentRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current >= rev {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	saved, err := Save(ctx, src, path, Options{BatchSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Revision < rev || saved.Keys != 26 {
+		t.Fatalf("expected 26 keys saved at revision %d or later, got %+v", rev, saved)
+	}
+
+	dst := newBackend(ctx, t, "dst")
+	restored, err := Restore(ctx, dst, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != saved {
+		t.Fatalf("expected restored snapshot %+v to match saved snapshot %+v", restored, saved)
+	}
+	if err := dst.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, want, err := src.List(ctx, "/registry/", "", 0, saved.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, got, err := dst.List(ctx, "/registry/", "", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d restored keys, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Key != want[i].Key || string(got[i].Value) != string(want[i].Value) || got[i].Lease != want[i].Lease ||
+			got[i].CreateRevision != want[i].CreateRevision || got[i].ModRevision != want[i].ModRevision {
+			t.Fatalf("expected restored key %+v, got %+v", want[i], got[i])
+		}
+	}
+
+	// New writes resume after the revision of the snapshot, which is also the compact revision.
+	created, err := dst.Create(ctx, "/registry/new", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created <= saved.Revision {
+		t.Fatalf("expected new key after revision %d, got %d", saved.Revision, created)
+	}
+	if _, _, err := dst.List(ctx, "/registry/", "", 0, saved.Revision-1); err != server.ErrCompacted {
+		t.Fatalf("expected list before the snapshot revision to be compacted, got %v", err)
+	}
+
+	// A datastore holding keys cannot be restored into.
+	if _, err := Restore(ctx, src, path); err == nil {
+		t.Fatal("expected restore into a datastore with keys to fail")
+	}
+
+	// A snapshot that does not match its hash is rejected.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(ctx, newBackend(ctx, t, "corrupt"), path); err == nil {
+		t.Fatal("expected restore of a snapshot with an invalid hash to fail")
+	}
+}
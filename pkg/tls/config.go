@@ -2,15 +2,34 @@ package tls
 
 import (
 	"crypto/tls"
+	"fmt"
+	"strings"
 
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 )
 
+const DefaultMinVersion = tls.VersionTLS12
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 type Config struct {
-	CAFile     string
-	CertFile   string
-	KeyFile    string
-	SkipVerify bool
+	CAFile       string
+	CertFile     string
+	KeyFile      string
+	SkipVerify   bool
+	MinVersion   string
+	CipherSuites []string
+	// ClientCAFile is the CA used to verify client certificates, when used as a server
+	// configuration. If set, clients must present a certificate signed by the CA.
+	ClientCAFile string
+	// AllowedCNs restricts the clients accepted by a server to those whose certificate has one
+	// of the given common names. All clients with a valid certificate are accepted if empty.
+	AllowedCNs []string
 }
 
 func (c Config) ClientConfig() (*tls.Config, error) {
@@ -18,11 +37,23 @@ func (c Config) ClientConfig() (*tls.Config, error) {
 		return nil, nil
 	}
 
+	minVersion, err := ParseVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := ParseCipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
 	info := &transport.TLSInfo{
 		CertFile:           c.CertFile,
 		KeyFile:            c.KeyFile,
 		TrustedCAFile:      c.CAFile,
 		InsecureSkipVerify: c.SkipVerify,
+		MinVersion:         minVersion,
+		CipherSuites:       cipherSuites,
 	}
 	tlsConfig, err := info.ClientConfig()
 	if err != nil {
@@ -31,3 +62,78 @@ func (c Config) ClientConfig() (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// ServerConfig returns the configuration for a server using the certificate and key files. Client
+// certificates are required and verified against the client CA, if set. Nil is returned if no
+// certificate and key are set.
+func (c Config) ServerConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		if c.ClientCAFile != "" {
+			return nil, fmt.Errorf("client certificate authentication requires a server certificate and key")
+		}
+		return nil, nil
+	}
+	if len(c.AllowedCNs) > 0 && c.ClientCAFile == "" {
+		return nil, fmt.Errorf("allowed client common names require a client CA")
+	}
+
+	minVersion, err := ParseVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := ParseCipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &transport.TLSInfo{
+		CertFile:       c.CertFile,
+		KeyFile:        c.KeyFile,
+		TrustedCAFile:  c.ClientCAFile,
+		ClientCertAuth: c.ClientCAFile != "",
+		AllowedCNs:     c.AllowedCNs,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+	return info.ServerConfig()
+}
+
+// ParseVersion converts a TLS version string such as "1.2" or "TLS1.2" to the corresponding
+// crypto/tls version constant. The default minimum version is returned for an empty string.
+func ParseVersion(version string) (uint16, error) {
+	if version == "" {
+		return DefaultMinVersion, nil
+	}
+	v, ok := versions[strings.TrimPrefix(strings.ToUpper(version), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q: must be one of 1.0, 1.1, 1.2, or 1.3", version)
+	}
+	return v, nil
+}
+
+// ParseCipherSuites converts a list of cipher suite names, as used by crypto/tls, to their IDs.
+// A nil list is returned if no names are given, so that the Go defaults are used.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	suites := map[string]uint16{}
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		suites[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
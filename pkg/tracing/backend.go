@@ -0,0 +1,235 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	keyAttr            = attribute.Key("kine.key")
+	rangeEndAttr       = attribute.Key("kine.range_end")
+	startKeyAttr       = attribute.Key("kine.start_key")
+	limitAttr          = attribute.Key("kine.limit")
+	revisionAttr       = attribute.Key("kine.revision")
+	resultRevisionAttr = attribute.Key("kine.result_revision")
+	leaseAttr          = attribute.Key("kine.lease")
+	valueSizeAttr      = attribute.Key("kine.value_size")
+	countAttr          = attribute.Key("kine.count")
+	succeededAttr      = attribute.Key("kine.succeeded")
+)
+
+// explicit interface check
+var _ server.Backend = (*Backend)(nil)
+
+// Backend wraps a server.Backend, recording a span for each operation.
+type Backend struct {
+	backend server.Backend
+}
+
+// NewBackend returns a Backend that traces calls to the provided backend.
+func NewBackend(backend server.Backend) *Backend {
+	return &Backend{backend: backend}
+}
+
+func (b *Backend) Start(ctx context.Context) error {
+	return b.backend.Start(ctx)
+}
+
+func (b *Backend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (rev int64, kv *server.KeyValue, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Get", trace.WithAttributes(
+		keyAttr.String(key),
+		rangeEndAttr.String(rangeEnd),
+		limitAttr.Int64(limit),
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		count := 0
+		if kv != nil {
+			count = 1
+		}
+		span.SetAttributes(resultRevisionAttr.Int64(rev), countAttr.Int(count))
+		End(span, err)
+	}()
+	return b.backend.Get(ctx, key, rangeEnd, limit, revision)
+}
+
+func (b *Backend) Create(ctx context.Context, key string, value []byte, lease int64) (rev int64, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Create", trace.WithAttributes(
+		keyAttr.String(key),
+		leaseAttr.Int64(lease),
+		valueSizeAttr.Int(len(value)),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev))
+		End(span, err)
+	}()
+	return b.backend.Create(ctx, key, value, lease)
+}
+
+func (b *Backend) Delete(ctx context.Context, key string, revision int64) (rev int64, kv *server.KeyValue, deleted bool, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Delete", trace.WithAttributes(
+		keyAttr.String(key),
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), succeededAttr.Bool(deleted))
+		End(span, err)
+	}()
+	return b.backend.Delete(ctx, key, revision)
+}
+
+func (b *Backend) List(ctx context.Context, prefix, startKey string, limit, revision int64) (rev int64, kvs []*server.KeyValue, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.List", trace.WithAttributes(
+		keyAttr.String(prefix),
+		startKeyAttr.String(startKey),
+		limitAttr.Int64(limit),
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), countAttr.Int(len(kvs)))
+		End(span, err)
+	}()
+	return b.backend.List(ctx, prefix, startKey, limit, revision)
+}
+
+func (b *Backend) Count(ctx context.Context, prefix, startKey string, revision int64) (rev int64, count int64, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Count", trace.WithAttributes(
+		keyAttr.String(prefix),
+		startKeyAttr.String(startKey),
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), countAttr.Int64(count))
+		End(span, err)
+	}()
+	return b.backend.Count(ctx, prefix, startKey, revision)
+}
+
+// ListRange lists by range if the wrapped backend supports it, or by prefix otherwise.
+func (b *Backend) ListRange(ctx context.Context, key, rangeEnd string, limit, revision int64) (rev int64, kvs []*server.KeyValue, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.ListRange", trace.WithAttributes(
+		keyAttr.String(key),
+		rangeEndAttr.String(rangeEnd),
+		limitAttr.Int64(limit),
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), countAttr.Int(len(kvs)))
+		End(span, err)
+	}()
+	return server.ListRange(ctx, b.backend, key, rangeEnd, limit, revision)
+}
+
+// CountRange counts by range if the wrapped backend supports it, or by prefix otherwise.
+func (b *Backend) CountRange(ctx context.Context, key, rangeEnd string, revision int64) (rev int64, count int64, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.CountRange", trace.WithAttributes(
+		keyAttr.String(key),
+		rangeEndAttr.String(rangeEnd),
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), countAttr.Int64(count))
+		End(span, err)
+	}()
+	return server.CountRange(ctx, b.backend, key, rangeEnd, revision)
+}
+
+func (b *Backend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (rev int64, kv *server.KeyValue, updated bool, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Update", trace.WithAttributes(
+		keyAttr.String(key),
+		revisionAttr.Int64(revision),
+		leaseAttr.Int64(lease),
+		valueSizeAttr.Int(len(value)),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), succeededAttr.Bool(updated))
+		End(span, err)
+	}()
+	return b.backend.Update(ctx, key, value, revision, lease)
+}
+
+// WriteBatch is passed through to the wrapped backend, if it supports applying writes atomically.
+func (b *Backend) WriteBatch(ctx context.Context, writes []*server.Write, conditions []*server.Condition) (rev int64, kvs []*server.KeyValue, ok bool, err error) {
+	writer, isWriter := b.backend.(server.BatchWriter)
+	if !isWriter {
+		return 0, nil, false, server.ErrNotSupported
+	}
+	ctx, span := Tracer().Start(ctx, "backend.WriteBatch", trace.WithAttributes(
+		countAttr.Int(len(writes)),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev), succeededAttr.Bool(ok))
+		End(span, err)
+	}()
+	return writer.WriteBatch(ctx, writes, conditions)
+}
+
+// Watch records a span for setting up the watch only; events delivered on the watch
+// channel are not traced, as the watch may remain open indefinitely.
+func (b *Backend) Watch(ctx context.Context, key string, revision int64) server.WatchResult {
+	ctx, span := Tracer().Start(ctx, "backend.Watch", trace.WithAttributes(
+		keyAttr.String(key),
+		revisionAttr.Int64(revision),
+	))
+	result := b.backend.Watch(ctx, key, revision)
+	span.SetAttributes(resultRevisionAttr.Int64(result.CurrentRevision))
+	span.End()
+	return result
+}
+
+func (b *Backend) DbSize(ctx context.Context) (int64, error) {
+	return b.backend.DbSize(ctx)
+}
+
+func (b *Backend) CurrentRevision(ctx context.Context) (int64, error) {
+	return b.backend.CurrentRevision(ctx)
+}
+
+func (b *Backend) Compact(ctx context.Context, revision int64) (rev int64, err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Compact", trace.WithAttributes(
+		revisionAttr.Int64(revision),
+	))
+	defer func() {
+		span.SetAttributes(resultRevisionAttr.Int64(rev))
+		End(span, err)
+	}()
+	return b.backend.Compact(ctx, revision)
+}
+
+func (b *Backend) Defragment(ctx context.Context) (err error) {
+	ctx, span := Tracer().Start(ctx, "backend.Defragment")
+	defer func() {
+		End(span, err)
+	}()
+	return b.backend.Defragment(ctx)
+}
+
+// DbSizeInUse is passed through to the wrapped backend, if it supports estimating the size in use.
+func (b *Backend) DbSizeInUse(ctx context.Context) (int64, error) {
+	reporter, ok := b.backend.(server.SizeInUseReporter)
+	if !ok {
+		return 0, status.New(codes.Unimplemented, "size in use reporting is not implemented by kine").Err()
+	}
+	return reporter.DbSizeInUse(ctx)
+}
+
+// Leases is passed through to the wrapped backend, if it supports listing leases.
+func (b *Backend) Leases(ctx context.Context) ([]server.Lease, error) {
+	lister, ok := b.backend.(server.LeaseLister)
+	if !ok {
+		return nil, status.New(codes.Unimplemented, "leases is not implemented by kine").Err()
+	}
+	return lister.Leases(ctx)
+}
+
+// SetReadOnly is passed through to the wrapped backend, if it supports pausing background writes.
+func (b *Backend) SetReadOnly(readOnly bool) {
+	if setter, ok := b.backend.(server.ReadOnlySetter); ok {
+		setter.SetReadOnly(readOnly)
+	}
+}
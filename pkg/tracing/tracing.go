@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/k3s-io/kine/pkg/version"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName    = "github.com/k3s-io/kine"
+	serviceName   = "kine"
+	endpointEnv   = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	tracesEnv     = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	serviceEnvVar = "OTEL_SERVICE_NAME"
+)
+
+// Tracer returns the kine tracer. Spans are discarded unless a tracer provider has been
+// configured, either by Init or by a program embedding kine.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Enabled returns true if an OTLP endpoint has been configured via the standard
+// OpenTelemetry environment variables.
+func Enabled() bool {
+	return os.Getenv(endpointEnv) != "" || os.Getenv(tracesEnv) != ""
+}
+
+// Init configures the global tracer provider to export spans to the OTLP gRPC endpoint set in
+// the OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT environment variable.
+// The remaining OTLP exporter settings, such as headers and TLS, are also read from the standard
+// environment variables. If no endpoint is set, tracing is left disabled. The returned function
+// flushes any pending spans and shuts down the exporter.
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name := os.Getenv(serviceEnvVar)
+	if name == "" {
+		name = serviceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(name),
+		semconv.ServiceVersion(version.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	logrus.Infof("OpenTelemetry tracing enabled")
+	return provider.Shutdown, nil
+}
+
+// End records the error on the span, if any, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
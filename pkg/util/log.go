@@ -0,0 +1,84 @@
+package util
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxLoggedBytes is the number of bytes of each byte slice argument that are logged when SQL
+// arguments are logged in full.
+const maxLoggedBytes = 64
+
+const (
+	// SQLArgsNone logs SQL statements without their arguments.
+	SQLArgsNone = "none"
+	// SQLArgsRedacted logs the arguments of SQL statements, with byte slices such as the value and
+	// old_value columns replaced by their length, as values may hold secrets.
+	SQLArgsRedacted = "redacted"
+	// SQLArgsFull logs the arguments of SQL statements, with byte slices truncated to
+	// maxLoggedBytes and their length shown.
+	SQLArgsFull = "full"
+)
+
+var sqlArgs atomic.Value
+
+// SetSQLArgs sets how the arguments of SQL statements are logged by TraceSQL. Arguments are not
+// logged unless enabled, as they include the keys and values being read and written.
+func SetSQLArgs(mode string) error {
+	switch mode {
+	case "":
+		mode = SQLArgsNone
+	case SQLArgsNone, SQLArgsRedacted, SQLArgsFull:
+	default:
+		return fmt.Errorf("invalid SQL argument logging mode %q; must be one of %s, %s or %s", mode, SQLArgsNone, SQLArgsRedacted, SQLArgsFull)
+	}
+	sqlArgs.Store(mode)
+	return nil
+}
+
+// TraceSQL logs a SQL statement at trace level. The statement and its arguments are logged as
+// structured fields rather than as part of the message, so that they can be extracted from
+// JSON-formatted logs. Arguments are only logged if enabled with SetSQLArgs; if args is nil, only
+// the statement and any additional fields are logged.
+func TraceSQL(msg, sql string, args []interface{}, fields logrus.Fields) {
+	if !logrus.IsLevelEnabled(logrus.TraceLevel) {
+		return
+	}
+	entry := logrus.WithFields(fields).WithField("sql", Stripped(sql).String())
+	if logged, ok := LoggedSQLArgs(args); ok {
+		entry = entry.WithField("args", logged)
+	}
+	entry.Trace(msg)
+}
+
+// LoggedSQLArgs returns the arguments of a SQL statement as they should be logged, or false if
+// arguments are not logged.
+func LoggedSQLArgs(args []interface{}) ([]interface{}, bool) {
+	mode, _ := sqlArgs.Load().(string)
+	if args == nil || mode == "" || mode == SQLArgsNone {
+		return nil, false
+	}
+	return loggedArgs(args, mode == SQLArgsFull), true
+}
+
+// loggedArgs returns the arguments as they are logged. Byte slices are replaced by their length,
+// followed by up to maxLoggedBytes of their content if full is set.
+func loggedArgs(args []interface{}, full bool) []interface{} {
+	logged := make([]interface{}, len(args))
+	for i, arg := range args {
+		b, ok := arg.([]byte)
+		switch {
+		case !ok:
+			logged[i] = arg
+		case !full:
+			logged[i] = fmt.Sprintf("<%d bytes>", len(b))
+		case len(b) > maxLoggedBytes:
+			logged[i] = fmt.Sprintf("<%d bytes> %q...", len(b), b[:maxLoggedBytes])
+		default:
+			logged[i] = fmt.Sprintf("<%d bytes> %q", len(b), b)
+		}
+	}
+	return logged
+}
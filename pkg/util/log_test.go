@@ -0,0 +1,27 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoggedArgs(t *testing.T) {
+	args := []interface{}{"/registry/secrets/default/token", int64(5), []byte("secret"), []byte(strings.Repeat("x", maxLoggedBytes+1)), nil}
+
+	redacted := loggedArgs(args, false)
+	if redacted[0] != args[0] || redacted[1] != args[1] || redacted[4] != nil {
+		t.Fatalf("expected arguments other than byte slices to be logged unchanged, got %v", redacted)
+	}
+	if redacted[2] != "<6 bytes>" || redacted[3] != "<65 bytes>" {
+		t.Fatalf("expected byte slices to be redacted, got %v", redacted)
+	}
+
+	full := loggedArgs(args, true)
+	if full[2] != `<6 bytes> "secret"` || full[3] != `<65 bytes> "`+strings.Repeat("x", maxLoggedBytes)+`"...` {
+		t.Fatalf("expected byte slices to be truncated, got %v", full)
+	}
+
+	if err := SetSQLArgs("values"); err == nil {
+		t.Fatal("expected error for invalid SQL argument logging mode")
+	}
+}